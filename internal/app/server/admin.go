@@ -0,0 +1,212 @@
+package server
+
+// Authentication of the administrators: API keys and client certificates, their roles,
+// and the credentials used by the command-line interfaces.
+// The client certificates of devices are verified here too.
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	gingonic "github.com/gin-gonic/gin"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/router/gin"
+	lurasrv "github.com/luraproject/lura/v2/transport/http/server"
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	"github.com/yuanyuanxiang/fss/plugins/admin_auth"
+)
+
+const (
+	adminKeysPath   = "./configs/admin_keys.json"
+	credentialsPath = "./configs/credentials.json"
+
+	// Environment variables of the CLI credentials, they take precedence over the credentials file.
+	APIKeyEnv     = "FSS_API_KEY"
+	ClientCertEnv = "FSS_CLIENT_CERT"
+	ClientKeyEnv  = "FSS_CLIENT_KEY"
+)
+
+// AdminIdentity is an administrator, who is authenticated by an API key or a client certificate.
+// Only the SHA-256 of the API key is stored.
+type AdminIdentity struct {
+	Name        string   `json:"name"`
+	KeySHA256   string   `json:"key_sha256,omitempty"`
+	CertSubject string   `json:"cert_subject,omitempty"` // common name of the client certificate
+	Roles       []string `json:"roles"`
+}
+
+// AdminRegistry implements admin_auth.IdentityProvider
+type AdminRegistry struct {
+	identities []AdminIdentity
+}
+
+// LoadAdminRegistry loads the administrators from the specified file. If the file doesn't exist,
+// an "admin" identity is created with a random API key, which is saved to the CLI credentials file.
+func LoadAdminRegistry(path string) (*AdminRegistry, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bootstrapAdmin(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []AdminIdentity
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("invalid admin keys file: %w", err)
+	}
+	return &AdminRegistry{identities: ids}, nil
+}
+
+func bootstrapAdmin(path string) (*AdminRegistry, error) {
+	key, err := common.GenerateRandomStringHex(32)
+	if err != nil {
+		return nil, err
+	}
+	ids := []AdminIdentity{{Name: "admin", KeySHA256: hashAPIKey(key), Roles: []string{admin_auth.RoleAdmin}}}
+	data, _ := json.MarshalIndent(ids, "", "  ")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save admin keys: %w", err)
+	}
+	if _, err := os.Stat(credentialsPath); os.IsNotExist(err) {
+		data, _ = json.MarshalIndent(Credentials{APIKey: key}, "", "  ")
+		if err := os.WriteFile(credentialsPath, data, 0600); err != nil {
+			return nil, fmt.Errorf("failed to save credentials: %w", err)
+		}
+	}
+	return &AdminRegistry{identities: ids}, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r *AdminRegistry) LookupAPIKey(key string) (string, []string, bool) {
+	hash := hashAPIKey(key)
+	for _, id := range r.identities {
+		if id.KeySHA256 != "" && subtle.ConstantTimeCompare([]byte(id.KeySHA256), []byte(hash)) == 1 {
+			return id.Name, id.Roles, true
+		}
+	}
+	return "", nil, false
+}
+
+func (r *AdminRegistry) LookupCertificate(subject string) (string, []string, bool) {
+	for _, id := range r.identities {
+		if id.CertSubject != "" && id.CertSubject == subject {
+			return id.Name, id.Roles, true
+		}
+	}
+	return "", nil, false
+}
+
+// clientCertMiddleware passes the common name of a client certificate issued by the admin CA,
+// or the serial number and the fingerprint of a certificate issued by the device CA, to the plugins.
+// The headers sent by the client are always removed, so they can't be forged.
+func clientCertMiddleware(adminCAs, deviceCAs *x509.CertPool) gingonic.HandlerFunc {
+	return func(c *gingonic.Context) {
+		c.Request.Header.Del(admin_auth.HeaderClientCert)
+		c.Request.Header.Del(common.HeaderDeviceCert)
+		c.Request.Header.Del(common.HeaderDeviceCertSHA256)
+		if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+			return
+		}
+		certs := c.Request.TLS.PeerCertificates
+		if verifyClientCert(certs, adminCAs) {
+			c.Request.Header.Set(admin_auth.HeaderClientCert, certs[0].Subject.CommonName)
+		} else if verifyClientCert(certs, deviceCAs) {
+			c.Request.Header.Set(common.HeaderDeviceCert, certs[0].Subject.CommonName)
+			c.Request.Header.Set(common.HeaderDeviceCertSHA256, certFingerprint(certs[0].Raw))
+		}
+	}
+}
+
+// verifyClientCert checks the peer certificate chain is issued by one of the roots for client authentication.
+func verifyClientCert(certs []*x509.Certificate, roots *x509.CertPool) bool {
+	if roots == nil {
+		return false
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err == nil
+}
+
+// runServer runs the server like lura does, but requests client certificates without requiring them,
+// so devices and administrators without a certificate can still connect.
+// The pool contains the CAs of both admin and device certificates.
+func runServer(clientCAs *x509.CertPool) gin.RunServerFunc {
+	return func(ctx context.Context, cfg config.ServiceConfig, handler http.Handler) error {
+		s := lurasrv.NewServer(cfg, handler)
+		if s.TLSConfig == nil || clientCAs == nil {
+			return lurasrv.RunServer(ctx, cfg, handler)
+		}
+		s.TLSConfig.ClientCAs = clientCAs
+		s.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		done := make(chan error)
+		go func() {
+			done <- s.ListenAndServeTLS(cfg.TLS.PublicKey, cfg.TLS.PrivateKey)
+		}()
+		select {
+		case err := <-done:
+			return err
+		case <-ctx.Done():
+			return s.Shutdown(context.Background())
+		}
+	}
+}
+
+// loadCertPool loads the PEM certificates of a file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// Credentials of the command-line interfaces
+type Credentials struct {
+	APIKey   string `json:"api_key,omitempty"`
+	CertFile string `json:"cert_file,omitempty"` // client certificate issued by the admin CA
+	KeyFile  string `json:"key_file,omitempty"`
+}
+
+// LoadCredentials loads the credentials from the specified file, the environment variables
+// take precedence over the file. A missing file is not an error.
+func LoadCredentials(path string) (Credentials, error) {
+	var c Credentials
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &c); err != nil {
+			return c, fmt.Errorf("invalid credentials file: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return c, err
+	}
+	if v := strings.TrimSpace(os.Getenv(APIKeyEnv)); v != "" {
+		c.APIKey = v
+	}
+	if v := os.Getenv(ClientCertEnv); v != "" {
+		c.CertFile, c.KeyFile = v, os.Getenv(ClientKeyEnv)
+	}
+	return c, nil
+}
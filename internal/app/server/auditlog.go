@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+)
+
+const (
+	auditDir     = "./audit"
+	auditLogPath = "svr_log.json" // the audit log before the segments
+	auditKeyPath = "./configs/audit_key.pem"
+	auditPubPath = "./configs/audit_pub.pem"
+)
+
+// generateAuditLogKey generates the key of signing audit log checkpoints. Its public key and key ID
+// are pinned off the server, whoever could rebuild the chain could replace a public key next to the logs.
+func generateAuditLogKey(keyPath, pubPath string) error {
+	if pubPath == "" {
+		pubPath = auditPubPath
+	}
+	key, err := common.GenerateEd25519Key(keyPath, pubPath)
+	if err != nil {
+		return fmt.Errorf("failed to generate audit log key: %w", err)
+	}
+	keyID, _ := firmware.KeyID(key.Public())
+	fmt.Printf("Succeed generating audit log key %s, Key ID: %s\n", keyPath, keyID)
+	fmt.Printf("Copy %s off the server, or pin the key ID, to verify the audit log (--audit-pub or --audit-key-id)\n", pubPath)
+	return nil
+}
+
+// verifyAuditLogDir verifies the audit log segments and the checkpoints with the pinned audit public key: the key
+// in pubPath, or the key in ./configs/audit_pub.pem if its key ID is keyID. It fails if no key is pinned.
+func verifyAuditLogDir(dir, pubPath, keyID string) (*audit.Report, error) {
+	if pubPath == "" && keyID == "" {
+		return nil, fmt.Errorf("%w, verify with --audit-pub or --audit-key-id", audit.ErrNoPublicKey)
+	}
+	if pubPath == "" {
+		pubPath = auditPubPath
+	}
+	pub, err := common.LoadEd25519PublicKey(pubPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load audit public key: %w", err)
+	}
+	if keyID != "" {
+		if id, _ := firmware.KeyID(pub); id != keyID {
+			return nil, fmt.Errorf("audit public key %s has key ID %s, not the pinned %s", pubPath, id, keyID)
+		}
+	}
+	report, err := audit.VerifyDir(dir, pub)
+	if err != nil {
+		return nil, fmt.Errorf("audit log is broken: %w", err)
+	}
+	return report, nil
+}
+
+// showAuditLogs displays a page of the logs which match the query, and the cursor of the next page.
+func showAuditLogs(exe Executer, typ audit.LogType, title string, values url.Values) error {
+	q, err := audit.ParseQuery(values)
+	if err != nil {
+		return err
+	}
+	page, err := exe.GetAuditLogs(string(typ), q)
+	if err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(page.Logs, "", "  ")
+	if q.Count {
+		fmt.Printf("%s: %d of %d\n%s\n", title, len(page.Logs), page.Total, string(data))
+	} else {
+		fmt.Printf("%s: %d\n%s\n", title, len(page.Logs), string(data))
+	}
+	if page.Next > 0 {
+		fmt.Printf("Next page: --cursor=%d\n", page.Next)
+	}
+	return nil
+}
+
+// followAuditLogs prints the new entries of the types which match the query, a line for each entry.
+func followAuditLogs(exe Executer, types []audit.LogType, values url.Values) error {
+	q, err := audit.ParseQuery(values)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(types))
+	for i, typ := range types {
+		names[i] = string(typ)
+	}
+	fmt.Printf("Following %s, press Ctrl+C to stop\n", strings.Join(names, ", "))
+	return exe.FollowLogs(names, q, func(ev audit.Event) error {
+		e := ev.Entry
+		line := fmt.Sprintf("%v [%s] %v %v %v %v", e["timestamp"], ev.Type, e["serial_number"], e["remote_addr"], e["code"], e["description"])
+		if d, ok := e["detail"]; ok {
+			data, _ := json.Marshal(d)
+			line += " " + string(data)
+		}
+		fmt.Println(line)
+		return nil
+	})
+}
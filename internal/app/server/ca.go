@@ -0,0 +1,160 @@
+package server
+
+// A small CA which issues the client certificates of devices. Devices send a certificate signing request
+// at registration, and then authenticate the firmware requests with the certificate in the TLS handshake.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+const (
+	deviceCACertPath = "./configs/device_ca.pem"
+	deviceCAKeyPath  = "./configs/device_ca_key.pem"
+
+	deviceCertValidity = 365 * 24 * time.Hour // device certificates are valid for 1 year
+)
+
+// DeviceCA signs the certificate signing requests of devices.
+type DeviceCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	pem  []byte
+}
+
+// LoadOrCreateDeviceCA loads the CA certificate and key, or generates them if they don't exist or are expired.
+func LoadOrCreateDeviceCA(certFile, keyFile string) (*DeviceCA, error) {
+	if ca, err := loadDeviceCA(certFile, keyFile); err == nil && time.Now().Before(ca.cert.NotAfter) {
+		return ca, nil
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "FSS Device CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return nil, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return nil, err
+	}
+	return loadDeviceCA(certFile, keyFile)
+}
+
+func loadDeviceCA(certFile, keyFile string) (*DeviceCA, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, fmt.Errorf("invalid CA certificate: %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("invalid CA key: %s", keyFile)
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceCA{cert: cert, key: key, pem: certPEM}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// CertificatePEM returns the CA certificate, which devices may use to check their certificate.
+func (ca *DeviceCA) CertificatePEM() string {
+	return string(ca.pem)
+}
+
+// Certificate returns the CA certificate.
+func (ca *DeviceCA) Certificate() *x509.Certificate {
+	return ca.cert
+}
+
+// SignCSR issues a client certificate for the device. The request must be signed by its key,
+// and its common name must be the serial number of the device.
+// It returns the PEM certificate and its SHA-256 fingerprint.
+func (ca *DeviceCA) SignCSR(serialNumber, csrPEM string) (string, string, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return "", "", fmt.Errorf("invalid certificate signing request")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid certificate signing request: %w", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return "", "", fmt.Errorf("invalid certificate signing request: %w", err)
+	}
+	if csr.Subject.CommonName != serialNumber {
+		return "", "", fmt.Errorf("common name '%s' doesn't match serial number '%s'", csr.Subject.CommonName, serialNumber)
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return "", "", err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: serialNumber},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(deviceCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return "", "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), certFingerprint(der), nil
+}
+
+// certFingerprint returns the hex SHA-256 of a DER certificate.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
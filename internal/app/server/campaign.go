@@ -0,0 +1,371 @@
+package server
+
+// Update campaigns: a version targeted by a campaign is only served to the devices the campaign admitted.
+// Versions of no campaign are served to every device, as before campaigns.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/campaign"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+	"github.com/yuanyuanxiang/fss/pkg/store"
+)
+
+type FirmwareLookup interface {
+	GetMetadata(version string) (*firmware.Metadata, error)
+}
+
+// CampaignManager keeps the campaigns in memory, backed by the store of the device registry. A campaign is stored
+// without its devices, and the state of each admitted device under its own key, so the progress of a device
+// doesn't rewrite the whole campaign.
+type CampaignManager struct {
+	mu        sync.Mutex
+	campaigns map[string]*campaign.Campaign
+	store     store.Store
+	dev       *DeviceManagerImpl
+	fw        FirmwareLookup
+	log       audit.LogManager
+}
+
+func NewCampaignManager(st store.Store, dev *DeviceManagerImpl, fw FirmwareLookup, log audit.LogManager) (*CampaignManager, error) {
+	m := &CampaignManager{campaigns: make(map[string]*campaign.Campaign), store: st, dev: dev, fw: fw, log: log}
+	var legacy []*campaign.Campaign // stored with their devices
+	err := st.ForEach(campaign.Bucket, func(key string, value json.RawMessage) error {
+		c := &campaign.Campaign{}
+		if err := json.Unmarshal(value, c); err != nil {
+			return fmt.Errorf("invalid campaign '%s': %w", key, err)
+		}
+		if len(c.Devices) > 0 {
+			legacy = append(legacy, c)
+		}
+		if c.Devices == nil {
+			c.Devices = make(map[string]*campaign.DeviceState)
+		}
+		m.campaigns[key] = c
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = st.ForEach(campaign.DeviceBucket, func(key string, value json.RawMessage) error {
+		id, serialNumber, _ := strings.Cut(key, "/")
+		c, ok := m.campaigns[id]
+		if !ok {
+			return nil
+		}
+		d := &campaign.DeviceState{}
+		if err := json.Unmarshal(value, d); err != nil {
+			return fmt.Errorf("invalid device state '%s': %w", key, err)
+		}
+		c.Devices[serialNumber] = d
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the devices of a campaign stored before are moved to their own keys
+	if len(legacy) > 0 {
+		err = st.Update(func(tx *store.Tx) error {
+			for _, c := range legacy {
+				for serialNumber, d := range c.Devices {
+					if err := tx.Put(campaign.DeviceBucket, deviceKey(c.ID, serialNumber), d); err != nil {
+						return err
+					}
+				}
+				if err := tx.Put(campaign.Bucket, c.ID, withoutDevices(c)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate campaign devices: %w", err)
+		}
+	}
+	return m, nil
+}
+
+func deviceKey(id, serialNumber string) string {
+	return id + "/" + serialNumber
+}
+
+// withoutDevices returns the campaign as it is stored, its devices are stored under their own keys.
+func withoutDevices(c *campaign.Campaign) *campaign.Campaign {
+	out := *c
+	out.Devices = nil
+	return &out
+}
+
+// save stores the campaign without its devices.
+func (m *CampaignManager) save(c *campaign.Campaign) error {
+	return m.store.Update(func(tx *store.Tx) error {
+		return tx.Put(campaign.Bucket, c.ID, withoutDevices(c))
+	})
+}
+
+// saveDevice stores the state of a device of the campaign, and the campaign whose counters or status it changed.
+func (m *CampaignManager) saveDevice(c *campaign.Campaign, serialNumber string) error {
+	return m.store.Update(func(tx *store.Tx) error {
+		if err := tx.Put(campaign.DeviceBucket, deviceKey(c.ID, serialNumber), c.Devices[serialNumber]); err != nil {
+			return err
+		}
+		return tx.Put(campaign.Bucket, c.ID, withoutDevices(c))
+	})
+}
+
+// copyOf returns a deep copy, so the caller can't race with the updates of the campaign.
+func copyOf(c *campaign.Campaign) *campaign.Campaign {
+	data, _ := json.Marshal(c)
+	out := &campaign.Campaign{}
+	_ = json.Unmarshal(data, out)
+	if out.Devices == nil {
+		out.Devices = make(map[string]*campaign.DeviceState)
+	}
+	return out
+}
+
+// Create starts a campaign of a version in the firmware repository.
+func (m *CampaignManager) Create(c campaign.Campaign, createdBy string) (*campaign.Campaign, error) {
+	if c.ID == "" {
+		c.ID = fmt.Sprintf("%s-%s", c.Version, time.Now().Format("20060102150405"))
+	}
+	c.Stage, c.Status, c.Reason, c.Devices, c.CreatedBy = 0, "", "", nil, createdBy
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := m.fw.GetMetadata(c.Version); err != nil {
+		return nil, fmt.Errorf("%w: %v", campaign.ErrInvalidCampaign, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.campaigns[c.ID]; ok {
+		return nil, fmt.Errorf("%w: '%s'", campaign.ErrExists, c.ID)
+	}
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+	if err := m.save(&c); err != nil {
+		return nil, fmt.Errorf("failed to save campaign: %w", err)
+	}
+	m.campaigns[c.ID] = &c
+	return copyOf(&c), nil
+}
+
+// List returns the summaries of the campaigns, the newest first.
+func (m *CampaignManager) List() []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]map[string]interface{}, 0, len(m.campaigns))
+	for _, c := range m.campaigns {
+		list = append(list, summary(c))
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i]["created_at"].(time.Time).After(list[j]["created_at"].(time.Time))
+	})
+	return list
+}
+
+func summary(c *campaign.Campaign) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                c.ID,
+		"version":           c.Version,
+		"selector":          c.Selector,
+		"stages":            c.Stages,
+		"stage":             c.Stage,
+		"percentage":        c.Percentage(),
+		"failure_threshold": c.FailureThreshold,
+		"status":            c.Status,
+		"reason":            c.Reason,
+		"devices":           c.Counts(),
+		"created_by":        c.CreatedBy,
+		"created_at":        c.CreatedAt,
+		"updated_at":        c.UpdatedAt,
+	}
+}
+
+// Get returns the campaign with the state of each admitted device.
+func (m *CampaignManager) Get(id string) (*campaign.Campaign, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.campaigns[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", campaign.ErrNotFound, id)
+	}
+	return copyOf(c), nil
+}
+
+// Control pauses, resumes, aborts or advances the campaign.
+func (m *CampaignManager) Control(id, op, reason string) (*campaign.Campaign, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.campaigns[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", campaign.ErrNotFound, id)
+	}
+	next := copyOf(c)
+	if err := next.Control(op, reason, time.Now()); err != nil {
+		return nil, err
+	}
+	if err := m.save(next); err != nil {
+		return nil, fmt.Errorf("failed to save campaign: %w", err)
+	}
+	m.campaigns[id] = next
+	return copyOf(next), nil
+}
+
+// Admit returns nil if the version may be served to the device: no campaign targets the version,
+// or a campaign of the version admits the device.
+func (m *CampaignManager) Admit(serialNumber, version string) error {
+	dev := m.device(serialNumber)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	gated := false
+	now := time.Now()
+	for _, c := range m.campaigns {
+		if c.Version != version {
+			continue
+		}
+		gated = true
+		ok, admitted := c.Admit(dev, now)
+		if admitted {
+			if err := m.saveDevice(c, serialNumber); err != nil {
+				delete(c.Devices, serialNumber)
+				return fmt.Errorf("failed to save campaign: %w", err)
+			}
+		}
+		if ok {
+			return nil
+		}
+	}
+	if gated {
+		return fmt.Errorf("%w of version %s", campaign.ErrNotAdmitted, version)
+	}
+	return nil
+}
+
+// Record records the progress of the device in the campaigns of the version which admitted it,
+// and halts the campaigns whose failures exceed the threshold.
+func (m *CampaignManager) Record(serialNumber, version, status, errMsg string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var errs []error
+	for _, c := range m.campaigns {
+		if _, ok := c.Devices[serialNumber]; !ok || c.Version != version {
+			continue
+		}
+		errs = append(errs, m.record(c, serialNumber, status, errMsg))
+	}
+	return errors.Join(errs...)
+}
+
+// record records the progress of the device, the campaign in memory is kept as it was if it can't be saved.
+func (m *CampaignManager) record(c *campaign.Campaign, serialNumber, status, errMsg string) error {
+	d, prev := *c.Devices[serialNumber], *c
+	halted := c.Record(serialNumber, status, errMsg, time.Now())
+	if err := m.saveDevice(c, serialNumber); err != nil {
+		*c, *c.Devices[serialNumber] = prev, d
+		return fmt.Errorf("failed to save campaign '%s': %w", c.ID, err)
+	}
+	if halted {
+		m.log.AddActionLog("", serialNumber, "halt campaign", http.StatusOK, map[string]interface{}{
+			"campaign": c.ID,
+			"version":  c.Version,
+			"reason":   c.Reason,
+		})
+	}
+	return nil
+}
+
+// Targeted returns whether a campaign targets the version, which is then only served to the admitted devices.
+func (m *CampaignManager) Targeted(version string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.campaigns {
+		if c.Version == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Assign returns the version and the campaign which the device should be updated to, the newest campaign first.
+// It admits the device to the campaign if the current stage includes it. Campaigns of the version the device runs,
+// of an older one, or of a version the device can't run are skipped.
+func (m *CampaignManager) Assign(serialNumber, current string, compatible func(version string) bool) (string, string) {
+	dev := m.device(serialNumber)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]*campaign.Campaign, 0, len(m.campaigns))
+	for _, c := range m.campaigns {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.After(list[j].CreatedAt)
+	})
+	now := time.Now()
+	for _, c := range list {
+		if firmware.CompareVersions(c.Version, current) <= 0 || !compatible(c.Version) {
+			continue
+		}
+		ok, admitted := c.Admit(dev, now)
+		if admitted {
+			if err := m.saveDevice(c, serialNumber); err != nil {
+				delete(c.Devices, serialNumber)
+				continue
+			}
+		}
+		if ok {
+			return c.Version, c.ID
+		}
+	}
+	return "", ""
+}
+
+// CheckIn records the report of the device in the campaigns which admitted it: the device succeeded in the
+// campaign of the version it runs, and failed in the others if it reports a failed update.
+func (m *CampaignManager) CheckIn(serialNumber, version string, failed bool, errMsg string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var errs []error
+	for _, c := range m.campaigns {
+		d, ok := c.Devices[serialNumber]
+		if !ok {
+			continue
+		}
+		status, msg := "", errMsg
+		switch {
+		case c.Version == version && d.Status != campaign.DeviceSucceeded:
+			status, msg = campaign.DeviceSucceeded, ""
+		case c.Version != version && failed && d.Status != campaign.DeviceFailed:
+			status = campaign.DeviceFailed
+		default:
+			continue
+		}
+		errs = append(errs, m.record(c, serialNumber, status, msg))
+	}
+	return errors.Join(errs...)
+}
+
+// device returns what the selectors of the campaigns know of the device.
+func (m *CampaignManager) device(serialNumber string) campaign.Device {
+	d := campaign.Device{SerialNumber: serialNumber}
+	rec := m.dev.GetDevice(serialNumber)
+	d.Pool = cvt.ToString(rec["pool"])
+	switch tags := rec["tags"].(type) {
+	case []string:
+		d.Tags = tags
+	case []interface{}:
+		for _, t := range tags {
+			d.Tags = append(d.Tags, cvt.ToString(t))
+		}
+	}
+	return d
+}
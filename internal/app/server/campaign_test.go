@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/campaign"
+	"github.com/yuanyuanxiang/fss/internal/pkg/ledger"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+	"github.com/yuanyuanxiang/fss/pkg/store"
+)
+
+type testFirmware struct{}
+
+func (testFirmware) GetMetadata(version string) (*firmware.Metadata, error) {
+	return &firmware.Metadata{Version: version, Status: firmware.StatusPublished}, nil
+}
+
+func newTestCampaignManager(t *testing.T, st store.Store, dev *DeviceManagerImpl) *CampaignManager {
+	t.Helper()
+	logs := audit.NewManager(t.TempDir())
+	t.Cleanup(logs.Close)
+	m, err := NewCampaignManager(st, dev, testFirmware{}, logs)
+	if err != nil {
+		t.Fatalf("Failed to create campaign manager: %v", err)
+	}
+	return m
+}
+
+func TestCampaignManager_Gating(t *testing.T) {
+	dev := newTestDeviceManager(t, 10)
+	if err := dev.RegisterDevice("0000000001", "key-a", "", "", ledger.DefaultPool, true); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+	st, _ := store.Open(t.TempDir())
+	defer st.Close()
+	m := newTestCampaignManager(t, st, dev)
+	all := func(string) bool { return true }
+
+	// a version of no campaign is served to every device
+	if err := m.Admit("0000000001", "1.0.1"); err != nil {
+		t.Fatalf("Version of no campaign should be served: %v", err)
+	}
+	if _, err := m.Create(campaign.Campaign{ID: "c1", Version: "1.0.2"}, "admin"); err != nil {
+		t.Fatalf("Failed to create campaign: %v", err)
+	}
+	if _, err := m.Create(campaign.Campaign{ID: "c2", Version: "1.0.3", Selector: campaign.Selector{Serials: []string{"0000000002"}}}, "admin"); err != nil {
+		t.Fatalf("Failed to create campaign: %v", err)
+	}
+	if err := m.Admit("0000000001", "1.0.2"); err != nil {
+		t.Fatalf("Device should be admitted: %v", err)
+	}
+	if err := m.Admit("0000000001", "1.0.3"); !errors.Is(err, campaign.ErrNotAdmitted) {
+		t.Fatalf("Expected ErrNotAdmitted of a device which isn't selected, got %v", err)
+	}
+
+	// a halted campaign serves nothing, not even to the admitted devices
+	if err := m.Record("0000000001", "1.0.2", campaign.DeviceFailed, "checksum mismatch"); err != nil {
+		t.Fatalf("Failed to record progress: %v", err)
+	}
+	if c, _ := m.Get("c1"); c.Status != campaign.StatusHalted {
+		t.Fatalf("Expected the campaign to be halted, got %s", c.Status)
+	}
+	if err := m.Admit("0000000001", "1.0.2"); !errors.Is(err, campaign.ErrNotAdmitted) {
+		t.Fatalf("Halted campaign shouldn't serve the device: %v", err)
+	}
+	if version, _ := m.Assign("0000000001", "1.0.0", all); version != "" {
+		t.Fatalf("Halted campaign shouldn't be assigned, got %s", version)
+	}
+
+	// the newest campaign first, skipping the versions the device runs or can't run
+	if _, err := m.Control("c1", campaign.OpResume, "fixed"); err != nil {
+		t.Fatalf("Failed to resume campaign: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := m.Create(campaign.Campaign{ID: "c3", Version: "1.0.4"}, "admin"); err != nil {
+		t.Fatalf("Failed to create campaign: %v", err)
+	}
+	if version, id := m.Assign("0000000001", "1.0.0", all); version != "1.0.4" || id != "c3" {
+		t.Fatalf("Expected the newest campaign, got %s of %s", version, id)
+	}
+	if version, _ := m.Assign("0000000001", "1.0.4", all); version != "" {
+		t.Fatalf("Expected no campaign of a newer version, got %s", version)
+	}
+	if version, _ := m.Assign("0000000001", "1.0.0", func(v string) bool { return v != "1.0.4" }); version != "1.0.2" {
+		t.Fatalf("Expected the campaign of a compatible version, got %s", version)
+	}
+	if _, err := m.Control("c1", "restart", ""); !errors.Is(err, campaign.ErrInvalidOperation) {
+		t.Fatalf("Expected ErrInvalidOperation, got %v", err)
+	}
+}
+
+func TestCampaignManager_DeviceStates(t *testing.T) {
+	dev := newTestDeviceManager(t, 10)
+	_ = dev.RegisterDevice("0000000001", "key-a", "", "", ledger.DefaultPool, true)
+	st, _ := store.Open(t.TempDir())
+	defer st.Close()
+
+	// a campaign stored with its devices before
+	legacy := campaign.Campaign{ID: "c0", Version: "1.0.1", CreatedAt: time.Now()}
+	_ = legacy.Validate()
+	legacy.Devices["0000000002"] = &campaign.DeviceState{Status: campaign.DeviceSucceeded, Timestamp: time.Now()}
+	_ = st.Update(func(tx *store.Tx) error { return tx.Put(campaign.Bucket, legacy.ID, legacy) })
+
+	m := newTestCampaignManager(t, st, dev)
+	_, _ = m.Create(campaign.Campaign{ID: "c1", Version: "1.0.2"}, "admin")
+	_ = m.Admit("0000000001", "1.0.2")
+	_ = m.Record("0000000001", "1.0.2", campaign.DeviceDelivered, "")
+
+	// the campaigns are stored without their devices, each device under its own key
+	for _, id := range []string{"c0", "c1"} {
+		var stored campaign.Campaign
+		if err := st.Get(campaign.Bucket, id, &stored); err != nil || len(stored.Devices) != 0 {
+			t.Fatalf("Campaign %s should be stored without devices: %+v, %v", id, stored.Devices, err)
+		}
+	}
+	var d campaign.DeviceState
+	if err := st.Get(campaign.DeviceBucket, "c1/0000000001", &d); err != nil || d.Status != campaign.DeviceDelivered {
+		t.Fatalf("Unexpected device state %+v: %v", d, err)
+	}
+
+	// and loaded with them
+	m = newTestCampaignManager(t, st, dev)
+	if c, _ := m.Get("c0"); c.Devices["0000000002"] == nil || c.Devices["0000000002"].Status != campaign.DeviceSucceeded {
+		t.Fatalf("Expected the device of the legacy campaign, got %+v", c.Devices)
+	}
+	if c, _ := m.Get("c1"); c.Devices["0000000001"] == nil || c.Devices["0000000001"].Status != campaign.DeviceDelivered {
+		t.Fatalf("Expected the delivered device, got %+v", c.Devices)
+	}
+
+	// the check-in succeeds the campaign of the version installed, and fails the others with the error reported
+	for _, version := range []string{"1.0.3", "1.0.4"} {
+		_, _ = m.Create(campaign.Campaign{ID: "c-" + version, Version: version}, "admin")
+		_ = m.Admit("0000000001", version)
+	}
+	if err := m.CheckIn("0000000001", "1.0.2", true, "boot failed"); err != nil {
+		t.Fatalf("Failed to check in: %v", err)
+	}
+	if c, _ := m.Get("c1"); c.Devices["0000000001"].Status != campaign.DeviceSucceeded || c.Devices["0000000001"].Error != "" {
+		t.Fatalf("Expected the device succeeded, got %+v", c.Devices["0000000001"])
+	}
+	for _, id := range []string{"c-1.0.3", "c-1.0.4"} {
+		if c, _ := m.Get(id); c.Devices["0000000001"].Status != campaign.DeviceFailed || c.Devices["0000000001"].Error != "boot failed" {
+			t.Fatalf("Expected the device of %s failed with the error, got %+v", id, c.Devices["0000000001"])
+		}
+	}
+}
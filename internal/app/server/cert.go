@@ -1,83 +1,86 @@
-package server
-
-// Generate a self-signed certificate and private key if they do not exist or are expired.
-
-import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
-	"crypto/rand"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
-	"math/big"
-	"net"
-	"os"
-	"time"
-)
-
-const (
-	certPath = "./configs/cert.pem"
-	keyPath  = "./configs/key.pem"
-)
-
-// Check if the certificate needs to be generated or updated.
-func needsNewCert(certPath string) bool {
-	data, err := os.ReadFile(certPath)
-	if err != nil {
-		return true // not exist
-	}
-	block, _ := pem.Decode(data)
-	if block == nil {
-		return true // not a valid PEM file
-	}
-	cert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		return true // not a valid certificate
-	}
-	return time.Now().After(cert.NotAfter) // check if the certificate is expired
-}
-
-// Generate a self-signed certificate and save it to the specified paths.
-func generateSelfSignedCert(certPath, keyPath string) error {
-	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
-	if err != nil {
-		return err
-	}
-
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject:      pkix.Name{CommonName: "localhost"},
-		NotBefore:    time.Now(),
-		NotAfter:     time.Now().Add(365 * 24 * time.Hour), // valid for 1 year
-		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
-	}
-
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
-	if err != nil {
-		return err
-	}
-
-	// write cert.pem
-	certOut, err := os.Create(certPath)
-	if err != nil {
-		return err
-	}
-	defer certOut.Close()
-	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
-		return err
-	}
-
-	// write key.pem
-	keyOut, err := os.Create(keyPath)
-	if err != nil {
-		return err
-	}
-	defer keyOut.Close()
-	b, err := x509.MarshalECPrivateKey(priv)
-	if err != nil {
-		return err
-	}
-	return pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
-}
+package server
+
+// Generate a self-signed certificate and private key if they do not exist or are expired.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	certPath = "./configs/cert.pem"
+	keyPath  = "./configs/key.pem"
+
+	signingPubPath = "./configs/signing_pub.pem" // public code signing key pinned on devices
+	vendorPubPath  = "./configs/vendor_pub.pem"  // public key of the vendor, which verifies licence files
+)
+
+// Check if the certificate needs to be generated or updated.
+func needsNewCert(certPath string) bool {
+	data, err := os.ReadFile(certPath)
+	if err != nil {
+		return true // not exist
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return true // not a valid PEM file
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return true // not a valid certificate
+	}
+	return time.Now().After(cert.NotAfter) // check if the certificate is expired
+}
+
+// Generate a self-signed certificate and save it to the specified paths.
+func generateSelfSignedCert(certPath, keyPath string) error {
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour), // valid for 1 year
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+
+	// write cert.pem
+	certOut, err := os.Create(certPath)
+	if err != nil {
+		return err
+	}
+	defer certOut.Close()
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
+		return err
+	}
+
+	// write key.pem
+	keyOut, err := os.Create(keyPath)
+	if err != nil {
+		return err
+	}
+	defer keyOut.Close()
+	b, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	return pem.Encode(keyOut, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+}
@@ -0,0 +1,127 @@
+package server
+
+// Check-in of devices: a device reports the firmware it runs, and is told the version it should run.
+
+import (
+	"time"
+
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+	"github.com/yuanyuanxiang/fss/plugins/device_checkin"
+)
+
+type FirmwareCatalog interface {
+	List() ([]firmware.Metadata, error)
+}
+
+// UpdatePlanner resolves the target version of a device among the versions published to its release channel,
+// which aren't below its security floor: the version assigned by a campaign which admits it, or else the newest
+// version of no campaign, if it's newer than the version the device runs. A rollback approved by an operator
+// is assigned before anything else, even below the security floor, until it's delivered. The security floor is
+// raised by the versions delivered to the device and reported installed, and never lowered.
+type UpdatePlanner struct {
+	dev       *DeviceManagerImpl
+	fw        FirmwareCatalog
+	campaigns *CampaignManager
+}
+
+func NewUpdatePlanner(dev *DeviceManagerImpl, fw FirmwareCatalog, campaigns *CampaignManager) *UpdatePlanner {
+	return &UpdatePlanner{dev: dev, fw: fw, campaigns: campaigns}
+}
+
+// CheckIn keeps the report of the device, records its progress in the campaigns, and returns its target.
+func (p *UpdatePlanner) CheckIn(serialNumber string, r device_checkin.Report) (*device_checkin.Target, error) {
+	report := map[string]interface{}{
+		"version":   r.Version,
+		"state":     r.State,
+		"hardware":  r.Hardware,
+		"timestamp": time.Now(),
+	}
+	if r.Error != "" {
+		report["error"] = r.Error
+	}
+	if err := p.dev.SetCheckIn(serialNumber, report); err != nil {
+		return nil, err
+	}
+	// a blocked or held device isn't updated, and its reports don't count in the campaigns
+	if p.dev.IsDeviceRegistered(serialNumber) != nil {
+		return &device_checkin.Target{Status: device_checkin.StatusBlocked}, nil
+	}
+	if err := p.campaigns.CheckIn(serialNumber, r.Version, r.State == device_checkin.StateFailed, r.Error); err != nil {
+		return nil, err
+	}
+	target, err := p.plan(serialNumber, r)
+	if err != nil {
+		return nil, err
+	}
+	// the target scopes the firmware requests of a device authenticated by its certificate
+	if err := p.dev.SetTarget(serialNumber, target.Version); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// plan resolves the target of the device which checked in.
+func (p *UpdatePlanner) plan(serialNumber string, r device_checkin.Report) (*device_checkin.Target, error) {
+
+	list, err := p.fw.List()
+	if err != nil {
+		return nil, err
+	}
+	channel := p.dev.GetDeviceChannel(serialNumber)
+	published := make(map[string]firmware.Metadata, len(list))
+	for _, meta := range list {
+		// the device installed the version it runs
+		if meta.Version == r.Version {
+			if err := p.dev.RaiseSecurityFloor(serialNumber, meta.SecurityVersion); err != nil {
+				return nil, err
+			}
+		}
+		if meta.Status == firmware.StatusPublished && meta.InChannel(channel) && supports(meta, r.Hardware) {
+			published[meta.Version] = meta
+		}
+	}
+	floor := p.dev.GetSecurityFloor(serialNumber)
+	compatible := func(version string) bool {
+		meta, ok := published[version]
+		return ok && meta.SecurityVersion >= floor
+	}
+	if version := p.dev.GetRollback(serialNumber); version == r.Version {
+		// the device installed the approved rollback
+		p.dev.ConsumeRollback(serialNumber, version)
+	} else if meta, ok := published[version]; ok {
+		return &device_checkin.Target{Status: device_checkin.StatusUpdateAvailable, Version: version,
+			Channel: channel, Size: meta.Size, SHA256: meta.SHA256}, nil
+	}
+	if version, id := p.campaigns.Assign(serialNumber, r.Version, compatible); version != "" {
+		meta := published[version]
+		return &device_checkin.Target{Status: device_checkin.StatusUpdateAvailable, Version: version, Campaign: id,
+			Channel: channel, Size: meta.Size, SHA256: meta.SHA256}, nil
+	}
+	var newest *firmware.Metadata
+	for _, meta := range published {
+		if !compatible(meta.Version) || p.campaigns.Targeted(meta.Version) || firmware.CompareVersions(meta.Version, r.Version) <= 0 {
+			continue
+		}
+		if newest == nil || firmware.CompareVersions(meta.Version, newest.Version) > 0 {
+			newest = &meta
+		}
+	}
+	if newest == nil {
+		return &device_checkin.Target{Status: device_checkin.StatusUpToDate, Channel: channel}, nil
+	}
+	return &device_checkin.Target{Status: device_checkin.StatusUpdateAvailable, Version: newest.Version,
+		Channel: channel, Size: newest.Size, SHA256: newest.SHA256}, nil
+}
+
+// supports returns whether the firmware runs on the hardware revision, a firmware of no target hardware runs on all.
+func supports(meta firmware.Metadata, hardware string) bool {
+	if len(meta.Hardware) == 0 || hardware == "" {
+		return true
+	}
+	for _, h := range meta.Hardware {
+		if h == hardware {
+			return true
+		}
+	}
+	return false
+}
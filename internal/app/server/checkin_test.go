@@ -0,0 +1,91 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/ledger"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+	"github.com/yuanyuanxiang/fss/pkg/store"
+	"github.com/yuanyuanxiang/fss/plugins/device_checkin"
+)
+
+type testCatalog []firmware.Metadata
+
+func (c testCatalog) List() ([]firmware.Metadata, error) {
+	return c, nil
+}
+
+func TestUpdatePlanner_Rollback(t *testing.T) {
+	dev := newTestDeviceManager(t, 10)
+	if err := dev.RegisterDevice("0000000001", "key-a", "", "", ledger.DefaultPool, true); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+	st, _ := store.Open(t.TempDir())
+	defer st.Close()
+	catalog := testCatalog{
+		{Version: "1.0.1", SecurityVersion: 1, Status: firmware.StatusPublished},
+		{Version: "1.0.2", SecurityVersion: 2, Status: firmware.StatusPublished},
+		{Version: "1.0.3", SecurityVersion: 2, Status: firmware.StatusPublished},
+	}
+	planner := NewUpdatePlanner(dev, catalog, newTestCampaignManager(t, st, dev))
+	checkIn := func(version string) *device_checkin.Target {
+		target, err := planner.CheckIn("0000000001", device_checkin.Report{Version: version})
+		if err != nil {
+			t.Fatalf("Failed to check in: %v", err)
+		}
+		return target
+	}
+
+	// the floor follows the version reported installed
+	if target := checkIn("1.0.1"); target.Version != "1.0.3" || dev.GetSecurityFloor("0000000001") != 1 {
+		t.Fatalf("Expected 1.0.3 and the floor 1, got %s and %d", target.Version, dev.GetSecurityFloor("0000000001"))
+	}
+	if target := checkIn("1.0.3"); target.Status != device_checkin.StatusUpToDate || dev.GetSecurityFloor("0000000001") != 2 {
+		t.Fatalf("Expected the device up to date with the floor 2, got %s and %d", target.Status, dev.GetSecurityFloor("0000000001"))
+	}
+
+	// a version below the floor is only assigned with the approval of a rollback
+	_ = dev.ApproveRollback("0000000001", "1.0.1", "admin", "")
+	for i := 0; i < 2; i++ {
+		if target := checkIn("1.0.3"); target.Version != "1.0.1" {
+			t.Fatalf("Expected the approved rollback, got %s", target.Version)
+		}
+	}
+	// the firmware update uses the approval when it's delivered
+	if !dev.ConsumeRollback("0000000001", "1.0.1") || dev.ConsumeRollback("0000000001", "1.0.1") {
+		t.Fatal("Expected the approval to be used once")
+	}
+	if target := checkIn("1.0.1"); target.Version != "1.0.3" {
+		t.Fatalf("Expected no rollback without approval, got %s", target.Version)
+	}
+	if floor := dev.GetSecurityFloor("0000000001"); floor != 2 {
+		t.Fatalf("The floor shouldn't be lowered, got %d", floor)
+	}
+}
+
+func TestUpdatePlanner_Target(t *testing.T) {
+	dev := newTestDeviceManager(t, 10)
+	_ = dev.RegisterDevice("0000000001", "key-a", "", "", ledger.DefaultPool, true)
+	st, _ := store.Open(t.TempDir())
+	defer st.Close()
+	catalog := testCatalog{{Version: "1.0.2", Status: firmware.StatusPublished}}
+	planner := NewUpdatePlanner(dev, catalog, newTestCampaignManager(t, st, dev))
+
+	// the target scopes the requests authenticated by the certificate, until the next check-in
+	if _, err := planner.CheckIn("0000000001", device_checkin.Report{Version: "1.0.1"}); err != nil {
+		t.Fatalf("Failed to check in: %v", err)
+	}
+	if target := dev.GetTarget("0000000001"); target != "1.0.2" {
+		t.Fatalf("Expected the target 1.0.2, got %s", target)
+	}
+	_ = dev.RegisterDevice("0000000001", "key-a", "", "", ledger.DefaultPool, true)
+	if target := dev.GetTarget("0000000001"); target != "1.0.2" {
+		t.Fatalf("The target should be kept when the device registers again, got %s", target)
+	}
+	if _, err := planner.CheckIn("0000000001", device_checkin.Report{Version: "1.0.2"}); err != nil {
+		t.Fatalf("Failed to check in: %v", err)
+	}
+	if target := dev.GetTarget("0000000001"); target != "" {
+		t.Fatalf("Expected no target of an up-to-date device, got %s", target)
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+// Detection of cloned devices: a serial number registered again with a different public key,
+// or authenticated from unrelated networks at the same time.
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/clone"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+)
+
+const (
+	ClonePolicyLog    = "log"    // only raise an incident
+	ClonePolicyBlock  = "block"  // block the serial number
+	ClonePolicyReview = "review" // hold the serial number until an operator authorizes it again
+)
+
+var (
+	ErrSuspectedClone = errors.New("suspected clone")
+)
+
+// CloneDetector raises an incident for a suspected clone, and blocks or holds its serial number by the policy.
+type CloneDetector struct {
+	policy  string
+	tracker *clone.Tracker
+	dev     *DeviceManagerImpl
+	log     audit.LogManager
+}
+
+func NewCloneDetector(policy string, window time.Duration, dev *DeviceManagerImpl, log audit.LogManager) (*CloneDetector, error) {
+	switch policy {
+	case ClonePolicyLog, ClonePolicyBlock, ClonePolicyReview:
+	default:
+		return nil, fmt.Errorf("invalid clone policy: '%s'", policy)
+	}
+	return &CloneDetector{policy: policy, tracker: clone.NewTracker(window), dev: dev, log: log}, nil
+}
+
+// Release forgets the networks the device was seen from, e.g. after an operator reviewed it.
+func (c *CloneDetector) Release(serialNumber string) {
+	c.tracker.Forget(serialNumber)
+}
+
+// Observe checks an authenticated request of the device. The public key is only given by a registration.
+// It returns ErrSuspectedClone if the request must be rejected by the policy.
+func (c *CloneDetector) Observe(serialNumber, remoteAddr, publicKey string) error {
+	var reason string
+	if other := c.tracker.Observe(serialNumber, remoteAddr, time.Now()); other != "" {
+		reason = fmt.Sprintf("seen from %s and %s at the same time", other, clone.Network(remoteAddr))
+	}
+	if old := c.dev.GetDevicePublicKey(serialNumber); publicKey != "" && old != "" && old != publicKey {
+		reason = "registered again with a different public key"
+	}
+	if reason == "" {
+		return nil
+	}
+	c.log.AddIncidentLog(remoteAddr, serialNumber, "suspected clone", http.StatusForbidden, reason, c.policy)
+	var err error
+	switch c.policy {
+	case ClonePolicyBlock:
+		err = c.dev.BlockDevice(serialNumber)
+	case ClonePolicyReview:
+		err = c.dev.HoldDevice(serialNumber, reason)
+	default:
+		return nil
+	}
+	detail, code := map[string]interface{}{"incident": "suspected clone", "reason": reason}, http.StatusOK
+	if err != nil {
+		detail["error"], code = err.Error(), http.StatusInternalServerError
+	}
+	action := map[string]string{ClonePolicyBlock: "block", ClonePolicyReview: "hold"}[c.policy]
+	c.log.AddActionLog(remoteAddr, serialNumber, action, code, detail)
+	if err != nil {
+		return fmt.Errorf("%w: %s, %v", ErrSuspectedClone, reason, err)
+	}
+	return fmt.Errorf("%w: %s", ErrSuspectedClone, reason)
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/ledger"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+)
+
+func TestCloneDetector(t *testing.T) {
+	dev := newTestDeviceManager(t, 10)
+	if err := dev.RegisterDevice("0000000001", "key-a", "", "", ledger.DefaultPool, true); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+	logs := audit.NewManager(t.TempDir())
+	defer logs.Close()
+	clones, err := NewCloneDetector(ClonePolicyReview, time.Minute, dev, logs)
+	if err != nil {
+		t.Fatalf("Failed to create clone detector: %v", err)
+	}
+	if _, err := NewCloneDetector("ignore", time.Minute, dev, logs); err == nil {
+		t.Errorf("Expected an unknown policy to be rejected")
+	}
+	// the same network, e.g. behind the same NAT
+	if err := clones.Observe("0000000001", "10.0.0.1:5000", ""); err != nil {
+		t.Fatalf("Unexpected clone: %v", err)
+	}
+	if err := clones.Observe("0000000001", "10.0.0.2:5000", ""); err != nil {
+		t.Fatalf("Unexpected clone: %v", err)
+	}
+	// an unrelated network at the same time
+	if err := clones.Observe("0000000001", "192.168.1.1:5000", ""); !errors.Is(err, ErrSuspectedClone) {
+		t.Fatalf("Expected a suspected clone, got %v", err)
+	}
+	if dev.IsDeviceRegistered("0000000001") == nil {
+		t.Fatalf("Expected the device to be held")
+	}
+	// the operator reviews the device, the sightings before the review don't hold it again
+	ops := NewOperatorDevices(dev, clones, nil)
+	if err := ops.AuthorizeDevice("0000000001"); err != nil {
+		t.Fatalf("Failed to authorize device: %v", err)
+	}
+	if err := clones.Observe("0000000001", "192.168.1.1:5000", ""); err != nil {
+		t.Fatalf("Expected the authorized device not to be held again: %v", err)
+	}
+	if dev.IsDeviceRegistered("0000000001") != nil {
+		t.Fatalf("Expected the device to be authorized")
+	}
+	// registered again with another key
+	if err := clones.Observe("0000000001", "192.168.1.1:5000", "key-b"); !errors.Is(err, ErrSuspectedClone) {
+		t.Fatalf("Expected a suspected clone, got %v", err)
+	}
+	if len(logs.Logs[audit.TYPE_INCIDENT]) != 2 || len(logs.Logs[audit.TYPE_ACTION]) != 2 {
+		t.Errorf("Expected 2 incidents and 2 actions, got %d and %d", len(logs.Logs[audit.TYPE_INCIDENT]), len(logs.Logs[audit.TYPE_ACTION]))
+	}
+}
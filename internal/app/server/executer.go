@@ -1,139 +1,432 @@
-package server
-
-import (
-	"bytes"
-	"crypto/tls"
-	"crypto/x509"
-	"encoding/json"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"net/http"
-	"time"
-
-	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
-)
-
-type Executer interface {
-	GetDeviceList() ([]map[string]interface{}, error)
-	BlockDevice(serialNumber string) error
-	AuthorizeDevice(serialNumber string) error
-	IncreaseAllowance(key string, inc int) (int, error)
-	GetAuditLogs(typ string) ([]map[string]interface{}, error)
-}
-
-func NewExecuter(addr string, opts ...Option) (Executer, error) {
-	exe := &ExecuterImpl{
-		protocol:   "http",
-		serverAddr: addr,
-		client: &http.Client{
-			Timeout: 15 * time.Second,
-		},
-	}
-	for _, f := range opts {
-		if err := f(exe); err != nil {
-			return nil, err
-		}
-	}
-	return exe, nil
-}
-
-// Send http request to the server and display the results.
-type ExecuterImpl struct {
-	protocol   string
-	serverAddr string
-	client     *http.Client
-}
-
-type Option func(*ExecuterImpl) error
-
-func WithCertFile(certFile string) Option {
-	return func(e *ExecuterImpl) error {
-		caCert, err := ioutil.ReadFile(certFile)
-		if err != nil {
-			return fmt.Errorf("failed to read CA certificate: %v", err)
-		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		e.protocol = "https"
-		e.client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{
-				RootCAs: caCertPool,
-			},
-		}
-		return nil
-	}
-}
-
-func (e *ExecuterImpl) request(method, url string, in map[string]interface{}) (map[string]interface{}, error) {
-	var body io.Reader = http.NoBody
-	if in != nil {
-		data, _ := json.Marshal(in)
-		body = bytes.NewBuffer(data)
-	}
-	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s%s", e.protocol, e.serverAddr, url), body)
-	if err != nil {
-		return nil, err
-	}
-	resp, err := e.client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	var out map[string]interface{}
-	err = json.Unmarshal(data, &out)
-	if err != nil {
-		return nil, err
-	}
-	if code := cvt.ToInt(out["code"]); code != 0 {
-		return out, fmt.Errorf("%s", cvt.ToString(out["msg"]))
-	}
-	return out, nil
-}
-
-func (e *ExecuterImpl) GetDeviceList() ([]map[string]interface{}, error) {
-	ret, err := e.request(http.MethodGet, "/api/devices", nil)
-	if err != nil {
-		return nil, err
-	}
-	arr, _ := ret["devices"].([]interface{})
-	out := make([]map[string]interface{}, len(arr))
-	for i, a := range arr {
-		out[i], _ = a.(map[string]interface{})
-	}
-	return out, nil
-}
-
-func (e *ExecuterImpl) BlockDevice(serialNumber string) error {
-	_, err := e.request(http.MethodPost, fmt.Sprintf("/api/devices/%s/block", serialNumber), nil)
-	return err
-}
-
-func (e *ExecuterImpl) AuthorizeDevice(serialNumber string) error {
-	_, err := e.request(http.MethodPost, fmt.Sprintf("/api/devices/%s/authorize", serialNumber), nil)
-	return err
-}
-
-func (e *ExecuterImpl) IncreaseAllowance(key string, inc int) (int, error) {
-	m := map[string]interface{}{
-		"increase_allowance": inc,
-	}
-	v, err := e.request(http.MethodPost, "/api/update-allowance", m)
-	return cvt.ToInt(v["allowance"]), err
-}
-
-func (e *ExecuterImpl) GetAuditLogs(typ string) ([]map[string]interface{}, error) {
-	ret, err := e.request(http.MethodGet, fmt.Sprintf("/api/logs/%s", typ), nil)
-	if err != nil {
-		return nil, err
-	}
-	arr, _ := ret["audit_logs"].([]interface{})
-	out := make([]map[string]interface{}, len(arr))
-	for i, a := range arr {
-		out[i], _ = a.(map[string]interface{})
-	}
-	return out, nil
-}
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/plugins/admin_auth"
+)
+
+type Executer interface {
+	GetDeviceList() ([]map[string]interface{}, error)
+	BlockDevice(serialNumber string) error
+	AuthorizeDevice(serialNumber string) error
+	ApplyLicence(file string) (map[string]interface{}, error)
+	GetAllowanceLedger(pool string) (map[string]interface{}, []map[string]interface{}, error)
+	GetAuditLogs(typ string, q audit.Query) (*audit.Page, error)
+	FollowLogs(types []string, q audit.Query, fn func(audit.Event) error) error
+	ListRules() ([]map[string]interface{}, error)
+	DryRunRules(file string) ([]map[string]interface{}, error)
+	UploadFirmware(version, file, releaseNotes, hardware, channels, securityVersion, signature string, publish bool) (map[string]interface{}, error)
+	ListFirmware() ([]map[string]interface{}, error)
+	PublishFirmware(version, signature string, channels []string) error
+	SetFirmwareChannels(version string, channels []string) (map[string]interface{}, error)
+	RetireFirmware(version, reason string) error
+	ListCampaigns() ([]map[string]interface{}, error)
+	CreateCampaign(file string) (map[string]interface{}, error)
+	GetCampaign(id string) (map[string]interface{}, error)
+	ControlCampaign(id, op, reason string) (map[string]interface{}, error)
+	SetDeviceTags(serialNumber string, tags []string) error
+	SetDeviceChannel(serialNumber, channel string) error
+	ApproveRollback(serialNumber, version, reason string) error
+}
+
+func NewExecuter(addr string, opts ...Option) (Executer, error) {
+	exe := &ExecuterImpl{
+		protocol:   "http",
+		serverAddr: addr,
+		client: &http.Client{
+			Timeout: 15 * time.Second,
+		},
+	}
+	for _, f := range opts {
+		if err := f(exe); err != nil {
+			return nil, err
+		}
+	}
+	return exe, nil
+}
+
+// Send http request to the server and display the results.
+type ExecuterImpl struct {
+	protocol   string
+	serverAddr string
+	client     *http.Client
+	apiKey     string
+}
+
+type Option func(*ExecuterImpl) error
+
+func WithCertFile(certFile string) Option {
+	return func(e *ExecuterImpl) error {
+		caCert, err := ioutil.ReadFile(certFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA certificate: %v", err)
+		}
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		e.protocol = "https"
+		e.client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: caCertPool,
+			},
+		}
+		return nil
+	}
+}
+
+// WithCredentials authenticates the requests with the API key, or the client certificate.
+// It must be applied after WithCertFile.
+func WithCredentials(c Credentials) Option {
+	return func(e *ExecuterImpl) error {
+		e.apiKey = c.APIKey
+		if c.CertFile == "" {
+			return nil
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		transport, ok := e.client.Transport.(*http.Transport)
+		if !ok || transport.TLSClientConfig == nil {
+			return fmt.Errorf("client certificate requires https")
+		}
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		return nil
+	}
+}
+
+func (e *ExecuterImpl) request(method, url string, in map[string]interface{}) (map[string]interface{}, error) {
+	var body io.Reader = http.NoBody
+	if in != nil {
+		data, _ := json.Marshal(in)
+		body = bytes.NewBuffer(data)
+	}
+	return e.requestRaw(method, url, "application/json", body)
+}
+
+func (e *ExecuterImpl) requestRaw(method, url, contentType string, body io.Reader) (map[string]interface{}, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("%s://%s%s", e.protocol, e.serverAddr, url), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.apiKey != "" {
+		req.Header.Set(admin_auth.HeaderAPIKey, e.apiKey)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	err = json.Unmarshal(data, &out)
+	if err != nil {
+		return nil, err
+	}
+	if code := cvt.ToInt(out["code"]); code != 0 {
+		return out, fmt.Errorf("%s", cvt.ToString(out["msg"]))
+	}
+	return out, nil
+}
+
+func (e *ExecuterImpl) GetDeviceList() ([]map[string]interface{}, error) {
+	ret, err := e.request(http.MethodGet, "/api/devices", nil)
+	if err != nil {
+		return nil, err
+	}
+	arr, _ := ret["devices"].([]interface{})
+	out := make([]map[string]interface{}, len(arr))
+	for i, a := range arr {
+		out[i], _ = a.(map[string]interface{})
+	}
+	return out, nil
+}
+
+func (e *ExecuterImpl) BlockDevice(serialNumber string) error {
+	_, err := e.request(http.MethodPost, fmt.Sprintf("/api/devices/%s/block", serialNumber), nil)
+	return err
+}
+
+func (e *ExecuterImpl) AuthorizeDevice(serialNumber string) error {
+	_, err := e.request(http.MethodPost, fmt.Sprintf("/api/devices/%s/authorize", serialNumber), nil)
+	return err
+}
+
+// SetDeviceTags replaces the tags of the device, which select it for update campaigns.
+func (e *ExecuterImpl) SetDeviceTags(serialNumber string, tags []string) error {
+	_, err := e.request(http.MethodPost, fmt.Sprintf("/api/devices/%s/tags", serialNumber), map[string]interface{}{"tags": tags})
+	return err
+}
+
+// SetDeviceChannel sets the release channel of the device.
+func (e *ExecuterImpl) SetDeviceChannel(serialNumber, channel string) error {
+	_, err := e.request(http.MethodPost, fmt.Sprintf("/api/devices/%s/channel", serialNumber), map[string]interface{}{"channel": channel})
+	return err
+}
+
+// ApproveRollback approves the device to be downgraded once to the version, below its security version.
+func (e *ExecuterImpl) ApproveRollback(serialNumber, version, reason string) error {
+	m := map[string]interface{}{
+		"version": version,
+		"reason":  reason,
+	}
+	_, err := e.request(http.MethodPost, fmt.Sprintf("/api/devices/%s/rollback", serialNumber), m)
+	return err
+}
+
+// ApplyLicence sends the signed licence file, which increases the allowance of its pool.
+func (e *ExecuterImpl) ApplyLicence(file string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read licence: %v", err)
+	}
+	return e.requestRaw(http.MethodPost, "/api/update-allowance", "application/json", bytes.NewReader(data))
+}
+
+// GetAllowanceLedger returns the allowance of the pools and the ledger entries of the pool, or of all pools.
+func (e *ExecuterImpl) GetAllowanceLedger(pool string) (map[string]interface{}, []map[string]interface{}, error) {
+	ret, err := e.request(http.MethodGet, "/api/allowance/ledger?pool="+url.QueryEscape(pool), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	arr, _ := ret["ledger"].([]interface{})
+	out := make([]map[string]interface{}, len(arr))
+	for i, a := range arr {
+		out[i], _ = a.(map[string]interface{})
+	}
+	pools, _ := ret["pools"].(map[string]interface{})
+	return pools, out, nil
+}
+
+// GetAuditLogs returns the page of the logs of the type which match the query.
+func (e *ExecuterImpl) GetAuditLogs(typ string, q audit.Query) (*audit.Page, error) {
+	ret, err := e.request(http.MethodGet, fmt.Sprintf("/api/logs/%s?%s", typ, q.Values().Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	arr, _ := ret["audit_logs"].([]interface{})
+	out := make([]map[string]interface{}, len(arr))
+	for i, a := range arr {
+		out[i], _ = a.(map[string]interface{})
+	}
+	return &audit.Page{Logs: out, Total: cvt.ToInt(ret["total"]), Next: cvt.ToInt64(ret["next_cursor"])}, nil
+}
+
+// FollowLogs streams the new entries of the types which match the query to fn, until the stream or fn fails.
+func (e *ExecuterImpl) FollowLogs(types []string, q audit.Query, fn func(audit.Event) error) error {
+	v := q.Values()
+	v.Set("types", strings.Join(types, ","))
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s/api/logs/stream?%s", e.protocol, e.serverAddr, v.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if e.apiKey != "" {
+		req.Header.Set(admin_auth.HeaderAPIKey, e.apiKey)
+	}
+	client := *e.client
+	client.Timeout = 0 // the stream has no end
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		var out map[string]interface{}
+		data, _ := io.ReadAll(resp.Body)
+		if err := json.Unmarshal(data, &out); err != nil {
+			return fmt.Errorf("unexpected response: %s", resp.Status)
+		}
+		return fmt.Errorf("%s", cvt.ToString(out["msg"]))
+	}
+	var ev audit.Event
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event:"):
+			ev.Type = audit.LogType(strings.TrimSpace(strings.TrimPrefix(line, "event:")))
+		case strings.HasPrefix(line, "data:"):
+			_ = json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &ev.Entry)
+		case line == "" && ev.Entry != nil:
+			if err := fn(ev); err != nil {
+				return err
+			}
+			ev = audit.Event{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream closed by the server")
+}
+
+// ListRules returns the rules of automatic actions in effect.
+func (e *ExecuterImpl) ListRules() ([]map[string]interface{}, error) {
+	ret, err := e.request(http.MethodGet, "/api/policy/rules", nil)
+	if err != nil {
+		return nil, err
+	}
+	arr, _ := ret["rules"].([]interface{})
+	out := make([]map[string]interface{}, len(arr))
+	for i, a := range arr {
+		out[i], _ = a.(map[string]interface{})
+	}
+	return out, nil
+}
+
+// DryRunRules returns the rules in the file which the logged incidents would fire.
+func (e *ExecuterImpl) DryRunRules(file string) ([]map[string]interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rules: %v", err)
+	}
+	body, err := json.Marshal(map[string]json.RawMessage{"rules": data})
+	if err != nil {
+		return nil, fmt.Errorf("invalid rules: %v", err)
+	}
+	ret, err := e.requestRaw(http.MethodPost, "/api/policy/dry-run", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	arr, _ := ret["fired"].([]interface{})
+	out := make([]map[string]interface{}, len(arr))
+	for i, a := range arr {
+		out[i], _ = a.(map[string]interface{})
+	}
+	return out, nil
+}
+
+func (e *ExecuterImpl) UploadFirmware(version, file, releaseNotes, hardware, channels, securityVersion, signature string, publish bool) (map[string]interface{}, error) {
+	image, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open firmware image: %v", err)
+	}
+	defer image.Close()
+	query := url.Values{}
+	query.Set("release_notes", releaseNotes)
+	query.Set("hardware", hardware)
+	query.Set("publish", fmt.Sprintf("%v", publish))
+	if channels != "" {
+		query.Set("channels", channels)
+	}
+	if securityVersion != "" {
+		query.Set("security_version", securityVersion)
+	}
+	if signature != "" {
+		query.Set("signature", signature)
+	}
+	ret, err := e.requestRaw(http.MethodPost, fmt.Sprintf("/api/firmwares/%s?%s", url.PathEscape(version), query.Encode()),
+		"application/octet-stream", image)
+	if err != nil {
+		return nil, err
+	}
+	meta, _ := ret["firmware"].(map[string]interface{})
+	return meta, nil
+}
+
+func (e *ExecuterImpl) ListFirmware() ([]map[string]interface{}, error) {
+	ret, err := e.request(http.MethodGet, "/api/firmwares", nil)
+	if err != nil {
+		return nil, err
+	}
+	arr, _ := ret["firmwares"].([]interface{})
+	out := make([]map[string]interface{}, len(arr))
+	for i, a := range arr {
+		out[i], _ = a.(map[string]interface{})
+	}
+	return out, nil
+}
+
+// PublishFirmware publishes the version to the channels, to the stable channel if none.
+// The signature of its manifest is made offline with the publisher key.
+func (e *ExecuterImpl) PublishFirmware(version, signature string, channels []string) error {
+	_, err := e.request(http.MethodPost, fmt.Sprintf("/api/firmwares/%s/publish", url.PathEscape(version)),
+		map[string]interface{}{"channels": channels, "signature": signature})
+	return err
+}
+
+// SetFirmwareChannels replaces the release channels of a published version.
+func (e *ExecuterImpl) SetFirmwareChannels(version string, channels []string) (map[string]interface{}, error) {
+	ret, err := e.request(http.MethodPost, fmt.Sprintf("/api/firmwares/%s/channels", url.PathEscape(version)), map[string]interface{}{"channels": channels})
+	if err != nil {
+		return nil, err
+	}
+	meta, _ := ret["firmware"].(map[string]interface{})
+	return meta, nil
+}
+
+func (e *ExecuterImpl) RetireFirmware(version, reason string) error {
+	m := map[string]interface{}{
+		"reason": reason,
+	}
+	_, err := e.request(http.MethodPost, fmt.Sprintf("/api/firmwares/%s/retire", url.PathEscape(version)), m)
+	return err
+}
+
+func (e *ExecuterImpl) ListCampaigns() ([]map[string]interface{}, error) {
+	ret, err := e.request(http.MethodGet, "/api/campaigns", nil)
+	if err != nil {
+		return nil, err
+	}
+	arr, _ := ret["campaigns"].([]interface{})
+	out := make([]map[string]interface{}, len(arr))
+	for i, a := range arr {
+		out[i], _ = a.(map[string]interface{})
+	}
+	return out, nil
+}
+
+// CreateCampaign creates the update campaign described by the JSON file.
+func (e *ExecuterImpl) CreateCampaign(file string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read campaign: %v", err)
+	}
+	ret, err := e.requestRaw(http.MethodPost, "/api/campaigns", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	c, _ := ret["campaign"].(map[string]interface{})
+	return c, nil
+}
+
+func (e *ExecuterImpl) GetCampaign(id string) (map[string]interface{}, error) {
+	ret, err := e.request(http.MethodGet, fmt.Sprintf("/api/campaigns/%s", url.PathEscape(id)), nil)
+	if err != nil {
+		return nil, err
+	}
+	c, _ := ret["campaign"].(map[string]interface{})
+	return c, nil
+}
+
+// ControlCampaign pauses, resumes, aborts or advances the campaign.
+func (e *ExecuterImpl) ControlCampaign(id, op, reason string) (map[string]interface{}, error) {
+	m := map[string]interface{}{
+		"reason": reason,
+	}
+	ret, err := e.request(http.MethodPost, fmt.Sprintf("/api/campaigns/%s/%s", url.PathEscape(id), op), m)
+	if err != nil {
+		return nil, err
+	}
+	c, _ := ret["campaign"].(map[string]interface{})
+	return c, nil
+}
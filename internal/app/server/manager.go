@@ -1,252 +1,805 @@
-package server
-
-// Implementation of the DeviceManager and SessionManager interfaces
-// for managing device registration and session management in the server.
-
-import (
-	"encoding/json"
-	"fmt"
-	"os"
-	"strings"
-	"sync"
-	"time"
-
-	"github.com/yuanyuanxiang/fss/internal/pkg/common"
-	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
-)
-
-const (
-	CONFIG_PATH = "settings.ini"
-)
-
-// SessionManager interface defines methods for managing user sessions.
-type SessionManager interface {
-	AddSess(serialNumber, challenge string, expiresAt time.Time, isVerified bool)
-	IsValidSess(serialNumber, challenge string) bool
-	MarkSessVerified(serialNumber, challenge string) bool
-
-	GenerateAuthHeader(serialNumber string) string
-	VerifyAuthHeader(authHeader string) (string, error)
-}
-
-type Session struct {
-	SerialNumber string
-	Challenge    string
-	ExpiresAt    time.Time
-	IsVerified   bool
-}
-
-type SessionManagerImpl struct {
-	mu       sync.Mutex
-	Sessions map[string]Session
-	Tokkens  map[string]struct{} // one time token
-}
-
-func NewSessionManager() *SessionManagerImpl {
-	return &SessionManagerImpl{
-		Sessions: make(map[string]Session),
-		Tokkens:  make(map[string]struct{}),
-	}
-}
-
-func (s *SessionManagerImpl) AddSess(serialNumber, challenge string, expiresAt time.Time, isVerified bool) {
-	sessId := fmt.Sprintf("%s-%s", serialNumber, challenge)
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if _, ok := s.Sessions[sessId]; !ok {
-		s.Sessions[sessId] = Session{
-			SerialNumber: serialNumber,
-			Challenge:    challenge,
-			ExpiresAt:    expiresAt,
-			IsVerified:   isVerified,
-		}
-	}
-}
-
-func (s *SessionManagerImpl) IsValidSess(serialNumber, challenge string) bool {
-	sessId := fmt.Sprintf("%s-%s", serialNumber, challenge)
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if sess, ok := s.Sessions[sessId]; ok {
-		if time.Now().After(sess.ExpiresAt) {
-			delete(s.Sessions, sessId)
-			return false
-		}
-		return true
-	}
-	return false
-}
-
-func (s *SessionManagerImpl) MarkSessVerified(serialNumber, challenge string) bool {
-	sessId := fmt.Sprintf("%s-%s", serialNumber, challenge)
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if sess, ok := s.Sessions[sessId]; ok {
-		if time.Now().After(sess.ExpiresAt) {
-			delete(s.Sessions, sessId)
-			return false
-		}
-		if sess.IsVerified {
-			return false
-		}
-		sess.IsVerified = true
-		return true
-	}
-	return false
-}
-
-func (s *SessionManagerImpl) GenerateAuthHeader(serialNumber string) string {
-	// finally we should use JWT or other token
-	// length: 7 + 10 + 15 = 32
-	str, _ := common.GenerateRandomStringBase64(15)
-	token := "Bearer " + serialNumber + str
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.Tokkens[token] = struct{}{}
-	return token
-}
-
-func (s *SessionManagerImpl) VerifyAuthHeader(authHeader string) (string, error) {
-	if !strings.HasPrefix(authHeader, "Bearer ") || len(authHeader) < 32 {
-		return "", fmt.Errorf("invalid auth header")
-	}
-	str := strings.TrimPrefix(authHeader, "Bearer ")
-	serialNumber := str[:10]
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if _, ok := s.Tokkens[authHeader]; !ok {
-		return serialNumber, fmt.Errorf("invalid auth header")
-	}
-	delete(s.Tokkens, authHeader)
-	return serialNumber, nil
-}
-
-///////////////////////////////////////////////////////////////////////////////////////////////////////
-
-// DeviceManager interface defines methods for managing device registration and verification.
-type DeviceManager interface {
-	IsDeviceRegistered(serialNumber string) error
-	RegisterDevice(serialNumber, publicKey string, isVerified bool)
-	GetDevicePublicKey(serialNumber string) string
-	GetDeviceList() ([]map[string]interface{}, error)
-	BlockDevice(serialNumber string) error
-	AuthorizeDevice(serialNumber string) error
-
-	GetAllowance(key string) int
-	IncreaseAllowance(key string, inc int)
-}
-
-type DeviceManagerImpl struct {
-	mu        sync.Mutex
-	Allowance int
-	devList   map[string]map[string]interface{}
-}
-
-func NewDeviceManager(allowance int) *DeviceManagerImpl {
-	dev := &DeviceManagerImpl{
-		Allowance: allowance,
-		devList:   make(map[string]map[string]interface{}),
-	}
-	data, _ := os.ReadFile(CONFIG_PATH)
-	settings := map[string]interface{}{}
-	err := json.Unmarshal(data, &settings)
-	if err == nil {
-		dev.Allowance = cvt.ToInt(settings["allowance"])
-	}
-	return dev
-}
-
-func (d *DeviceManagerImpl) IsDeviceRegistered(serialNumber string) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if m, ok := d.devList[serialNumber]; ok {
-		authorize := cvt.ToBoolean(m["is_verified"])
-		if !authorize {
-			return fmt.Errorf("device is authorized")
-		}
-		return nil
-	}
-	return fmt.Errorf("device not registered")
-}
-
-func (d *DeviceManagerImpl) RegisterDevice(serialNumber, publicKey, state string, isVerified bool) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if d.Allowance <= 0 {
-		return fmt.Errorf("allowance exceeded")
-	}
-	if _, ok := d.devList[serialNumber]; !ok {
-		d.Allowance--
-	}
-	d.devList[serialNumber] = make(map[string]interface{})
-	d.devList[serialNumber]["serial_number"] = serialNumber
-	d.devList[serialNumber]["public_key"] = publicKey
-	d.devList[serialNumber]["is_verified"] = isVerified
-	d.devList[serialNumber]["state"] = state
-
-	return nil
-}
-
-func (d *DeviceManagerImpl) GetDevicePublicKey(serialNumber string) string {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if dev, ok := d.devList[serialNumber]; ok {
-		return cvt.ToString(dev["public_key"])
-	}
-	return ""
-}
-
-func (d *DeviceManagerImpl) GetDeviceList() ([]map[string]interface{}, error) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	devices := make([]map[string]interface{}, 0, len(d.devList))
-	for _, device := range d.devList {
-		devices = append(devices, device)
-	}
-	return devices, nil
-}
-
-func (d *DeviceManagerImpl) BlockDevice(serialNumber string) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if m, ok := d.devList[serialNumber]; ok {
-		m["is_verified"] = false // marked as unauthorized
-	} else {
-		d.devList[serialNumber] = make(map[string]interface{})
-		d.devList[serialNumber]["serial_number"] = serialNumber
-		d.devList[serialNumber]["public_key"] = ""
-		d.devList[serialNumber]["is_verified"] = false
-		d.devList[serialNumber]["state"] = ""
-	}
-	return nil
-}
-
-func (d *DeviceManagerImpl) AuthorizeDevice(serialNumber string) error {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	if m, ok := d.devList[serialNumber]; ok {
-		m["is_verified"] = true // marked as unauthorized
-	} else {
-		d.devList[serialNumber] = make(map[string]interface{})
-		d.devList[serialNumber]["serial_number"] = serialNumber
-		d.devList[serialNumber]["public_key"] = ""
-		d.devList[serialNumber]["is_verified"] = true
-		d.devList[serialNumber]["state"] = ""
-	}
-	return nil
-}
-
-func (d *DeviceManagerImpl) GetAllowance(key string) int {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	return d.Allowance
-}
-
-func (d *DeviceManagerImpl) IncreaseAllowance(key string, inc int) {
-	d.mu.Lock()
-	defer d.mu.Unlock()
-	d.Allowance += inc
-	// use database instead
-	data, _ := json.MarshalIndent(map[string]interface{}{"allowance": d.Allowance}, "", "  ")
-	_ = os.WriteFile(CONFIG_PATH, data, 0644)
-}
+package server
+
+// Implementation of the DeviceManager and SessionManager interfaces
+// for managing device registration and session management in the server.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/ledger"
+	"github.com/yuanyuanxiang/fss/internal/pkg/licence"
+	"github.com/yuanyuanxiang/fss/internal/pkg/token"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+	"github.com/yuanyuanxiang/fss/pkg/store"
+)
+
+const (
+	CONFIG_PATH = "settings.ini" // legacy settings file, only read to import the allowance
+
+	devicesBucket  = "devices"
+	settingsBucket = "settings" // only read to import the allowance of an older registry
+	allowanceKey   = "allowance"
+)
+
+// SessionManager interface defines methods for managing user sessions.
+type SessionManager interface {
+	AddSess(serialNumber, challenge string, isVerified bool) (time.Time, error)
+	IsValidSess(serialNumber, challenge string) bool
+	MarkSessVerified(serialNumber, challenge string) bool
+
+	GenerateAuthHeader(serialNumber, purpose, version string) (string, error)
+	VerifyAuthHeader(authHeader, purpose, version string) (string, error)
+	GenerateRegisterHeader(serialNumber, pool string) (string, error)
+	VerifyRegisterHeader(authHeader string) (string, string, error)
+	GenerateDownloadTicket(serialNumber, version string) (string, time.Time, error)
+	VerifyDownloadTicket(authHeader, version string) (string, error)
+
+	Stats() map[string]interface{}
+}
+
+var (
+	ErrTooManySessions = errors.New("too many pending sessions")
+	ErrUnknownPool     = errors.New("unknown allowance pool")
+)
+
+// SessionConfig defines the lifetime and the limits of sessions and one-time tokens.
+type SessionConfig struct {
+	SessionTTL       time.Duration // lifetime of a challenge session
+	TokenTTL         time.Duration // lifetime of a one-time token
+	DownloadTTL      time.Duration // lifetime of a download ticket, which covers a resumable download
+	MaxSessPerSerial int           // maximum pending sessions of one serial number
+	MaxSessions      int           // maximum pending sessions of all serial numbers
+	SweepInterval    time.Duration // interval of removing expired sessions and tokens
+}
+
+func DefaultSessionConfig() SessionConfig {
+	return SessionConfig{
+		SessionTTL:       5 * time.Minute,
+		TokenTTL:         10 * time.Minute,
+		DownloadTTL:      time.Hour,
+		MaxSessPerSerial: 5,
+		MaxSessions:      100000,
+		SweepInterval:    time.Minute,
+	}
+}
+
+type Session struct {
+	SerialNumber string
+	Challenge    string
+	ExpiresAt    time.Time
+	IsVerified   bool
+}
+
+type SessionManagerImpl struct {
+	mu        sync.Mutex
+	cfg       SessionConfig
+	Sessions  map[string]Session
+	tokens    *token.Manager // one time token
+	perSerial map[string]int // number of pending sessions of each serial number
+	rejected  uint64         // sessions rejected by the limits
+	expired   uint64         // sessions and tokens removed after expiry
+}
+
+// NewSessionManager creates a session manager, whose tokens are signed with the token key.
+func NewSessionManager(cfg SessionConfig, tokenKey []byte) *SessionManagerImpl {
+	return &SessionManagerImpl{
+		cfg:       cfg,
+		Sessions:  make(map[string]Session),
+		tokens:    token.NewManager(tokenKey, cfg.TokenTTL),
+		perSerial: make(map[string]int),
+	}
+}
+
+// StartSweeper removes expired sessions and tokens periodically, until the context is done.
+func (s *SessionManagerImpl) StartSweeper(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.cfg.SweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				s.sweep(now)
+			}
+		}
+	}()
+}
+
+func (s *SessionManagerImpl) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.Sessions {
+		if now.After(sess.ExpiresAt) {
+			s.deleteSess(id)
+			s.expired++
+		}
+	}
+	s.expired += uint64(s.tokens.Sweep(now))
+}
+
+// deleteSess must be called with the lock held.
+func (s *SessionManagerImpl) deleteSess(sessId string) {
+	sess, ok := s.Sessions[sessId]
+	if !ok {
+		return
+	}
+	delete(s.Sessions, sessId)
+	if s.perSerial[sess.SerialNumber] <= 1 {
+		delete(s.perSerial, sess.SerialNumber)
+	} else {
+		s.perSerial[sess.SerialNumber]--
+	}
+}
+
+// AddSess adds a session alive for the session TTL, and returns its expiry.
+// It fails if the serial number or the server has too many pending sessions.
+func (s *SessionManagerImpl) AddSess(serialNumber, challenge string, isVerified bool) (time.Time, error) {
+	sessId := fmt.Sprintf("%s-%s", serialNumber, challenge)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.Sessions[sessId]; ok {
+		return sess.ExpiresAt, nil
+	}
+	if s.perSerial[serialNumber] >= s.cfg.MaxSessPerSerial || len(s.Sessions) >= s.cfg.MaxSessions {
+		s.rejected++
+		return time.Time{}, ErrTooManySessions
+	}
+	expiresAt := time.Now().Add(s.cfg.SessionTTL)
+	s.Sessions[sessId] = Session{
+		SerialNumber: serialNumber,
+		Challenge:    challenge,
+		ExpiresAt:    expiresAt,
+		IsVerified:   isVerified,
+	}
+	s.perSerial[serialNumber]++
+	return expiresAt, nil
+}
+
+func (s *SessionManagerImpl) IsValidSess(serialNumber, challenge string) bool {
+	sessId := fmt.Sprintf("%s-%s", serialNumber, challenge)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.Sessions[sessId]; ok {
+		if time.Now().After(sess.ExpiresAt) {
+			s.deleteSess(sessId)
+			s.expired++
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// MarkSessVerified consumes the session, so a challenge can only be verified once.
+func (s *SessionManagerImpl) MarkSessVerified(serialNumber, challenge string) bool {
+	sessId := fmt.Sprintf("%s-%s", serialNumber, challenge)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, ok := s.Sessions[sessId]; ok {
+		s.deleteSess(sessId)
+		if time.Now().After(sess.ExpiresAt) {
+			s.expired++
+			return false
+		}
+		return !sess.IsVerified
+	}
+	return false
+}
+
+// Stats returns the number of live sessions and tokens.
+func (s *SessionManagerImpl) Stats() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]interface{}{
+		"sessions":            len(s.Sessions),
+		"tokens":              s.tokens.Live(),
+		"used_tokens":         s.tokens.Used(),
+		"serial_numbers":      len(s.perSerial),
+		"rejected_sessions":   s.rejected,
+		"expired":             s.expired,
+		"session_ttl":         s.cfg.SessionTTL.String(),
+		"token_ttl":           s.cfg.TokenTTL.String(),
+		"download_ttl":        s.cfg.DownloadTTL.String(),
+		"max_sess_per_serial": s.cfg.MaxSessPerSerial,
+		"max_sessions":        s.cfg.MaxSessions,
+	}
+}
+
+// GenerateAuthHeader issues a one-time token of the device for the purpose and version scope.
+func (s *SessionManagerImpl) GenerateAuthHeader(serialNumber, purpose, version string) (string, error) {
+	t, err := s.tokens.Issue(serialNumber, purpose, version)
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + t, nil
+}
+
+// VerifyAuthHeader verifies the token is valid for the purpose and version, and consumes it.
+// The serial number is returned on error too if the token is authentic.
+func (s *SessionManagerImpl) VerifyAuthHeader(authHeader, purpose, version string) (string, error) {
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return "", fmt.Errorf("invalid auth header")
+	}
+	claims, err := s.tokens.Consume(strings.TrimPrefix(authHeader, "Bearer "), purpose, version)
+	if claims == nil {
+		return "", err
+	}
+	return claims.Serial, err
+}
+
+// GenerateRegisterHeader issues a one-time register token of the device, which draws from the allowance pool.
+func (s *SessionManagerImpl) GenerateRegisterHeader(serialNumber, pool string) (string, error) {
+	t, err := s.tokens.IssueRegister(serialNumber, pool)
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + t, nil
+}
+
+// VerifyRegisterHeader verifies the register token, consumes it, and returns the serial number and the pool of
+// the token. The serial number is returned on error too if the token is authentic.
+func (s *SessionManagerImpl) VerifyRegisterHeader(authHeader string) (string, string, error) {
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return "", "", fmt.Errorf("invalid auth header")
+	}
+	claims, err := s.tokens.Consume(strings.TrimPrefix(authHeader, "Bearer "), token.PurposeRegister, "")
+	if claims == nil {
+		return "", "", err
+	}
+	if err == nil && claims.Pool == "" {
+		err = fmt.Errorf("%w: no allowance pool", token.ErrScope)
+	}
+	return claims.Serial, claims.Pool, err
+}
+
+// GenerateDownloadTicket issues the ticket of a resumable download of the version, and returns when it expires.
+func (s *SessionManagerImpl) GenerateDownloadTicket(serialNumber, version string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(s.cfg.DownloadTTL)
+	t, err := s.tokens.IssueFor(serialNumber, token.PurposeDownload, version, s.cfg.DownloadTTL)
+	if err != nil {
+		return "", expiresAt, err
+	}
+	return t, expiresAt, nil
+}
+
+// VerifyDownloadTicket verifies the ticket in the auth header is valid for the version, without consuming it,
+// so every request of the download is authorized by the same ticket.
+func (s *SessionManagerImpl) VerifyDownloadTicket(authHeader, version string) (string, error) {
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return "", fmt.Errorf("invalid auth header")
+	}
+	claims, err := s.tokens.Verify(strings.TrimPrefix(authHeader, "Bearer "), token.PurposeDownload, version)
+	if claims == nil {
+		return "", err
+	}
+	return claims.Serial, err
+}
+
+///////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// DeviceManager interface defines methods for managing device registration and verification.
+type DeviceManager interface {
+	IsDeviceRegistered(serialNumber string) error
+	RegisterDevice(serialNumber, publicKey, state, productID, pool string, isVerified bool) error
+	GetDevicePublicKey(serialNumber string) string
+	SetDeviceCertificate(serialNumber, fingerprint string) error
+	GetDeviceCertificate(serialNumber string) string
+	GetDeviceList() ([]map[string]interface{}, error)
+	SetCheckIn(serialNumber string, report map[string]interface{}) error
+	SetTarget(serialNumber, version string) error
+	GetTarget(serialNumber string) string
+	BlockDevice(serialNumber string) error
+	AuthorizeDevice(serialNumber string) error
+	HoldDevice(serialNumber, reason string) error
+	GetDevice(serialNumber string) map[string]interface{}
+	SetDeviceTags(serialNumber string, tags []string) error
+	SetDeviceChannel(serialNumber, channel string) error
+	GetDeviceChannel(serialNumber string) string
+	GetSecurityFloor(serialNumber string) uint32
+	RaiseSecurityFloor(serialNumber string, securityVersion uint32) error
+	ApproveRollback(serialNumber, version, operator, reason string) error
+	GetRollback(serialNumber string) string
+	ConsumeRollback(serialNumber, version string) bool
+
+	ResolvePool(serialNumber, productID string) string
+	GetAllowance(key string) int
+	GetAllowances() map[string]int
+	ApplyLicence(l licence.Licence, operator string) error
+	GetAllowanceLedger(key string) []ledger.Entry
+}
+
+// DeviceManagerImpl keeps the device registry in memory, backed by a persistent store.
+// Every change is written to the store before it is applied in memory, and a registration
+// and the ledger entry of the allowance it consumes are always written in the same batch.
+type DeviceManagerImpl struct {
+	mu      sync.Mutex
+	ledger  *ledger.Ledger // the allowance of each pool is its balance in the ledger
+	pools   []AllowancePool
+	devList map[string]map[string]interface{}
+	store   store.Store
+}
+
+// NewDeviceManager loads the device registry and the allowance ledger from the store. On first start,
+// the allowance of an older store or of the legacy settings file is imported, or the initial allowance is granted
+// to the default pool.
+func NewDeviceManager(allowance int, pools []AllowancePool, st store.Store) (*DeviceManagerImpl, error) {
+	dev := &DeviceManagerImpl{
+		pools:   pools,
+		devList: make(map[string]map[string]interface{}),
+		store:   st,
+	}
+	var err error
+	if dev.ledger, err = ledger.Load(st); err != nil {
+		return nil, err
+	}
+	if dev.ledger.Len() == 0 {
+		reason := "initial allowance"
+		err = st.Get(settingsBucket, allowanceKey, &allowance)
+		if err == nil {
+			reason = "imported from the device registry"
+		} else if err == store.ErrNotFound {
+			data, _ := os.ReadFile(CONFIG_PATH)
+			settings := map[string]interface{}{}
+			if json.Unmarshal(data, &settings) == nil {
+				allowance, reason = cvt.ToInt(settings["allowance"]), "imported from "+CONFIG_PATH
+			}
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load allowance: %w", err)
+		}
+		e := dev.ledger.Next(ledger.Entry{Type: ledger.TypeGrant, Amount: allowance, Operator: "system", Reason: reason})
+		if err := dev.persist([]ledger.Entry{e}); err != nil {
+			return nil, fmt.Errorf("failed to save allowance: %w", err)
+		}
+		dev.ledger.Commit(e)
+	}
+	err = st.ForEach(devicesBucket, func(key string, value json.RawMessage) error {
+		m := make(map[string]interface{})
+		if err := json.Unmarshal(value, &m); err != nil {
+			return fmt.Errorf("invalid device record '%s': %w", key, err)
+		}
+		dev.devList[key] = m
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dev, nil
+}
+
+// persist writes the ledger entries and the device records in one batch.
+// The entries must be committed to the ledger after they are written.
+func (d *DeviceManagerImpl) persist(entries []ledger.Entry, devices ...map[string]interface{}) error {
+	return d.store.Update(func(tx *store.Tx) error {
+		for _, m := range devices {
+			if err := tx.Put(devicesBucket, cvt.ToString(m["serial_number"]), m); err != nil {
+				return err
+			}
+		}
+		return ledger.Put(tx, entries...)
+	})
+}
+
+func (d *DeviceManagerImpl) IsDeviceRegistered(serialNumber string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if m, ok := d.devList[serialNumber]; ok {
+		authorize := cvt.ToBoolean(m["is_verified"])
+		if !authorize {
+			return fmt.Errorf("device is authorized")
+		}
+		return nil
+	}
+	return fmt.Errorf("device not registered")
+}
+
+// RegisterDevice registers the device, and consumes the allowance of its pool on first registration.
+func (d *DeviceManagerImpl) RegisterDevice(serialNumber, publicKey, state, productID, pool string, isVerified bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// the pool was resolved when the register token was issued, the product ID must still select it
+	if resolved := resolvePool(d.pools, serialNumber, productID); resolved != pool {
+		return fmt.Errorf("%w: the product ID selects the pool '%s', not '%s'", ledger.ErrPoolMismatch, resolved, pool)
+	}
+	old, ok := d.devList[serialNumber]
+	// a device stays in the pool of its first registration, which consumed its allowance
+	if ok && registeredPool(old) != pool {
+		return fmt.Errorf("%w: the device is registered in the pool '%s', not '%s'", ledger.ErrPoolMismatch, registeredPool(old), pool)
+	}
+	if d.ledger.Balance(pool) <= 0 {
+		return fmt.Errorf("allowance of pool '%s' exceeded", pool)
+	}
+	// only the first registration of a device consumes the allowance
+	var entries []ledger.Entry
+	if !ok {
+		entries = append(entries, d.ledger.Next(ledger.Entry{Type: ledger.TypeConsume, Pool: pool, Amount: -1, Serial: serialNumber}))
+	}
+	m := map[string]interface{}{
+		"serial_number": serialNumber,
+		"public_key":    publicKey,
+		"is_verified":   isVerified,
+		"state":         state,
+		"pool":          pool,
+	}
+	// a blocked or held device stays so, registering again doesn't authorize it
+	if ok && !cvt.ToBoolean(old["is_verified"]) {
+		m["is_verified"] = false
+	}
+	if cvt.ToBoolean(old["held"]) {
+		m["held"], m["hold_reason"] = true, old["hold_reason"]
+	}
+	// attributes set by the operators, and the last report of the device
+	for _, k := range []string{"tags", "channel", "security_version", "rollback", "check_in", "target"} {
+		if v, ok := old[k]; ok {
+			m[k] = v
+		}
+	}
+	if productID != "" {
+		m["product_id"] = productID
+	}
+	if err := d.persist(entries, m); err != nil {
+		return fmt.Errorf("failed to save device: %w", err)
+	}
+	d.ledger.Commit(entries...)
+	d.devList[serialNumber] = m
+
+	return nil
+}
+
+// registeredPool returns the allowance pool the device was registered in, the default pool for a device registered
+// before the pools.
+func registeredPool(dev map[string]interface{}) string {
+	if pool := cvt.ToString(dev["pool"]); pool != "" {
+		return pool
+	}
+	return ledger.DefaultPool
+}
+
+func (d *DeviceManagerImpl) GetDevicePublicKey(serialNumber string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dev, ok := d.devList[serialNumber]; ok {
+		return cvt.ToString(dev["public_key"])
+	}
+	return ""
+}
+
+// SetDeviceCertificate binds the certificate of the fingerprint to a registered device.
+func (d *DeviceManagerImpl) SetDeviceCertificate(serialNumber, fingerprint string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev, ok := d.devList[serialNumber]
+	if !ok {
+		return fmt.Errorf("device not registered")
+	}
+	m := make(map[string]interface{}, len(dev)+1)
+	for k, v := range dev {
+		m[k] = v
+	}
+	m["cert_sha256"] = fingerprint
+	if err := d.persist(nil, m); err != nil {
+		return fmt.Errorf("failed to save device: %w", err)
+	}
+	d.devList[serialNumber] = m
+	return nil
+}
+
+// GetDeviceCertificate returns the fingerprint of the certificate bound to the device, or "" if there is none.
+func (d *DeviceManagerImpl) GetDeviceCertificate(serialNumber string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dev, ok := d.devList[serialNumber]; ok {
+		return cvt.ToString(dev["cert_sha256"])
+	}
+	return ""
+}
+
+func (d *DeviceManagerImpl) GetDeviceList() ([]map[string]interface{}, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	devices := make([]map[string]interface{}, 0, len(d.devList))
+	for _, device := range d.devList {
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// GetDevice returns a copy of the device record, nil if the device is unknown.
+func (d *DeviceManagerImpl) GetDevice(serialNumber string) map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev, ok := d.devList[serialNumber]
+	if !ok {
+		return nil
+	}
+	m := make(map[string]interface{}, len(dev))
+	for k, v := range dev {
+		m[k] = v
+	}
+	return m
+}
+
+// SetDeviceTags replaces the tags of the device, which select it for update campaigns.
+func (d *DeviceManagerImpl) SetDeviceTags(serialNumber string, tags []string) error {
+	return d.updateDevice(serialNumber, func(m map[string]interface{}) {
+		if len(tags) == 0 {
+			delete(m, "tags")
+		} else {
+			m["tags"] = tags
+		}
+	})
+}
+
+// SetDeviceChannel sets the release channel of the device, the device is only delivered the versions of its channel.
+func (d *DeviceManagerImpl) SetDeviceChannel(serialNumber, channel string) error {
+	if !firmware.ValidChannel(channel) {
+		return fmt.Errorf("%w: '%s'", firmware.ErrInvalidChannel, channel)
+	}
+	return d.updateDevice(serialNumber, func(m map[string]interface{}) {
+		if channel == firmware.DefaultChannel {
+			delete(m, "channel")
+		} else {
+			m["channel"] = channel
+		}
+	})
+}
+
+// GetDeviceChannel returns the release channel of the device, the default channel if none is set.
+func (d *DeviceManagerImpl) GetDeviceChannel(serialNumber string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if channel := cvt.ToString(d.devList[serialNumber]["channel"]); channel != "" {
+		return channel
+	}
+	return firmware.DefaultChannel
+}
+
+// GetSecurityFloor returns the highest security version delivered to or installed on the device, it isn't downgraded
+// below it unless an operator approves a rollback. Like the fuse counter of the device, the floor is never lowered.
+func (d *DeviceManagerImpl) GetSecurityFloor(serialNumber string) uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return uint32(cvt.ToInt64(d.devList[serialNumber]["security_version"]))
+}
+
+// RaiseSecurityFloor raises the security floor of a registered device to the security version delivered to it or
+// reported installed, a lower security version is ignored.
+func (d *DeviceManagerImpl) RaiseSecurityFloor(serialNumber string, securityVersion uint32) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev, ok := d.devList[serialNumber]
+	if !ok {
+		return fmt.Errorf("device not registered")
+	}
+	if securityVersion <= uint32(cvt.ToInt64(dev["security_version"])) {
+		return nil
+	}
+	return d.setLocked(dev, map[string]interface{}{"security_version": securityVersion})
+}
+
+// ApproveRollback allows the device to be downgraded once to the version, below its security floor.
+func (d *DeviceManagerImpl) ApproveRollback(serialNumber, version, operator, reason string) error {
+	if !firmware.ValidVersion(version) {
+		return firmware.ErrInvalidVersion
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev, ok := d.devList[serialNumber]
+	if !ok {
+		return fmt.Errorf("device not registered")
+	}
+	return d.setLocked(dev, map[string]interface{}{"rollback": map[string]interface{}{
+		"version":     version,
+		"approved_by": operator,
+		"reason":      reason,
+		"approved_at": time.Now(),
+	}})
+}
+
+// GetRollback returns the version of the rollback approved for the device, empty if none.
+func (d *DeviceManagerImpl) GetRollback(serialNumber string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rollback, _ := d.devList[serialNumber]["rollback"].(map[string]interface{})
+	return cvt.ToString(rollback["version"])
+}
+
+// ConsumeRollback returns true if a rollback to the version is approved for the device, and removes the approval.
+// The security floor is kept, the rollback is an exception for this version only.
+func (d *DeviceManagerImpl) ConsumeRollback(serialNumber, version string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev, ok := d.devList[serialNumber]
+	rollback, _ := dev["rollback"].(map[string]interface{})
+	if !ok || rollback == nil || cvt.ToString(rollback["version"]) != version {
+		return false
+	}
+	return d.setLocked(dev, map[string]interface{}{"rollback": nil}) == nil
+}
+
+// SetTarget keeps the version assigned to the device at its last check-in, empty if it's up to date.
+func (d *DeviceManagerImpl) SetTarget(serialNumber, version string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev, ok := d.devList[serialNumber]
+	if !ok {
+		return fmt.Errorf("device not registered")
+	}
+	if cvt.ToString(dev["target"]) == version {
+		return nil
+	}
+	var target interface{}
+	if version != "" {
+		target = version
+	}
+	return d.setLocked(dev, map[string]interface{}{"target": target})
+}
+
+// GetTarget returns the version assigned to the device at its last check-in, empty if none.
+func (d *DeviceManagerImpl) GetTarget(serialNumber string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return cvt.ToString(d.devList[serialNumber]["target"])
+}
+
+// setLocked writes the device with the attributes changed, a nil value removes the attribute. d.mu must be held.
+func (d *DeviceManagerImpl) setLocked(dev map[string]interface{}, attrs map[string]interface{}) error {
+	m := make(map[string]interface{}, len(dev)+len(attrs))
+	for k, v := range dev {
+		m[k] = v
+	}
+	for k, v := range attrs {
+		if v == nil {
+			delete(m, k)
+		} else {
+			m[k] = v
+		}
+	}
+	if err := d.persist(nil, m); err != nil {
+		return fmt.Errorf("failed to save device: %w", err)
+	}
+	d.devList[cvt.ToString(m["serial_number"])] = m
+	return nil
+}
+
+// SetCheckIn keeps the last check-in report of a registered device: its firmware version, state and hardware.
+func (d *DeviceManagerImpl) SetCheckIn(serialNumber string, report map[string]interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev, ok := d.devList[serialNumber]
+	if !ok {
+		return fmt.Errorf("device not registered")
+	}
+	m := make(map[string]interface{}, len(dev)+1)
+	for k, v := range dev {
+		m[k] = v
+	}
+	m["check_in"] = report
+	if err := d.persist(nil, m); err != nil {
+		return fmt.Errorf("failed to save device: %w", err)
+	}
+	d.devList[serialNumber] = m
+	return nil
+}
+
+func (d *DeviceManagerImpl) BlockDevice(serialNumber string) error {
+	return d.updateDevice(serialNumber, func(m map[string]interface{}) {
+		m["is_verified"] = false
+	})
+}
+
+// AuthorizeDevice authorizes the device, and releases it if it is held for review.
+func (d *DeviceManagerImpl) AuthorizeDevice(serialNumber string) error {
+	return d.updateDevice(serialNumber, func(m map[string]interface{}) {
+		m["is_verified"] = true
+		delete(m, "held")
+		delete(m, "hold_reason")
+	})
+}
+
+// HoldDevice unauthorizes the device until an operator reviews and authorizes it again.
+func (d *DeviceManagerImpl) HoldDevice(serialNumber, reason string) error {
+	return d.updateDevice(serialNumber, func(m map[string]interface{}) {
+		m["is_verified"] = false
+		m["held"] = true
+		m["hold_reason"] = reason
+	})
+}
+
+// updateDevice applies the update to a copy of the device and saves it.
+// Only registered devices are updated, so incidents of unknown serial numbers don't add records.
+func (d *DeviceManagerImpl) updateDevice(serialNumber string, update func(m map[string]interface{})) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dev, ok := d.devList[serialNumber]
+	if !ok {
+		return fmt.Errorf("device not registered")
+	}
+	m := make(map[string]interface{}, len(dev))
+	for k, v := range dev {
+		m[k] = v
+	}
+	update(m)
+	if err := d.persist(nil, m); err != nil {
+		return fmt.Errorf("failed to save device: %w", err)
+	}
+	d.devList[serialNumber] = m
+	return nil
+}
+
+// ResolvePool returns the allowance pool of the device.
+func (d *DeviceManagerImpl) ResolvePool(serialNumber, productID string) string {
+	return resolvePool(d.pools, serialNumber, productID)
+}
+
+// GetAllowance returns the allowance of the pool, "" is the default pool.
+func (d *DeviceManagerImpl) GetAllowance(key string) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ledger.Balance(key)
+}
+
+// GetAllowances returns the allowance of every pool.
+func (d *DeviceManagerImpl) GetAllowances() map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m := d.ledger.Balances()
+	if _, ok := m[ledger.DefaultPool]; !ok {
+		m[ledger.DefaultPool] = 0
+	}
+	for _, p := range d.pools {
+		if _, ok := m[p.Name]; !ok {
+			m[p.Name] = 0
+		}
+	}
+	return m
+}
+
+// ApplyLicence appends a grant entry of the verified licence to the ledger of its pool, "" is the default pool.
+// A licence can only be applied once.
+func (d *DeviceManagerImpl) ApplyLicence(l licence.Licence, operator string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.isPool(l.Pool) {
+		return fmt.Errorf("%w: '%s'", ErrUnknownPool, l.Pool)
+	}
+	if d.ledger.HasLicence(l.ID) {
+		return fmt.Errorf("%w: '%s'", ledger.ErrLicenceUsed, l.ID)
+	}
+	e := d.ledger.Next(ledger.Entry{Type: ledger.TypeGrant, Pool: l.Pool, Amount: l.Amount, Operator: operator,
+		Reason: "licence", PONumber: l.PONumber, LicenceID: l.ID})
+	if err := d.persist([]ledger.Entry{e}); err != nil {
+		return fmt.Errorf("failed to save allowance: %w", err)
+	}
+	d.ledger.Commit(e)
+	return nil
+}
+
+// GetAllowanceLedger returns the ledger entries of the pool, or of all pools if key is "".
+func (d *DeviceManagerImpl) GetAllowanceLedger(key string) []ledger.Entry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.ledger.Entries(key)
+}
+
+func (d *DeviceManagerImpl) isPool(name string) bool {
+	if name == "" || name == ledger.DefaultPool {
+		return true
+	}
+	for _, p := range d.pools {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
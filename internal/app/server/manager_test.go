@@ -0,0 +1,106 @@
+package server
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/ledger"
+	"github.com/yuanyuanxiang/fss/internal/pkg/licence"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/pkg/store"
+)
+
+// newTestDeviceManager returns a device registry in a temporary store, with the allowance in the default pool.
+func newTestDeviceManager(t *testing.T, allowance int) *DeviceManagerImpl {
+	t.Helper()
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+	dev, err := NewDeviceManager(allowance, nil, st)
+	if err != nil {
+		t.Fatalf("Failed to create device manager: %v", err)
+	}
+	return dev
+}
+
+func TestDeviceManager_RegisterKeepsBlocked(t *testing.T) {
+	dev := newTestDeviceManager(t, 10)
+	for _, sn := range []string{"0000000001", "0000000002"} {
+		if err := dev.RegisterDevice(sn, "key", "", "", ledger.DefaultPool, true); err != nil {
+			t.Fatalf("Failed to register %s: %v", sn, err)
+		}
+	}
+	if err := dev.BlockDevice("0000000001"); err != nil {
+		t.Fatalf("Failed to block device: %v", err)
+	}
+	if err := dev.HoldDevice("0000000002", "seen from two networks"); err != nil {
+		t.Fatalf("Failed to hold device: %v", err)
+	}
+	// registering again doesn't authorize the devices
+	for _, sn := range []string{"0000000001", "0000000002"} {
+		if err := dev.RegisterDevice(sn, "key", "", "", ledger.DefaultPool, true); err != nil {
+			t.Fatalf("Failed to register %s again: %v", sn, err)
+		}
+		if dev.IsDeviceRegistered(sn) == nil {
+			t.Errorf("Expected %s to stay unauthorized", sn)
+		}
+	}
+	if m := dev.GetDevice("0000000002"); !cvt.ToBoolean(m["held"]) || m["hold_reason"] != "seen from two networks" {
+		t.Errorf("Expected the device to stay held: %v", m)
+	}
+	if n := dev.GetAllowance(""); n != 8 {
+		t.Errorf("Expected only the first registrations to consume the allowance, got %d", n)
+	}
+}
+
+func TestDeviceManager_UpdateUnknownDevice(t *testing.T) {
+	dev := newTestDeviceManager(t, 10)
+	if err := dev.BlockDevice("0000000001"); err == nil {
+		t.Error("Expected blocking an unknown device to fail")
+	}
+	if err := dev.SetDeviceTags("0000000001", []string{"lab"}); err == nil {
+		t.Error("Expected tagging an unknown device to fail")
+	}
+	if err := dev.SetDeviceChannel("0000000001", "beta"); err == nil {
+		t.Error("Expected setting the channel of an unknown device to fail")
+	}
+	if list, _ := dev.GetDeviceList(); len(list) != 0 {
+		t.Errorf("Expected no device records, got %v", list)
+	}
+}
+
+func TestDeviceManager_RegisterPool(t *testing.T) {
+	st, _ := store.Open(t.TempDir())
+	defer st.Close()
+	dev, err := NewDeviceManager(10, []AllowancePool{{Name: "pro", ProductIDs: []string{"PRO"}}}, st)
+	if err != nil {
+		t.Fatalf("Failed to create device manager: %v", err)
+	}
+	if err := dev.ApplyLicence(licence.Licence{ID: "LIC-1", Pool: "pro", Amount: 10}, "admin"); err != nil {
+		t.Fatalf("Failed to apply licence: %v", err)
+	}
+
+	// the product ID must select the pool of the register token
+	if err := dev.RegisterDevice("0000000001", "key", "", "PRO", ledger.DefaultPool, true); !errors.Is(err, ledger.ErrPoolMismatch) {
+		t.Fatalf("Expected ErrPoolMismatch, got %v", err)
+	}
+	if err := dev.RegisterDevice("0000000001", "key", "", "PRO", "pro", true); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+	if dev.GetAllowance("pro") != 9 || dev.GetAllowance(ledger.DefaultPool) != 10 {
+		t.Fatalf("Expected only the pool of the token consumed, got %v", dev.GetAllowances())
+	}
+
+	// registering again doesn't move the device to another pool
+	if err := dev.RegisterDevice("0000000001", "key", "", "", ledger.DefaultPool, true); !errors.Is(err, ledger.ErrPoolMismatch) {
+		t.Fatalf("Expected ErrPoolMismatch, got %v", err)
+	}
+	if err := dev.RegisterDevice("0000000001", "key", "", "PRO", "pro", true); err != nil {
+		t.Fatalf("Failed to register device again: %v", err)
+	}
+	if pool := cvt.ToString(dev.GetDevice("0000000001")["pool"]); pool != "pro" || dev.GetAllowance("pro") != 9 {
+		t.Fatalf("Expected the device in the pool 'pro' consumed once, got '%s' and %d", pool, dev.GetAllowance("pro"))
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+// Device operations of the operators, which also reset what the server inferred about the device.
+
+// OperatorDevices is the device registry as the operators change it: a device which an operator authorizes
+// is released from the clone detection, so the sightings before the review don't hold it again,
+// and a device which an operator blocks is notified to the webhooks.
+type OperatorDevices struct {
+	*DeviceManagerImpl
+	clones   *CloneDetector
+	notifier *WebhookNotifier // nil without webhook targets
+}
+
+func NewOperatorDevices(dev *DeviceManagerImpl, clones *CloneDetector, notifier *WebhookNotifier) *OperatorDevices {
+	return &OperatorDevices{DeviceManagerImpl: dev, clones: clones, notifier: notifier}
+}
+
+// BlockDevice blocks the device, and notifies it.
+func (o *OperatorDevices) BlockDevice(serialNumber string) error {
+	if err := o.DeviceManagerImpl.BlockDevice(serialNumber); err != nil {
+		return err
+	}
+	if o.notifier != nil {
+		o.notifier.DeviceBlocked(serialNumber)
+	}
+	return nil
+}
+
+// AuthorizeDevice authorizes the device, and forgets the networks it was seen from.
+func (o *OperatorDevices) AuthorizeDevice(serialNumber string) error {
+	if err := o.DeviceManagerImpl.AuthorizeDevice(serialNumber); err != nil {
+		return err
+	}
+	o.clones.Release(serialNumber)
+	return nil
+}
@@ -0,0 +1,119 @@
+package server
+
+// Automatic actions on security incidents, by the rules in rulesPath,
+// and temporary lockouts of devices and addresses after repeated failed signatures.
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/policy"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/pkg/logger"
+	"github.com/yuanyuanxiang/fss/pkg/ratelimit"
+)
+
+const (
+	rulesPath = "./configs/rules.json"
+	// failures of this incident lock out the serial number and the address
+	lockoutIncident = "invalid signature"
+)
+
+// PolicyLogManager is the log manager of the server: it evaluates the rules on each incident,
+// takes the actions of the fired rules, and records every action with the rule in the actions log.
+type PolicyLogManager struct {
+	audit.LogManager
+	engine    *policy.Engine
+	serials   *ratelimit.Lockout // nil if disabled
+	addresses *ratelimit.Lockout // nil if disabled
+	dev       *DeviceManagerImpl
+	logger    logger.Logger
+}
+
+func NewPolicyLogManager(log audit.LogManager, rules []policy.Rule, serials, addresses *ratelimit.Lockout, dev *DeviceManagerImpl, logger logger.Logger) *PolicyLogManager {
+	return &PolicyLogManager{LogManager: log, engine: policy.NewEngine(rules), serials: serials, addresses: addresses, dev: dev, logger: logger}
+}
+
+func (p *PolicyLogManager) AddIncidentLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{}) {
+	p.LogManager.AddIncidentLog(remoteAddr, serialNumber, desc, code, detail...)
+	inc := policy.Incident{
+		RemoteAddr:   remoteAddr,
+		SerialNumber: serialNumber,
+		Description:  desc,
+		Timestamp:    time.Now(),
+	}
+	if len(detail) > 0 {
+		inc.Detail = cvt.ToString(detail[0]) // only the first detail is logged
+	}
+	fired := p.engine.Evaluate(inc)
+	for _, f := range fired {
+		p.act(f)
+	}
+	if desc == lockoutIncident {
+		address := inc.RemoteAddr
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			address = host
+		}
+		p.lockOut(p.serials, inc.SerialNumber, inc)
+		p.lockOut(p.addresses, address, inc)
+	}
+}
+
+// lockOut counts the failure of the key, and records the lockout if it causes one.
+func (p *PolicyLogManager) lockOut(lockout *ratelimit.Lockout, key string, inc policy.Incident) {
+	if lockout == nil || key == "" || !lockout.Fail(key, inc.Timestamp) {
+		return
+	}
+	until, _ := lockout.LockedUntil(key, inc.Timestamp)
+	p.LogManager.AddActionLog(inc.RemoteAddr, inc.SerialNumber, "lockout", http.StatusOK, map[string]interface{}{
+		"key":      key,
+		"incident": inc.Description,
+		"until":    until.Format(time.RFC3339),
+	})
+}
+
+// act takes the actions of the fired rule.
+func (p *PolicyLogManager) act(f policy.Firing) {
+	for _, action := range f.Actions {
+		detail := map[string]interface{}{
+			"rule":     f.Rule,
+			"incident": f.Incident,
+			"count":    f.Count,
+		}
+		code := http.StatusOK
+		switch action {
+		case policy.ActionBlock:
+			if err := p.dev.BlockDevice(f.SerialNumber); err != nil {
+				code = http.StatusInternalServerError
+				detail["error"] = err.Error()
+			}
+		case policy.ActionAlert:
+			p.logger.Warnf("🚨 Rule '%s' fired on device %s: %d '%s' incidents", f.Rule, f.SerialNumber, f.Count, f.Incident)
+		}
+		p.LogManager.AddActionLog(f.RemoteAddr, f.SerialNumber, action, code, detail)
+	}
+}
+
+// Rules returns the rules in effect.
+func (p *PolicyLogManager) Rules() []policy.Rule {
+	return p.engine.Rules()
+}
+
+// DryRun evaluates the rules against the recent logged incidents held in memory, without taking any action.
+func (p *PolicyLogManager) DryRun(rules []policy.Rule) []policy.Firing {
+	logs, _ := p.LogManager.GetAuditLogs(string(audit.TYPE_INCIDENT)) // no incidents yet is not an error
+	incidents := make([]policy.Incident, 0, len(logs))
+	for _, l := range logs {
+		ts, _ := time.Parse(time.RFC3339, cvt.ToString(l["timestamp"]))
+		incidents = append(incidents, policy.Incident{
+			RemoteAddr:   cvt.ToString(l["remote_addr"]),
+			SerialNumber: cvt.ToString(l["serial_number"]),
+			Description:  cvt.ToString(l["description"]),
+			Detail:       cvt.ToString(l["detail"]),
+			Timestamp:    ts,
+		})
+	}
+	return policy.DryRun(rules, incidents)
+}
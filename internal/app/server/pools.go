@@ -0,0 +1,69 @@
+package server
+
+// Allowance pools: each product line or contract manufacturer has its own registration quota.
+// A device draws from the pool of its product ID, or of the longest matching serial number prefix,
+// or from the default pool.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/ledger"
+)
+
+const poolsPath = "./configs/pools.json"
+
+// AllowancePool defines which devices draw from a pool.
+type AllowancePool struct {
+	Name           string   `json:"name"`
+	SerialPrefixes []string `json:"serial_prefixes,omitempty"`
+	ProductIDs     []string `json:"product_ids,omitempty"`
+}
+
+// LoadAllowancePools loads the pools from the specified file. A missing file means there is only the default pool.
+func LoadAllowancePools(path string) ([]AllowancePool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pools []AllowancePool
+	if err := json.Unmarshal(data, &pools); err != nil {
+		return nil, fmt.Errorf("invalid pools file: %w", err)
+	}
+	names := map[string]bool{ledger.DefaultPool: true}
+	for _, p := range pools {
+		if p.Name == "" || names[p.Name] {
+			return nil, fmt.Errorf("invalid or duplicate pool name: '%s'", p.Name)
+		}
+		names[p.Name] = true
+	}
+	return pools, nil
+}
+
+// resolvePool returns the pool of the device: the pool of its product ID comes first,
+// then the pool of the longest serial number prefix, and then the default pool.
+func resolvePool(pools []AllowancePool, serialNumber, productID string) string {
+	if productID != "" {
+		for _, p := range pools {
+			for _, id := range p.ProductIDs {
+				if id == productID {
+					return p.Name
+				}
+			}
+		}
+	}
+	pool, longest := ledger.DefaultPool, 0
+	for _, p := range pools {
+		for _, prefix := range p.SerialPrefixes {
+			if len(prefix) > longest && strings.HasPrefix(serialNumber, prefix) {
+				pool, longest = p.Name, len(prefix)
+			}
+		}
+	}
+	return pool
+}
@@ -1,255 +1,762 @@
-package server
-
-import (
-	"context"
-	"crypto/ecdh"
-	"encoding/json"
-	"flag"
-	"fmt"
-	"io"
-	"os"
-	"time"
-
-	"github.com/gin-contrib/pprof"
-	"github.com/luraproject/lura/v2/config"
-	"github.com/luraproject/lura/v2/logging"
-	"github.com/luraproject/lura/v2/router/gin"
-	"github.com/luraproject/lura/v2/vicg"
-	"github.com/yuanyuanxiang/fss/internal/pkg/common"
-	"github.com/yuanyuanxiang/fss/pkg/audit"
-	"github.com/yuanyuanxiang/fss/pkg/logger"
-	"github.com/yuanyuanxiang/fss/plugins/allowance_update"
-	"github.com/yuanyuanxiang/fss/plugins/audit_logs"
-	"github.com/yuanyuanxiang/fss/plugins/challenge_gen"
-	"github.com/yuanyuanxiang/fss/plugins/challenge_verify"
-	"github.com/yuanyuanxiang/fss/plugins/device_auth"
-	"github.com/yuanyuanxiang/fss/plugins/device_list"
-	"github.com/yuanyuanxiang/fss/plugins/device_register"
-	"github.com/yuanyuanxiang/fss/plugins/firmware_update"
-	"github.com/yuanyuanxiang/fss/plugins/httpdata_parse"
-)
-
-// Server application
-type Server struct {
-	name      string // Module name
-	cfg       string
-	logger    logger.Logger
-	keyPath   string
-	key       *ecdh.PrivateKey
-	port      int
-	allowance int
-	ready     bool
-}
-
-func New(privateKeyPath string, logger logger.Logger) *Server {
-	return &Server{name: "server", logger: logger, keyPath: privateKeyPath}
-}
-
-func (svr *Server) GetName() string {
-	return svr.name
-}
-
-func (svr *Server) Setup(ctx context.Context, args []string) error {
-	// Define flags for the command line arguments
-	f := flag.NewFlagSet(svr.name, flag.ContinueOnError)
-	f.StringVar(&svr.cfg, "config", "./internal/app/server/apis.json", "Path to the configuration file")
-	port := f.Int("port", 0, "Start the server on specified port")
-	allowance := f.Int("allowance", 0, "Set initial device registration allowance")
-	increaseAllowance := f.Int("increase-allowance", 0, "Increase allowance counter")
-	block := f.String("block", "", "Block a specific device")
-	authorize := f.String("authorize", "", "Authorize a specific device")
-	listDevices := f.Bool("list-devices", false, "List all registered devices")
-	showIncidents := f.Bool("show-incidents", false, "Show security incident logs")
-	showUpdates := f.Bool("show-updates", false, "Show successful update logs")
-	endpoint := f.String("endpoint", "127.0.0.1:9000", "Server address")
-
-	err := f.Parse(args)
-	if err != nil {
-		return err
-	}
-	var exe Executer
-	if !(*port > 0 && *allowance > 0) {
-		exe, err = NewExecuter(*endpoint, WithCertFile(certPath))
-		if err != nil {
-			return err
-		}
-	}
-	switch {
-	case *port > 0 && *allowance > 0:
-		svr.port = *port
-		svr.allowance = *allowance
-		fmt.Printf("Server started on port %d, allowance: %d\n", *port, *allowance)
-
-	case *increaseAllowance > 0:
-		allow, err := exe.IncreaseAllowance("", *increaseAllowance)
-		if err != nil {
-			return err
-		}
-		fmt.Printf("Increasing allowance by %d succeed. Current allowance: %d\n", *increaseAllowance, allow)
-		os.Exit(0)
-
-	case *listDevices:
-		list, err := exe.GetDeviceList()
-		if err != nil {
-			return err
-		}
-		data, _ := json.MarshalIndent(list, "", "  ")
-		fmt.Printf("Registered devices: %d\n%s\n", len(list), string(data))
-		os.Exit(0)
-
-	case *showIncidents:
-		list, err := exe.GetAuditLogs(string(audit.TYPE_INCIDENT))
-		if err != nil {
-			return err
-		}
-		data, _ := json.MarshalIndent(list, "", "  ")
-		fmt.Printf("Security incidents: %d\n%s\n", len(list), string(data))
-		os.Exit(0)
-
-	case *showUpdates:
-		list, err := exe.GetAuditLogs(string(audit.TYPE_UPDATE))
-		if err != nil {
-			return err
-		}
-		data, _ := json.MarshalIndent(list, "", "  ")
-		fmt.Printf("Update logs: %d\n%s\n", len(list), string(data))
-		os.Exit(0)
-
-	case *block != "":
-		if err := exe.BlockDevice(*block); err != nil {
-			return err
-		}
-		fmt.Println("Succeed blocking device: ", *block)
-		os.Exit(0)
-
-	case *authorize != "":
-		if err := exe.AuthorizeDevice(*block); err != nil {
-			return err
-		}
-		fmt.Println("Succeed authorizing device: ", *authorize)
-		os.Exit(0)
-
-	default:
-		fmt.Println("Usage: server --port=<port> - Start the server on specified port")
-		fmt.Println("       server --allowance=<number> - Set initial device registration allowance")
-		fmt.Println("       server --increase-allowance=<number> - Increase allowance counter by specified amount")
-		fmt.Println("       server --list-devices - Display all registered devices")
-		fmt.Println("       server --show-incidents - Display security incident logs")
-		fmt.Println("       server --show-updates - Display successful update logs")
-		fmt.Println("       server --block=<serialNumber> - Block a specific device")
-		fmt.Println("       server --authorize=<serialNumber> - Authorize a specific device")
-		os.Exit(1)
-	}
-
-	privKey, err := getOrCreatePrivateKey(svr.keyPath)
-	if err != nil {
-		return fmt.Errorf("failed to load or generate private key: %w", err)
-	}
-	svr.key = privKey
-	svr.logger.Println("✅ Private key loaded or generated successfully:", svr.keyPath)
-
-	flag.Parse()
-	if svr.port <= 0 || svr.allowance <= 0 {
-		return fmt.Errorf("invalid port number: %d or allowance number: %d", svr.port, svr.allowance)
-	}
-
-	svr.logger.Println("✅ Server setup completed. Port:", svr.port, "Allowance:", svr.allowance)
-	return nil
-}
-
-func (svr *Server) IsReady() bool {
-	return svr.ready
-}
-
-func (svr *Server) SetReady(bool) {
-	svr.ready = true
-}
-
-func (svr *Server) Run(ctx context.Context) error {
-	if svr.port <= 0 {
-		return nil
-	}
-	// Check if cert exists and is valid
-	if needsNewCert(certPath) {
-		svr.logger.Println("Generate new cert:", certPath)
-		if err := generateSelfSignedCert(certPath, keyPath); err != nil {
-			return err
-		}
-	} else {
-		svr.logger.Println("Use current cert:", certPath)
-	}
-	var tls = config.TLS{
-		IsDisabled: false,
-		PublicKey:  certPath,
-		PrivateKey: keyPath,
-	}
-	logManager := audit.NewManager("svr_log.json")
-	var log, _ = logging.NewLogger("INFO", os.Stdout, "")
-	var srvConf = config.ServiceConfig{
-		Version:         1,
-		Name:            svr.name,
-		Debug:           false,
-		Timeout:         time.Duration(180) * time.Second,
-		CacheTTL:        time.Duration(10) * time.Second,
-		Port:            svr.port,
-		SequentialStart: true,
-		ExtraConfig:     map[string]interface{}{audit.LOG_MANAGER: logManager}, // pass log manager to all plugins
-		TLS:             &tls,
-	}
-	var err error
-	srvConf.Endpoints, err = readPluginFile(svr.cfg)
-	if err != nil {
-		return err
-	}
-	srvConf.NormalizeEndpoints()
-	sessManeger := NewSessionManager()
-	devManager := NewDeviceManager(svr.allowance)
-	// Global plugin factory
-	factory := map[string]vicg.VicgPluginFactory{
-		"HttpData_Parse":   httpdata_parse.NewFactory(),
-		"Challenge_Gen":    challenge_gen.NewFactory(sessManeger),
-		"Challenge_Verify": challenge_verify.NewFactory(sessManeger, devManager, common.SymmetricKey),
-		"Device_Register":  device_register.NewFactory(sessManeger, devManager, common.PublicKeyToBase64(svr.key.PublicKey())),
-		"Allowance_Update": allowance_update.NewFactory(devManager),
-		"Firmware_Update":  firmware_update.NewFactory(sessManeger, devManager, svr.key),
-		"Device_List":      device_list.NewFactory(devManager),
-		"Device_Auth":      device_auth.NewFactory(devManager),
-		"Audit_Logs":       audit_logs.NewFactory(),
-	}
-	f := func(cfg *gin.Config) {
-		pprof.Register(cfg.Engine) // register pprof
-	}
-	router := gin.DefaultVicgFactory(vicg.DefaultVicgFactory(log, factory), log, f).NewWithContext(ctx)
-	router.Run(srvConf)
-
-	return nil
-}
-
-func (svr *Server) Stop(context.Context) {
-
-}
-
-func (svr *Server) IsDebug() bool {
-	return false
-}
-
-func readPluginFile(fileName string) ([]*config.EndpointConfig, error) {
-	plugin := &config.EndpointPluginList{}
-	file, err := os.Open(fileName)
-	if err != nil {
-		return nil, err
-	}
-
-	defer file.Close()
-
-	bytes, err := io.ReadAll(file)
-	if err != nil {
-		return nil, err
-	}
-
-	err = json.Unmarshal(bytes, plugin)
-	if err != nil {
-		return nil, err
-	}
-	return plugin.Plugin, nil
-}
+package server
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-contrib/pprof"
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/logging"
+	"github.com/luraproject/lura/v2/router/gin"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/internal/pkg/campaign"
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	"github.com/yuanyuanxiang/fss/internal/pkg/licence"
+	"github.com/yuanyuanxiang/fss/internal/pkg/policy"
+	"github.com/yuanyuanxiang/fss/internal/pkg/webhook"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+	"github.com/yuanyuanxiang/fss/pkg/logger"
+	"github.com/yuanyuanxiang/fss/pkg/ratelimit"
+	"github.com/yuanyuanxiang/fss/pkg/store"
+	"github.com/yuanyuanxiang/fss/plugins/admin_auth"
+	"github.com/yuanyuanxiang/fss/plugins/allowance_ledger"
+	"github.com/yuanyuanxiang/fss/plugins/allowance_update"
+	"github.com/yuanyuanxiang/fss/plugins/audit_logs"
+	"github.com/yuanyuanxiang/fss/plugins/campaign_admin"
+	"github.com/yuanyuanxiang/fss/plugins/challenge_gen"
+	"github.com/yuanyuanxiang/fss/plugins/challenge_verify"
+	"github.com/yuanyuanxiang/fss/plugins/device_auth"
+	"github.com/yuanyuanxiang/fss/plugins/device_checkin"
+	"github.com/yuanyuanxiang/fss/plugins/device_list"
+	"github.com/yuanyuanxiang/fss/plugins/device_register"
+	"github.com/yuanyuanxiang/fss/plugins/firmware_admin"
+	"github.com/yuanyuanxiang/fss/plugins/firmware_download"
+	"github.com/yuanyuanxiang/fss/plugins/firmware_update"
+	"github.com/yuanyuanxiang/fss/plugins/firmware_upload"
+	"github.com/yuanyuanxiang/fss/plugins/httpdata_parse"
+	"github.com/yuanyuanxiang/fss/plugins/log_stream"
+	"github.com/yuanyuanxiang/fss/plugins/policy_rules"
+	"github.com/yuanyuanxiang/fss/plugins/rate_limit"
+	"github.com/yuanyuanxiang/fss/plugins/session_stats"
+)
+
+// Server application
+type Server struct {
+	name        string // Module name
+	cfg         string
+	logger      logger.Logger
+	keyPath     string
+	key         *ecdh.PrivateKey
+	firmwareDir string           // Firmware repository directory
+	dataDir     string           // Device registry directory
+	signingPub  string           // Public key of the publisher, which signs firmware images offline
+	publisher   crypto.PublicKey // nil if no firmware can be published
+	masterPath  string           // Master secret path, used when FSS_MASTER_SECRET is not set
+	keys        *common.MasterKeyProvider
+	tokenKey    []byte // Key of device access tokens, derived from the master secret
+	sessCfg     SessionConfig
+	poolsPath   string // Allowance pools
+	pools       []AllowancePool
+	vendorPub   string            // Public key of the vendor, which signs licence files
+	vendorKey   ed25519.PublicKey // nil if licences can't be verified
+	adminKeys   string            // Admin API keys and certificate subjects
+	adminCA     string            // CA of admin client certificates, optional
+	admins      *AdminRegistry
+	adminCAs    *x509.CertPool
+	deviceCA    *DeviceCA // issues device certificates, nil if disabled
+	auditDir    string    // Segments of the audit log
+	auditKey    string    // Key of signing audit log checkpoints
+	auditEvery  int       // Entries between signed checkpoints
+	auditWindow int       // Recent entries of each log type held in memory
+	auditSigner ed25519.PrivateKey
+	auditSize   int           // MB of a segment before it's rotated
+	auditRotate time.Duration // Age of a segment before it's rotated
+	auditKeep   time.Duration // Retention of the rotated segments, 0 to keep all
+	rulesPath   string        // Rules of automatic actions on incidents
+	webhooks    webhook.Config
+	rules       []policy.Rule
+	serialLock  *ratelimit.Lockout // nil if disabled
+	addressLock *ratelimit.Lockout // nil if disabled
+	clonePolicy string             // what to do with a suspected clone: log, block or review
+	cloneWindow time.Duration
+	port        int
+	allowance   int
+	ready       bool
+}
+
+func New(privateKeyPath string, logger logger.Logger) *Server {
+	return &Server{name: "server", logger: logger, keyPath: privateKeyPath}
+}
+
+func (svr *Server) GetName() string {
+	return svr.name
+}
+
+func (svr *Server) Setup(ctx context.Context, args []string) error {
+	// Define flags for the command line arguments
+	f := flag.NewFlagSet(svr.name, flag.ContinueOnError)
+	f.StringVar(&svr.cfg, "config", "./internal/app/server/apis.json", "Path to the configuration file")
+	f.StringVar(&svr.dataDir, "data-dir", "./data", "Directory of the device registry")
+	f.StringVar(&svr.firmwareDir, "firmware-dir", "./firmware", "Directory of the firmware repository")
+	f.StringVar(&svr.signingPub, "signing-pub", signingPubPath, "Path to the public key of the publisher, which verifies the signatures of published firmware")
+	f.StringVar(&svr.masterPath, "master-secret", "./configs/master_secret", "Path to the master secret of device keys, overridden by "+common.MasterSecretEnv)
+	f.StringVar(&svr.poolsPath, "pools", poolsPath, "Path to the allowance pools of product lines")
+	f.StringVar(&svr.vendorPub, "vendor-pub", vendorPubPath, "Path to the vendor public key, which verifies licence files")
+	f.StringVar(&svr.adminKeys, "admin-keys", adminKeysPath, "Path to the admin identities and their roles")
+	f.StringVar(&svr.adminCA, "admin-ca", "", "Path to the CA certificate of admin client certificates")
+	deviceCA := f.Bool("device-ca", false, "Issue client certificates to devices at registration, which authenticate firmware requests")
+	f.StringVar(&svr.auditDir, "audit-dir", auditDir, "Directory of the audit log segments, "+auditLogPath+" is imported into it on the first start")
+	f.IntVar(&svr.auditSize, "audit-max-size", 64, "MB of an audit log segment before it's rotated")
+	f.DurationVar(&svr.auditRotate, "audit-rotate", 24*time.Hour, "Age of an audit log segment before it's rotated")
+	f.DurationVar(&svr.auditKeep, "audit-retention", 90*24*time.Hour, "Retention of the rotated audit log segments, 0 to keep all")
+	f.StringVar(&svr.auditKey, "audit-key", auditKeyPath, "Path to the key of signing audit log checkpoints")
+	f.IntVar(&svr.auditEvery, "audit-checkpoint", 100, "Audit log entries between signed checkpoints")
+	f.IntVar(&svr.auditWindow, "audit-window", 10000, "Recent audit log entries of each type held in memory, queries read the segments")
+	verifyAuditLog := f.Bool("verify-audit-log", false, "Verify the hash chain and the signed checkpoints of the audit log (offline)")
+	auditPub := f.String("audit-pub", "", "Path to the public key of the audit log key, kept off the server, which verifies the checkpoints")
+	auditKeyID := f.String("audit-key-id", "", "Key ID of the audit log key, pinned when it was generated, which verifies the public key of the checkpoints")
+	generateAuditKey := f.Bool("generate-audit-key", false, "Generate the key of signing audit log checkpoints, an existing key is never overwritten (offline)")
+	f.StringVar(&svr.rulesPath, "rules", rulesPath, "Path to the rules of automatic actions on incidents")
+	webhooksFile := f.String("webhooks", webhooksPath, "Path to the webhook targets of notifications")
+	testWebhook := f.Bool("test-webhook", false, "Send a test event to every webhook target (offline)")
+	lockoutFailures := f.Int("lockout-failures", 5, "Failed signatures which lock out a serial number, 0 to disable")
+	lockoutAddressFailures := f.Int("lockout-address-failures", 20, "Failed signatures which lock out a remote address, 0 to disable")
+	lockoutWindow := f.Duration("lockout-window", 10*time.Minute, "Window of counting failed signatures")
+	lockoutDuration := f.Duration("lockout-duration", 15*time.Minute, "Duration of a lockout")
+	f.StringVar(&svr.clonePolicy, "clone-policy", ClonePolicyReview, "What to do with a suspected clone: log, block or review")
+	f.DurationVar(&svr.cloneWindow, "clone-window", time.Minute, "Window in which a device seen from two networks is a suspected clone")
+	credentials := f.String("credentials", credentialsPath, "Path to the CLI credentials, overridden by "+APIKeyEnv+" or "+ClientCertEnv+"/"+ClientKeyEnv)
+	svr.sessCfg = DefaultSessionConfig()
+	f.DurationVar(&svr.sessCfg.SessionTTL, "session-ttl", svr.sessCfg.SessionTTL, "Lifetime of a challenge session")
+	f.DurationVar(&svr.sessCfg.TokenTTL, "token-ttl", svr.sessCfg.TokenTTL, "Lifetime of a one-time token")
+	f.DurationVar(&svr.sessCfg.DownloadTTL, "download-ttl", svr.sessCfg.DownloadTTL, "Lifetime of a download ticket, which covers a resumable download")
+	f.IntVar(&svr.sessCfg.MaxSessPerSerial, "max-sessions-per-serial", svr.sessCfg.MaxSessPerSerial, "Maximum pending sessions of a serial number")
+	f.IntVar(&svr.sessCfg.MaxSessions, "max-sessions", svr.sessCfg.MaxSessions, "Maximum pending sessions of the server")
+	f.DurationVar(&svr.sessCfg.SweepInterval, "sweep-interval", svr.sessCfg.SweepInterval, "Interval of removing expired sessions and tokens")
+	port := f.Int("port", 0, "Start the server on specified port")
+	allowance := f.Int("allowance", 0, "Set initial device registration allowance")
+	applyLicence := f.String("apply-licence", "", "Apply a licence file, which increases the allowance of its pool")
+	pool := f.String("pool", "", "Allowance pool of the allowance history")
+	allowanceHistory := f.Bool("allowance-history", false, "Show the allowance ledger")
+	block := f.String("block", "", "Block a specific device")
+	authorize := f.String("authorize", "", "Authorize a specific device")
+	listDevices := f.Bool("list-devices", false, "List all registered devices")
+	showIncidents := f.Bool("show-incidents", false, "Show security incident logs")
+	showUpdates := f.Bool("show-updates", false, "Show successful update logs")
+	showActions := f.Bool("show-actions", false, "Show automatic actions taken on incidents")
+	followIncidents := f.Bool("follow-incidents", false, "Follow new security incidents as they happen")
+	logSerial := f.String("serial", "", "Show the logs of the serial number")
+	logAddr := f.String("remote-addr", "", "Show the logs of the remote address")
+	logCode := f.String("code", "", "Show the logs of the code")
+	logSince := f.String("since", "", "Show the logs since the time (RFC 3339)")
+	logUntil := f.String("until", "", "Show the logs before the time (RFC 3339)")
+	logSearch := f.String("search", "", "Show the logs whose description or detail contains the text")
+	logCursor := f.String("cursor", "", "Show the logs after the cursor of the previous page")
+	logLimit := f.String("limit", "", "Logs of a page, 100 by default")
+	logOrder := f.String("order", "", "Order of the logs: asc (default) or desc")
+	logCount := f.Bool("count", false, "Count the logs of all pages, which reads every retained segment")
+	listRules := f.Bool("list-rules", false, "List the rules of automatic actions in effect")
+	dryRunRules := f.String("dry-run-rules", "", "Evaluate the rules in a file against the logged incidents, without taking any action")
+	uploadFirmware := f.String("upload-firmware", "", "Upload a firmware image file")
+	version := f.String("version", "", "Firmware version")
+	releaseNotes := f.String("release-notes", "", "Release notes of the uploaded firmware")
+	hardware := f.String("hardware", "", "Comma separated target hardware of the uploaded firmware")
+	securityVersion := f.String("security-version", "", "Security version of the uploaded firmware, raised by a release which fixes a vulnerability")
+	publish := f.Bool("publish", false, "Publish the firmware right after uploading")
+	signature := f.String("signature", "", "Signed manifest of the published firmware, made offline by fss vendor --sign-firmware")
+	listFirmware := f.Bool("list-firmware", false, "List all firmware versions")
+	publishFirmware := f.String("publish-firmware", "", "Publish a firmware version")
+	firmwareChannels := f.String("firmware-channels", "", "Set the release channels of a published firmware version, e.g. to promote it to stable")
+	channels := f.String("channels", "", "Comma separated release channels of the firmware, stable if none are given to publish it")
+	retireFirmware := f.String("retire-firmware", "", "Retire a firmware version")
+	reason := f.String("reason", "", "Reason of retiring a firmware version, of pausing, resuming or aborting a campaign, or of a rollback")
+	campaignCreate := f.String("campaign-create", "", "Create an update campaign described by a JSON file")
+	campaignList := f.Bool("campaign-list", false, "List the update campaigns")
+	campaignShow := f.String("campaign-show", "", "Show an update campaign and the progress of its devices")
+	campaignPause := f.String("campaign-pause", "", "Pause an update campaign")
+	campaignResume := f.String("campaign-resume", "", "Resume a paused or halted update campaign")
+	campaignAbort := f.String("campaign-abort", "", "Abort an update campaign")
+	campaignAdvance := f.String("campaign-advance", "", "Advance an update campaign to its next stage")
+	tagDevice := f.String("tag-device", "", "Set the tags of a device, which select it for update campaigns")
+	tags := f.String("tags", "", "Comma separated tags of --tag-device, empty to remove them")
+	assignChannel := f.String("assign-channel", "", "Set the release channel of a device")
+	channel := f.String("channel", firmware.DefaultChannel, "Release channel of --assign-channel")
+	approveRollback := f.String("approve-rollback", "", "Approve a device to be downgraded once to --version, below its security version")
+	endpoint := f.String("endpoint", "127.0.0.1:9000", "Server address")
+
+	err := f.Parse(args)
+	if err != nil {
+		return err
+	}
+	if c := svr.sessCfg; c.SessionTTL <= 0 || c.TokenTTL <= 0 || c.DownloadTTL <= 0 || c.SweepInterval <= 0 || c.MaxSessPerSerial <= 0 || c.MaxSessions <= 0 {
+		return fmt.Errorf("invalid session settings: %+v", c)
+	}
+	if *generateAuditKey {
+		if err := generateAuditLogKey(svr.auditKey, *auditPub); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+	// the audit log is verified where it is stored, even if the server is down
+	if *verifyAuditLog {
+		report, err := verifyAuditLogDir(svr.auditDir, *auditPub, *auditKeyID)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Audit log is intact: %d entries from seq %d, %d signed checkpoints, signed up to seq %d\n",
+			report.Entries, report.First, report.Checkpoints, report.Signed)
+		os.Exit(0)
+	}
+	if *testWebhook {
+		if err := testWebhooks(*webhooksFile); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+	var exe Executer
+	if !(*port > 0 && *allowance > 0) {
+		cred, err := LoadCredentials(*credentials)
+		if err != nil {
+			return err
+		}
+		exe, err = NewExecuter(*endpoint, WithCertFile(certPath), WithCredentials(cred))
+		if err != nil {
+			return err
+		}
+	}
+	logQuery := url.Values{"serial_number": {*logSerial}, "remote_addr": {*logAddr}, "code": {*logCode}, "since": {*logSince},
+		"until": {*logUntil}, "q": {*logSearch}, "cursor": {*logCursor}, "limit": {*logLimit}, "order": {*logOrder},
+		"count": {strconv.FormatBool(*logCount)}}
+	switch {
+	case *port > 0 && *allowance > 0:
+		svr.port = *port
+		svr.allowance = *allowance
+		fmt.Printf("Server started on port %d, allowance: %d\n", *port, *allowance)
+
+	case *applyLicence != "":
+		ret, err := exe.ApplyLicence(*applyLicence)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applying licence %v succeed. Current allowance of pool '%v': %v\n", ret["licence_id"], ret["pool"], ret["allowance"])
+		os.Exit(0)
+
+	case *allowanceHistory:
+		pools, list, err := exe.GetAllowanceLedger(*pool)
+		if err != nil {
+			return err
+		}
+		balances, _ := json.Marshal(pools)
+		data, _ := json.MarshalIndent(list, "", "  ")
+		fmt.Printf("Allowance of pools: %s, ledger entries: %d\n%s\n", string(balances), len(list), string(data))
+		os.Exit(0)
+
+	case *listDevices:
+		list, err := exe.GetDeviceList()
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(list, "", "  ")
+		fmt.Printf("Registered devices: %d\n%s\n", len(list), string(data))
+		os.Exit(0)
+
+	case *showIncidents:
+		if err := showAuditLogs(exe, audit.TYPE_INCIDENT, "Security incidents", logQuery); err != nil {
+			return err
+		}
+		os.Exit(0)
+
+	case *showUpdates:
+		if err := showAuditLogs(exe, audit.TYPE_UPDATE, "Update logs", logQuery); err != nil {
+			return err
+		}
+		os.Exit(0)
+
+	case *followIncidents:
+		if err := followAuditLogs(exe, []audit.LogType{audit.TYPE_INCIDENT}, logQuery); err != nil {
+			return err
+		}
+		os.Exit(0)
+
+	case *showActions:
+		if err := showAuditLogs(exe, audit.TYPE_ACTION, "Automatic actions", logQuery); err != nil {
+			return err
+		}
+		os.Exit(0)
+
+	case *listRules:
+		list, err := exe.ListRules()
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(list, "", "  ")
+		fmt.Printf("Rules: %d\n%s\n", len(list), string(data))
+		os.Exit(0)
+
+	case *dryRunRules != "":
+		list, err := exe.DryRunRules(*dryRunRules)
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(list, "", "  ")
+		fmt.Printf("Rules fired by the logged incidents: %d\n%s\n", len(list), string(data))
+		os.Exit(0)
+
+	case *uploadFirmware != "":
+		if *version == "" {
+			return fmt.Errorf("missing --version for the uploaded firmware")
+		}
+		var sig string
+		if *publish {
+			if sig, err = loadSignature(*signature, *version); err != nil {
+				return err
+			}
+		}
+		meta, err := exe.UploadFirmware(*version, *uploadFirmware, *releaseNotes, *hardware, *channels, *securityVersion, sig, *publish)
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(meta, "", "  ")
+		fmt.Printf("Upload firmware %s succeed\n%s\n", *version, string(data))
+		os.Exit(0)
+
+	case *listFirmware:
+		list, err := exe.ListFirmware()
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(list, "", "  ")
+		fmt.Printf("Firmware versions: %d\n%s\n", len(list), string(data))
+		os.Exit(0)
+
+	case *publishFirmware != "":
+		sig, err := loadSignature(*signature, *publishFirmware)
+		if err != nil {
+			return err
+		}
+		if err := exe.PublishFirmware(*publishFirmware, sig, splitList(*channels)); err != nil {
+			return err
+		}
+		fmt.Println("Succeed publishing firmware: ", *publishFirmware)
+		os.Exit(0)
+
+	case *firmwareChannels != "":
+		meta, err := exe.SetFirmwareChannels(*firmwareChannels, splitList(*channels))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Succeed setting the channels of firmware %s: %v\n", *firmwareChannels, meta["channels"])
+		os.Exit(0)
+
+	case *retireFirmware != "":
+		if err := exe.RetireFirmware(*retireFirmware, *reason); err != nil {
+			return err
+		}
+		fmt.Println("Succeed retiring firmware: ", *retireFirmware)
+		os.Exit(0)
+
+	case *campaignCreate != "":
+		c, err := exe.CreateCampaign(*campaignCreate)
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(c, "", "  ")
+		fmt.Printf("Create campaign %v succeed\n%s\n", c["id"], string(data))
+		os.Exit(0)
+
+	case *campaignList:
+		list, err := exe.ListCampaigns()
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(list, "", "  ")
+		fmt.Printf("Campaigns: %d\n%s\n", len(list), string(data))
+		os.Exit(0)
+
+	case *campaignShow != "":
+		c, err := exe.GetCampaign(*campaignShow)
+		if err != nil {
+			return err
+		}
+		data, _ := json.MarshalIndent(c, "", "  ")
+		fmt.Printf("Campaign %s\n%s\n", *campaignShow, string(data))
+		os.Exit(0)
+
+	case *campaignPause != "" || *campaignResume != "" || *campaignAbort != "" || *campaignAdvance != "":
+		id, op := *campaignPause, campaign.OpPause
+		switch {
+		case *campaignResume != "":
+			id, op = *campaignResume, campaign.OpResume
+		case *campaignAbort != "":
+			id, op = *campaignAbort, campaign.OpAbort
+		case *campaignAdvance != "":
+			id, op = *campaignAdvance, campaign.OpAdvance
+		}
+		c, err := exe.ControlCampaign(id, op, *reason)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Succeed to %s campaign %s: %v, stage %v of %v\n", op, id, c["status"], c["stage"], c["stages"])
+		os.Exit(0)
+
+	case *tagDevice != "":
+		var list []string
+		if *tags != "" {
+			list = strings.Split(*tags, ",")
+		}
+		if err := exe.SetDeviceTags(*tagDevice, list); err != nil {
+			return err
+		}
+		fmt.Printf("Succeed tagging device %s: %v\n", *tagDevice, list)
+		os.Exit(0)
+
+	case *assignChannel != "":
+		if err := exe.SetDeviceChannel(*assignChannel, *channel); err != nil {
+			return err
+		}
+		fmt.Printf("Succeed assigning device %s to channel: %s\n", *assignChannel, *channel)
+		os.Exit(0)
+
+	case *approveRollback != "":
+		if *version == "" {
+			return fmt.Errorf("missing --version of the rollback")
+		}
+		if err := exe.ApproveRollback(*approveRollback, *version, *reason); err != nil {
+			return err
+		}
+		fmt.Printf("Succeed approving the rollback of device %s to firmware: %s\n", *approveRollback, *version)
+		os.Exit(0)
+
+	case *block != "":
+		if err := exe.BlockDevice(*block); err != nil {
+			return err
+		}
+		fmt.Println("Succeed blocking device: ", *block)
+		os.Exit(0)
+
+	case *authorize != "":
+		if err := exe.AuthorizeDevice(*authorize); err != nil {
+			return err
+		}
+		fmt.Println("Succeed authorizing device: ", *authorize)
+		os.Exit(0)
+
+	default:
+		fmt.Println("Usage: server --port=<port> - Start the server on specified port")
+		fmt.Println("       server --allowance=<number> - Set initial device registration allowance")
+		fmt.Println("       server --firmware-dir=<dir> - Directory of the firmware repository")
+		fmt.Println("       server --signing-pub=<file> - Public key of the publisher, which verifies the signatures of published firmware")
+		fmt.Println("       server --device-ca - Issue client certificates to devices at registration")
+		fmt.Println("       server --apply-licence=<file> - Increase the allowance with a licence file signed by the vendor")
+		fmt.Println("       server --allowance-history [--pool=<name>] - Display the allowance ledger")
+		fmt.Println("       server --list-devices - Display all registered devices")
+		fmt.Println("       server --show-incidents [--serial=<s>] [--remote-addr=<ip>] [--code=<c>] [--since=<t>] [--until=<t>] [--search=<text>] [--cursor=<seq>] [--limit=<n>] [--order=desc] [--count] - Display security incident logs")
+		fmt.Println("       server --show-updates [<filters of --show-incidents>] - Display successful update logs")
+		fmt.Println("       server --follow-incidents [--serial=<s>] [--remote-addr=<ip>] [--code=<c>] [--search=<text>] - Follow new security incidents as they happen")
+		fmt.Println("       server --generate-audit-key [--audit-key=<file>] [--audit-pub=<file>] - Generate the key of signing audit log checkpoints (offline)")
+		fmt.Println("       server --verify-audit-log --audit-pub=<file> | --audit-key-id=<id> - Verify the hash chain of the audit log with the pinned key (offline)")
+		fmt.Println("       server --show-actions [<filters of --show-incidents>] - Display automatic actions taken on incidents")
+		fmt.Println("       server --test-webhook [--webhooks=<file>] - Send a test event to every webhook target (offline)")
+		fmt.Println("       server --list-rules - Display the rules of automatic actions")
+		fmt.Println("       server --dry-run-rules=<file> - Evaluate rules against the logged incidents")
+		fmt.Println("       server --block=<serialNumber> - Block a specific device")
+		fmt.Println("       server --authorize=<serialNumber> - Authorize a specific device")
+		fmt.Println("       server --upload-firmware=<file> --version=<v> [--release-notes=<text>] [--hardware=<a,b>] [--security-version=<n>] [--publish --signature=<file> [--channels=<a,b>]] - Upload a firmware image")
+		fmt.Println("       server --list-firmware - Display all firmware versions")
+		fmt.Println("       server --publish-firmware=<v> --signature=<file> [--channels=<a,b>] - Publish a firmware version to its release channels")
+		fmt.Println("       server --firmware-channels=<v> --channels=<a,b> - Set the release channels of a published firmware version")
+		fmt.Println("       server --retire-firmware=<v> [--reason=<text>] - Retire a firmware version")
+		fmt.Println("       server --campaign-create=<file> - Create an update campaign of a firmware version")
+		fmt.Println("       server --campaign-list - Display the update campaigns")
+		fmt.Println("       server --campaign-show=<id> - Display an update campaign and the progress of its devices")
+		fmt.Println("       server --campaign-pause|--campaign-resume|--campaign-abort=<id> [--reason=<text>] - Pause, resume or abort an update campaign")
+		fmt.Println("       server --campaign-advance=<id> - Advance an update campaign to its next stage")
+		fmt.Println("       server --tag-device=<serialNumber> --tags=<a,b> - Set the tags of a device for the update campaigns")
+		fmt.Println("       server --assign-channel=<serialNumber> --channel=<name> - Set the release channel of a device")
+		fmt.Println("       server --approve-rollback=<serialNumber> --version=<v> [--reason=<text>] - Approve a device to be downgraded once below its security version")
+		os.Exit(1)
+	}
+
+	privKey, err := getOrCreatePrivateKey(svr.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load or generate private key: %w", err)
+	}
+	svr.key = privKey
+	svr.logger.Println("✅ Private key loaded or generated successfully:", svr.keyPath)
+
+	// the publisher key stays offline, the server only verifies the signatures made with it
+	if svr.publisher, err = firmware.LoadPublicKey(svr.signingPub); err != nil {
+		svr.publisher = nil
+		svr.logger.Println("⚠️ No publisher public key, firmware can't be published:", err)
+	} else {
+		keyID, _ := firmware.KeyID(svr.publisher)
+		svr.logger.Println("✅ Publisher public key loaded:", svr.signingPub, "Key ID:", keyID)
+	}
+
+	master, err := common.LoadOrCreateMasterSecret(svr.masterPath)
+	if err != nil {
+		return fmt.Errorf("failed to load or generate master secret: %w", err)
+	}
+	if svr.keys, err = common.NewMasterKeyProvider(master); err != nil {
+		return err
+	}
+	svr.tokenKey = common.DeriveKey(master, "FSS_TOKEN_KEY")
+	svr.logger.Println("✅ Master secret of device keys loaded")
+
+	if svr.pools, err = LoadAllowancePools(svr.poolsPath); err != nil {
+		return fmt.Errorf("failed to load allowance pools: %w", err)
+	}
+
+	if svr.rules, err = policy.LoadRules(svr.rulesPath); err != nil {
+		return fmt.Errorf("failed to load rules: %w", err)
+	}
+	svr.logger.Println("✅ Rules of automatic actions loaded:", len(svr.rules))
+	if svr.webhooks, err = webhook.LoadConfig(*webhooksFile); err != nil {
+		return fmt.Errorf("failed to load webhooks: %w", err)
+	}
+	svr.logger.Println("✅ Webhook targets loaded:", len(svr.webhooks.Targets))
+	if *lockoutFailures > 0 {
+		svr.serialLock = ratelimit.NewLockout(*lockoutFailures, *lockoutWindow, *lockoutDuration)
+	}
+	if *lockoutAddressFailures > 0 {
+		svr.addressLock = ratelimit.NewLockout(*lockoutAddressFailures, *lockoutWindow, *lockoutDuration)
+	}
+
+	if svr.vendorKey, err = licence.LoadPublicKey(svr.vendorPub); err != nil {
+		svr.logger.Println("⚠️ No vendor public key, the allowance can't be increased:", err)
+	}
+
+	if svr.admins, err = LoadAdminRegistry(svr.adminKeys); err != nil {
+		return fmt.Errorf("failed to load admin keys: %w", err)
+	}
+	if svr.adminCA != "" {
+		if svr.adminCAs, err = loadCertPool(svr.adminCA); err != nil {
+			return fmt.Errorf("failed to load admin CA: %w", err)
+		}
+	}
+	svr.logger.Println("✅ Admin identities loaded:", svr.adminKeys)
+
+	// the audit log key is generated by --generate-audit-key, never on start
+	if svr.auditSigner, err = common.LoadEd25519Key(svr.auditKey); errors.Is(err, os.ErrNotExist) {
+		svr.auditSigner = nil
+		svr.logger.Println("⚠️ No audit log key, checkpoints are not signed:", err)
+	} else if err != nil {
+		return fmt.Errorf("failed to load audit log key: %w", err)
+	} else {
+		keyID, _ := firmware.KeyID(svr.auditSigner.Public())
+		svr.logger.Println("✅ Audit log key loaded:", svr.auditKey, "Key ID:", keyID)
+	}
+
+	if *deviceCA {
+		if svr.deviceCA, err = LoadOrCreateDeviceCA(deviceCACertPath, deviceCAKeyPath); err != nil {
+			return fmt.Errorf("failed to load or generate device CA: %w", err)
+		}
+		svr.logger.Println("✅ Device CA loaded:", deviceCACertPath)
+	}
+
+	flag.Parse()
+	if svr.port <= 0 || svr.allowance <= 0 {
+		return fmt.Errorf("invalid port number: %d or allowance number: %d", svr.port, svr.allowance)
+	}
+
+	svr.logger.Println("✅ Server setup completed. Port:", svr.port, "Allowance:", svr.allowance)
+	return nil
+}
+
+func (svr *Server) IsReady() bool {
+	return svr.ready
+}
+
+func (svr *Server) SetReady(bool) {
+	svr.ready = true
+}
+
+func (svr *Server) Run(ctx context.Context) error {
+	if svr.port <= 0 {
+		return nil
+	}
+	// Check if cert exists and is valid
+	if needsNewCert(certPath) {
+		svr.logger.Println("Generate new cert:", certPath)
+		if err := generateSelfSignedCert(certPath, keyPath); err != nil {
+			return err
+		}
+	} else {
+		svr.logger.Println("Use current cert:", certPath)
+	}
+	var tls = config.TLS{
+		IsDisabled: false,
+		PublicKey:  certPath,
+		PrivateKey: keyPath,
+	}
+	logManager := audit.NewManager(svr.auditDir, audit.WithLegacyFile(auditLogPath),
+		audit.WithCheckpoints(svr.auditSigner, svr.auditEvery), audit.WithWindow(svr.auditWindow),
+		audit.WithRotation(int64(svr.auditSize)<<20, svr.auditRotate), audit.WithRetention(svr.auditKeep))
+	defer logManager.Close()
+	var log, _ = logging.NewLogger("INFO", os.Stdout, "")
+	var srvConf = config.ServiceConfig{
+		Version:         1,
+		Name:            svr.name,
+		Debug:           false,
+		Timeout:         time.Duration(180) * time.Second,
+		CacheTTL:        time.Duration(10) * time.Second,
+		Port:            svr.port,
+		SequentialStart: true,
+		ExtraConfig:     map[string]interface{}{audit.LOG_MANAGER: logManager}, // pass log manager to all plugins
+		TLS:             &tls,
+	}
+	var err error
+	srvConf.Endpoints, err = readPluginFile(svr.cfg)
+	if err != nil {
+		return err
+	}
+	srvConf.NormalizeEndpoints()
+	sessManeger := NewSessionManager(svr.sessCfg, svr.tokenKey)
+	sessManeger.StartSweeper(ctx)
+	st, err := store.Open(svr.dataDir)
+	if err != nil {
+		return fmt.Errorf("failed to open device registry: %w", err)
+	}
+	defer st.Close()
+	devManager, err := NewDeviceManager(svr.allowance, svr.pools, st)
+	if err != nil {
+		return err
+	}
+	// incidents logged by the plugins are evaluated by the rules
+	logs := NewPolicyLogManager(logManager, svr.rules, svr.serialLock, svr.addressLock, devManager, svr.logger)
+	srvConf.ExtraConfig[audit.LOG_MANAGER] = logs
+	clones, err := NewCloneDetector(svr.clonePolicy, svr.cloneWindow, devManager, logs)
+	if err != nil {
+		return err
+	}
+	var notifier *WebhookNotifier
+	if len(svr.webhooks.Targets) > 0 {
+		notifier = NewWebhookNotifier(svr.webhooks, logs, devManager, svr.logger)
+		go notifier.Run(ctx)
+	}
+	fwStore, err := firmware.NewStore(svr.firmwareDir, firmware.WithPublisherKey(svr.publisher))
+	if err != nil {
+		return err
+	}
+	campaigns, err := NewCampaignManager(st, devManager, fwStore, logs)
+	if err != nil {
+		return fmt.Errorf("failed to load campaigns: %w", err)
+	}
+	planner := NewUpdatePlanner(devManager, fwStore, campaigns)
+	// the certificates of devices are only requested if the device CA is enabled
+	var ca device_register.CertificateAuthority
+	var deviceCAs *x509.CertPool
+	clientCAs := svr.adminCAs
+	if svr.deviceCA != nil {
+		ca = svr.deviceCA
+		deviceCAs = x509.NewCertPool()
+		deviceCAs.AddCert(svr.deviceCA.Certificate())
+		if clientCAs == nil {
+			clientCAs = x509.NewCertPool()
+		} else {
+			clientCAs = clientCAs.Clone()
+		}
+		clientCAs.AddCert(svr.deviceCA.Certificate())
+	}
+	// Global plugin factory
+	factory := map[string]vicg.VicgPluginFactory{
+		"HttpData_Parse":    httpdata_parse.NewFactory(),
+		"Rate_Limit":        rate_limit.NewFactory(svr.serialLock, svr.addressLock),
+		"Challenge_Gen":     challenge_gen.NewFactory(sessManeger),
+		"Challenge_Verify":  challenge_verify.NewFactory(sessManeger, devManager, svr.keys, clones),
+		"Device_Register":   device_register.NewFactory(sessManeger, devManager, common.PublicKeyToBase64(svr.key.PublicKey()), ca, clones),
+		"Allowance_Update":  allowance_update.NewFactory(devManager, svr.vendorKey),
+		"Allowance_Ledger":  allowance_ledger.NewFactory(devManager),
+		"Policy_Rules":      policy_rules.NewFactory(logs),
+		"Firmware_Update":   firmware_update.NewFactory(sessManeger, devManager, fwStore, svr.key, clones, campaigns),
+		"Firmware_Download": firmware_download.NewFactory(sessManeger, devManager, fwStore, svr.key, clones, campaigns),
+		"Firmware_Upload":   firmware_upload.NewFactory(fwStore),
+		"Firmware_Admin":    firmware_admin.NewFactory(fwStore),
+		"Campaign_Admin":    campaign_admin.NewFactory(campaigns),
+		"Device_CheckIn":    device_checkin.NewFactory(sessManeger, devManager, planner, clones),
+		"Device_List":       device_list.NewFactory(devManager),
+		"Device_Auth":       device_auth.NewFactory(NewOperatorDevices(devManager, clones, notifier)),
+		"Audit_Logs":        audit_logs.NewFactory(),
+		"Log_Stream":        log_stream.NewFactory(),
+		"Session_Stats":     session_stats.NewFactory(sessManeger),
+		"Admin_Auth":        admin_auth.NewFactory(svr.admins),
+	}
+	f := func(cfg *gin.Config) {
+		pprof.Register(cfg.Engine) // register pprof
+		cfg.Middlewares = append(cfg.Middlewares, clientCertMiddleware(svr.adminCAs, deviceCAs))
+		cfg.RunServer = runServer(clientCAs)
+	}
+	router := gin.DefaultVicgFactory(vicg.DefaultVicgFactory(log, factory), log, f).NewWithContext(ctx)
+	router.Run(srvConf)
+
+	return nil
+}
+
+func (svr *Server) Stop(context.Context) {
+
+}
+
+func (svr *Server) IsDebug() bool {
+	return false
+}
+
+func readPluginFile(fileName string) ([]*config.EndpointConfig, error) {
+	plugin := &config.EndpointPluginList{}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	bytes, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(bytes, plugin)
+	if err != nil {
+		return nil, err
+	}
+	return plugin.Plugin, nil
+}
+
+// splitList splits a comma separated flag, skipping the empty items.
+func splitList(flag string) []string {
+	var list []string
+	for _, item := range strings.Split(flag, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// loadSignature returns the signature of the signed manifest of the version, made offline by the publisher.
+func loadSignature(path, version string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("missing --signature of firmware %s, sign it with fss vendor --sign-firmware", version)
+	}
+	m, err := firmware.LoadSignedManifest(path)
+	if err != nil {
+		return "", err
+	}
+	if m.Version != version {
+		return "", fmt.Errorf("the signed manifest is of firmware %s, not %s", m.Version, version)
+	}
+	return m.Signature, nil
+}
@@ -0,0 +1,160 @@
+package server
+
+// Webhook notifications driven by the audit log: blocked devices, fired rules, incidents,
+// and allowance pools which drop below the threshold.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/webhook"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/pkg/logger"
+)
+
+const (
+	webhooksPath = "./configs/webhooks.json"
+	// interval of reporting the events dropped by the dispatcher
+	droppedInterval = time.Minute
+)
+
+// WebhookNotifier turns the new entries of the audit log into webhook events.
+type WebhookNotifier struct {
+	dispatcher *webhook.Dispatcher
+	log        audit.LogManager
+	dev        *DeviceManagerImpl
+	threshold  int             // allowance.low is sent when a pool drops below it, 0 to disable
+	low        map[string]bool // pools below the threshold, notified once until they are above it again
+	logger     logger.Logger
+}
+
+func NewWebhookNotifier(cfg webhook.Config, log audit.LogManager, dev *DeviceManagerImpl, logger logger.Logger) *WebhookNotifier {
+	return &WebhookNotifier{
+		dispatcher: webhook.NewDispatcher(cfg),
+		log:        log,
+		dev:        dev,
+		threshold:  cfg.AllowanceThreshold,
+		low:        make(map[string]bool),
+		logger:     logger,
+	}
+}
+
+// DeviceBlocked notifies that an operator blocked the device.
+func (n *WebhookNotifier) DeviceBlocked(serialNumber string) {
+	n.dispatcher.Notify(webhook.NewEvent(webhook.EventDeviceBlocked, map[string]interface{}{
+		"serial_number": serialNumber,
+		"by":            "operator",
+	}))
+}
+
+// Run notifies the events until the context is done.
+func (n *WebhookNotifier) Run(ctx context.Context) {
+	events, cancel := n.log.Subscribe(1024)
+	defer cancel()
+	n.dispatcher.Start(ctx, 4)
+	defer n.dispatcher.Wait()
+	n.checkAllowances()
+	ticker := time.NewTicker(droppedInterval)
+	defer ticker.Stop()
+	var dropped uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-events:
+			n.handle(ev)
+		case <-ticker.C:
+			if d := n.dispatcher.Dropped(); d > dropped {
+				n.logger.Warnf("🚨 %d webhook events dropped, the dead-letter file is full or can't be written", d-dropped)
+				dropped = d
+			}
+		}
+	}
+}
+
+func (n *WebhookNotifier) handle(ev audit.Event) {
+	e := ev.Entry
+	data := map[string]interface{}{
+		"serial_number": e["serial_number"],
+		"remote_addr":   e["remote_addr"],
+		"seq":           e["seq"],
+	}
+	detail, _ := e["detail"].(map[string]interface{})
+	switch ev.Type {
+	case audit.TYPE_INCIDENT:
+		data["description"], data["code"] = e["description"], e["code"]
+		if d, ok := e["detail"]; ok {
+			data["detail"] = d
+		}
+		n.dispatcher.Notify(webhook.NewEvent(webhook.EventIncident, data))
+
+	case audit.TYPE_ACTION:
+		// an action of a rule, or of the clone policy
+		if rule, ok := detail["rule"]; ok {
+			fired := map[string]interface{}{"rule": rule, "action": e["description"], "incident": detail["incident"], "count": detail["count"]}
+			for k, v := range data {
+				fired[k] = v
+			}
+			n.dispatcher.Notify(webhook.NewEvent(webhook.EventRuleFired, fired))
+		}
+		if e["description"] == "block" && cvt.ToInt(e["code"]) == http.StatusOK {
+			if rule, ok := detail["rule"]; ok {
+				data["by"], data["rule"], data["incident"] = "rule", rule, detail["incident"]
+			} else {
+				data["by"], data["incident"], data["reason"] = "clone detection", detail["incident"], detail["reason"]
+			}
+			n.dispatcher.Notify(webhook.NewEvent(webhook.EventDeviceBlocked, data))
+		}
+
+	case audit.TYPE_NORMAL:
+		// registrations consume and licences grant the allowance
+		n.checkAllowances()
+	}
+}
+
+// checkAllowances notifies the pools which dropped below the threshold.
+func (n *WebhookNotifier) checkAllowances() {
+	if n.threshold <= 0 {
+		return
+	}
+	for pool, allowance := range n.dev.GetAllowances() {
+		switch {
+		case allowance < n.threshold && !n.low[pool]:
+			n.low[pool] = true
+			n.dispatcher.Notify(webhook.NewEvent(webhook.EventAllowanceLow, map[string]interface{}{
+				"pool":      pool,
+				"allowance": allowance,
+				"threshold": n.threshold,
+			}))
+		case allowance >= n.threshold:
+			delete(n.low, pool)
+		}
+	}
+}
+
+// testWebhooks sends a test event to every target, and reports the result of each.
+func testWebhooks(path string) error {
+	cfg, err := webhook.LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Targets) == 0 {
+		return fmt.Errorf("no webhook targets in %s", path)
+	}
+	failed := 0
+	for name, err := range webhook.NewDispatcher(cfg).Test(context.Background()) {
+		if err != nil {
+			failed++
+			fmt.Printf("❌ %s: %v\n", name, err)
+		} else {
+			fmt.Printf("✅ %s: delivered\n", name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d webhook targets failed", failed, len(cfg.Targets))
+	}
+	return nil
+}
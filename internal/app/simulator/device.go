@@ -1,411 +1,758 @@
-package simulator
-
-import (
-	"bytes"
-	"context"
-	"crypto/ecdh"
-	"crypto/rand"
-	"encoding/base64"
-	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"os"
-	"time"
-
-	"github.com/yuanyuanxiang/fss/internal/pkg/common"
-	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
-	"github.com/yuanyuanxiang/fss/pkg/logger"
-)
-
-var log, _ = logger.NewLogger()
-
-// DeviceState represents the device state
-type DeviceState string
-
-const (
-	Bootloader DeviceState = "bootloader"
-	Updated    DeviceState = "updated"
-)
-
-// UpdateRecord represents an update history record
-type UpdateRecord struct {
-	Version   string    `json:"version"`
-	Timestamp time.Time `json:"timestamp"`
-}
-
-// Device represents the device with various fields including keys
-type Device struct {
-	ServerPublicKey *ecdh.PublicKey  `json:"server_pubkey"`  // Server public key for encryption
-	MasterAddress   string           `json:"master_address"` // Master address of the device
-	SerialNumber    string           `json:"serial_number"`
-	FirmwareVersion string           `json:"firmware_version"`
-	State           DeviceState      `json:"state"`
-	SymmetricKey    []byte           `json:"symmetric_key"`
-	PrivateKey      *ecdh.PrivateKey `json:"private_key,omitempty"`
-	PublicKey       *ecdh.PublicKey  `json:"public_key,omitempty"`
-	UpdateHistory   []UpdateRecord   `json:"update_history"`
-	simulator       *Simulator
-}
-
-type Callback func(d *Device, v map[string]interface{}, auth, version string) error
-
-func (d *Device) SetSimulator(s *Simulator) *Device {
-	d.simulator = s
-	return d
-}
-
-func (d *Device) GetChallenge() (string, error) {
-	// get challenge
-	var client = d.simulator.client
-	var protocol = d.simulator.protocol
-	resp, err := client.Get(fmt.Sprintf("%s://%s/api/challenge/%s", protocol, d.MasterAddress, d.SerialNumber))
-	if err != nil {
-		return "", err
-	}
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
-	var m map[string]interface{}
-	err = json.Unmarshal(data, &m)
-	if err != nil {
-		return "", err
-	}
-	serial := cvt.ToString(m["serial_number"])
-	if serial != d.SerialNumber {
-		return "", fmt.Errorf("serial number mismatch: expected %s, got %s", d.SerialNumber, serial)
-	}
-	challenge := cvt.ToString(m["challenge"])
-	return challenge, nil
-}
-
-func (d *Device) GetToken(challenge string) (string, error) {
-	signature := common.SignSignature(challenge, string(d.SymmetricKey))
-	// verify
-	data, _ := json.Marshal(map[string]interface{}{"serial_number": d.SerialNumber, "signature": signature, "challenge": challenge})
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s://%s/api/verify", d.simulator.protocol, d.MasterAddress), bytes.NewBuffer(data))
-	if err != nil {
-		return "", err
-	}
-	resp, err := d.simulator.client.Do(req)
-	if err != nil {
-		return "", err
-	}
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return "", fmt.Errorf("failed to verify device: %s", resp.Status)
-	}
-	data, _ = io.ReadAll(resp.Body)
-	var token map[string]interface{}
-	err = json.Unmarshal(data, &token)
-	if err != nil {
-		return "", err
-	}
-	auth := cvt.ToString(token["token"])
-	return auth, nil
-}
-
-func (d *Device) RegisterProc(ctx context.Context, duration time.Duration) {
-	ticker := time.NewTicker(duration)
-	registered := false
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			if registered {
-				continue
-			}
-			if err := d.Register(); err != nil {
-				continue
-			}
-			registered = true
-		}
-	}
-}
-
-func (d *Device) Register() error {
-	// get challenge
-	challenge, err := d.GetChallenge()
-	if err != nil {
-		return err
-	}
-	// verify
-	auth, err := d.GetToken(challenge)
-	if err != nil {
-		return err
-	}
-	// register
-	pubKeyBase64 := common.PublicKeyToBase64(d.PublicKey)
-	data, _ := json.Marshal(map[string]interface{}{"serial_number": d.SerialNumber, "public_key": pubKeyBase64, "state": d.State})
-	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s://%s/api/register", d.simulator.protocol, d.MasterAddress), bytes.NewBuffer(data))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Authorization", auth)
-	resp, err := d.simulator.client.Do(req)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to register device: %s", resp.Status)
-	}
-	data, _ = io.ReadAll(resp.Body)
-	var m map[string]interface{}
-	err = json.Unmarshal(data, &m)
-	if err != nil {
-		return err
-	}
-	// save the server public key
-	publicKey := cvt.ToString(m["public_key"])
-	d.ServerPublicKey, err = common.Base64ToPublicKey(publicKey)
-	if err != nil {
-		return err
-	}
-	log.Infof("Device %s registered to '%s' succeed\n", d.SerialNumber, d.MasterAddress)
-	return d.Save()
-}
-
-func (d *Device) Update(callback Callback, version string) error {
-	if d.ServerPublicKey == nil {
-		return fmt.Errorf("server public key is nil")
-	}
-	// get challenge
-	challenge, err := d.GetChallenge()
-	if err != nil {
-		return err
-	}
-	// verify
-	auth, err := d.GetToken(challenge)
-	if err != nil {
-		return err
-	}
-
-	signature := common.SignSignature(challenge, string(d.SymmetricKey))
-	// update the device
-	return callback(d, map[string]interface{}{
-		"serial_number": d.SerialNumber,
-		"challenge":     challenge,
-		"signature":     signature,
-	}, auth, version)
-}
-
-// communicate with server to get firmware
-func getFirmware(d *Device, v map[string]interface{}, auth, version string) error {
-	data, _ := json.Marshal(v)
-	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s/api/firmware/%s", d.simulator.protocol, d.MasterAddress, version),
-		bytes.NewBuffer(data))
-	if err != nil {
-		return err
-	}
-	req.Header.Set("Authorization", auth)
-	resp, err := d.simulator.client.Do(req)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return fmt.Errorf("failed to register device: %s", resp.Status)
-	}
-	data, err = io.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
-	var m map[string]interface{}
-	err = json.Unmarshal(data, &m)
-	if err != nil {
-		return err
-	}
-	code := cvt.ToInt(m["code"])
-	if code != 0 {
-		return fmt.Errorf("failed to update device: %d[%v]", code, m["msg"])
-	}
-	base64Data := cvt.ToString(m["data"])
-	data, err = base64.StdEncoding.DecodeString(base64Data)
-	if err != nil {
-		return fmt.Errorf("failed to decode base64 data: %v", err)
-	}
-	mac := cvt.ToString(m["signature"])
-	// derive shared secret
-	sharedSecret, _ := d.PrivateKey.ECDH(d.ServerPublicKey)
-	encKey, macKey := common.DeriveKeys(sharedSecret)
-	// check signature
-	if !common.VerifySignature(base64Data, string(macKey), mac) {
-		return fmt.Errorf("failed to verify signature")
-	}
-	// decrypt data
-	firmwareData, err := common.DecryptData(data, encKey)
-	if err != nil {
-		return fmt.Errorf("failed to decrypt firmware: %v", err)
-	}
-	// mark device as updated
-	d.State = Updated
-	d.UpdateHistory = append(d.UpdateHistory, UpdateRecord{
-		Version:   version,
-		Timestamp: time.Now(),
-	})
-	// save firmware data to file
-	d.FirmwareVersion = version
-	log.Printf("Device %s updated to firmware version %s\n", d.SerialNumber, string(firmwareData))
-
-	return d.Save()
-}
-
-// MarshalJSON customizes the JSON marshaling for Device
-func (d *Device) MarshalJSON() ([]byte, error) {
-	type Alias Device // Create an alias to avoid recursion in the Marshal method
-	var pubKeyBase64, privKeyBase64, svrPubkey string
-
-	// Marshal public key as base64-encoded string
-	if d.PublicKey != nil {
-		pubKeyBase64 = common.PublicKeyToBase64(d.PublicKey)
-	}
-
-	// Marshal private key as base64-encoded string
-	if d.PrivateKey != nil {
-		privKeyBase64 = common.PrivateKeyToBase64(d.PrivateKey)
-	}
-	if d.ServerPublicKey != nil {
-		svrPubkey = common.PublicKeyToBase64(d.ServerPublicKey)
-	}
-	// Return the struct with the keys encoded as strings
-	return json.Marshal(&struct {
-		*Alias
-		PrivateKey      string `json:"private_key,omitempty"`
-		PublicKey       string `json:"public_key,omitempty"`
-		ServerPublicKey string `json:"server_pubkey,omitempty"`
-	}{
-		Alias:           (*Alias)(d),
-		PrivateKey:      privKeyBase64,
-		PublicKey:       pubKeyBase64,
-		ServerPublicKey: svrPubkey,
-	})
-}
-
-// UnmarshalJSON customizes the JSON unmarshaling for Device
-func (d *Device) UnmarshalJSON(data []byte) error {
-	type Alias Device // Create an alias to avoid recursion in the Unmarshal method
-	aux := &struct {
-		*Alias
-		PrivateKey      string `json:"private_key,omitempty"`
-		PublicKey       string `json:"public_key,omitempty"`
-		ServerPublicKey string `json:"server_pubkey,omitempty"`
-	}{
-		Alias: (*Alias)(d),
-	}
-
-	// Unmarshal the base structure
-	if err := json.Unmarshal(data, &aux); err != nil {
-		return err
-	}
-
-	// Decode private key if available
-	if aux.PrivateKey != "" {
-		privKey, err := common.Base64ToPrivateKey(aux.PrivateKey)
-		if err != nil {
-			return fmt.Errorf("error decoding private key: %v", err)
-		}
-		// Set the private key
-		d.PrivateKey = privKey
-	}
-
-	// Decode public key if available
-	if aux.PublicKey != "" {
-		pubKey, err := common.Base64ToPublicKey(aux.PublicKey)
-		if err != nil {
-			return fmt.Errorf("error decoding public key: %v", err)
-		}
-		// Set the public key
-		d.PublicKey = pubKey
-	}
-
-	if aux.ServerPublicKey != "" {
-		pubKey, err := common.Base64ToPublicKey(aux.ServerPublicKey)
-		if err != nil {
-			return fmt.Errorf("error decoding server public key: %v", err)
-		}
-		d.ServerPublicKey = pubKey
-	}
-
-	return nil
-}
-
-func (d *Device) Save() error {
-	fileName := fmt.Sprintf("%s.json", d.SerialNumber)
-	// Marshal the device to JSON
-	deviceJSON, err := json.MarshalIndent(d, "", "  ")
-	if err != nil {
-		return fmt.Errorf("error marshaling device to JSON: %v", err)
-	}
-	// Save the new device to the file
-	if err := os.WriteFile(fileName, deviceJSON, 0644); err != nil {
-		return fmt.Errorf("error writing device file: %v", err)
-	}
-
-	log.Printf("Device %s created and saved to file", d.SerialNumber)
-	return nil
-}
-
-// NewDevice creates a new device if the device doesn't exist. If it exists, it loads from JSON.
-func NewDevice(master string, serial int, firmwareVersion, symmetricKey string) (*Device, error) {
-	serialNumber := fmt.Sprintf("%010d", serial)
-	fileName := fmt.Sprintf("%s.json", serialNumber)
-
-	// Check if the file exists
-	if _, err := os.Stat(fileName); err == nil {
-		// File exists, load the device from JSON
-		log.Printf("Device %s found, loading from JSON", serialNumber)
-
-		// Read the file
-		data, err := os.ReadFile(fileName)
-		if err != nil {
-			return nil, fmt.Errorf("error reading device file: %v", err)
-		}
-
-		// Unmarshal the device data
-		var device Device
-		if err := json.Unmarshal(data, &device); err != nil {
-			return nil, fmt.Errorf("error unmarshaling device data: %v", err)
-		}
-
-		return &device, nil
-	} else if os.IsNotExist(err) {
-		// File does not exist, create a new device
-		log.Printf("Device %s not found, creating a new device", serialNumber)
-
-		// Create a new device
-		priv, err := ecdh.P384().GenerateKey(rand.Reader)
-		if err != nil {
-			return nil, fmt.Errorf("error generating keys: %v", err)
-		}
-
-		// Create the new device object
-		device := &Device{
-			MasterAddress:   master,
-			SerialNumber:    serialNumber,
-			FirmwareVersion: firmwareVersion,
-			State:           Bootloader,
-			SymmetricKey:    []byte(symmetricKey),
-			PrivateKey:      priv,
-			PublicKey:       priv.PublicKey(),
-			UpdateHistory:   []UpdateRecord{},
-		}
-
-		// Marshal the device to JSON
-		deviceJSON, err := json.MarshalIndent(device, "", "  ")
-		if err != nil {
-			return nil, fmt.Errorf("error marshaling device to JSON: %v", err)
-		}
-
-		// Save the new device to the file
-		if err := os.WriteFile(fileName, deviceJSON, 0644); err != nil {
-			return nil, fmt.Errorf("error writing device file: %v", err)
-		}
-
-		log.Printf("Device %s created and saved to file", serialNumber)
-
-		return device, nil
-	} else {
-		// Some other error occurred while checking file existence
-		return nil, fmt.Errorf("error checking if file exists: %v", err)
-	}
-}
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+	"github.com/yuanyuanxiang/fss/pkg/logger"
+)
+
+var log, _ = logger.NewLogger()
+
+// DeviceState represents the device state
+type DeviceState string
+
+const (
+	Bootloader DeviceState = "bootloader"
+	Updated    DeviceState = "updated"
+	Failed     DeviceState = "failed" // the last update failed, reported at the next check-in
+
+	// maxStalledRanges is the number of ranges in a row which may fail before a download is given up
+	maxStalledRanges = 3
+)
+
+// UpdateRecord represents an update history record
+type UpdateRecord struct {
+	Version   string    `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Device represents the device with various fields including keys
+type Device struct {
+	ServerPublicKey *ecdh.PublicKey  `json:"server_pubkey"`  // Server public key for encryption
+	MasterAddress   string           `json:"master_address"` // Master address of the device
+	SerialNumber    string           `json:"serial_number"`
+	FirmwareVersion string           `json:"firmware_version"`
+	Hardware        string           `json:"hardware,omitempty"`   // hardware revision reported at check-in
+	LastError       string           `json:"last_error,omitempty"` // why the last update failed
+	SecurityVersion uint32           `json:"security_version"`     // fuse counter, an image of a lower security version needs an approved rollback
+	State           DeviceState      `json:"state"`
+	SymmetricKey    []byte           `json:"symmetric_key"`
+	PrivateKey      *ecdh.PrivateKey `json:"private_key,omitempty"`
+	PublicKey       *ecdh.PublicKey  `json:"public_key,omitempty"`
+	UpdateHistory   []UpdateRecord   `json:"update_history"`
+	TLSKey          string           `json:"tls_key,omitempty"`     // PEM key of the client certificate
+	Certificate     string           `json:"certificate,omitempty"` // PEM client certificate issued by the device CA
+	Download        *PartialDownload `json:"download,omitempty"`    // interrupted download, resumed by the next update
+	simulator       *Simulator
+	client          *http.Client // presents the client certificate
+}
+
+// PartialDownload is an interrupted download, whose received part is kept in the part file of the device.
+type PartialDownload struct {
+	Version  string `json:"version"`
+	Received int64  `json:"received"`
+}
+
+type Callback func(d *Device, v map[string]interface{}, auth, version string) error
+
+func (d *Device) SetSimulator(s *Simulator) *Device {
+	d.simulator = s
+	return d
+}
+
+func (d *Device) GetChallenge() (string, error) {
+	// get challenge
+	var client = d.simulator.client
+	var protocol = d.simulator.protocol
+	resp, err := client.Get(fmt.Sprintf("%s://%s/api/challenge/%s", protocol, d.MasterAddress, d.SerialNumber))
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return "", err
+	}
+	serial := cvt.ToString(m["serial_number"])
+	if serial != d.SerialNumber {
+		return "", fmt.Errorf("serial number mismatch: expected %s, got %s", d.SerialNumber, serial)
+	}
+	challenge := cvt.ToString(m["challenge"])
+	return challenge, nil
+}
+
+// GetToken gets a one-time token for the purpose, which is "register", "firmware" or "check-in".
+// A firmware token is limited to the version.
+func (d *Device) GetToken(challenge, purpose, version string) (string, error) {
+	signature := common.SignSignature(challenge, string(d.SymmetricKey))
+	// verify
+	data, _ := json.Marshal(map[string]interface{}{"serial_number": d.SerialNumber, "signature": signature, "challenge": challenge,
+		"purpose": purpose, "version": version})
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s://%s/api/verify", d.simulator.protocol, d.MasterAddress), bytes.NewBuffer(data))
+	if err != nil {
+		return "", err
+	}
+	resp, err := d.simulator.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("failed to verify device: %s", resp.Status)
+	}
+	data, _ = io.ReadAll(resp.Body)
+	var token map[string]interface{}
+	err = json.Unmarshal(data, &token)
+	if err != nil {
+		return "", err
+	}
+	auth := cvt.ToString(token["token"])
+	return auth, nil
+}
+
+func (d *Device) RegisterProc(ctx context.Context, duration time.Duration) {
+	ticker := time.NewTicker(duration)
+	registered := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if registered {
+				continue
+			}
+			if err := d.Register(); err != nil {
+				continue
+			}
+			registered = true
+		}
+	}
+}
+
+func (d *Device) Register() error {
+	// get challenge
+	challenge, err := d.GetChallenge()
+	if err != nil {
+		return err
+	}
+	// verify
+	auth, err := d.GetToken(challenge, "register", "")
+	if err != nil {
+		return err
+	}
+	// register, and request a client certificate
+	csr, err := d.certificateRequest()
+	if err != nil {
+		return err
+	}
+	pubKeyBase64 := common.PublicKeyToBase64(d.PublicKey)
+	data, _ := json.Marshal(map[string]interface{}{"serial_number": d.SerialNumber, "public_key": pubKeyBase64, "state": d.State,
+		"csr": csr})
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s://%s/api/register", d.simulator.protocol, d.MasterAddress), bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	resp, err := d.simulator.client.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("failed to register device: %s", resp.Status)
+	}
+	data, _ = io.ReadAll(resp.Body)
+	var m map[string]interface{}
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return err
+	}
+	// save the server public key
+	publicKey := cvt.ToString(m["public_key"])
+	d.ServerPublicKey, err = common.Base64ToPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	// the certificate is only issued if the server enables the device CA
+	d.Certificate, d.client = cvt.ToString(m["certificate"]), nil
+	log.Infof("Device %s registered to '%s' succeed\n", d.SerialNumber, d.MasterAddress)
+	return d.Save()
+}
+
+// Update updates the device to the version, or to the version assigned by the server if it's empty.
+// The device reports the result of the update at its next check-in.
+func (d *Device) Update(callback Callback, version string) error {
+	if d.ServerPublicKey == nil {
+		return fmt.Errorf("server public key is nil")
+	}
+	if version != "" {
+		return d.update(callback, version, "")
+	}
+	status, version, auth, err := d.CheckIn()
+	if err != nil {
+		return err
+	}
+	if status != "update-available" {
+		log.Infof("Device %s running firmware version '%s' is %s\n", d.SerialNumber, d.FirmwareVersion, status)
+		if status == "blocked" {
+			return fmt.Errorf("device %s is blocked", d.SerialNumber)
+		}
+		return nil
+	}
+	if err := d.update(callback, version, auth); err != nil {
+		d.State, d.LastError = Failed, err.Error()
+		_ = d.Save()
+		return err
+	}
+	return nil
+}
+
+// CheckIn reports the firmware of the device, and returns the status, the version it should run,
+// and the token of downloading the version.
+func (d *Device) CheckIn() (string, string, string, error) {
+	var auth string
+	if d.Certificate == "" {
+		challenge, err := d.GetChallenge()
+		if err != nil {
+			return "", "", "", err
+		}
+		if auth, err = d.GetToken(challenge, "check-in", ""); err != nil {
+			return "", "", "", err
+		}
+	}
+	data, _ := json.Marshal(map[string]interface{}{
+		"version":  d.FirmwareVersion,
+		"state":    d.State,
+		"hardware": d.Hardware,
+		"error":    d.LastError,
+	})
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s://%s/api/devices/%s/check-in", d.simulator.protocol, d.MasterAddress,
+		d.SerialNumber), bytes.NewBuffer(data))
+	if err != nil {
+		return "", "", "", err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return "", "", "", err
+	}
+	defer resp.Body.Close()
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", "", err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return "", "", "", fmt.Errorf("failed to check in: %s", resp.Status)
+	}
+	if code := cvt.ToInt(m["code"]); code != 0 {
+		return "", "", "", fmt.Errorf("failed to check in: %d[%v]", code, m["msg"])
+	}
+	return cvt.ToString(m["status"]), cvt.ToString(m["target_version"]), cvt.ToString(m["token"]), nil
+}
+
+func (d *Device) update(callback Callback, version, auth string) error {
+	// the client certificate or the token of the check-in authenticates the request, no challenge is needed
+	if d.Certificate != "" || auth != "" {
+		d.httpClient() // create the client before the callback, which may send concurrent requests
+		return callback(d, map[string]interface{}{"serial_number": d.SerialNumber}, auth, version)
+	}
+	// get challenge
+	challenge, err := d.GetChallenge()
+	if err != nil {
+		return err
+	}
+	// verify
+	auth, err = d.GetToken(challenge, "firmware", version)
+	if err != nil {
+		return err
+	}
+
+	signature := common.SignSignature(challenge, string(d.SymmetricKey))
+	// update the device
+	return callback(d, map[string]interface{}{
+		"serial_number": d.SerialNumber,
+		"challenge":     challenge,
+		"signature":     signature,
+	}, auth, version)
+}
+
+// communicate with server to get firmware
+func getFirmware(d *Device, v map[string]interface{}, auth, version string) error {
+	m, err := d.requestFirmware(v, auth, version, "")
+	if err != nil {
+		return err
+	}
+	base64Data := cvt.ToString(m["data"])
+	data, err := base64.StdEncoding.DecodeString(base64Data)
+	if err != nil {
+		return fmt.Errorf("failed to decode base64 data: %v", err)
+	}
+	mac := cvt.ToString(m["signature"])
+	// derive shared secret
+	sharedSecret, _ := d.PrivateKey.ECDH(d.ServerPublicKey)
+	encKey, macKey := common.DeriveKeys(sharedSecret)
+	// check signature
+	if !common.VerifySignature(base64Data, string(macKey), mac) {
+		return fmt.Errorf("failed to verify signature")
+	}
+	// decrypt data
+	firmwareData, err := common.DecryptData(data, encKey)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt firmware: %v", err)
+	}
+	return d.install(version, firmwareData, m)
+}
+
+// requestFirmware requests the update to the version, the query selects the mode of the download.
+func (d *Device) requestFirmware(v map[string]interface{}, auth, version, query string) (map[string]interface{}, error) {
+	data, _ := json.Marshal(v)
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s/api/firmware/%s%s", d.simulator.protocol, d.MasterAddress, version, query),
+		bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("failed to register device: %s", resp.Status)
+	}
+	data, err = io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, err
+	}
+	code := cvt.ToInt(m["code"])
+	if code != 0 {
+		return nil, fmt.Errorf("failed to update device: %d[%v]", code, m["msg"])
+	}
+	return m, nil
+}
+
+// downloadFirmware downloads the firmware in ranges authorized by a download ticket. The chunks verified before
+// an interruption are kept in the part file of the device, so the download resumes after them.
+func downloadFirmware(d *Device, v map[string]interface{}, auth, version string) error {
+	m, err := d.requestFirmware(v, auth, version, "?mode=binary")
+	if err != nil {
+		return err
+	}
+	ticket := cvt.ToString(m["ticket"])
+	chunks := firmware.Chunks{Version: version, Size: cvt.ToInt64(m["size"]), ChunkSize: cvt.ToInt64(m["chunk_size"])}
+	list, _ := m["chunks"].([]interface{})
+	for _, sum := range list {
+		chunks.SHA256 = append(chunks.SHA256, cvt.ToString(sum))
+	}
+	// derive shared secret
+	sharedSecret, _ := d.PrivateKey.ECDH(d.ServerPublicKey)
+	encKey, macKey := common.DeriveKeys(sharedSecret)
+	// the ticket and the chunk manifest are authenticated by the server
+	if ticket == "" || !common.VerifySignature(ticket+string(chunks.Bytes()), string(macKey), cvt.ToString(m["signature"])) {
+		return fmt.Errorf("failed to verify signature")
+	}
+	image := d.loadPartial(chunks)
+	for stalled := 0; int64(len(image)) < chunks.Size; {
+		if stalled == maxStalledRanges {
+			return fmt.Errorf("download of firmware %s stalled at %d of %d bytes", version, len(image), chunks.Size)
+		}
+		if len(image) > 0 {
+			log.Infof("Device %s resuming the download of firmware %s at offset %d\n", d.SerialNumber, version, len(image))
+		}
+		offset := int64(len(image))
+		data, start, err := d.downloadRange(cvt.ToString(m["download"]), ticket, offset)
+		if err != nil && len(data) == 0 {
+			log.Warnf("Device %s failed to download firmware %s: %v\n", d.SerialNumber, version, err)
+			stalled++
+			continue
+		}
+		// the bytes of a range are encrypted at their offset in the image
+		stream, err := common.NewStreamAt(encKey, common.DeriveIV(ticket), start)
+		if err != nil {
+			return err
+		}
+		stream.XORKeyStream(data, data)
+		next := received(chunks, append(image[:start], data...))
+		if len(next) > len(image) {
+			stalled = 0
+		} else {
+			stalled++
+		}
+		image = next
+		if err := d.savePartial(version, image); err != nil {
+			return err
+		}
+	}
+	if err := d.install(version, image[:chunks.Size], m); err != nil {
+		return err
+	}
+	_ = os.Remove(d.partFile())
+	return nil
+}
+
+// downloadRange requests the encrypted image from the offset, and returns the bytes received before the
+// connection dropped, and the offset they start at, which is 0 if the server ignored the range.
+func (d *Device) downloadRange(path, ticket string, offset int64) ([]byte, int64, error) {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s%s", d.simulator.protocol, d.MasterAddress, path), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+ticket)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := d.httpClient().Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		offset = 0
+	default:
+		data, _ := io.ReadAll(resp.Body)
+		return nil, 0, fmt.Errorf("failed to download firmware: %s %s", resp.Status, bytes.TrimSpace(data))
+	}
+	var body io.Reader = resp.Body
+	if d.simulator.dropAfter > 0 {
+		body = io.LimitReader(resp.Body, d.simulator.dropAfter)
+	}
+	data, err := io.ReadAll(body)
+	return data, offset, err
+}
+
+// received returns the part of the image to resume from: the verified chunks, and the incomplete chunk after them.
+// A complete chunk which fails the verification is downloaded again.
+func received(chunks firmware.Chunks, data []byte) []byte {
+	n := chunks.Verified(data)
+	if int64(len(data)) >= min(n+chunks.ChunkSize, chunks.Size) {
+		return data[:n]
+	}
+	return data
+}
+
+func (d *Device) partFile() string {
+	return fmt.Sprintf("%s.part", d.SerialNumber)
+}
+
+// loadPartial returns the part of the image received by an interrupted download of the version.
+func (d *Device) loadPartial(chunks firmware.Chunks) []byte {
+	if d.Download == nil || d.Download.Version != chunks.Version {
+		return nil
+	}
+	data, err := os.ReadFile(d.partFile())
+	if err != nil {
+		return nil
+	}
+	return received(chunks, data)
+}
+
+// savePartial keeps the part of the image received, so the download resumes after a restart.
+func (d *Device) savePartial(version string, data []byte) error {
+	if err := os.WriteFile(d.partFile(), data, 0644); err != nil {
+		return fmt.Errorf("error writing part file: %v", err)
+	}
+	d.Download = &PartialDownload{Version: version, Received: int64(len(data))}
+	return d.Save()
+}
+
+// install verifies the firmware image and the code signature of the publisher, and marks the device updated.
+func (d *Device) install(version string, firmwareData []byte, m map[string]interface{}) error {
+	// check the integrity of the firmware image
+	sum := sha256.Sum256(firmwareData)
+	if int64(len(firmwareData)) != cvt.ToInt64(m["size"]) || hex.EncodeToString(sum[:]) != cvt.ToString(m["sha256"]) {
+		return fmt.Errorf("firmware image integrity check failed")
+	}
+	// check the code signature of the publisher, which also binds the image to the requested version
+	svn := uint32(cvt.ToInt64(m["security_version"]))
+	if err := d.verifyPublisher(firmware.Manifest{
+		Version:         version,
+		Size:            cvt.ToInt64(m["size"]),
+		SHA256:          cvt.ToString(m["sha256"]),
+		SecurityVersion: svn,
+	}, m); err != nil {
+		return err
+	}
+	// an image below the fuse counter is only installed with the approval of a rollback, authenticated by the MAC key.
+	// The fuse counter only goes up, like the security floor of the device on the server.
+	if svn < d.SecurityVersion {
+		sharedSecret, _ := d.PrivateKey.ECDH(d.ServerPublicKey)
+		_, macKey := common.DeriveKeys(sharedSecret)
+		approval := cvt.ToString(m["rollback"])
+		if approval == "" || !common.VerifySignature(common.RollbackMessage(d.SerialNumber, version), string(macKey), approval) {
+			return fmt.Errorf("rollback rejected: security version %d of firmware %s is below the fuse counter %d", svn, version, d.SecurityVersion)
+		}
+		log.Printf("Device %s rolled back to firmware version %s (security version %d) with approval\n", d.SerialNumber, version, svn)
+	}
+	d.SecurityVersion = max(d.SecurityVersion, svn)
+	// mark device as updated
+	d.State, d.LastError, d.Download = Updated, "", nil
+	d.UpdateHistory = append(d.UpdateHistory, UpdateRecord{
+		Version:   version,
+		Timestamp: time.Now(),
+	})
+	// save firmware data to file
+	d.FirmwareVersion = version
+	log.Printf("Device %s updated to firmware version %s (%d bytes)\n", d.SerialNumber, version, len(firmwareData))
+
+	return d.Save()
+}
+
+// certificateRequest returns a PEM certificate signing request, whose common name is the serial number.
+// The key of the client certificate is generated on first use.
+func (d *Device) certificateRequest() (string, error) {
+	if d.TLSKey == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return "", err
+		}
+		d.TLSKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	}
+	block, _ := pem.Decode([]byte(d.TLSKey))
+	if block == nil {
+		return "", fmt.Errorf("invalid TLS key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: d.SerialNumber},
+	}, key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})), nil
+}
+
+// httpClient returns the client which presents the certificate of the device,
+// or the client of the simulator if the device has no certificate.
+func (d *Device) httpClient() *http.Client {
+	if d.client != nil {
+		return d.client
+	}
+	transport, ok := d.simulator.client.Transport.(*http.Transport)
+	if d.Certificate == "" || !ok || transport.TLSClientConfig == nil {
+		return d.simulator.client
+	}
+	cert, err := tls.X509KeyPair([]byte(d.Certificate), []byte(d.TLSKey))
+	if err != nil {
+		log.Warnf("Device %s has an invalid certificate: %v\n", d.SerialNumber, err)
+		return d.simulator.client
+	}
+	transport = transport.Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	d.client = &http.Client{Timeout: d.simulator.client.Timeout, Transport: transport}
+	return d.client
+}
+
+// verifyPublisher verifies the firmware manifest is signed with the pinned publisher key.
+func (d *Device) verifyPublisher(manifest firmware.Manifest, m map[string]interface{}) error {
+	if d.simulator.publisherKey == nil {
+		return fmt.Errorf("no pinned publisher key")
+	}
+	if keyID := cvt.ToString(m["signer_key_id"]); keyID != d.simulator.publisherKeyID {
+		return fmt.Errorf("firmware signed by unknown key '%s'", keyID)
+	}
+	if err := firmware.VerifySignature(d.simulator.publisherKey, manifest,
+		cvt.ToString(m["signature_algorithm"]), cvt.ToString(m["code_signature"])); err != nil {
+		return fmt.Errorf("failed to verify firmware code signature: %v", err)
+	}
+	return nil
+}
+
+// MarshalJSON customizes the JSON marshaling for Device
+func (d *Device) MarshalJSON() ([]byte, error) {
+	type Alias Device // Create an alias to avoid recursion in the Marshal method
+	var pubKeyBase64, privKeyBase64, svrPubkey string
+
+	// Marshal public key as base64-encoded string
+	if d.PublicKey != nil {
+		pubKeyBase64 = common.PublicKeyToBase64(d.PublicKey)
+	}
+
+	// Marshal private key as base64-encoded string
+	if d.PrivateKey != nil {
+		privKeyBase64 = common.PrivateKeyToBase64(d.PrivateKey)
+	}
+	if d.ServerPublicKey != nil {
+		svrPubkey = common.PublicKeyToBase64(d.ServerPublicKey)
+	}
+	// Return the struct with the keys encoded as strings
+	return json.Marshal(&struct {
+		*Alias
+		PrivateKey      string `json:"private_key,omitempty"`
+		PublicKey       string `json:"public_key,omitempty"`
+		ServerPublicKey string `json:"server_pubkey,omitempty"`
+	}{
+		Alias:           (*Alias)(d),
+		PrivateKey:      privKeyBase64,
+		PublicKey:       pubKeyBase64,
+		ServerPublicKey: svrPubkey,
+	})
+}
+
+// UnmarshalJSON customizes the JSON unmarshaling for Device
+func (d *Device) UnmarshalJSON(data []byte) error {
+	type Alias Device // Create an alias to avoid recursion in the Unmarshal method
+	aux := &struct {
+		*Alias
+		PrivateKey      string `json:"private_key,omitempty"`
+		PublicKey       string `json:"public_key,omitempty"`
+		ServerPublicKey string `json:"server_pubkey,omitempty"`
+	}{
+		Alias: (*Alias)(d),
+	}
+
+	// Unmarshal the base structure
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	// Decode private key if available
+	if aux.PrivateKey != "" {
+		privKey, err := common.Base64ToPrivateKey(aux.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("error decoding private key: %v", err)
+		}
+		// Set the private key
+		d.PrivateKey = privKey
+	}
+
+	// Decode public key if available
+	if aux.PublicKey != "" {
+		pubKey, err := common.Base64ToPublicKey(aux.PublicKey)
+		if err != nil {
+			return fmt.Errorf("error decoding public key: %v", err)
+		}
+		// Set the public key
+		d.PublicKey = pubKey
+	}
+
+	if aux.ServerPublicKey != "" {
+		pubKey, err := common.Base64ToPublicKey(aux.ServerPublicKey)
+		if err != nil {
+			return fmt.Errorf("error decoding server public key: %v", err)
+		}
+		d.ServerPublicKey = pubKey
+	}
+
+	return nil
+}
+
+func (d *Device) Save() error {
+	fileName := fmt.Sprintf("%s.json", d.SerialNumber)
+	// Marshal the device to JSON
+	deviceJSON, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshaling device to JSON: %v", err)
+	}
+	// Save the new device to the file
+	if err := os.WriteFile(fileName, deviceJSON, 0644); err != nil {
+		return fmt.Errorf("error writing device file: %v", err)
+	}
+
+	log.Printf("Device %s created and saved to file", d.SerialNumber)
+	return nil
+}
+
+// NewDevice creates a new device if the device doesn't exist. If it exists, it loads from JSON.
+func NewDevice(master string, serial int, firmwareVersion, symmetricKey string) (*Device, error) {
+	serialNumber := fmt.Sprintf("%010d", serial)
+	fileName := fmt.Sprintf("%s.json", serialNumber)
+
+	// Check if the file exists
+	if _, err := os.Stat(fileName); err == nil {
+		// File exists, load the device from JSON
+		log.Printf("Device %s found, loading from JSON", serialNumber)
+
+		// Read the file
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			return nil, fmt.Errorf("error reading device file: %v", err)
+		}
+
+		// Unmarshal the device data
+		var device Device
+		if err := json.Unmarshal(data, &device); err != nil {
+			return nil, fmt.Errorf("error unmarshaling device data: %v", err)
+		}
+
+		return &device, nil
+	} else if os.IsNotExist(err) {
+		// File does not exist, create a new device
+		log.Printf("Device %s not found, creating a new device", serialNumber)
+
+		// Create a new device
+		priv, err := ecdh.P384().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("error generating keys: %v", err)
+		}
+
+		// Create the new device object
+		device := &Device{
+			MasterAddress:   master,
+			SerialNumber:    serialNumber,
+			FirmwareVersion: firmwareVersion,
+			State:           Bootloader,
+			SymmetricKey:    []byte(symmetricKey),
+			PrivateKey:      priv,
+			PublicKey:       priv.PublicKey(),
+			UpdateHistory:   []UpdateRecord{},
+		}
+
+		// Marshal the device to JSON
+		deviceJSON, err := json.MarshalIndent(device, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("error marshaling device to JSON: %v", err)
+		}
+
+		// Save the new device to the file
+		if err := os.WriteFile(fileName, deviceJSON, 0644); err != nil {
+			return nil, fmt.Errorf("error writing device file: %v", err)
+		}
+
+		log.Printf("Device %s created and saved to file", serialNumber)
+
+		return device, nil
+	} else {
+		// Some other error occurred while checking file existence
+		return nil, fmt.Errorf("error checking if file exists: %v", err)
+	}
+}
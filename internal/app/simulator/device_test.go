@@ -1,43 +1,97 @@
-package simulator
-
-import (
-	"encoding/json"
-	"testing"
-
-	"github.com/yuanyuanxiang/fss/internal/pkg/common"
-)
-
-func TestDevice_MarshalJSON(t *testing.T) {
-	// Create a device instance
-	device, err := NewDevice("127.0.0.1:9000", 123456, "1.0.0", common.SymmetricKey)
-	if err != nil {
-		log.Fatalf("Error creating or loading device: %v", err)
-	}
-
-	// Marshal the device to JSON
-	jsonData, err := json.Marshal(device)
-	if err != nil {
-		t.Fatalf("Failed to marshal device: %v", err)
-	}
-
-	// Unmarshal the JSON back to a Device struct
-	var unmarshaledDevice Device
-	err = json.Unmarshal(jsonData, &unmarshaledDevice)
-	if err != nil {
-		t.Fatalf("Failed to unmarshal JSON: %v", err)
-	}
-
-	// Check if the unmarshaled data matches the original device
-	if device.SerialNumber != unmarshaledDevice.SerialNumber {
-		t.Errorf("Expected SerialNumber %s, got %s", device.SerialNumber, unmarshaledDevice.SerialNumber)
-	}
-	if device.FirmwareVersion != unmarshaledDevice.FirmwareVersion {
-		t.Errorf("Expected FirmwareVersion %s, got %s", device.FirmwareVersion, unmarshaledDevice.FirmwareVersion)
-	}
-	if device.State != unmarshaledDevice.State {
-		t.Errorf("Expected State %s, got %s", device.State, unmarshaledDevice.State)
-	}
-	if string(device.SymmetricKey) != string(unmarshaledDevice.SymmetricKey) {
-		t.Errorf("Expected SymmetricKey %s, got %s", string(device.SymmetricKey), string(unmarshaledDevice.SymmetricKey))
-	}
-}
+package simulator
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+)
+
+func TestDevice_MarshalJSON(t *testing.T) {
+	// Create a device instance
+	device, err := NewDevice("127.0.0.1:9000", 123456, "1.0.0", common.DeriveDeviceKey([]byte("test master secret"), "0000123456"))
+	if err != nil {
+		log.Fatalf("Error creating or loading device: %v", err)
+	}
+
+	// Marshal the device to JSON
+	jsonData, err := json.Marshal(device)
+	if err != nil {
+		t.Fatalf("Failed to marshal device: %v", err)
+	}
+
+	// Unmarshal the JSON back to a Device struct
+	var unmarshaledDevice Device
+	err = json.Unmarshal(jsonData, &unmarshaledDevice)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal JSON: %v", err)
+	}
+
+	// Check if the unmarshaled data matches the original device
+	if device.SerialNumber != unmarshaledDevice.SerialNumber {
+		t.Errorf("Expected SerialNumber %s, got %s", device.SerialNumber, unmarshaledDevice.SerialNumber)
+	}
+	if device.FirmwareVersion != unmarshaledDevice.FirmwareVersion {
+		t.Errorf("Expected FirmwareVersion %s, got %s", device.FirmwareVersion, unmarshaledDevice.FirmwareVersion)
+	}
+	if device.State != unmarshaledDevice.State {
+		t.Errorf("Expected State %s, got %s", device.State, unmarshaledDevice.State)
+	}
+	if string(device.SymmetricKey) != string(unmarshaledDevice.SymmetricKey) {
+		t.Errorf("Expected SymmetricKey %s, got %s", string(device.SymmetricKey), string(unmarshaledDevice.SymmetricKey))
+	}
+}
+
+func TestDevice_Rollback(t *testing.T) {
+	// the device is saved in the working directory
+	wd, _ := os.Getwd()
+	_ = os.Chdir(t.TempDir())
+	defer func() { _ = os.Chdir(wd) }()
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := firmware.NewSigner(key)
+	serverPriv, _ := ecdh.P384().GenerateKey(rand.Reader)
+	device, err := NewDevice("127.0.0.1:9000", 1, "1.0.2", "key")
+	if err != nil {
+		t.Fatalf("Failed to create device: %v", err)
+	}
+	device.SetSimulator(&Simulator{publisherKey: key.Public(), publisherKeyID: signer.KeyID()})
+	device.ServerPublicKey, device.SecurityVersion = serverPriv.PublicKey(), 2
+
+	image := []byte("firmware 1.0.1")
+	manifest := firmware.NewManifest("1.0.1", image, 1)
+	signature, _ := signer.Sign(manifest)
+	response := func(approval string) map[string]interface{} {
+		return map[string]interface{}{"size": manifest.Size, "sha256": manifest.SHA256, "security_version": 1,
+			"code_signature": signature, "signer_key_id": signer.KeyID(), "signature_algorithm": signer.Algorithm(),
+			"rollback": approval}
+	}
+	shared, _ := serverPriv.ECDH(device.PrivateKey.PublicKey())
+	_, macKey := common.DeriveKeys(shared)
+
+	// an image below the fuse counter is rejected, unless the server approved its rollback
+	if err := device.install("1.0.1", image, response("")); err == nil {
+		t.Fatal("Expected the image below the fuse counter to be rejected")
+	}
+	forged := common.SignSignature(common.RollbackMessage(device.SerialNumber, "1.0.1"), "another key")
+	if err := device.install("1.0.1", image, response(forged)); err == nil {
+		t.Fatal("Expected a forged approval to be rejected")
+	}
+	other := common.SignSignature(common.RollbackMessage(device.SerialNumber, "1.0.0"), string(macKey))
+	if err := device.install("1.0.1", image, response(other)); err == nil {
+		t.Fatal("Expected the approval of another version to be rejected")
+	}
+	approval := common.SignSignature(common.RollbackMessage(device.SerialNumber, "1.0.1"), string(macKey))
+	if err := device.install("1.0.1", image, response(approval)); err != nil {
+		t.Fatalf("Failed to install the approved rollback: %v", err)
+	}
+	// the fuse counter isn't lowered, like the security floor on the server
+	if device.FirmwareVersion != "1.0.1" || device.SecurityVersion != 2 {
+		t.Fatalf("Expected 1.0.1 with the fuse counter 2, got %s and %d", device.FirmwareVersion, device.SecurityVersion)
+	}
+}
@@ -0,0 +1,266 @@
+package campaign
+
+// Package campaign rolls a firmware version out to a selection of devices in stages.
+// A stage admits a percentage of the selected devices: each device falls into a fixed bucket of the
+// campaign by the hash of its serial number, and is admitted when its bucket is below the percentage,
+// so the devices of a stage stay admitted in the later stages. Failed updates of admitted devices
+// halt the campaign when they exceed the failure threshold. A campaign is JSON:
+//
+//	{
+//		"id": "spring-release",
+//		"version": "1.0.2",
+//		"selector": {"serials": ["0000000001-0000000500"], "tags": ["lab"], "pools": ["acme"]},
+//		"stages": [1, 10, 50, 100],
+//		"failure_threshold": 5
+//	}
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+)
+
+const (
+	Bucket       = "campaigns"
+	DeviceBucket = "campaign_devices" // the state of each admitted device, keyed by "<campaign id>/<serial number>"
+
+	StatusRunning = "running" // admits devices of the current stage
+	StatusPaused  = "paused"  // admits no more devices, the admitted ones are still served
+	StatusHalted  = "halted"  // halted by the failures, serves no device until it's resumed
+	StatusAborted = "aborted" // serves no device, for good
+
+	DeviceAdmitted  = "admitted"  // may download the version
+	DeviceDelivered = "delivered" // downloaded the version
+	DeviceSucceeded = "succeeded" // runs the version
+	DeviceFailed    = "failed"    // failed to download or install the version
+
+	// DefaultFailureThreshold is the percentage of failed devices of the admitted ones which halts a campaign.
+	DefaultFailureThreshold = 10
+)
+
+var (
+	ErrInvalidCampaign   = errors.New("invalid campaign")
+	ErrInvalidTransition = errors.New("invalid campaign transition")
+	ErrInvalidOperation  = errors.New("invalid campaign operation")
+	ErrNotAdmitted       = errors.New("device is not admitted by a campaign")
+	ErrNotFound          = errors.New("campaign not found")
+	ErrExists            = errors.New("campaign already exists")
+)
+
+// Selector selects the devices which match all of its criteria, an empty criterion matches all.
+type Selector struct {
+	Serials []string `json:"serials,omitempty"` // serial numbers, or ranges "first-last"
+	Tags    []string `json:"tags,omitempty"`    // devices with any of the tags
+	Pools   []string `json:"pools,omitempty"`   // devices in any of the allowance pools
+}
+
+// Device is what a selector knows of a device.
+type Device struct {
+	SerialNumber string
+	Tags         []string
+	Pool         string
+}
+
+func (s Selector) Match(d Device) bool {
+	if len(s.Serials) > 0 && !matchSerial(s.Serials, d.SerialNumber) {
+		return false
+	}
+	if len(s.Tags) > 0 && !intersects(s.Tags, d.Tags) {
+		return false
+	}
+	if len(s.Pools) > 0 && !intersects(s.Pools, []string{d.Pool}) {
+		return false
+	}
+	return true
+}
+
+func matchSerial(serials []string, serial string) bool {
+	n, numeric := strconv.ParseUint(serial, 10, 64)
+	for _, s := range serials {
+		if first, last, ok := strings.Cut(s, "-"); ok {
+			a, err1 := strconv.ParseUint(first, 10, 64)
+			b, err2 := strconv.ParseUint(last, 10, 64)
+			if numeric == nil && err1 == nil && err2 == nil && a <= n && n <= b {
+				return true
+			}
+		} else if s == serial {
+			return true
+		}
+	}
+	return false
+}
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DeviceState is the progress of an admitted device.
+type DeviceState struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type Campaign struct {
+	ID               string                  `json:"id"`
+	Version          string                  `json:"version"`
+	Selector         Selector                `json:"selector"`
+	Stages           []int                   `json:"stages"`                      // ascending percentages, 100 if not set
+	Stage            int                     `json:"stage"`                       // index of the current stage
+	FailureThreshold int                     `json:"failure_threshold,omitempty"` // percentage of the admitted devices
+	Status           string                  `json:"status"`
+	Reason           string                  `json:"reason,omitempty"` // of the last pause, halt or abort
+	Devices          map[string]*DeviceState `json:"devices,omitempty"`
+	CreatedBy        string                  `json:"created_by,omitempty"`
+	CreatedAt        time.Time               `json:"created_at"`
+	UpdatedAt        time.Time               `json:"updated_at"`
+}
+
+// Validate checks the campaign and fills the defaults of a new campaign.
+func (c *Campaign) Validate() error {
+	if c.ID == "" || strings.ContainsAny(c.ID, "/ ") {
+		return fmt.Errorf("%w: invalid id '%s'", ErrInvalidCampaign, c.ID)
+	}
+	if !firmware.ValidVersion(c.Version) {
+		return fmt.Errorf("%w: invalid version '%s'", ErrInvalidCampaign, c.Version)
+	}
+	if len(c.Stages) == 0 {
+		c.Stages = []int{100}
+	}
+	for i, p := range c.Stages {
+		if p <= 0 || p > 100 || (i > 0 && p <= c.Stages[i-1]) {
+			return fmt.Errorf("%w: stages must be ascending percentages up to 100", ErrInvalidCampaign)
+		}
+	}
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = DefaultFailureThreshold
+	}
+	if c.FailureThreshold < 0 || c.FailureThreshold > 100 {
+		return fmt.Errorf("%w: failure threshold must be a percentage", ErrInvalidCampaign)
+	}
+	if c.Status == "" {
+		c.Status = StatusRunning
+	}
+	if c.Devices == nil {
+		c.Devices = make(map[string]*DeviceState)
+	}
+	return nil
+}
+
+// Percentage returns the percentage of the selected devices admitted by the current stage.
+func (c *Campaign) Percentage() int {
+	return c.Stages[min(c.Stage, len(c.Stages)-1)]
+}
+
+// bucket returns the fixed bucket [0, 100) of the device in the campaign.
+func (c *Campaign) bucket(serialNumber string) int {
+	sum := sha256.Sum256([]byte(c.ID + ":" + serialNumber))
+	return int(binary.BigEndian.Uint32(sum[:4]) % 100)
+}
+
+// Admit returns whether the campaign serves its version to the device, and admits the device if the
+// current stage includes it. It returns true for a new admission too, which must be saved.
+func (c *Campaign) Admit(d Device, now time.Time) (ok, admitted bool) {
+	switch c.Status {
+	case StatusHalted, StatusAborted:
+		return false, false
+	}
+	if _, ok := c.Devices[d.SerialNumber]; ok {
+		return true, false
+	}
+	if c.Status != StatusRunning || !c.Selector.Match(d) || c.bucket(d.SerialNumber) >= c.Percentage() {
+		return false, false
+	}
+	if c.Devices == nil {
+		c.Devices = make(map[string]*DeviceState)
+	}
+	c.Devices[d.SerialNumber] = &DeviceState{Status: DeviceAdmitted, Timestamp: now}
+	c.UpdatedAt = now
+	return true, true
+}
+
+// Record records the progress of an admitted device. It halts the campaign when the failed devices
+// exceed the threshold, and returns true if it did.
+func (c *Campaign) Record(serialNumber, status, errMsg string, now time.Time) (halted bool) {
+	d, ok := c.Devices[serialNumber]
+	if !ok {
+		return false
+	}
+	// a device which runs the version has succeeded for good
+	if d.Status == DeviceSucceeded && status != DeviceSucceeded {
+		return false
+	}
+	d.Status, d.Error, d.Timestamp = status, errMsg, now
+	c.UpdatedAt = now
+	if status != DeviceFailed || c.Status != StatusRunning && c.Status != StatusPaused {
+		return false
+	}
+	counts := c.Counts()
+	if counts[DeviceFailed]*100 > c.FailureThreshold*len(c.Devices) {
+		c.Status = StatusHalted
+		c.Reason = fmt.Sprintf("%d of %d admitted devices failed, threshold %d%%", counts[DeviceFailed], len(c.Devices), c.FailureThreshold)
+		return true
+	}
+	return false
+}
+
+// Counts returns the number of admitted devices of each status.
+func (c *Campaign) Counts() map[string]int {
+	counts := map[string]int{DeviceAdmitted: 0, DeviceDelivered: 0, DeviceSucceeded: 0, DeviceFailed: 0}
+	for _, d := range c.Devices {
+		counts[d.Status]++
+	}
+	return counts
+}
+
+const (
+	OpPause   = "pause"
+	OpResume  = "resume"
+	OpAbort   = "abort"
+	OpAdvance = "advance"
+)
+
+// Control pauses, resumes, aborts or advances the campaign to the next stage.
+func (c *Campaign) Control(op, reason string, now time.Time) error {
+	switch op {
+	case OpPause, OpResume, OpAbort, OpAdvance:
+	default:
+		return fmt.Errorf("%w: '%s'", ErrInvalidOperation, op)
+	}
+	from := c.Status
+	switch {
+	case from == StatusAborted:
+		return fmt.Errorf("%w: campaign '%s' is aborted", ErrInvalidTransition, c.ID)
+	case op == OpPause && from == StatusRunning:
+		c.Status = StatusPaused
+	case op == OpResume && (from == StatusPaused || from == StatusHalted):
+		c.Status = StatusRunning
+	case op == OpAbort:
+		c.Status = StatusAborted
+	case op == OpAdvance && from == StatusRunning:
+		if c.Stage >= len(c.Stages)-1 {
+			return fmt.Errorf("%w: campaign '%s' is at the last stage", ErrInvalidTransition, c.ID)
+		}
+		c.Stage++
+	default:
+		return fmt.Errorf("%w: can't %s a %s campaign", ErrInvalidTransition, op, from)
+	}
+	if op != OpAdvance {
+		c.Reason = reason
+	}
+	c.UpdatedAt = now
+	return nil
+}
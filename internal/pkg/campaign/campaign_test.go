@@ -0,0 +1,96 @@
+package campaign
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSelector_Match(t *testing.T) {
+	s := Selector{Serials: []string{"0000000001-0000000010", "0000000042"}, Tags: []string{"lab", "beta"}}
+	cases := []struct {
+		dev  Device
+		want bool
+	}{
+		{Device{SerialNumber: "0000000005", Tags: []string{"beta"}}, true},
+		{Device{SerialNumber: "0000000042", Tags: []string{"lab"}}, true},
+		{Device{SerialNumber: "0000000011", Tags: []string{"lab"}}, false},
+		{Device{SerialNumber: "0000000005"}, false},
+	}
+	for _, c := range cases {
+		if got := s.Match(c.dev); got != c.want {
+			t.Errorf("Match(%+v) = %v, want %v", c.dev, got, c.want)
+		}
+	}
+	if !(Selector{Pools: []string{"acme"}}).Match(Device{SerialNumber: "x", Pool: "acme"}) {
+		t.Errorf("Pool should match")
+	}
+}
+
+func TestCampaign_Rollout(t *testing.T) {
+	c := &Campaign{ID: "spring", Version: "1.0.2", Stages: []int{10, 50, 100}, FailureThreshold: 20}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	admit := func() int {
+		n := 0
+		for i := 1; i <= 1000; i++ {
+			if ok, _ := c.Admit(Device{SerialNumber: fmt.Sprintf("%010d", i)}, now); ok {
+				n++
+			}
+		}
+		return n
+	}
+	first := admit()
+	if first < 50 || first > 150 {
+		t.Fatalf("About 10%% should be admitted, got %d", first)
+	}
+	if err := c.Control(OpAdvance, "", now); err != nil {
+		t.Fatal(err)
+	}
+	// the devices of the first stage stay admitted
+	if second := admit(); second < 400 || second > 600 || len(c.Devices) != second {
+		t.Fatalf("About 50%% should be admitted, got %d", second)
+	}
+
+	_ = c.Control(OpPause, "weekend", now)
+	if ok, _ := c.Admit(Device{SerialNumber: "0000001001"}, now); ok {
+		t.Fatalf("Paused campaign shouldn't admit new devices")
+	}
+
+	// failures of more than 20% of the admitted devices halt it
+	n := 0
+	for serial := range c.Devices {
+		n++
+		if c.Record(serial, DeviceFailed, "bad image", now) {
+			break
+		}
+	}
+	if c.Status != StatusHalted || n != len(c.Devices)/5+1 {
+		t.Fatalf("Campaign should be halted after %d failures: %s, %d", len(c.Devices)/5+1, c.Status, n)
+	}
+	for serial := range c.Devices {
+		if ok, _ := c.Admit(Device{SerialNumber: serial}, now); ok {
+			t.Fatalf("Halted campaign shouldn't serve devices")
+		}
+		break
+	}
+	if err := c.Control(OpAdvance, "", now); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("Halted campaign shouldn't advance: %v", err)
+	}
+	if err := c.Control(OpResume, "fixed", now); err != nil || c.Status != StatusRunning {
+		t.Fatalf("Halted campaign should resume: %v", err)
+	}
+	if err := c.Control("restart", "", now); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("Expected ErrInvalidOperation, got %v", err)
+	}
+	_ = c.Control(OpAbort, "", now)
+	if err := c.Control(OpResume, "", now); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("Aborted campaign shouldn't resume: %v", err)
+	}
+	if err := c.Control("restart", "", now); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("Expected ErrInvalidOperation of an aborted campaign, got %v", err)
+	}
+}
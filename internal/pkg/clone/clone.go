@@ -0,0 +1,72 @@
+package clone
+
+// Package clone tracks where devices are seen from, to notice cloned devices.
+// A genuine device is seen from one network at a time, so a serial number which is
+// authenticated from unrelated networks within a short window is likely cloned.
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Tracker remembers the networks each serial number was seen from during the window.
+type Tracker struct {
+	mu     sync.Mutex
+	window time.Duration
+	seen   map[string]map[string]time.Time // serial number -> network -> last seen
+}
+
+func NewTracker(window time.Duration) *Tracker {
+	return &Tracker{
+		window: window,
+		seen:   make(map[string]map[string]time.Time),
+	}
+}
+
+// Network returns the network of a remote address: the /24 of an IPv4 address, or the /64 of an IPv6 address.
+// Addresses of the same network are related, e.g. devices behind the same NAT or in the same factory.
+func Network(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// Observe records the serial number is seen from the remote address. It returns the other network
+// the serial number was seen from during the window, or "" if there is none.
+func (t *Tracker) Observe(serialNumber, remoteAddr string, now time.Time) string {
+	network := Network(remoteAddr)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	networks := t.seen[serialNumber]
+	if networks == nil {
+		networks = make(map[string]time.Time)
+		t.seen[serialNumber] = networks
+	}
+	var other string
+	for n, at := range networks {
+		if now.Sub(at) > t.window {
+			delete(networks, n)
+		} else if n != network {
+			other = n
+		}
+	}
+	networks[network] = now
+	return other
+}
+
+// Forget removes the sightings of the serial number, e.g. after the device is reviewed.
+func (t *Tracker) Forget(serialNumber string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.seen, serialNumber)
+}
@@ -0,0 +1,31 @@
+package clone
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTracker_Observe(t *testing.T) {
+	tr := NewTracker(time.Minute)
+	now := time.Now()
+	if other := tr.Observe("0000000001", "10.0.0.1:5000", now); other != "" {
+		t.Fatalf("Unexpected conflict on first sighting: %s", other)
+	}
+	// the same network, e.g. another port or another host behind the same NAT
+	if other := tr.Observe("0000000001", "10.0.0.2:5001", now.Add(time.Second)); other != "" {
+		t.Fatalf("Unexpected conflict in the same network: %s", other)
+	}
+	if other := tr.Observe("0000000001", "192.168.7.1:5000", now.Add(2*time.Second)); other != "10.0.0.0/24" {
+		t.Fatalf("Expected conflict with 10.0.0.0/24, got '%s'", other)
+	}
+	// after the window, the device may have moved
+	if other := tr.Observe("0000000002", "10.0.0.1:5000", now); other != "" {
+		t.Fatalf("Unexpected conflict: %s", other)
+	}
+	if other := tr.Observe("0000000002", "172.16.0.1:5000", now.Add(2*time.Minute)); other != "" {
+		t.Fatalf("Unexpected conflict after the window: %s", other)
+	}
+	if n := Network("[2001:db8::1]:443"); n != "2001:db8::/64" {
+		t.Fatalf("Unexpected IPv6 network: %s", n)
+	}
+}
@@ -0,0 +1,76 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+)
+
+// LoadEd25519Key loads the PKCS#8 Ed25519 key.
+func LoadEd25519Key(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key: %w", err)
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key must be Ed25519, got %T", key)
+	}
+	return priv, nil
+}
+
+// GenerateEd25519Key generates an Ed25519 key and saves it to path, and its public key to pubPath.
+// An existing key is never overwritten.
+func GenerateEd25519Key(path, pubPath string) (ed25519.PrivateKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save key: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, fmt.Errorf("failed to save key: %w", err)
+	}
+	der, err = x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		return nil, fmt.Errorf("failed to save public key: %w", err)
+	}
+	return priv, nil
+}
+
+// LoadEd25519PublicKey loads the PEM Ed25519 public key.
+func LoadEd25519PublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := firmware.LoadPublicKey(path)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key must be Ed25519, got %T", key)
+	}
+	return pub, nil
+}
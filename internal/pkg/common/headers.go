@@ -0,0 +1,8 @@
+package common
+
+const (
+	// HeaderDeviceCert is set by the server to the serial number of a verified device certificate.
+	HeaderDeviceCert = "X-Device-Cert-Serial"
+	// HeaderDeviceCertSHA256 is set by the server to the fingerprint of the verified device certificate.
+	HeaderDeviceCertSHA256 = "X-Device-Cert-SHA256"
+)
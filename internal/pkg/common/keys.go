@@ -0,0 +1,85 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// MasterSecretEnv is the environment variable holding the hex encoded master secret.
+	// It takes precedence over the master secret file.
+	MasterSecretEnv = "FSS_MASTER_SECRET"
+
+	masterSecretLength = 32
+)
+
+// KeyProvider provides the symmetric key of each device.
+type KeyProvider interface {
+	GetDeviceKey(serialNumber string) (string, error)
+}
+
+// DeriveKey derives a 256 bits key for the specified usage from the master secret.
+func DeriveKey(master []byte, info string) []byte {
+	kdf := hkdf.New(sha256.New, master, nil, []byte(info))
+	key := make([]byte, 32)
+	_, _ = io.ReadFull(kdf, key)
+	return key
+}
+
+// DeriveDeviceKey derives the HMAC key of a device from the master secret and its serial number,
+// so an extracted device key only leaks the secret of this device.
+func DeriveDeviceKey(master []byte, serialNumber string) string {
+	return hex.EncodeToString(DeriveKey(master, "FSS_DEVICE_KEY:"+serialNumber))
+}
+
+// MasterKeyProvider derives device keys from a master secret.
+type MasterKeyProvider struct {
+	master []byte
+}
+
+func NewMasterKeyProvider(master []byte) (*MasterKeyProvider, error) {
+	if len(master) < masterSecretLength {
+		return nil, fmt.Errorf("master secret must be at least %d bytes", masterSecretLength)
+	}
+	return &MasterKeyProvider{master: master}, nil
+}
+
+func (p *MasterKeyProvider) GetDeviceKey(serialNumber string) (string, error) {
+	if serialNumber == "" {
+		return "", fmt.Errorf("serial number is required")
+	}
+	return DeriveDeviceKey(p.master, serialNumber), nil
+}
+
+// LoadOrCreateMasterSecret loads the master secret from the environment variable or the specified file.
+// If neither exists, a random secret is generated and saved to the file with owner only permissions.
+func LoadOrCreateMasterSecret(path string) ([]byte, error) {
+	if v := strings.TrimSpace(os.Getenv(MasterSecretEnv)); v != "" {
+		master, err := hex.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", MasterSecretEnv, err)
+		}
+		return master, nil
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		master, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid master secret file: %w", err)
+		}
+		return master, nil
+	}
+	master, err := generateSymmetricKey(masterSecretLength)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(master)), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save master secret: %w", err)
+	}
+	return master, nil
+}
@@ -1,17 +1,64 @@
-package common
-
-import (
-	"testing"
-)
-
-func TestGenerateSymmetricKey(t *testing.T) {
-	length := 32 // 256 bits
-	key, err := generateSymmetricKey(length)
-	if err != nil {
-		t.Fatalf("Failed to generate symmetric key: %v", err)
-	}
-	if len(key) != length {
-		t.Fatalf("Generated key length is incorrect: got %d, want %d", len(key), length)
-	}
-	t.Logf("Generated symmetric key: %x\n", key)
-}
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestGenerateSymmetricKey(t *testing.T) {
+	length := 32 // 256 bits
+	key, err := generateSymmetricKey(length)
+	if err != nil {
+		t.Fatalf("Failed to generate symmetric key: %v", err)
+	}
+	if len(key) != length {
+		t.Fatalf("Generated key length is incorrect: got %d, want %d", len(key), length)
+	}
+	t.Logf("Generated symmetric key: %x\n", key)
+}
+
+func TestDeriveDeviceKey(t *testing.T) {
+	keys, err := NewMasterKeyProvider([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("Failed to create key provider: %v", err)
+	}
+	k1, _ := keys.GetDeviceKey("0000000001")
+	k2, _ := keys.GetDeviceKey("0000000002")
+	if k1 == k2 {
+		t.Fatalf("Devices must not share the same key")
+	}
+	if k, _ := keys.GetDeviceKey("0000000001"); k != k1 {
+		t.Fatalf("Derived key is not deterministic")
+	}
+	if _, err := NewMasterKeyProvider([]byte("short")); err == nil {
+		t.Fatalf("Expected short master secret to be rejected")
+	}
+}
+
+func TestNewStreamAt(t *testing.T) {
+	key := make([]byte, 32)
+	plain := make([]byte, 1000)
+	_, _ = rand.Read(key)
+	_, _ = rand.Read(plain)
+	// the counter carries into the high 64 bits
+	iv := DeriveIV("ticket")
+	copy(iv[8:], bytes.Repeat([]byte{0xff}, 8))
+	stream, err := NewStreamAt(key, iv, 0)
+	if err != nil {
+		t.Fatalf("Failed to create stream: %v", err)
+	}
+	cipherText := make([]byte, len(plain))
+	stream.XORKeyStream(cipherText, plain)
+	for _, offset := range []int64{1, 15, 16, 17, 500, 999} {
+		stream, _ := NewStreamAt(key, iv, offset)
+		out := make([]byte, len(plain)-int(offset))
+		stream.XORKeyStream(out, cipherText[offset:])
+		if !bytes.Equal(out, plain[offset:]) {
+			t.Errorf("Failed to decrypt from offset %d", offset)
+		}
+	}
+	if _, err := NewStreamAt(key, iv[:8], 0); err == nil {
+		t.Errorf("Expected short iv to be rejected")
+	}
+}
@@ -0,0 +1,158 @@
+package ledger
+
+// Package ledger keeps an append-only ledger of the device registration allowance.
+// Every grant and every consumption by a registered device is an entry of the ledger,
+// and the balance of an allowance pool is the sum of its entries. The entries are kept in a store bucket,
+// keyed by their sequence number, and are never changed once written.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/pkg/store"
+)
+
+const (
+	Bucket = "ledger"
+
+	// DefaultPool is the pool of devices which match no other pool, and of entries written before pools existed.
+	DefaultPool = "default"
+
+	TypeGrant   = "grant"   // allowance granted by an operator
+	TypeConsume = "consume" // allowance consumed by the registration of a device
+)
+
+var (
+	ErrEntryExists = errors.New("ledger entry already exists")
+	ErrLicenceUsed = errors.New("licence already applied")
+	// ErrPoolMismatch is returned when a device registers in another pool than the one it may draw from.
+	ErrPoolMismatch = errors.New("allowance pool mismatch")
+)
+
+// Entry of the ledger
+type Entry struct {
+	Seq       uint64    `json:"seq"`
+	Type      string    `json:"type"`
+	Pool      string    `json:"pool"`
+	Amount    int       `json:"amount"` // positive for a grant, negative for a consumption
+	Serial    string    `json:"serial_number,omitempty"`
+	Operator  string    `json:"operator,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	PONumber  string    `json:"po_number,omitempty"`
+	LicenceID string    `json:"licence_id,omitempty"` // licence of the grant
+	Timestamp time.Time `json:"timestamp"`
+	Balance   int       `json:"balance"` // balance of the pool after this entry
+}
+
+// Ledger keeps the entries in memory. It is not safe for concurrent use, the caller must serialize
+// the calls, like the device manager does.
+type Ledger struct {
+	entries  []Entry
+	balances map[string]int  // balance of each pool
+	licences map[string]bool // ID of applied licences
+}
+
+// Load reads all entries of the store.
+func Load(st store.Store) (*Ledger, error) {
+	l := &Ledger{balances: make(map[string]int), licences: make(map[string]bool)}
+	err := st.ForEach(Bucket, func(key string, value json.RawMessage) error {
+		var e Entry
+		if err := json.Unmarshal(value, &e); err != nil {
+			return fmt.Errorf("invalid ledger entry '%s': %w", key, err)
+		}
+		if e.Pool == "" {
+			e.Pool = DefaultPool
+		}
+		l.commit(e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func entryKey(seq uint64) string {
+	return fmt.Sprintf("%016d", seq)
+}
+
+// Balance returns the sum of the entries of the pool, "" is the default pool.
+func (l *Ledger) Balance(pool string) int {
+	if pool == "" {
+		pool = DefaultPool
+	}
+	return l.balances[pool]
+}
+
+// Balances returns the balance of every pool which has entries.
+func (l *Ledger) Balances() map[string]int {
+	m := make(map[string]int, len(l.balances))
+	for pool, balance := range l.balances {
+		m[pool] = balance
+	}
+	return m
+}
+
+// Len returns the number of entries.
+func (l *Ledger) Len() int {
+	return len(l.entries)
+}
+
+// Entries returns a copy of the entries of the pool in order, or of all pools if pool is "".
+func (l *Ledger) Entries(pool string) []Entry {
+	out := make([]Entry, 0, len(l.entries))
+	for _, e := range l.entries {
+		if pool == "" || e.Pool == pool {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Next fills the sequence number, the timestamp and the balance of a new entry, whose pool defaults to DefaultPool.
+// The entry is only added by Commit after it is written with Put.
+func (l *Ledger) Next(e Entry) Entry {
+	if e.Pool == "" {
+		e.Pool = DefaultPool
+	}
+	e.Seq = uint64(len(l.entries)) + 1
+	e.Timestamp = time.Now().UTC()
+	e.Balance = l.balances[e.Pool] + e.Amount
+	return e
+}
+
+// Put writes the entries in the batch, an existing entry is never overwritten.
+func Put(tx *store.Tx, entries ...Entry) error {
+	for _, e := range entries {
+		var old Entry
+		if err := tx.Get(Bucket, entryKey(e.Seq), &old); err != store.ErrNotFound {
+			return fmt.Errorf("%w: %d", ErrEntryExists, e.Seq)
+		}
+		if err := tx.Put(Bucket, entryKey(e.Seq), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit adds the written entries to the ledger.
+func (l *Ledger) Commit(entries ...Entry) {
+	for _, e := range entries {
+		l.commit(e)
+	}
+}
+
+func (l *Ledger) commit(e Entry) {
+	l.entries = append(l.entries, e)
+	l.balances[e.Pool] += e.Amount
+	if e.LicenceID != "" {
+		l.licences[e.LicenceID] = true
+	}
+}
+
+// HasLicence checks if the licence is already applied.
+func (l *Ledger) HasLicence(id string) bool {
+	return l.licences[id]
+}
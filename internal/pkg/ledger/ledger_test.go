@@ -0,0 +1,60 @@
+package ledger
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/yuanyuanxiang/fss/pkg/store"
+)
+
+func TestLedger_Balance(t *testing.T) {
+	dir := t.TempDir()
+	st, err := store.Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	l, err := Load(st)
+	if err != nil {
+		t.Fatalf("Failed to load ledger: %v", err)
+	}
+	grant := l.Next(Entry{Type: TypeGrant, Amount: 10, Operator: "admin", PONumber: "PO-1"})
+	if err := st.Update(func(tx *store.Tx) error { return Put(tx, grant) }); err != nil {
+		t.Fatalf("Failed to write grant: %v", err)
+	}
+	l.Commit(grant)
+	consume := l.Next(Entry{Type: TypeConsume, Amount: -1, Serial: "0000000001"})
+	if consume.Seq != 2 || consume.Balance != 9 {
+		t.Fatalf("Unexpected entry: %+v", consume)
+	}
+	if err := st.Update(func(tx *store.Tx) error { return Put(tx, consume) }); err != nil {
+		t.Fatalf("Failed to write consumption: %v", err)
+	}
+	l.Commit(consume)
+	other := l.Next(Entry{Type: TypeGrant, Pool: "acme", Amount: 3})
+	if other.Seq != 3 || other.Balance != 3 {
+		t.Fatalf("Unexpected entry of another pool: %+v", other)
+	}
+	if err := st.Update(func(tx *store.Tx) error { return Put(tx, other) }); err != nil {
+		t.Fatalf("Failed to write grant: %v", err)
+	}
+	l.Commit(other)
+	// an entry is never overwritten
+	if err := st.Update(func(tx *store.Tx) error { return Put(tx, grant) }); !errors.Is(err, ErrEntryExists) {
+		t.Fatalf("Expected ErrEntryExists, got %v", err)
+	}
+	st.Close()
+
+	st, _ = store.Open(dir)
+	defer st.Close()
+	l, err = Load(st)
+	if err != nil {
+		t.Fatalf("Failed to reload ledger: %v", err)
+	}
+	entries := l.Entries(DefaultPool)
+	if l.Balance("") != 9 || len(entries) != 2 || entries[0].PONumber != "PO-1" || entries[1].Serial != "0000000001" {
+		t.Fatalf("Unexpected ledger after reload: balance %d, %+v", l.Balance(""), entries)
+	}
+	if l.Balance("acme") != 3 || len(l.Entries("")) != 3 {
+		t.Fatalf("Unexpected pools after reload: %v", l.Balances())
+	}
+}
@@ -0,0 +1,113 @@
+package licence
+
+// Package licence issues and verifies the licence files of allowance top-ups.
+// A licence grants an amount of registrations to an allowance pool. It is signed with the Ed25519 key
+// of the vendor, which is held offline, and the server only knows the public key. Each licence has
+// a unique ID, so it can be applied only once, and an expiry after which it can't be applied.
+//
+// The file is JSON: the payload is the base64 JSON encoding of the licence, and the signature is the
+// base64 Ed25519 signature of the payload bytes, so the signature doesn't depend on how JSON is encoded.
+//
+//	{
+//		"payload": "eyJpZCI6IkxJQy0wMDAxIiwicG9vbCI6ImFjbWUiLCJhbW91bnQiOjEwMCwuLi59",
+//		"signature": "base64 Ed25519 signature",
+//		"key_id": "0123456789abcdef"
+//	}
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+)
+
+var (
+	ErrInvalidLicence   = errors.New("invalid licence")
+	ErrInvalidSignature = errors.New("invalid licence signature")
+	ErrExpiredLicence   = errors.New("licence expired")
+)
+
+// Licence grants an amount of registrations to an allowance pool.
+type Licence struct {
+	ID        string    `json:"id"`
+	Pool      string    `json:"pool"`
+	Amount    int       `json:"amount"`
+	PONumber  string    `json:"po_number,omitempty"`
+	IssuedAt  time.Time `json:"issued_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// File is the signed licence file.
+type File struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+	KeyID     string `json:"key_id,omitempty"`
+}
+
+// Sign returns the licence file signed with the vendor key.
+func Sign(key ed25519.PrivateKey, l Licence) ([]byte, error) {
+	if l.ID == "" || l.Amount <= 0 || l.ExpiresAt.IsZero() {
+		return nil, fmt.Errorf("%w: id, positive amount and expiry are required", ErrInvalidLicence)
+	}
+	payload, err := json.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := firmware.KeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(File{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+		KeyID:     keyID,
+	}, "", "  ")
+}
+
+// Verify checks the signature of the licence file with the vendor public key, and that it isn't expired.
+func Verify(pub ed25519.PublicKey, data []byte, now time.Time) (*Licence, error) {
+	var f File
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLicence, err)
+	}
+	payload, err := base64.StdEncoding.DecodeString(f.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLicence, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(f.Signature)
+	if err != nil || !ed25519.Verify(pub, payload, sig) {
+		return nil, ErrInvalidSignature
+	}
+	var l Licence
+	if err := json.Unmarshal(payload, &l); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidLicence, err)
+	}
+	if l.ID == "" || l.Amount <= 0 {
+		return nil, fmt.Errorf("%w: missing id or amount", ErrInvalidLicence)
+	}
+	if !now.Before(l.ExpiresAt) {
+		return &l, ErrExpiredLicence
+	}
+	return &l, nil
+}
+
+// LoadVendorKey loads the PKCS#8 vendor key, a licence can't be issued without it.
+func LoadVendorKey(path string) (ed25519.PrivateKey, error) {
+	return common.LoadEd25519Key(path)
+}
+
+// GenerateVendorKey generates the vendor key, and saves its public key to pubPath.
+// An existing key is never overwritten.
+func GenerateVendorKey(path, pubPath string) (ed25519.PrivateKey, error) {
+	return common.GenerateEd25519Key(path, pubPath)
+}
+
+// LoadPublicKey loads the PEM vendor public key.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	return common.LoadEd25519PublicKey(path)
+}
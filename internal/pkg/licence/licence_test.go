@@ -0,0 +1,85 @@
+package licence
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLicence_Verify(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+	data, err := Sign(priv, Licence{ID: "LIC-0001", Pool: "acme", Amount: 100, IssuedAt: now, ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Failed to sign licence: %v", err)
+	}
+	l, err := Verify(pub, data, now)
+	if err != nil || l.ID != "LIC-0001" || l.Pool != "acme" || l.Amount != 100 {
+		t.Fatalf("Unexpected licence %+v: %v", l, err)
+	}
+	if _, err := Verify(pub, data, now.Add(2*time.Hour)); !errors.Is(err, ErrExpiredLicence) {
+		t.Fatalf("Expected ErrExpiredLicence, got %v", err)
+	}
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := Verify(other, data, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected ErrInvalidSignature with another key, got %v", err)
+	}
+	// a corrupted signature
+	corrupted := strings.Replace(string(data), `"signature": "`, `"signature": "A`, 1)
+	if _, err := Verify(pub, []byte(corrupted), now); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected ErrInvalidSignature for a corrupted signature, got %v", err)
+	}
+	if _, err := Sign(priv, Licence{ID: "LIC-0002", Amount: 0, ExpiresAt: now}); !errors.Is(err, ErrInvalidLicence) {
+		t.Fatalf("Expected ErrInvalidLicence for no amount, got %v", err)
+	}
+}
+
+func TestLicence_TamperedAmount(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+	data, _ := Sign(priv, Licence{ID: "LIC-0001", Pool: "acme", Amount: 100, IssuedAt: now, ExpiresAt: now.Add(time.Hour)})
+
+	// the amount can't be raised without the vendor key, the signature of the original payload is kept
+	var f File
+	_ = json.Unmarshal(data, &f)
+	payload, _ := base64.StdEncoding.DecodeString(f.Payload)
+	var l Licence
+	_ = json.Unmarshal(payload, &l)
+	l.Amount = 100000
+	payload, _ = json.Marshal(l)
+	f.Payload = base64.StdEncoding.EncodeToString(payload)
+	forged, _ := json.Marshal(f)
+	if _, err := Verify(pub, forged, now); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected ErrInvalidSignature for a tampered amount, got %v", err)
+	}
+}
+
+func TestLoadVendorKey(t *testing.T) {
+	dir := t.TempDir()
+	keyPath, pubPath := filepath.Join(dir, "vendor_key.pem"), filepath.Join(dir, "vendor_pub.pem")
+	// a wrong path fails, it never creates a new key
+	if _, err := LoadVendorKey(keyPath); err == nil {
+		t.Fatalf("Expected an error for a missing vendor key")
+	}
+	key, err := GenerateVendorKey(keyPath, pubPath)
+	if err != nil {
+		t.Fatalf("Failed to generate vendor key: %v", err)
+	}
+	if _, err := GenerateVendorKey(keyPath, pubPath); err == nil {
+		t.Fatalf("Expected an error overwriting the vendor key")
+	}
+	loaded, err := LoadVendorKey(keyPath)
+	if err != nil || !loaded.Equal(key) {
+		t.Fatalf("Unexpected vendor key: %v", err)
+	}
+	pub, err := LoadPublicKey(pubPath)
+	if err != nil || !pub.Equal(key.Public()) {
+		t.Fatalf("Unexpected vendor public key: %v", err)
+	}
+}
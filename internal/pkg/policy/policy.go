@@ -0,0 +1,211 @@
+package policy
+
+// Package policy evaluates the rules of automatic actions on security incidents.
+// A rule fires when a serial number has raised enough incidents of a description within a window,
+// e.g. 5 "invalid signature" in 10 minutes, and the server takes the actions of the rule.
+// The rules are JSON:
+//
+//	[
+//		{"name": "brute-force", "incident": "invalid signature", "threshold": 5, "window": "10m", "actions": ["block"]},
+//		{"name": "replay", "incident": "missing or invalid authorization header", "detail": "token already used", "actions": ["block", "alert"]}
+//	]
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ActionBlock = "block" // block the serial number
+	ActionAlert = "alert" // alert the operators
+)
+
+var (
+	ErrInvalidRule = errors.New("invalid rule")
+)
+
+// sweepInterval is the interval of removing the counts out of the window, so serial numbers which
+// never reach a threshold don't pile up.
+const sweepInterval = time.Minute
+
+// Duration is a time.Duration written as a string in JSON, e.g. "10m".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Rule takes the actions when a serial number raises the incident threshold times within the window.
+type Rule struct {
+	Name      string   `json:"name"`
+	Incident  string   `json:"incident"`            // description of the incident, e.g. "invalid signature"
+	Detail    string   `json:"detail,omitempty"`    // only incidents whose detail contains it, if set
+	Threshold int      `json:"threshold,omitempty"` // 1 if not set
+	Window    Duration `json:"window,omitempty"`    // only needed if the threshold is more than 1
+	Actions   []string `json:"actions"`
+}
+
+// Incident is a security incident raised by a serial number.
+type Incident struct {
+	RemoteAddr   string
+	SerialNumber string
+	Description  string
+	Detail       string
+	Timestamp    time.Time
+}
+
+// Firing is a rule fired by the incidents of a serial number.
+type Firing struct {
+	Rule         string    `json:"rule"`
+	SerialNumber string    `json:"serial_number"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Incident     string    `json:"incident"`
+	Count        int       `json:"count"`
+	Actions      []string  `json:"actions"`
+	Timestamp    time.Time `json:"timestamp"`
+}
+
+// Validate checks the rules, and that their names are unique.
+func Validate(rules []Rule) error {
+	names := make(map[string]bool)
+	for i, r := range rules {
+		if r.Name == "" || r.Incident == "" {
+			return fmt.Errorf("%w #%d: name and incident are required", ErrInvalidRule, i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("%w: duplicate name '%s'", ErrInvalidRule, r.Name)
+		}
+		names[r.Name] = true
+		if r.Threshold < 0 || (r.Threshold > 1 && r.Window <= 0) {
+			return fmt.Errorf("%w '%s': a threshold above 1 needs a window", ErrInvalidRule, r.Name)
+		}
+		if len(r.Actions) == 0 {
+			return fmt.Errorf("%w '%s': no actions", ErrInvalidRule, r.Name)
+		}
+		for _, a := range r.Actions {
+			if a != ActionBlock && a != ActionAlert {
+				return fmt.Errorf("%w '%s': unknown action '%s'", ErrInvalidRule, r.Name, a)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadRules loads the rules. No rules are configured if the file doesn't exist.
+func LoadRules(path string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse rules: %w", err)
+	}
+	if err := Validate(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// Engine counts the incidents of each rule and serial number.
+type Engine struct {
+	mu    sync.Mutex
+	rules []Rule
+	hits  map[hitKey][]time.Time // incidents in the window
+	swept time.Time
+}
+
+// hitKey is the index of the rule and the serial number.
+type hitKey struct {
+	rule   int
+	serial string
+}
+
+func NewEngine(rules []Rule) *Engine {
+	return &Engine{rules: rules, hits: make(map[hitKey][]time.Time)}
+}
+
+// Rules returns the rules of the engine.
+func (e *Engine) Rules() []Rule {
+	return e.rules
+}
+
+// Evaluate counts the incident, and returns the rules it fires. The count of a fired rule starts over,
+// so a rule fires once per threshold incidents. Incidents without a serial number are ignored.
+func (e *Engine) Evaluate(inc Incident) []Firing {
+	if inc.SerialNumber == "" {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if inc.Timestamp.Sub(e.swept) > sweepInterval {
+		e.sweep(inc.Timestamp)
+	}
+	var fired []Firing
+	for i, r := range e.rules {
+		if r.Incident != inc.Description || !strings.Contains(inc.Detail, r.Detail) {
+			continue
+		}
+		key := hitKey{rule: i, serial: inc.SerialNumber}
+		hits := append(e.hits[key], inc.Timestamp)
+		for len(hits) > 0 && inc.Timestamp.Sub(hits[0]) > time.Duration(r.Window) {
+			hits = hits[1:]
+		}
+		threshold := max(r.Threshold, 1)
+		if len(hits) < threshold {
+			e.hits[key] = hits
+			continue
+		}
+		delete(e.hits, key)
+		fired = append(fired, Firing{
+			Rule:         r.Name,
+			SerialNumber: inc.SerialNumber,
+			RemoteAddr:   inc.RemoteAddr,
+			Incident:     inc.Description,
+			Count:        len(hits),
+			Actions:      r.Actions,
+			Timestamp:    inc.Timestamp,
+		})
+	}
+	return fired
+}
+
+// sweep removes the counts whose last incident is out of the window of the rule.
+func (e *Engine) sweep(now time.Time) {
+	for k, hits := range e.hits {
+		if now.Sub(hits[len(hits)-1]) > time.Duration(e.rules[k.rule].Window) {
+			delete(e.hits, k)
+		}
+	}
+	e.swept = now
+}
+
+// DryRun evaluates the rules against the incidents in time order, and returns the rules they would fire.
+func DryRun(rules []Rule, incidents []Incident) []Firing {
+	e := NewEngine(rules)
+	var fired []Firing
+	for _, inc := range incidents {
+		fired = append(fired, e.Evaluate(inc)...)
+	}
+	return fired
+}
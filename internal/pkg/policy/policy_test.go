@@ -0,0 +1,72 @@
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEngine_Evaluate(t *testing.T) {
+	var rules []Rule
+	data := `[
+		{"name": "brute-force", "incident": "invalid signature", "threshold": 3, "window": "10m", "actions": ["block"]},
+		{"name": "replay", "incident": "missing or invalid authorization header", "detail": "token already used", "actions": ["block", "alert"]}
+	]`
+	if err := json.Unmarshal([]byte(data), &rules); err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	if err := Validate(rules); err != nil {
+		t.Fatalf("Unexpected invalid rules: %v", err)
+	}
+	now := time.Now()
+	var incidents []Incident
+	for _, d := range []time.Duration{0, time.Minute, 20 * time.Minute, 21 * time.Minute, 22 * time.Minute} {
+		incidents = append(incidents, Incident{SerialNumber: "0000000001", Description: "invalid signature", Timestamp: now.Add(d)})
+	}
+	incidents = append(incidents,
+		Incident{SerialNumber: "0000000002", Description: "missing or invalid authorization header", Detail: "token expired", Timestamp: now},
+		Incident{SerialNumber: "0000000002", Description: "missing or invalid authorization header", Detail: "token already used", Timestamp: now},
+		Incident{SerialNumber: "", Description: "missing or invalid authorization header", Detail: "token already used", Timestamp: now},
+	)
+	fired := DryRun(rules, incidents)
+	if len(fired) != 2 {
+		t.Fatalf("Expected 2 firings, got %+v", fired)
+	}
+	// the first two incidents are out of the window of the last three
+	if fired[0].Rule != "brute-force" || fired[0].Count != 3 || !fired[0].Timestamp.Equal(now.Add(22*time.Minute)) {
+		t.Fatalf("Unexpected firing: %+v", fired[0])
+	}
+	if fired[1].Rule != "replay" || fired[1].SerialNumber != "0000000002" || len(fired[1].Actions) != 2 {
+		t.Fatalf("Unexpected firing: %+v", fired[1])
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, rules := range [][]Rule{
+		{{Name: "a", Incident: "x", Threshold: 5, Actions: []string{ActionBlock}}},
+		{{Name: "a", Incident: "x", Actions: []string{"shutdown"}}},
+		{{Name: "a", Incident: "x", Actions: []string{ActionAlert}}, {Name: "a", Incident: "y", Actions: []string{ActionAlert}}},
+	} {
+		if err := Validate(rules); !errors.Is(err, ErrInvalidRule) {
+			t.Fatalf("Expected ErrInvalidRule for %+v, got %v", rules, err)
+		}
+	}
+}
+
+func TestEngine_Sweep(t *testing.T) {
+	e := NewEngine([]Rule{{Name: "brute-force", Incident: "invalid signature", Threshold: 3, Window: Duration(10 * time.Minute), Actions: []string{ActionBlock}}})
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		e.Evaluate(Incident{SerialNumber: fmt.Sprintf("%010d", i), Description: "invalid signature", Timestamp: now})
+	}
+	if len(e.hits) != 100 {
+		t.Fatalf("Expected 100 counts, got %d", len(e.hits))
+	}
+	// the counts below the threshold are removed once they are out of the window
+	e.Evaluate(Incident{SerialNumber: "0000000001", Description: "invalid signature", Timestamp: now.Add(11 * time.Minute)})
+	if len(e.hits) != 1 {
+		t.Fatalf("Expected 1 count after the sweep, got %d", len(e.hits))
+	}
+}
@@ -0,0 +1,214 @@
+package token
+
+// Package token issues and verifies the access tokens of devices.
+// A token is a JWT signed with HMAC-SHA256 (HS256), which carries the serial number of the device,
+// what the token may be used for and until when. Tokens are one-time: the ID of a used token is
+// kept in a replay cache until the token expires. Download tickets are the exception, they are used
+// by every request of a resumable download until they expire.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+)
+
+const (
+	PurposeRegister = "register" // register the device public key
+	PurposeFirmware = "firmware" // download a firmware image
+	PurposeCheckIn  = "check-in" // report the device state and get the target version
+	PurposeDownload = "download" // ticket of a resumable firmware download, not one-time
+)
+
+var (
+	ErrInvalidToken  = errors.New("invalid token")
+	ErrExpiredToken  = errors.New("token expired")
+	ErrReplayedToken = errors.New("token already used")
+	ErrScope         = errors.New("token is not valid for this request")
+)
+
+// header of all tokens: {"alg":"HS256","typ":"JWT"}
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Claims of a device access token
+type Claims struct {
+	Serial    string `json:"sn"`
+	Purpose   string `json:"purpose"`
+	Version   string `json:"ver,omitempty"`  // firmware version the token is limited to, empty for any version
+	Pool      string `json:"pool,omitempty"` // allowance pool a register token draws from, resolved when it's issued
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+// ValidPurpose checks if the purpose is known.
+func ValidPurpose(purpose string) bool {
+	return purpose == PurposeRegister || purpose == PurposeFirmware || purpose == PurposeCheckIn || purpose == PurposeDownload
+}
+
+// RequestablePurpose checks if a device may request a token of the purpose. A download ticket is only issued by the
+// firmware update, once the version is checked for the device.
+func RequestablePurpose(purpose string) bool {
+	return purpose == PurposeRegister || purpose == PurposeFirmware || purpose == PurposeCheckIn
+}
+
+// Manager issues tokens and verifies them.
+type Manager struct {
+	mu     sync.Mutex
+	key    []byte
+	ttl    time.Duration
+	issued map[string]int64 // ID of one-time tokens issued but not used yet, and their expiry
+	used   map[string]int64 // ID of used tokens and their expiry
+}
+
+func NewManager(key []byte, ttl time.Duration) *Manager {
+	return &Manager{
+		key:    key,
+		ttl:    ttl,
+		issued: make(map[string]int64),
+		used:   make(map[string]int64),
+	}
+}
+
+// Issue returns a new token of the device for the purpose and version scope.
+func (m *Manager) Issue(serialNumber, purpose, version string) (string, error) {
+	return m.IssueFor(serialNumber, purpose, version, m.ttl)
+}
+
+// IssueFor returns a new token which expires after the ttl instead of the lifetime of the manager.
+func (m *Manager) IssueFor(serialNumber, purpose, version string, ttl time.Duration) (string, error) {
+	return m.issue(Claims{Serial: serialNumber, Purpose: purpose, Version: version}, ttl)
+}
+
+// IssueRegister returns a new register token of the device, which may only draw from the allowance pool.
+func (m *Manager) IssueRegister(serialNumber, pool string) (string, error) {
+	if pool == "" {
+		return "", fmt.Errorf("invalid token request: serial '%s', no pool", serialNumber)
+	}
+	return m.issue(Claims{Serial: serialNumber, Purpose: PurposeRegister, Pool: pool}, m.ttl)
+}
+
+func (m *Manager) issue(claims Claims, ttl time.Duration) (string, error) {
+	if claims.Serial == "" || !ValidPurpose(claims.Purpose) {
+		return "", fmt.Errorf("invalid token request: serial '%s', purpose '%s'", claims.Serial, claims.Purpose)
+	}
+	jti, err := common.GenerateRandomStringBase64(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims.IssuedAt, claims.ExpiresAt, claims.ID = now.Unix(), now.Add(ttl).Unix(), jti
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	if claims.Purpose != PurposeDownload {
+		m.mu.Lock()
+		m.issued[jti] = claims.ExpiresAt
+		m.mu.Unlock()
+	}
+	return signed + "." + m.sign(signed), nil
+}
+
+func (m *Manager) sign(signed string) string {
+	h := hmac.New(sha256.New, m.key)
+	h.Write([]byte(signed))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Parse verifies the signature and the expiry of the token, and returns its claims.
+func (m *Manager) Parse(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != header {
+		return nil, ErrInvalidToken
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(m.sign(parts[0]+"."+parts[1]))) {
+		return nil, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.ID == "" {
+		return nil, ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return &claims, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// Consume verifies the token is valid for the purpose and version, and marks it as used.
+// The claims are returned on error too if the token is authentic, so the caller can log the serial number.
+func (m *Manager) Consume(token, purpose, version string) (*Claims, error) {
+	claims, err := m.Parse(token)
+	if err != nil {
+		return claims, err
+	}
+	if claims.Purpose != purpose || (claims.Version != "" && claims.Version != version) {
+		return claims, ErrScope
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.used[claims.ID]; ok {
+		return claims, ErrReplayedToken
+	}
+	delete(m.issued, claims.ID)
+	m.used[claims.ID] = claims.ExpiresAt
+	return claims, nil
+}
+
+// Verify verifies the download ticket is valid for the version, without marking it as used.
+func (m *Manager) Verify(token, purpose, version string) (*Claims, error) {
+	if purpose != PurposeDownload {
+		return nil, fmt.Errorf("%w: '%s' tokens are one-time", ErrScope, purpose)
+	}
+	claims, err := m.Parse(token)
+	if err != nil {
+		return claims, err
+	}
+	if claims.Purpose != purpose || claims.Version != version {
+		return claims, ErrScope
+	}
+	return claims, nil
+}
+
+// Sweep removes the expired tokens, used or not, and returns the number of removed tokens.
+// An expired token is rejected by its expiry, so it doesn't need to be remembered any more.
+func (m *Manager) Sweep(now time.Time) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, ids := range []map[string]int64{m.issued, m.used} {
+		for id, exp := range ids {
+			if now.Unix() >= exp {
+				delete(ids, id)
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Live returns the number of one-time tokens issued and not used yet, which may not have been swept after expiry.
+func (m *Manager) Live() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.issued)
+}
+
+// Used returns the number of tokens in the replay cache.
+func (m *Manager) Used() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.used)
+}
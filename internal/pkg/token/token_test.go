@@ -0,0 +1,102 @@
+package token
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManager_Consume(t *testing.T) {
+	m := NewManager([]byte("0123456789abcdef0123456789abcdef"), time.Minute)
+	// serial numbers are not limited to 10 characters
+	tk, err := m.Issue("SN-42", PurposeFirmware, "1.0.1")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	if _, err := m.Consume(tk, PurposeRegister, ""); err != ErrScope {
+		t.Errorf("Expected purpose mismatch, got %v", err)
+	}
+	if _, err := m.Consume(tk, PurposeFirmware, "1.0.2"); err != ErrScope {
+		t.Errorf("Expected version mismatch, got %v", err)
+	}
+	if m.Live() != 1 {
+		t.Errorf("Expected 1 live token, got %d", m.Live())
+	}
+	claims, err := m.Consume(tk, PurposeFirmware, "1.0.1")
+	if err != nil || claims.Serial != "SN-42" {
+		t.Fatalf("Failed to consume token: %v", err)
+	}
+	if m.Live() != 0 || m.Used() != 1 {
+		t.Errorf("Expected the used token not to be live, got %d live and %d used", m.Live(), m.Used())
+	}
+	if _, err := m.Consume(tk, PurposeFirmware, "1.0.1"); err != ErrReplayedToken {
+		t.Errorf("Expected replayed token to be rejected, got %v", err)
+	}
+
+	parts := strings.Split(tk, ".")
+	other, _ := m.Issue("SN-43", PurposeFirmware, "1.0.1")
+	forged := parts[0] + "." + strings.Split(other, ".")[1] + "." + parts[2]
+	if _, err := m.Consume(forged, PurposeFirmware, "1.0.1"); err != ErrInvalidToken {
+		t.Errorf("Expected forged token to be rejected, got %v", err)
+	}
+	if _, err := NewManager([]byte("another key"), time.Minute).Parse(tk); err != ErrInvalidToken {
+		t.Errorf("Expected token of another key to be rejected, got %v", err)
+	}
+}
+
+func TestManager_Verify(t *testing.T) {
+	m := NewManager([]byte("0123456789abcdef0123456789abcdef"), time.Minute)
+	ticket, err := m.IssueFor("0000000001", PurposeDownload, "1.0.1", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to issue ticket: %v", err)
+	}
+	// a ticket is used by every request of the download
+	for i := 0; i < 3; i++ {
+		if claims, err := m.Verify(ticket, PurposeDownload, "1.0.1"); err != nil || claims.Serial != "0000000001" {
+			t.Fatalf("Failed to verify ticket: %v", err)
+		}
+	}
+	if claims, _ := m.Parse(ticket); claims.ExpiresAt-claims.IssuedAt != int64(time.Hour.Seconds()) {
+		t.Errorf("Unexpected lifetime of ticket: %+v", claims)
+	}
+	if _, err := m.Verify(ticket, PurposeDownload, "1.0.2"); err != ErrScope {
+		t.Errorf("Expected version mismatch, got %v", err)
+	}
+	// a one-time token can't be verified without being used
+	tk, _ := m.Issue("0000000001", PurposeFirmware, "1.0.1")
+	if _, err := m.Verify(tk, PurposeFirmware, "1.0.1"); !errors.Is(err, ErrScope) {
+		t.Errorf("Expected one-time token to be rejected, got %v", err)
+	}
+	if _, err := m.Verify(tk, PurposeDownload, "1.0.1"); err != ErrScope {
+		t.Errorf("Expected purpose mismatch, got %v", err)
+	}
+}
+
+func TestManager_Expiry(t *testing.T) {
+	m := NewManager([]byte("key"), -time.Second)
+	tk, _ := m.Issue("0000000001", PurposeRegister, "")
+	if _, err := m.Consume(tk, PurposeRegister, ""); err != ErrExpiredToken {
+		t.Errorf("Expected expired token to be rejected, got %v", err)
+	}
+	m.used["jti"] = time.Now().Unix() - 1
+	// the expired token which wasn't used, and the used one
+	if n := m.Sweep(time.Now()); n != 2 || m.Used() != 0 || m.Live() != 0 {
+		t.Errorf("Expected expired tokens to be swept, got %d", n)
+	}
+}
+
+func TestManager_IssueRegister(t *testing.T) {
+	m := NewManager([]byte("0123456789abcdef0123456789abcdef"), time.Minute)
+	if _, err := m.IssueRegister("SN-42", ""); err == nil {
+		t.Fatal("Expected a register token without pool to be refused")
+	}
+	tk, err := m.IssueRegister("SN-42", "pro")
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+	claims, err := m.Consume(tk, PurposeRegister, "")
+	if err != nil || claims.Serial != "SN-42" || claims.Pool != "pro" {
+		t.Fatalf("Unexpected claims %+v: %v", claims, err)
+	}
+}
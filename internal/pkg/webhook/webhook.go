@@ -0,0 +1,356 @@
+package webhook
+
+// Package webhook delivers notifications of the server to HTTP targets, e.g. a SOC or a chat bot.
+// An event is POSTed as JSON with an HMAC-SHA256 signature of the timestamp and the body by the
+// secret of the target, and retried with exponential backoff. An event which can't be delivered is
+// appended to the dead-letter file, a line of JSON for each, until the file reaches its size limit.
+// A target without events gets the high-severity events only. The targets are JSON:
+//
+//	{
+//		"targets": [
+//			{"name": "soc", "url": "https://soc.example.com/fss", "secret": "...", "events": ["device.blocked", "rule.fired"]}
+//		],
+//		"allowance_threshold": 10,
+//		"retries": 5,
+//		"backoff": "2s",
+//		"timeout": "10s",
+//		"dead_letter": "./webhook_dead_letter.ndjson",
+//		"dead_letter_limit": 16777216
+//	}
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	"github.com/yuanyuanxiang/fss/internal/pkg/policy"
+)
+
+const (
+	EventDeviceBlocked = "device.blocked" // a device is blocked by an operator, a rule or the clone policy
+	EventRuleFired     = "rule.fired"     // an incident rule fired
+	EventAllowanceLow  = "allowance.low"  // an allowance pool dropped below the threshold
+	EventIncident      = "incident"       // a security incident is logged
+	EventTest          = "test"           // sent by server --test-webhook
+
+	HeaderEvent     = "X-FSS-Event"
+	HeaderDelivery  = "X-FSS-Delivery"
+	HeaderTimestamp = "X-FSS-Timestamp"
+	HeaderSignature = "X-FSS-Signature"
+
+	defaultRetries    = 5
+	defaultBackoff    = 2 * time.Second
+	defaultTimeout    = 10 * time.Second
+	defaultDeadLetter = "./webhook_dead_letter.ndjson"
+	defaultDeadLimit  = 16 << 20 // bytes
+	queueSize         = 1024
+
+	AllEvents = "*" // subscribes a target to every event
+)
+
+// DefaultEvents are the events of a target without events, the incidents are only sent on subscription.
+var DefaultEvents = []string{EventDeviceBlocked, EventRuleFired, EventAllowanceLow}
+
+var (
+	ErrInvalidConfig = errors.New("invalid webhook config")
+)
+
+// Target receives the events it subscribes to, DefaultEvents if Events is empty.
+type Target struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events,omitempty"`
+}
+
+func (t Target) subscribes(typ string) bool {
+	if typ == EventTest {
+		return true
+	}
+	events := t.Events
+	if len(events) == 0 {
+		events = DefaultEvents
+	}
+	for _, e := range events {
+		if e == typ || e == AllEvents {
+			return true
+		}
+	}
+	return false
+}
+
+type Config struct {
+	Targets            []Target        `json:"targets"`
+	AllowanceThreshold int             `json:"allowance_threshold,omitempty"` // 0 to disable allowance.low
+	Retries            int             `json:"retries,omitempty"`             // retries after the first attempt
+	Backoff            policy.Duration `json:"backoff,omitempty"`             // before the first retry, doubled for each retry
+	Timeout            policy.Duration `json:"timeout,omitempty"`             // of an attempt
+	DeadLetter         string          `json:"dead_letter,omitempty"`
+	DeadLetterLimit    int64           `json:"dead_letter_limit,omitempty"` // size of the dead-letter file in bytes
+}
+
+// LoadConfig loads the config of the webhooks, there are no targets if the file doesn't exist.
+func LoadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	} else if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse webhook config: %w", err)
+	}
+	names := make(map[string]bool)
+	for _, t := range cfg.Targets {
+		if t.Name == "" || names[t.Name] {
+			return cfg, fmt.Errorf("%w: missing or duplicate target name '%s'", ErrInvalidConfig, t.Name)
+		}
+		names[t.Name] = true
+		if u, err := url.Parse(t.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("%w: invalid url of target '%s'", ErrInvalidConfig, t.Name)
+		}
+		if t.Secret == "" {
+			return cfg, fmt.Errorf("%w: missing secret of target '%s'", ErrInvalidConfig, t.Name)
+		}
+	}
+	return cfg, nil
+}
+
+// Event is the payload of a notification.
+type Event struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	Timestamp string                 `json:"timestamp"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// NewEvent returns an event with a random ID.
+func NewEvent(typ string, data map[string]interface{}) Event {
+	id, _ := common.GenerateRandomStringHex(16)
+	return Event{ID: id, Type: typ, Timestamp: time.Now().Format(time.RFC3339), Data: data}
+}
+
+// Sign returns the signature header of the body sent at the timestamp.
+func Sign(secret, timestamp string, body []byte) string {
+	return "sha256=" + common.SignSignature(timestamp+"."+string(body), secret)
+}
+
+// Verify verifies the signature header of a received body, for receivers.
+func Verify(secret, timestamp string, body []byte, signature string) bool {
+	return len(signature) > 7 && common.VerifySignature(timestamp+"."+string(body), secret, signature[7:])
+}
+
+type delivery struct {
+	target Target
+	event  Event
+}
+
+type Dispatcher struct {
+	cfg     Config
+	client  *http.Client
+	queue   chan delivery
+	mu      sync.Mutex // dead-letter file
+	wg      sync.WaitGroup
+	dropped atomic.Uint64 // events which are neither delivered nor dead-lettered
+}
+
+func NewDispatcher(cfg Config) *Dispatcher {
+	if cfg.Retries <= 0 {
+		cfg.Retries = defaultRetries
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = policy.Duration(defaultBackoff)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = policy.Duration(defaultTimeout)
+	}
+	if cfg.DeadLetter == "" {
+		cfg.DeadLetter = defaultDeadLetter
+	}
+	if cfg.DeadLetterLimit <= 0 {
+		cfg.DeadLetterLimit = defaultDeadLimit
+	}
+	return &Dispatcher{
+		cfg:    cfg,
+		client: &http.Client{Timeout: time.Duration(cfg.Timeout)},
+		queue:  make(chan delivery, queueSize),
+	}
+}
+
+// Targets returns the targets of the dispatcher.
+func (d *Dispatcher) Targets() []Target {
+	return d.cfg.Targets
+}
+
+// Start delivers the queued events with the workers until the context is done. An attempt in progress
+// is completed then, and the events still queued or waiting for a retry go to the dead-letter file.
+func (d *Dispatcher) Start(ctx context.Context, workers int) {
+	for i := 0; i < max(workers, 1); i++ {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					for {
+						select {
+						case job := <-d.queue:
+							d.deadLetter(job.target, job.event, 0, ctx.Err())
+						default:
+							return
+						}
+					}
+				case job := <-d.queue:
+					d.deliverWithRetries(ctx, job)
+				}
+			}
+		}()
+	}
+}
+
+// Dropped returns the number of events which are lost, because the dead-letter file is full or can't be written.
+func (d *Dispatcher) Dropped() uint64 {
+	return d.dropped.Load()
+}
+
+// Wait waits for the workers to stop after the context of Start is done.
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// Notify queues the event for the targets which subscribe to it. If the queue is full,
+// the event goes to the dead-letter file, so notifying never blocks.
+func (d *Dispatcher) Notify(ev Event) {
+	for _, t := range d.cfg.Targets {
+		if !t.subscribes(ev.Type) {
+			continue
+		}
+		select {
+		case d.queue <- delivery{target: t, event: ev}:
+		default:
+			d.deadLetter(t, ev, 0, errors.New("queue is full"))
+		}
+	}
+}
+
+// Test sends a test event to every target once, and returns the error of each target.
+func (d *Dispatcher) Test(ctx context.Context) map[string]error {
+	ev := NewEvent(EventTest, map[string]interface{}{"msg": "webhook test from fss server"})
+	out := make(map[string]error, len(d.cfg.Targets))
+	for _, t := range d.cfg.Targets {
+		out[t.Name] = d.Deliver(ctx, t, ev)
+	}
+	return out
+}
+
+// StatusError is the unexpected status of a target.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.Code, http.StatusText(e.Code))
+}
+
+// retryable returns whether the target may accept the event later. A 4xx status other than
+// 408 and 429 means the target rejects the event, so it's not retried.
+func retryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) && se.Code >= 400 && se.Code < 500 {
+		return se.Code == http.StatusRequestTimeout || se.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// Deliver sends the event to the target once, a 2xx status is success.
+func (d *Dispatcher) Deliver(ctx context.Context, t Target, ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, ev.Type)
+	req.Header.Set(HeaderDelivery, ev.ID)
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderSignature, Sign(t.Secret, ts, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &StatusError{Code: resp.StatusCode}
+	}
+	return nil
+}
+
+func (d *Dispatcher) deliverWithRetries(ctx context.Context, job delivery) {
+	backoff := time.Duration(d.cfg.Backoff)
+	var err error
+	attempts := 0
+	for attempts <= d.cfg.Retries {
+		attempts++
+		// the attempt is limited by the timeout of the client
+		if err = d.Deliver(context.Background(), job.target, job.event); err == nil || !retryable(err) {
+			break
+		}
+		if attempts <= d.cfg.Retries {
+			select {
+			case <-ctx.Done():
+				d.deadLetter(job.target, job.event, attempts, ctx.Err())
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+	if err != nil {
+		d.deadLetter(job.target, job.event, attempts, err)
+	}
+}
+
+// deadLetter appends the event which can't be delivered to the dead-letter file. The event is dropped
+// if the file would exceed its limit, so a target which is down for long doesn't fill the disk.
+func (d *Dispatcher) deadLetter(t Target, ev Event, attempts int, cause error) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"target":    t.Name,
+		"url":       t.URL,
+		"event":     ev,
+		"attempts":  attempts,
+		"error":     cause.Error(),
+		"timestamp": time.Now().Format(time.RFC3339),
+	})
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, err := os.OpenFile(d.cfg.DeadLetter, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		d.dropped.Add(1)
+		return
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil || fi.Size()+int64(len(data))+1 > d.cfg.DeadLetterLimit {
+		d.dropped.Add(1)
+		return
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		d.dropped.Add(1)
+	}
+}
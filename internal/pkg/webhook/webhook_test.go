@@ -0,0 +1,111 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yuanyuanxiang/fss/internal/pkg/policy"
+)
+
+func TestDispatcher_Notify(t *testing.T) {
+	var calls atomic.Int32
+	received := make(chan Event, 1)
+	// a receiver which is down for the first two attempts
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !Verify("secret", r.Header.Get(HeaderTimestamp), body, r.Header.Get(HeaderSignature)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev Event
+		_ = json.Unmarshal(body, &ev)
+		received <- ev
+	}))
+	defer flaky.Close()
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+
+	deadLetter := filepath.Join(t.TempDir(), "dead.ndjson")
+	d := NewDispatcher(Config{
+		Targets: []Target{
+			{Name: "soc", URL: flaky.URL, Secret: "secret", Events: []string{EventDeviceBlocked}},
+			{Name: "bot", URL: rejecting.URL, Secret: "secret"},
+			{Name: "audit", URL: flaky.URL, Secret: "secret", Events: []string{EventAllowanceLow}},
+		},
+		Retries:    3,
+		Backoff:    policy.Duration(time.Millisecond),
+		DeadLetter: deadLetter,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	d.Start(ctx, 2)
+	d.Notify(NewEvent(EventDeviceBlocked, map[string]interface{}{"serial_number": "0000000001"}))
+
+	select {
+	case ev := <-received:
+		if ev.Type != EventDeviceBlocked || ev.Data["serial_number"] != "0000000001" || calls.Load() != 3 {
+			t.Fatalf("Unexpected event %+v after %d calls", ev, calls.Load())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Event wasn't delivered")
+	}
+	cancel()
+	d.Wait()
+
+	// the rejected event isn't retried, and goes to the dead-letter file
+	data, err := os.ReadFile(deadLetter)
+	if err != nil || strings.Count(string(data), "\n") != 1 || !strings.Contains(string(data), `"target":"bot"`) ||
+		!strings.Contains(string(data), `"attempts":1`) {
+		t.Fatalf("Unexpected dead letters %s: %v", data, err)
+	}
+}
+
+func TestDispatcher_DeadLetterLimit(t *testing.T) {
+	deadLetter := filepath.Join(t.TempDir(), "dead.ndjson")
+	d := NewDispatcher(Config{
+		Targets:         []Target{{Name: "soc", URL: "https://soc.example.com/fss", Secret: "secret"}},
+		DeadLetter:      deadLetter,
+		DeadLetterLimit: 2048,
+	})
+	// a target without events isn't sent the incidents
+	d.Notify(NewEvent(EventIncident, map[string]interface{}{"serial_number": "0000000001"}))
+	if len(d.queue) != 0 {
+		t.Fatalf("Expected the incident to be filtered, got %d queued", len(d.queue))
+	}
+	// without workers, the events beyond the queue go to the dead-letter file until it's full
+	for i := 0; i < queueSize+100; i++ {
+		d.Notify(NewEvent(EventDeviceBlocked, map[string]interface{}{"serial_number": "0000000001"}))
+	}
+	data, err := os.ReadFile(deadLetter)
+	if err != nil || len(data) > 2048 {
+		t.Fatalf("Expected the dead-letter file within its limit, got %d bytes: %v", len(data), err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines == 0 || d.Dropped() != uint64(100-lines) {
+		t.Fatalf("Expected %d dropped events, got %d", 100-lines, d.Dropped())
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	if cfg, err := LoadConfig(path); err != nil || len(cfg.Targets) != 0 {
+		t.Fatalf("Missing config should have no targets: %v", err)
+	}
+	_ = os.WriteFile(path, []byte(`{"targets": [{"name": "soc", "url": "ftp://soc", "secret": "s"}]}`), 0644)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatalf("Expected an error for an invalid url")
+	}
+}
@@ -1,87 +1,476 @@
-package audit
-
-import (
-	"encoding/json"
-	"fmt"
-	"os"
-	"sync"
-	"time"
-)
-
-// Package audit_log provides a plugin for logging device registration and authentication events.
-
-type LogType string
-
-const (
-	LOG_MANAGER = "LogManager"
-
-	TYPE_NORMAL   LogType = "normal"
-	TYPE_UPDATE   LogType = "updates"
-	TYPE_INCIDENT LogType = "incidents"
-)
-
-type LogManager interface {
-	GetAuditLogs(typ string) ([]map[string]interface{}, error)
-	AddLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{})
-	AddUpdateLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{})
-	AddIncidentLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{})
-}
-
-type LogManagerImpl struct {
-	mu   sync.Mutex
-	Logs map[LogType][]map[string]interface{}
-	path string
-}
-
-func NewManager(path string) *LogManagerImpl {
-	v := &LogManagerImpl{
-		Logs: make(map[LogType][]map[string]interface{}),
-		path: path,
-	}
-	data, _ := os.ReadFile(path)
-	_ = json.Unmarshal(data, &v.Logs)
-	return v
-}
-
-func (l *LogManagerImpl) GetAuditLogs(typ string) ([]map[string]interface{}, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	if logs, ok := l.Logs[LogType(typ)]; ok {
-		return logs, nil
-	}
-	return nil, fmt.Errorf("no logs found for type: %s", typ)
-}
-
-func (l *LogManagerImpl) addLog(typ LogType, remoteAddr, serialNumber, desc string, code int, detail ...interface{}) {
-	log := map[string]interface{}{
-		"code":          code,
-		"remote_addr":   remoteAddr,
-		"serial_number": serialNumber,
-		"description":   desc,
-		"timestamp":     time.Now().Format(time.RFC3339),
-	}
-	if len(detail) > 0 {
-		log["detail"] = detail[0]
-	}
-	l.mu.Lock()
-	defer l.mu.Unlock()
-	if _, ok := l.Logs[typ]; !ok {
-		l.Logs[typ] = make([]map[string]interface{}, 0)
-	}
-	l.Logs[typ] = append(l.Logs[typ], log)
-	// use database instead
-	data, _ := json.MarshalIndent(l.Logs, "", "  ")
-	_ = os.WriteFile(l.path, data, 0644)
-}
-
-func (l *LogManagerImpl) AddLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{}) {
-	l.addLog(TYPE_NORMAL, remoteAddr, serialNumber, desc, code, detail...)
-}
-
-func (l *LogManagerImpl) AddUpdateLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{}) {
-	l.addLog(TYPE_UPDATE, remoteAddr, serialNumber, desc, code, detail...)
-}
-
-func (l *LogManagerImpl) AddIncidentLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{}) {
-	l.addLog(TYPE_INCIDENT, remoteAddr, serialNumber, desc, code, detail...)
-}
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Package audit_log provides a plugin for logging device registration and authentication events.
+//
+// The logs are tamper-evident: every entry has a sequence number across all types, the hash of the previous
+// entry and its own hash, so an edited, inserted or removed entry breaks the chain. With a checkpoint key,
+// the hash of every n-th entry is signed, so the chain can't be rebuilt without the key either. The entries
+// removed by the retention are replaced by a signed tombstone of their range and the hash of the last one,
+// which anchors the chain of the rest.
+
+type LogType string
+
+const (
+	LOG_MANAGER = "LogManager"
+
+	TYPE_NORMAL     LogType = "normal"
+	TYPE_UPDATE     LogType = "updates"
+	TYPE_INCIDENT   LogType = "incidents"
+	TYPE_ACTION     LogType = "actions"     // automatic actions taken on incidents
+	TYPE_CHECKPOINT LogType = "checkpoints" // signed checkpoints of the chain, not chained themselves
+	TYPE_TOMBSTONE  LogType = "tombstones"  // signed records of the entries removed by the retention, not chained
+
+	defaultWindow = 10000
+)
+
+type LogManager interface {
+	// GetAuditLogs returns the recent entries of the type which are held in memory.
+	GetAuditLogs(typ string) ([]map[string]interface{}, error)
+	// QueryLogs returns the page of the entries of the type which match the query, read from the segments.
+	QueryLogs(typ string, q Query) (*Page, error)
+	AddLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{})
+	AddUpdateLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{})
+	AddIncidentLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{})
+	AddActionLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{})
+	// Subscribe returns a channel of the new entries, and a function to cancel the subscription.
+	// Entries are dropped when the channel is full, so a slow subscriber never delays logging.
+	Subscribe(buffer int) (<-chan Event, func())
+}
+
+// Event is a new entry of the logs.
+type Event struct {
+	Type  LogType
+	Entry map[string]interface{}
+}
+
+type LogManagerImpl struct {
+	mu     sync.Mutex
+	Logs   map[LogType][]map[string]interface{} // recent entries of each type, all of them are in the segments
+	window int                                  // entries of each type held in memory
+	w      *segmentWriter
+	legacy string                 // JSON file of the logs written before the segments, imported on start
+	seq    int64                  // sequence number of the last entry
+	last   string                 // hash of the last entry
+	key    ed25519.PrivateKey     // signs the checkpoints, nil if there are none
+	every  int64                  // entries between checkpoints
+	anchor map[string]interface{} // the last tombstone, nil if no entries were removed
+	subs   map[int]chan Event
+	nextID int
+}
+
+type Option func(*LogManagerImpl)
+
+// WithCheckpoints signs a checkpoint of the chain every n entries.
+func WithCheckpoints(key ed25519.PrivateKey, every int) Option {
+	return func(l *LogManagerImpl) {
+		l.key, l.every = key, int64(max(every, 1))
+	}
+}
+
+// WithWindow holds the last n entries of each type in memory, the queries read the segments.
+func WithWindow(n int) Option {
+	return func(l *LogManagerImpl) {
+		l.window = max(n, 1)
+	}
+}
+
+// WithRotation rotates the segment when it reaches the size in bytes or the age.
+func WithRotation(maxSize int64, maxAge time.Duration) Option {
+	return func(l *LogManagerImpl) {
+		if maxSize > 0 {
+			l.w.maxSize = maxSize
+		}
+		if maxAge > 0 {
+			l.w.maxAge = maxAge
+		}
+	}
+}
+
+// WithRetention removes the compressed segments older than the retention, when a new segment is opened.
+func WithRetention(retention time.Duration) Option {
+	return func(l *LogManagerImpl) {
+		l.w.retention = retention
+	}
+}
+
+// WithLegacyFile imports the JSON file of the logs written before the segments, e.g. "svr_log.json".
+// It's renamed to "<file>.imported" after it's imported.
+func WithLegacyFile(path string) Option {
+	return func(l *LogManagerImpl) {
+		l.legacy = path
+	}
+}
+
+// NewManager loads the logs from the segments in the directory, and appends new entries to a new segment.
+func NewManager(dir string, opts ...Option) *LogManagerImpl {
+	v := &LogManagerImpl{
+		Logs:   make(map[LogType][]map[string]interface{}),
+		window: defaultWindow,
+		w:      &segmentWriter{dir: dir, maxSize: defaultMaxSize, maxAge: defaultMaxAge},
+	}
+	for _, f := range opts {
+		f(v)
+	}
+	_ = os.MkdirAll(dir, 0755)
+	files := segments(dir)
+	_ = scanSegments(files, func(typ LogType, e map[string]interface{}) bool {
+		switch typ {
+		case TYPE_TOMBSTONE:
+			if v.anchor == nil || toInt64(e["last"]) > toInt64(v.anchor["last"]) {
+				v.anchor = e
+			}
+		case TYPE_CHECKPOINT:
+		default:
+			if seq := toInt64(e["seq"]); seq > v.seq {
+				v.seq, v.last = seq, fmt.Sprint(e["hash"])
+			}
+		}
+		v.keep(typ, e)
+		return true
+	})
+	// the segments of the last run are closed, compress them
+	for _, f := range files {
+		if strings.HasSuffix(f, segmentExt) {
+			v.w.wg.Add(1)
+			go func(path string) {
+				defer v.w.wg.Done()
+				_ = compressSegment(path)
+			}(f)
+		}
+	}
+	// the legacy file is only imported into empty logs, or its entries would be chained twice
+	if v.legacy != "" && len(files) == 0 {
+		v.importLegacy()
+	}
+	return v
+}
+
+// importLegacy appends the entries of the legacy file to the chain in their order. Entries written before
+// the logs were chained are chained after them, in the order of their timestamps.
+func (l *LogManagerImpl) importLegacy() {
+	data, err := os.ReadFile(l.legacy)
+	if err != nil {
+		return
+	}
+	var legacy map[LogType][]map[string]interface{}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return
+	}
+	type typedEntry struct {
+		typ LogType
+		e   map[string]interface{}
+	}
+	var sealed, unsealed []typedEntry
+	for typ, logs := range legacy {
+		for _, e := range logs {
+			if typ == TYPE_CHECKPOINT {
+				l.keep(typ, e)
+				_ = l.w.write(segmentLine(typ, e), l.seq+1)
+			} else if _, ok := e["hash"]; ok {
+				sealed = append(sealed, typedEntry{typ, e})
+			} else {
+				unsealed = append(unsealed, typedEntry{typ, e})
+			}
+		}
+	}
+	sort.SliceStable(sealed, func(i, j int) bool {
+		return toInt64(sealed[i].e["seq"]) < toInt64(sealed[j].e["seq"])
+	})
+	sort.SliceStable(unsealed, func(i, j int) bool {
+		return fmt.Sprint(unsealed[i].e["timestamp"]) < fmt.Sprint(unsealed[j].e["timestamp"])
+	})
+	for _, te := range sealed {
+		l.w.rotateIfDue()
+		l.seq, l.last = toInt64(te.e["seq"]), fmt.Sprint(te.e["hash"])
+		l.keep(te.typ, te.e)
+		_ = l.w.write(segmentLine(te.typ, te.e), l.seq)
+	}
+	for _, te := range unsealed {
+		l.append(te.typ, te.e)
+	}
+	_ = os.Rename(l.legacy, l.legacy+".imported")
+}
+
+// append links the entry to the last one and writes it, and signs a checkpoint if it's due.
+func (l *LogManagerImpl) append(typ LogType, e map[string]interface{}) {
+	l.w.rotateIfDue() // a checkpoint is in the segment of its entry
+	if l.w.f == nil {
+		l.applyRetention() // the tombstone is in the new segment, before its first entry
+	}
+	l.seq++
+	e["seq"] = l.seq
+	e["prev_hash"] = l.last
+	l.last = EntryHash(e)
+	e["hash"] = l.last
+	l.keep(typ, e)
+	_ = l.w.write(segmentLine(typ, e), l.seq)
+	for _, ch := range l.subs {
+		select {
+		case ch <- Event{Type: typ, Entry: e}:
+		default:
+		}
+	}
+	if l.key != nil && l.seq%l.every == 0 {
+		cp := map[string]interface{}{
+			"seq":       l.seq,
+			"hash":      l.last,
+			"timestamp": time.Now().Format(time.RFC3339),
+			"signature": base64.StdEncoding.EncodeToString(ed25519.Sign(l.key, checkpointMessage(l.seq, l.last))),
+		}
+		l.keep(TYPE_CHECKPOINT, cp)
+		_ = l.w.write(segmentLine(TYPE_CHECKPOINT, cp), l.seq)
+	}
+}
+
+// keep holds the entry in memory, and drops the oldest entries of its type beyond the window.
+func (l *LogManagerImpl) keep(typ LogType, e map[string]interface{}) {
+	logs := append(l.Logs[typ], e)
+	// trimmed once in a window, so an entry isn't copied on every append
+	if len(logs) >= 2*l.window {
+		logs = append([]map[string]interface{}(nil), logs[len(logs)-l.window:]...)
+	}
+	l.Logs[typ] = logs
+}
+
+// applyRetention removes the segments older than the retention. A tombstone of the removed entries is written
+// before they are removed: the range of their sequence numbers and the hash of the last one, signed with the
+// checkpoint key. It anchors the chain of the rest, whose first entry links to the hash of the tombstone.
+func (l *LogManagerImpl) applyRetention() {
+	files := l.w.expired()
+	if len(files) == 0 {
+		return
+	}
+	first, last, hash := int64(1), int64(0), ""
+	if l.anchor != nil {
+		first, last, hash = toInt64(l.anchor["first"]), toInt64(l.anchor["last"]), fmt.Sprint(l.anchor["hash"])
+	} else {
+		_, _ = fmt.Sscanf(filepath.Base(files[0]), segmentPrefix+"%d", &first)
+	}
+	err := readSegment(files[len(files)-1], func(typ LogType, e map[string]interface{}) bool {
+		if seq := toInt64(e["seq"]); typ != TYPE_CHECKPOINT && typ != TYPE_TOMBSTONE && seq > last {
+			last, hash = seq, fmt.Sprint(e["hash"])
+		}
+		return true
+	})
+	// the segments are kept if the tombstone can't be written
+	if err != nil || last == 0 {
+		return
+	}
+	ts := map[string]interface{}{
+		"first":     first,
+		"last":      last,
+		"hash":      hash,
+		"timestamp": time.Now().Format(time.RFC3339),
+	}
+	if l.key != nil {
+		ts["signature"] = base64.StdEncoding.EncodeToString(ed25519.Sign(l.key, tombstoneMessage(first, last, hash)))
+	}
+	if err := l.w.write(segmentLine(TYPE_TOMBSTONE, ts), l.seq+1); err != nil {
+		return
+	}
+	// the tombstone is read back as JSON
+	if data, err := json.Marshal(ts); err == nil {
+		_ = json.Unmarshal(data, &ts)
+	}
+	l.anchor = ts
+	l.keep(TYPE_TOMBSTONE, ts)
+	for _, file := range files {
+		_ = os.Remove(file)
+	}
+}
+
+// Close closes the current segment, and waits for the segments being compressed.
+func (l *LogManagerImpl) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.close()
+}
+
+func (l *LogManagerImpl) Subscribe(buffer int) (<-chan Event, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.subs == nil {
+		l.subs = make(map[int]chan Event)
+	}
+	id, ch := l.nextID, make(chan Event, max(buffer, 1))
+	l.nextID++
+	l.subs[id] = ch
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			delete(l.subs, id)
+			close(ch)
+		})
+	}
+}
+
+func (l *LogManagerImpl) GetAuditLogs(typ string) ([]map[string]interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if logs, ok := l.Logs[LogType(typ)]; ok {
+		return logs[max(len(logs)-l.window, 0):], nil
+	}
+	return nil, fmt.Errorf("no logs found for type: %s", typ)
+}
+
+// QueryLogs reads the segments, so the entries beyond the window are found too. The segments are named by their
+// first sequence number, so only the segments after the cursor are read, and only until the entry after the page.
+// The entries of all pages are counted if the query asks for it, which reads every segment.
+func (l *LogManagerImpl) QueryLogs(typ string, q Query) (*Page, error) {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+	match := func(t LogType, e map[string]interface{}) bool {
+		return t == LogType(typ) && q.Match(e)
+	}
+	files := segments(l.w.dir)
+	var matched []map[string]interface{} // the page and the entry after it
+	if q.Desc {
+		// the newest segments first, the entries of a segment are read in ascending order
+		for i := len(files) - 1; i >= 0 && len(matched) <= limit; i-- {
+			if seq, ok := segmentSeq(files[i]); ok && q.Cursor > 0 && seq >= q.Cursor {
+				continue
+			}
+			var found []map[string]interface{}
+			err := scanSegments(files[i:i+1], func(t LogType, e map[string]interface{}) bool {
+				if match(t, e) && (q.Cursor <= 0 || toInt64(e["seq"]) < q.Cursor) {
+					found = append(found, e)
+					if len(found) > limit+1 {
+						found = found[1:]
+					}
+				}
+				return true
+			})
+			if err != nil {
+				return nil, err
+			}
+			slices.Reverse(found)
+			matched = append(matched, found...)
+		}
+	} else {
+		// a segment ends before the first entry of the next one
+		start := 0
+		for ; start+1 < len(files); start++ {
+			if seq, ok := segmentSeq(files[start+1]); !ok || seq > q.Cursor+1 {
+				break
+			}
+		}
+		err := scanSegments(files[start:], func(t LogType, e map[string]interface{}) bool {
+			if match(t, e) && toInt64(e["seq"]) > q.Cursor {
+				matched = append(matched, e)
+			}
+			return len(matched) <= limit
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	page := &Page{Logs: []map[string]interface{}{}}
+	if len(matched) > limit {
+		matched = matched[:limit]
+		page.Next = toInt64(matched[limit-1]["seq"])
+	}
+	page.Logs = append(page.Logs, matched...)
+	if q.Count {
+		err := scanSegments(files, func(t LogType, e map[string]interface{}) bool {
+			if match(t, e) {
+				page.Total++
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+func (l *LogManagerImpl) addLog(typ LogType, remoteAddr, serialNumber, desc string, code int, detail ...interface{}) {
+	log := map[string]interface{}{
+		"code":          code,
+		"remote_addr":   remoteAddr,
+		"serial_number": serialNumber,
+		"description":   desc,
+		"timestamp":     time.Now().Format(time.RFC3339),
+	}
+	if len(detail) > 0 {
+		log["detail"] = detail[0]
+	}
+	// keep the entry as it is read from the file, so its hash is the same after loading
+	if data, err := json.Marshal(log); err == nil {
+		_ = json.Unmarshal(data, &log)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.append(typ, log)
+}
+
+func (l *LogManagerImpl) AddLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{}) {
+	l.addLog(TYPE_NORMAL, remoteAddr, serialNumber, desc, code, detail...)
+}
+
+func (l *LogManagerImpl) AddUpdateLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{}) {
+	l.addLog(TYPE_UPDATE, remoteAddr, serialNumber, desc, code, detail...)
+}
+
+func (l *LogManagerImpl) AddIncidentLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{}) {
+	l.addLog(TYPE_INCIDENT, remoteAddr, serialNumber, desc, code, detail...)
+}
+
+func (l *LogManagerImpl) AddActionLog(remoteAddr, serialNumber, desc string, code int, detail ...interface{}) {
+	l.addLog(TYPE_ACTION, remoteAddr, serialNumber, desc, code, detail...)
+}
+
+// EntryHash returns the hex SHA-256 of the JSON encoding of the entry without its hash.
+// The keys of the JSON object are sorted, so the encoding doesn't depend on the order of the fields.
+func EntryHash(e map[string]interface{}) string {
+	m := make(map[string]interface{}, len(e))
+	for k, v := range e {
+		if k != "hash" {
+			m[k] = v
+		}
+	}
+	data, _ := json.Marshal(m)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func checkpointMessage(seq int64, hash string) []byte {
+	return []byte(fmt.Sprintf("fss-audit-checkpoint:%d:%s", seq, hash))
+}
+
+func tombstoneMessage(first, last int64, hash string) []byte {
+	return []byte(fmt.Sprintf("fss-audit-tombstone:%d:%d:%s", first, last, hash))
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case float64:
+		return int64(n)
+	case int64:
+		return n
+	case int:
+		return int64(n)
+	}
+	return 0
+}
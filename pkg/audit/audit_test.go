@@ -0,0 +1,187 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogManager_Verify(t *testing.T) {
+	tmp := t.TempDir()
+	dir, legacy := filepath.Join(tmp, "audit"), filepath.Join(tmp, "log.json")
+	// entries written before the logs were chained are chained on importing
+	if err := os.WriteFile(legacy, []byte(`{"incidents": [{"code": 401, "description": "invalid signature", "timestamp": "2024-05-01T08:00:00Z"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	l := NewManager(dir, WithLegacyFile(legacy), WithCheckpoints(key, 2))
+	l.AddLog("10.0.0.1:5000", "0000000001", "success", 200)
+	l.AddIncidentLog("10.0.0.1:5000", "0000000001", "invalid signature", 401, map[string]interface{}{"attempt": 2})
+	l.AddUpdateLog("10.0.0.1:5000", "0000000001", "success", 200, "1.0.1")
+	l.Close()
+	if _, err := os.Stat(legacy + ".imported"); err != nil {
+		t.Fatalf("Legacy file should be renamed after importing: %v", err)
+	}
+
+	// the chain continues after reloading
+	l = NewManager(dir, WithLegacyFile(legacy), WithCheckpoints(key, 2))
+	l.AddActionLog("10.0.0.1:5000", "0000000001", "block", 200)
+	l.Close()
+	report, err := VerifyDir(dir, pub)
+	if err != nil || report.Entries != 5 || report.Checkpoints != 2 || report.Signed != 4 {
+		t.Fatalf("Unexpected report %+v: %v", report, err)
+	}
+	// the logs aren't verified without a pinned key
+	if _, err := VerifyDir(dir, nil); !errors.Is(err, ErrNoPublicKey) {
+		t.Fatalf("Expected ErrNoPublicKey, got %v", err)
+	}
+	// nor with the key of whoever rebuilt the chain
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := VerifyDir(dir, other); err == nil {
+		t.Fatalf("Expected invalid checkpoint signature with another key")
+	}
+
+	// edit an entry
+	logs, _ := readSegments(dir)
+	logs[TYPE_UPDATE][0]["detail"] = "1.0.2"
+	var broken *BrokenLinkError
+	if _, err := Verify(logs, pub); !errors.As(err, &broken) || broken.Seq != 4 || broken.Type != TYPE_UPDATE {
+		t.Fatalf("Expected broken link at seq 4, got %v", err)
+	}
+
+	// remove an entry
+	logs, _ = readSegments(dir)
+	logs[TYPE_INCIDENT] = logs[TYPE_INCIDENT][:1]
+	if _, err := Verify(logs, pub); !errors.As(err, &broken) || broken.Seq != 3 {
+		t.Fatalf("Expected broken link at seq 3, got %v", err)
+	}
+}
+
+func TestLogManager_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	l := NewManager(dir, WithRotation(1, time.Hour), WithCheckpoints(key, 1)) // every entry in its own segment
+	for i := 0; i < 3; i++ {
+		l.AddLog("10.0.0.1:5000", "0000000001", "success", 200)
+	}
+	l.Close()
+	compressed, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt+compressedExt))
+	if len(compressed) != 2 {
+		t.Fatalf("Expected 2 compressed segments, got %v", compressed)
+	}
+	if report, err := VerifyDir(dir, pub); err != nil || report.Entries != 3 {
+		t.Fatalf("Unexpected report %+v: %v", report, err)
+	}
+
+	// the oldest segment is removed by the retention, the rest of the chain is still valid
+	old := time.Now().Add(-48 * time.Hour)
+	_ = os.Chtimes(compressed[0], old, old)
+	l = NewManager(dir, WithRetention(24*time.Hour), WithCheckpoints(key, 1))
+	l.AddLog("10.0.0.1:5000", "0000000001", "success", 200)
+	l.Close()
+	report, err := VerifyDir(dir, pub)
+	if err != nil || report.First != 2 || report.Removed != 1 || report.Entries != 3 {
+		t.Fatalf("Unexpected report %+v: %v", report, err)
+	}
+
+	// the oldest retained entry can't be removed as if it was removed by the retention
+	logs, _ := readSegments(dir)
+	var broken *BrokenLinkError
+	logs[TYPE_NORMAL] = logs[TYPE_NORMAL][1:]
+	if _, err := Verify(logs, pub); !errors.As(err, &broken) || broken.Seq != 2 {
+		t.Fatalf("Expected broken link at seq 2, got %v", err)
+	}
+	// nor can the tombstone
+	logs, _ = readSegments(dir)
+	delete(logs, TYPE_TOMBSTONE)
+	if _, err := Verify(logs, pub); !errors.As(err, &broken) || broken.Seq != 1 {
+		t.Fatalf("Expected broken link at seq 1, got %v", err)
+	}
+	// nor forged
+	logs, _ = readSegments(dir)
+	logs[TYPE_TOMBSTONE][0]["last"] = 2
+	if _, err := Verify(logs, pub); !errors.As(err, &broken) || broken.Type != TYPE_TOMBSTONE {
+		t.Fatalf("Expected invalid tombstone, got %v", err)
+	}
+}
+
+func TestLogManager_Window(t *testing.T) {
+	dir := t.TempDir()
+	l := NewManager(dir, WithWindow(2))
+	for i := 0; i < 5; i++ {
+		l.AddIncidentLog("10.0.0.1:5000", "0000000001", "invalid signature", 401)
+	}
+	if logs, _ := l.GetAuditLogs(string(TYPE_INCIDENT)); len(logs) != 2 || toInt64(logs[1]["seq"]) != 5 {
+		t.Fatalf("Expected the last 2 entries in memory, got %v", logs)
+	}
+	l.Close()
+
+	// the entries beyond the window are read from the segments
+	l = NewManager(dir, WithWindow(2))
+	defer l.Close()
+	if n := len(l.Logs[TYPE_INCIDENT]); n >= 4 {
+		t.Fatalf("Expected at most 2 windows of entries in memory, got %d", n)
+	}
+	page, err := l.QueryLogs(string(TYPE_INCIDENT), Query{Limit: 2, Count: true})
+	if err != nil || page.Total != 5 || len(page.Logs) != 2 || toInt64(page.Logs[0]["seq"]) != 1 || page.Next != 2 {
+		t.Fatalf("Unexpected page %+v: %v", page, err)
+	}
+	page, _ = l.QueryLogs(string(TYPE_INCIDENT), Query{Limit: 2, Desc: true, Cursor: 4})
+	if len(page.Logs) != 2 || toInt64(page.Logs[0]["seq"]) != 3 || page.Next != 2 {
+		t.Fatalf("Unexpected page in descending order %+v", page)
+	}
+}
+
+func TestLogManager_QuerySegments(t *testing.T) {
+	dir := t.TempDir()
+	l := NewManager(dir, WithRotation(1, time.Hour)) // every entry in its own segment
+	for i := 0; i < 6; i++ {
+		l.AddIncidentLog("10.0.0.1:5000", "0000000001", "invalid signature", 401)
+	}
+	l.Close()
+	// the segments before the cursor and after the page aren't read
+	files := segments(dir)
+	for _, file := range []string{files[0], files[5]} {
+		if err := os.WriteFile(file, []byte("broken"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, err := l.QueryLogs(string(TYPE_INCIDENT), Query{Limit: 2, Cursor: 2})
+	if err != nil || len(page.Logs) != 2 || toInt64(page.Logs[0]["seq"]) != 3 || page.Next != 4 {
+		t.Fatalf("Unexpected page %+v: %v", page, err)
+	}
+	page, err = l.QueryLogs(string(TYPE_INCIDENT), Query{Limit: 2, Desc: true, Cursor: 5})
+	if err != nil || len(page.Logs) != 2 || toInt64(page.Logs[0]["seq"]) != 4 || page.Next != 3 {
+		t.Fatalf("Unexpected page in descending order %+v: %v", page, err)
+	}
+	// counting reads every segment
+	if _, err = l.QueryLogs(string(TYPE_INCIDENT), Query{Limit: 2, Cursor: 2, Count: true}); err == nil {
+		t.Fatal("Expected the broken segments to be read by counting")
+	}
+}
+
+func TestLogManager_Subscribe(t *testing.T) {
+	l := NewManager(t.TempDir())
+	defer l.Close()
+	events, cancel := l.Subscribe(1)
+	l.AddIncidentLog("10.0.0.1:5000", "0000000001", "invalid signature", 401)
+	l.AddUpdateLog("10.0.0.1:5000", "0000000001", "success", 200) // dropped, the channel is full
+	if ev := <-events; ev.Type != TYPE_INCIDENT || ev.Entry["description"] != "invalid signature" {
+		t.Fatalf("Unexpected event %+v", ev)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("Event should be dropped: %+v", ev)
+	default:
+	}
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatalf("Channel should be closed")
+	}
+	l.AddLog("10.0.0.1:5000", "0000000001", "success", 200)
+}
@@ -0,0 +1,189 @@
+package audit
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Query filters and pages the logs of a type, the zero value matches all entries.
+type Query struct {
+	SerialNumber string
+	RemoteAddr   string // the IP, or IP:port
+	Code         int    // 0 for any code
+	Since        time.Time
+	Until        time.Time
+	Text         string // case-insensitive substring of the description or detail
+	Cursor       int64  // sequence number of the last entry of the previous page
+	Limit        int
+	Desc         bool // the newest entries first
+	Count        bool // count the entries of all pages, which reads all segments
+}
+
+// Page is a page of the logs which match a query.
+type Page struct {
+	Logs  []map[string]interface{}
+	Total int   // entries which match the query, only counted if the query asks for it
+	Next  int64 // cursor of the next page, 0 if it's the last one
+}
+
+// ParseQuery parses the query of a URL, e.g.
+// ?serial_number=0000000001&remote_addr=10.0.0.1&code=401&since=2024-05-01T00:00:00Z&until=...&q=signature&cursor=120&limit=50&order=desc&count=true
+func ParseQuery(v url.Values) (Query, error) {
+	q := Query{
+		SerialNumber: v.Get("serial_number"),
+		RemoteAddr:   v.Get("remote_addr"),
+		Text:         v.Get("q"),
+	}
+	var err error
+	if s := v.Get("code"); s != "" {
+		if q.Code, err = strconv.Atoi(s); err != nil {
+			return q, fmt.Errorf("invalid code: '%s'", s)
+		}
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if s := v.Get(name); s != "" {
+			if *t, err = time.Parse(time.RFC3339, s); err != nil {
+				return q, fmt.Errorf("invalid %s, expected RFC 3339: '%s'", name, s)
+			}
+		}
+	}
+	if s := v.Get("cursor"); s != "" {
+		if q.Cursor, err = strconv.ParseInt(s, 10, 64); err != nil || q.Cursor < 0 {
+			return q, fmt.Errorf("invalid cursor: '%s'", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit: '%s'", s)
+		}
+	}
+	if s := v.Get("count"); s != "" {
+		if q.Count, err = strconv.ParseBool(s); err != nil {
+			return q, fmt.Errorf("invalid count: '%s'", s)
+		}
+	}
+	switch order := v.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, fmt.Errorf("invalid order, expected asc or desc: '%s'", order)
+	}
+	return q, nil
+}
+
+// Values returns the query of a URL, which is parsed by ParseQuery.
+func (q Query) Values() url.Values {
+	v := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	set("serial_number", q.SerialNumber)
+	set("remote_addr", q.RemoteAddr)
+	set("q", q.Text)
+	if q.Code != 0 {
+		v.Set("code", strconv.Itoa(q.Code))
+	}
+	if !q.Since.IsZero() {
+		v.Set("since", q.Since.Format(time.RFC3339))
+	}
+	if !q.Until.IsZero() {
+		v.Set("until", q.Until.Format(time.RFC3339))
+	}
+	if q.Cursor > 0 {
+		v.Set("cursor", strconv.FormatInt(q.Cursor, 10))
+	}
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Desc {
+		v.Set("order", "desc")
+	}
+	if q.Count {
+		v.Set("count", "true")
+	}
+	return v
+}
+
+// Match returns whether the entry matches the filters of the query.
+func (q Query) Match(e map[string]interface{}) bool {
+	if q.SerialNumber != "" && fmt.Sprint(e["serial_number"]) != q.SerialNumber {
+		return false
+	}
+	if q.RemoteAddr != "" {
+		addr := fmt.Sprint(e["remote_addr"])
+		if addr != q.RemoteAddr && !strings.HasPrefix(addr, q.RemoteAddr+":") && !strings.HasPrefix(addr, "["+q.RemoteAddr+"]:") {
+			return false
+		}
+	}
+	if q.Code != 0 && toInt64(e["code"]) != int64(q.Code) {
+		return false
+	}
+	if !q.Since.IsZero() || !q.Until.IsZero() {
+		t, err := time.Parse(time.RFC3339, fmt.Sprint(e["timestamp"]))
+		if err != nil || (!q.Since.IsZero() && t.Before(q.Since)) || (!q.Until.IsZero() && !t.Before(q.Until)) {
+			return false
+		}
+	}
+	if q.Text != "" {
+		text := strings.ToLower(q.Text)
+		desc := strings.ToLower(fmt.Sprint(e["description"]))
+		detail := ""
+		if d, ok := e["detail"]; ok {
+			detail = strings.ToLower(fmt.Sprint(d))
+		}
+		if !strings.Contains(desc, text) && !strings.Contains(detail, text) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply returns the page of the logs after the cursor, in the order of their sequence numbers.
+// Until is exclusive, so consecutive ranges don't overlap.
+func (q Query) Apply(logs []map[string]interface{}) Page {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+	var matched []map[string]interface{}
+	for _, e := range logs {
+		if q.Match(e) {
+			matched = append(matched, e)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if q.Desc {
+			return toInt64(matched[i]["seq"]) > toInt64(matched[j]["seq"])
+		}
+		return toInt64(matched[i]["seq"]) < toInt64(matched[j]["seq"])
+	})
+	page := Page{Total: len(matched), Logs: []map[string]interface{}{}}
+	start := 0
+	if q.Cursor > 0 {
+		start = sort.Search(len(matched), func(i int) bool {
+			if q.Desc {
+				return toInt64(matched[i]["seq"]) < q.Cursor
+			}
+			return toInt64(matched[i]["seq"]) > q.Cursor
+		})
+	}
+	end := min(start+limit, len(matched))
+	page.Logs = append(page.Logs, matched[start:end]...)
+	if end < len(matched) {
+		page.Next = toInt64(matched[end-1]["seq"])
+	}
+	return page
+}
@@ -0,0 +1,53 @@
+package audit
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestQuery_Apply(t *testing.T) {
+	l := NewManager(t.TempDir())
+	for _, serial := range []string{"0000000001", "0000000002", "0000000001", "0000000001"} {
+		l.AddIncidentLog("10.0.0.1:5000", serial, "invalid signature", 401, "signature mismatch")
+	}
+	l.AddIncidentLog("10.0.0.2:5000", "0000000001", "token already used", 401)
+	l.Close()
+	logs, _ := l.GetAuditLogs(string(TYPE_INCIDENT))
+
+	q, err := ParseQuery(url.Values{"serial_number": {"0000000001"}, "remote_addr": {"10.0.0.1"}, "q": {"MISMATCH"}, "limit": {"2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := q.Apply(logs)
+	if page.Total != 3 || len(page.Logs) != 2 || page.Next != 3 {
+		t.Fatalf("Unexpected first page: %+v", page)
+	}
+	q.Cursor = page.Next
+	if page = q.Apply(logs); len(page.Logs) != 1 || toInt64(page.Logs[0]["seq"]) != 4 || page.Next != 0 {
+		t.Fatalf("Unexpected last page: %+v", page)
+	}
+
+	// the newest first, and the query survives the URL
+	q, _ = ParseQuery(Query{SerialNumber: "0000000001", Desc: true, Limit: 1, Count: true}.Values())
+	if page = q.Apply(logs); !q.Count || page.Total != 4 || toInt64(page.Logs[0]["seq"]) != 5 || page.Next != 5 {
+		t.Fatalf("Unexpected page in descending order: %+v", page)
+	}
+
+	// the same pages are read from the segments
+	for _, q := range []Query{{SerialNumber: "0000000001", Limit: 2, Count: true},
+		{SerialNumber: "0000000001", Limit: 2, Cursor: 3, Count: true}, {Desc: true, Limit: 2, Count: true},
+		{Desc: true, Limit: 2, Cursor: 2, Count: true}, {Text: "used", Count: true}} {
+		want := q.Apply(logs)
+		got, err := l.QueryLogs(string(TYPE_INCIDENT), q)
+		if err != nil || got.Total != want.Total || got.Next != want.Next || len(got.Logs) != len(want.Logs) ||
+			(len(got.Logs) > 0 && toInt64(got.Logs[0]["seq"]) != toInt64(want.Logs[0]["seq"])) {
+			t.Fatalf("Unexpected page of %+v: %+v, expected %+v", q, got, want)
+		}
+	}
+
+	for _, v := range []url.Values{{"code": {"x"}}, {"since": {"yesterday"}}, {"order": {"random"}}, {"count": {"all"}}} {
+		if _, err := ParseQuery(v); err == nil {
+			t.Fatalf("Expected an error for %v", v)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package audit
+
+// Append-only storage of the logs: every entry is a line of JSON (NDJSON) appended to the current segment.
+// A segment is rotated when it reaches its maximum size or age, then it's compressed, and compressed
+// segments older than the retention are removed. A segment is named by the sequence number of its first
+// entry, so the names sort in the order of the chain.
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	segmentPrefix = "audit-"
+	segmentExt    = ".ndjson"
+	compressedExt = ".gz"
+
+	defaultMaxSize = 64 << 20
+	defaultMaxAge  = 24 * time.Hour
+)
+
+type segmentWriter struct {
+	dir       string
+	maxSize   int64
+	maxAge    time.Duration
+	retention time.Duration // 0 to keep all segments
+	f         *os.File
+	size      int64
+	opened    time.Time
+	wg        sync.WaitGroup // compressing segments
+}
+
+// rotateIfDue rotates the segment if it has reached its maximum size or age.
+func (w *segmentWriter) rotateIfDue() {
+	if w.f != nil && (w.size >= w.maxSize || time.Since(w.opened) >= w.maxAge) {
+		w.rotate()
+	}
+}
+
+// expired returns the compressed segments older than the retention, the oldest first. Only the oldest segments
+// are removed, so the rest of the chain stays contiguous.
+func (w *segmentWriter) expired() []string {
+	if w.retention <= 0 {
+		return nil
+	}
+	var files []string
+	for _, file := range segments(w.dir) {
+		info, err := os.Stat(file)
+		if !strings.HasSuffix(file, compressedExt) || err != nil || time.Since(info.ModTime()) <= w.retention {
+			break
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// write appends the line to the current segment, the segment of a new one is named by the sequence number.
+func (w *segmentWriter) write(line []byte, seq int64) error {
+	if w.f == nil {
+		f, err := os.OpenFile(filepath.Join(w.dir, fmt.Sprintf("%s%016d%s", segmentPrefix, seq, segmentExt)),
+			os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		w.f, w.size, w.opened = f, 0, time.Now()
+	}
+	n, err := w.f.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+// rotate closes the current segment, and compresses it in the background.
+func (w *segmentWriter) rotate() {
+	if w.f == nil {
+		return
+	}
+	path := w.f.Name()
+	_ = w.f.Close()
+	w.f = nil
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		_ = compressSegment(path)
+	}()
+}
+
+func (w *segmentWriter) close() {
+	if w.f != nil {
+		_ = w.f.Close()
+		w.f = nil
+	}
+	w.wg.Wait()
+}
+
+// compressSegment replaces the segment with its gzip compression.
+func compressSegment(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + compressedExt)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path + compressedExt)
+		return err
+	}
+	// the retention is counted from the last entry of the segment
+	if info, err := in.Stat(); err == nil {
+		_ = os.Chtimes(path+compressedExt, info.ModTime(), info.ModTime())
+	}
+	return os.Remove(path)
+}
+
+// segments returns the segments in the directory in the order of the chain.
+func segments(dir string) []string {
+	files, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"+segmentExt+"*"))
+	plain := make(map[string]bool)
+	for _, f := range files {
+		plain[f] = strings.HasSuffix(f, segmentExt)
+	}
+	var out []string
+	for _, f := range files {
+		// a segment whose compression was interrupted is read from the original
+		if plain[f] || (strings.HasSuffix(f, segmentExt+compressedExt) && !plain[strings.TrimSuffix(f, compressedExt)]) {
+			out = append(out, f)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// segmentSeq returns the sequence number of the first entry of the segment, which names it.
+func segmentSeq(path string) (int64, bool) {
+	var seq int64
+	_, err := fmt.Sscanf(filepath.Base(path), segmentPrefix+"%d", &seq)
+	return seq, err == nil
+}
+
+// readSegments reads the entries of all segments in the directory. An incomplete last line,
+// e.g. after a crash, is skipped, it breaks the chain if it's not the last entry.
+func readSegments(dir string) (map[LogType][]map[string]interface{}, error) {
+	logs := make(map[LogType][]map[string]interface{})
+	err := scanSegments(segments(dir), func(typ LogType, e map[string]interface{}) bool {
+		logs[typ] = append(logs[typ], e)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return logs, nil
+}
+
+// scanSegments calls fn for each entry of the segments in their order, without holding them in memory,
+// until fn returns false.
+func scanSegments(files []string, fn func(typ LogType, e map[string]interface{}) bool) error {
+	for _, path := range files {
+		err := readSegment(path, fn)
+		// compressed or removed by the retention since the segments were listed
+		if errors.Is(err, os.ErrNotExist) && strings.HasSuffix(path, segmentExt) {
+			err = readSegment(path+compressedExt, fn)
+		}
+		if errors.Is(err, errStopScan) {
+			return nil
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// errStopScan is returned by readSegment when fn stops the scan.
+var errStopScan = errors.New("scan stopped")
+
+func readSegment(path string, fn func(typ LogType, e map[string]interface{}) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(path, compressedExt) {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		var e map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		typ := LogType(fmt.Sprint(e["type"]))
+		delete(e, "type")
+		if !fn(typ, e) {
+			return errStopScan
+		}
+	}
+	return scanner.Err()
+}
+
+// segmentLine returns the NDJSON line of the entry, the type isn't part of the entry hash.
+func segmentLine(typ LogType, e map[string]interface{}) []byte {
+	m := make(map[string]interface{}, len(e)+1)
+	for k, v := range e {
+		m[k] = v
+	}
+	m["type"] = typ
+	data, _ := json.Marshal(m)
+	return append(data, '\n')
+}
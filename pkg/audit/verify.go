@@ -0,0 +1,133 @@
+package audit
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// ErrNoPublicKey is returned when the logs are verified without a pinned public key. The key on the disk of the
+// logs can't be trusted, whoever rebuilds the chain can replace it too.
+var ErrNoPublicKey = errors.New("no audit public key is pinned")
+
+// BrokenLinkError reports the first entry which breaks the chain of the logs.
+type BrokenLinkError struct {
+	Seq    int64
+	Type   LogType
+	Reason string
+}
+
+func (e *BrokenLinkError) Error() string {
+	return fmt.Sprintf("broken link at seq %d (%s): %s", e.Seq, e.Type, e.Reason)
+}
+
+// Report is the result of verifying the logs.
+type Report struct {
+	First       int64 // sequence number of the first entry
+	Removed     int64 // entries up to this sequence number were removed by the retention, 0 if none
+	Entries     int   // chained entries
+	Checkpoints int   // verified checkpoints
+	Signed      int64 // sequence number of the last signed checkpoint
+}
+
+type typedEntry struct {
+	typ LogType
+	e   map[string]interface{}
+}
+
+// VerifyDir verifies the chain of the segments in the directory, and the signatures of the checkpoints with pub.
+func VerifyDir(dir string, pub ed25519.PublicKey) (*Report, error) {
+	if pub == nil {
+		return nil, ErrNoPublicKey
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	logs, err := readSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	return Verify(logs, pub)
+}
+
+// Verify verifies the chain of the logs, and the signatures of the checkpoints with pub, which is pinned out of band.
+// The chain starts from the last signed tombstone of the entries removed by the retention, or from the first entry.
+// It returns a *BrokenLinkError for the first entry which breaks the chain.
+func Verify(logs map[LogType][]map[string]interface{}, pub ed25519.PublicKey) (*Report, error) {
+	if pub == nil {
+		return nil, ErrNoPublicKey
+	}
+	report := &Report{First: 1}
+	last := ""
+	for _, ts := range logs[TYPE_TOMBSTONE] {
+		first, removed, hash := toInt64(ts["first"]), toInt64(ts["last"]), fmt.Sprint(ts["hash"])
+		sig, err := base64.StdEncoding.DecodeString(fmt.Sprint(ts["signature"]))
+		if err != nil || !ed25519.Verify(pub, tombstoneMessage(first, removed, hash), sig) {
+			return report, &BrokenLinkError{Seq: removed, Type: TYPE_TOMBSTONE, Reason: "invalid tombstone signature"}
+		}
+		if removed > report.Removed {
+			report.Removed, last = removed, hash
+		}
+	}
+	report.First = report.Removed + 1
+	var entries []typedEntry
+	for typ, list := range logs {
+		if typ == TYPE_CHECKPOINT || typ == TYPE_TOMBSTONE {
+			continue
+		}
+		for _, e := range list {
+			// left by a crash after the tombstone was written, before the segments were removed
+			if toInt64(e["seq"]) > report.Removed {
+				entries = append(entries, typedEntry{typ: typ, e: e})
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return toInt64(entries[i].e["seq"]) < toInt64(entries[j].e["seq"])
+	})
+	report.Entries = len(entries)
+	hashes := make([]string, len(entries))
+	for i, te := range entries {
+		seq := report.First + int64(i)
+		switch got := toInt64(te.e["seq"]); {
+		case got < seq:
+			return report, &BrokenLinkError{Seq: seq, Type: te.typ, Reason: fmt.Sprintf("duplicate or missing sequence number %d", got)}
+		case got > seq:
+			return report, &BrokenLinkError{Seq: seq, Type: te.typ, Reason: fmt.Sprintf("entry is missing, next is %d", got)}
+		}
+		// the first entry links to the tombstone of the removed entries
+		if prev := fmt.Sprint(te.e["prev_hash"]); prev != last {
+			return report, &BrokenLinkError{Seq: seq, Type: te.typ, Reason: "previous hash mismatch, an entry before it was changed or removed"}
+		}
+		last = fmt.Sprint(te.e["hash"])
+		if EntryHash(te.e) != last {
+			return report, &BrokenLinkError{Seq: seq, Type: te.typ, Reason: "hash mismatch, the entry was changed"}
+		}
+		hashes[i] = last
+	}
+	for _, cp := range logs[TYPE_CHECKPOINT] {
+		seq := toInt64(cp["seq"])
+		// a checkpoint of a removed entry, which is covered by the tombstone
+		if seq <= report.Removed {
+			continue
+		}
+		if seq >= report.First+int64(len(hashes)) {
+			return report, &BrokenLinkError{Seq: report.First + int64(len(hashes)), Type: TYPE_CHECKPOINT,
+				Reason: fmt.Sprintf("entries up to the checkpoint at seq %d are missing", seq)}
+		}
+		hash := hashes[seq-report.First]
+		if fmt.Sprint(cp["hash"]) != hash {
+			return report, &BrokenLinkError{Seq: seq, Type: TYPE_CHECKPOINT, Reason: "hash differs from the signed checkpoint"}
+		}
+		sig, err := base64.StdEncoding.DecodeString(fmt.Sprint(cp["signature"]))
+		if err != nil || !ed25519.Verify(pub, checkpointMessage(seq, hash), sig) {
+			return report, &BrokenLinkError{Seq: seq, Type: TYPE_CHECKPOINT, Reason: "invalid checkpoint signature"}
+		}
+		report.Checkpoints++
+		report.Signed = max(report.Signed, seq)
+	}
+	return report, nil
+}
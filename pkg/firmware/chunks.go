@@ -0,0 +1,60 @@
+package firmware
+
+// Chunk manifests of resumable downloads. The image is downloaded in ranges, and the device verifies
+// each chunk as it arrives, so it keeps the verified chunks when the download is interrupted.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+const DefaultChunkSize = 64 << 10
+
+// Chunks is the SHA-256 of each chunk of a firmware image, the last chunk may be shorter.
+type Chunks struct {
+	Version   string   `json:"version"`
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunk_size"`
+	SHA256    []string `json:"chunks"`
+}
+
+// NewChunks returns the chunk manifest of the image, of chunks of DefaultChunkSize if the size isn't positive.
+func NewChunks(version string, image []byte, chunkSize int64) Chunks {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	c := Chunks{Version: version, Size: int64(len(image)), ChunkSize: chunkSize}
+	for start := int64(0); start < c.Size; start += chunkSize {
+		sum := sha256.Sum256(image[start:min(start+chunkSize, c.Size)])
+		c.SHA256 = append(c.SHA256, hex.EncodeToString(sum[:]))
+	}
+	return c
+}
+
+// Bytes returns the canonical encoding of the manifest which is authenticated.
+func (c Chunks) Bytes() []byte {
+	data, _ := json.Marshal(c)
+	return data
+}
+
+// Verified returns the length of the longest prefix of the data made of verified chunks.
+// The data is a prefix of the image, whose last chunk may be incomplete.
+func (c Chunks) Verified(data []byte) int64 {
+	if c.ChunkSize <= 0 {
+		return 0
+	}
+	var n int64
+	for _, want := range c.SHA256 {
+		end := min(n+c.ChunkSize, c.Size)
+		if end > int64(len(data)) {
+			break
+		}
+		sum := sha256.Sum256(data[n:end])
+		if hex.EncodeToString(sum[:]) != want {
+			break
+		}
+		n = end
+	}
+	return n
+}
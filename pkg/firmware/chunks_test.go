@@ -0,0 +1,33 @@
+package firmware
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChunks_Verified(t *testing.T) {
+	image := bytes.Repeat([]byte("0123456789"), 25) // 250 bytes, the last chunk is 50 bytes
+	c := NewChunks("1.0.1", image, 100)
+	if len(c.SHA256) != 3 || c.Size != 250 {
+		t.Fatalf("Unexpected chunks: %+v", c)
+	}
+	if n := NewChunks("1.0.1", image, 0).ChunkSize; n != DefaultChunkSize {
+		t.Errorf("Expected default chunk size, got %d", n)
+	}
+	if n := c.Verified(image); n != 250 {
+		t.Errorf("Expected the whole image to be verified, got %d", n)
+	}
+	// an incomplete chunk isn't kept
+	if n := c.Verified(image[:199]); n != 100 {
+		t.Errorf("Expected 100 verified bytes, got %d", n)
+	}
+	// nor the chunks after a corrupted one
+	corrupted := bytes.Clone(image)
+	corrupted[150] ^= 0xff
+	if n := c.Verified(corrupted); n != 100 {
+		t.Errorf("Expected 100 verified bytes, got %d", n)
+	}
+	if n := c.Verified(append(bytes.Clone(image), 'x')); n != 250 {
+		t.Errorf("Expected the bytes after the image to be ignored, got %d", n)
+	}
+}
@@ -0,0 +1,474 @@
+package firmware
+
+// Package firmware provides a repository of firmware images keyed by version.
+// Each version is stored in its own directory, holding the binary image and
+// a JSON metadata file describing it.
+
+import (
+	"cmp"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	imageFile    = "image.bin"
+	metadataFile = "metadata.json"
+)
+
+// Status is the lifecycle state of a firmware version
+type Status string
+
+const (
+	StatusDraft     Status = "draft"     // uploaded, not yet delivered to devices
+	StatusPublished Status = "published" // delivered to devices
+	StatusRetired   Status = "retired"   // yanked, devices can no longer fetch it
+)
+
+// Release channels of the published versions, a device is only delivered the versions of its channel.
+const (
+	ChannelStable  = "stable"  // released to all devices
+	ChannelBeta    = "beta"    // pre-release, for the devices which test it
+	ChannelFactory = "factory" // installed on the production line
+
+	DefaultChannel = ChannelStable
+)
+
+var (
+	ErrNotFound       = errors.New("firmware not found")
+	ErrExists         = errors.New("firmware version already exists")
+	ErrInvalidVersion = errors.New("invalid firmware version")
+	ErrInvalidStatus  = errors.New("invalid firmware status transition")
+	ErrInvalidChannel = errors.New("invalid release channel")
+
+	versionPattern = regexp.MustCompile(`^[0-9A-Za-z][0-9A-Za-z._-]{0,63}$`)
+	channelPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+)
+
+// Metadata describes a stored firmware image
+type Metadata struct {
+	Version         string     `json:"version"`
+	Size            int64      `json:"size"`
+	SHA256          string     `json:"sha256"`
+	ReleaseNotes    string     `json:"release_notes,omitempty"`
+	Hardware        []string   `json:"hardware,omitempty"` // target hardware revisions
+	SecurityVersion uint32     `json:"security_version"`   // raised by the releases which fix a vulnerability
+	Status          Status     `json:"status"`
+	Channels        []string   `json:"channels,omitempty"`      // release channels of the published version
+	Signature       string     `json:"signature,omitempty"`     // code signature of the manifest
+	SignerKeyID     string     `json:"signer_key_id,omitempty"` // key ID of the publisher key
+	SignatureAlg    string     `json:"signature_algorithm,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	PublishedAt     *time.Time `json:"published_at,omitempty"`
+	RetiredAt       *time.Time `json:"retired_at,omitempty"`
+	RetireReason    string     `json:"retire_reason,omitempty"`
+}
+
+// FirmwareStore interface defines methods for storing and retrieving firmware images.
+type FirmwareStore interface {
+	Put(meta Metadata, image []byte) (*Metadata, error)
+	GetMetadata(version string) (*Metadata, error)
+	GetImage(version string) (*Metadata, []byte, error)
+	OpenImage(version string) (*Metadata, *os.File, error)
+	List() ([]Metadata, error)
+	Publish(version, signature string, channels ...string) (*Metadata, error)
+	SetChannels(version string, channels []string) (*Metadata, error)
+	Retire(version, reason string) (*Metadata, error)
+}
+
+// FirmwareStoreImpl is a filesystem backed firmware store.
+type FirmwareStoreImpl struct {
+	mu        sync.RWMutex
+	dir       string
+	publisher crypto.PublicKey // nil if no version can be published
+}
+
+type Option func(*FirmwareStoreImpl)
+
+// WithPublisherKey pins the public key of the publisher, which verifies the signatures of the published versions.
+func WithPublisherKey(pub crypto.PublicKey) Option {
+	return func(s *FirmwareStoreImpl) {
+		s.publisher = pub
+	}
+}
+
+func NewStore(dir string, opts ...Option) (*FirmwareStoreImpl, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create firmware directory: %w", err)
+	}
+	s := &FirmwareStoreImpl{dir: dir}
+	for _, f := range opts {
+		f(s)
+	}
+	return s, nil
+}
+
+// ValidVersion reports whether the version can be used as a storage key.
+func ValidVersion(version string) bool {
+	return versionPattern.MatchString(version) && version != "." && version != ".."
+}
+
+// CompareVersions compares two versions by their dot separated parts, numerically where both parts are numbers,
+// so "1.10.0" is newer than "1.9.2". As in semantic versioning, a pre-release follows the first "-" and is older
+// than its release, so "2.0.0-rc1" is older than "2.0.0". It returns -1, 0 or 1 if a is older than, the same as
+// or newer than b.
+func CompareVersions(a, b string) int {
+	a, preA, hasPreA := strings.Cut(a, "-")
+	b, preB, hasPreB := strings.Cut(b, "-")
+	if c := compareParts(strings.Split(a, "."), strings.Split(b, "."), "0"); c != 0 {
+		return c
+	}
+	switch {
+	case hasPreA && hasPreB:
+		return compareParts(strings.Split(preA, "."), strings.Split(preB, "."), "")
+	case hasPreA:
+		return -1
+	case hasPreB:
+		return 1
+	}
+	return 0
+}
+
+// compareParts compares the parts one by one, a missing part is the padding: "1.0" is the same as "1.0.0", and
+// "rc.1" is older than "rc.1.1". Numbers are compared numerically, and are older than the other parts.
+func compareParts(pa, pb []string, padding string) int {
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		x, y := padding, padding
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		nx, errx := strconv.ParseUint(x, 10, 64)
+		ny, erry := strconv.ParseUint(y, 10, 64)
+		switch {
+		case x == y:
+		case errx == nil && erry == nil:
+			if nx != ny {
+				return cmp.Compare(nx, ny)
+			}
+		case x == "" || y == "":
+			return strings.Compare(x, y)
+		case errx == nil:
+			return -1
+		case erry == nil:
+			return 1
+		default:
+			return strings.Compare(x, y)
+		}
+	}
+	return 0
+}
+
+// Put stores a new firmware image as a draft. Size and SHA-256 are computed from the image,
+// and an existing version is never overwritten.
+func (s *FirmwareStoreImpl) Put(meta Metadata, image []byte) (*Metadata, error) {
+	if !ValidVersion(meta.Version) {
+		return nil, ErrInvalidVersion
+	}
+	if len(image) == 0 {
+		return nil, fmt.Errorf("empty firmware image")
+	}
+	sum := sha256.Sum256(image)
+	meta.Size = int64(len(image))
+	meta.SHA256 = hex.EncodeToString(sum[:])
+	meta.Status = StatusDraft
+	if meta.CreatedAt.IsZero() {
+		meta.CreatedAt = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := filepath.Join(s.dir, meta.Version)
+	if _, err := os.Stat(dir); err == nil {
+		return nil, ErrExists
+	}
+	// write everything in a temporary directory and rename it at last,
+	// so a half written version is never visible
+	tmp, err := os.MkdirTemp(s.dir, ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := writeFile(filepath.Join(tmp, imageFile), image); err != nil {
+		return nil, err
+	}
+	if err := writeMetadata(tmp, &meta); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return nil, fmt.Errorf("failed to store firmware: %w", err)
+	}
+	return &meta, nil
+}
+
+func (s *FirmwareStoreImpl) GetMetadata(version string) (*Metadata, error) {
+	if !ValidVersion(version) {
+		return nil, ErrInvalidVersion
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return readMetadata(filepath.Join(s.dir, version))
+}
+
+// GetImage returns the metadata and the image of the specified version.
+// The image is checked against the recorded SHA-256 before it is returned.
+func (s *FirmwareStoreImpl) GetImage(version string) (*Metadata, []byte, error) {
+	if !ValidVersion(version) {
+		return nil, nil, ErrInvalidVersion
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dir := filepath.Join(s.dir, version)
+	meta, err := readMetadata(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	image, err := os.ReadFile(filepath.Join(dir, imageFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read firmware image: %w", err)
+	}
+	sum := sha256.Sum256(image)
+	if int64(len(image)) != meta.Size || hex.EncodeToString(sum[:]) != meta.SHA256 {
+		return nil, nil, fmt.Errorf("firmware image %s is corrupted", version)
+	}
+	return meta, image, nil
+}
+
+// OpenImage returns the metadata and the opened image of the specified version, so a range of it is read
+// without reading the whole image. Only the size is checked, the SHA-256 is checked by GetImage, e.g. once
+// before a download ticket is issued. The caller closes the file.
+func (s *FirmwareStoreImpl) OpenImage(version string) (*Metadata, *os.File, error) {
+	if !ValidVersion(version) {
+		return nil, nil, ErrInvalidVersion
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dir := filepath.Join(s.dir, version)
+	meta, err := readMetadata(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(filepath.Join(dir, imageFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open firmware image: %w", err)
+	}
+	if info, err := f.Stat(); err != nil || info.Size() != meta.Size {
+		_ = f.Close()
+		return nil, nil, fmt.Errorf("firmware image %s is corrupted", version)
+	}
+	return meta, f, nil
+}
+
+// Publish makes a draft version available to devices. The signature of its manifest is made offline
+// with the publisher key, and verified against the pinned public key, so devices never get an unsigned image.
+func (s *FirmwareStoreImpl) Publish(version, signature string, channels ...string) (*Metadata, error) {
+	if len(channels) == 0 {
+		channels = []string{DefaultChannel}
+	}
+	channels, err := normalizeChannels(channels)
+	if err != nil {
+		return nil, err
+	}
+	if s.publisher == nil {
+		return nil, fmt.Errorf("%w: no publisher key is pinned", ErrInvalidSignature)
+	}
+	alg, err := Algorithm(s.publisher)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := KeyID(s.publisher)
+	if err != nil {
+		return nil, err
+	}
+	return s.update(version, func(meta *Metadata) error {
+		if meta.Status != StatusDraft {
+			return fmt.Errorf("%w: %s -> %s", ErrInvalidStatus, meta.Status, StatusPublished)
+		}
+		if err := VerifySignature(s.publisher, meta.Manifest(), alg, signature); err != nil {
+			return fmt.Errorf("%w of %s by key %s", err, version, keyID)
+		}
+		meta.Signature = signature
+		meta.SignerKeyID = keyID
+		meta.SignatureAlg = alg
+		now := time.Now().UTC()
+		meta.Status = StatusPublished
+		meta.PublishedAt = &now
+		meta.Channels = channels
+		return nil
+	})
+}
+
+// SetChannels replaces the release channels of a published version, e.g. to promote it from beta to stable.
+// There's no default, so a request which lost its channels doesn't promote the version to stable.
+func (s *FirmwareStoreImpl) SetChannels(version string, channels []string) (*Metadata, error) {
+	if len(channels) == 0 {
+		return nil, fmt.Errorf("%w: no release channel", ErrInvalidChannel)
+	}
+	channels, err := normalizeChannels(channels)
+	if err != nil {
+		return nil, err
+	}
+	return s.update(version, func(meta *Metadata) error {
+		if meta.Status != StatusPublished {
+			return fmt.Errorf("%w: channels of a %s version", ErrInvalidStatus, meta.Status)
+		}
+		meta.Channels = channels
+		return nil
+	})
+}
+
+// ValidChannel reports whether the name can be used as a release channel.
+func ValidChannel(channel string) bool {
+	return channelPattern.MatchString(channel)
+}
+
+// normalizeChannels checks the channels, and returns them sorted without duplicates.
+func normalizeChannels(channels []string) ([]string, error) {
+	out := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		if !ValidChannel(ch) {
+			return nil, fmt.Errorf("%w: '%s'", ErrInvalidChannel, ch)
+		}
+		if !slices.Contains(out, ch) {
+			out = append(out, ch)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// InChannel reports whether the version is published to the channel, a version published
+// before the channels is in the default channel.
+func (m *Metadata) InChannel(channel string) bool {
+	if channel == "" {
+		channel = DefaultChannel
+	}
+	if len(m.Channels) == 0 {
+		return channel == DefaultChannel
+	}
+	return slices.Contains(m.Channels, channel)
+}
+
+// Retire yanks a version, so it can no longer be delivered to devices.
+// The image is kept in the repository for auditing.
+func (s *FirmwareStoreImpl) Retire(version, reason string) (*Metadata, error) {
+	return s.update(version, func(meta *Metadata) error {
+		if meta.Status == StatusRetired {
+			return fmt.Errorf("%w: %s is already retired", ErrInvalidStatus, version)
+		}
+		now := time.Now().UTC()
+		meta.Status = StatusRetired
+		meta.RetiredAt = &now
+		meta.RetireReason = reason
+		return nil
+	})
+}
+
+func (s *FirmwareStoreImpl) update(version string, f func(meta *Metadata) error) (*Metadata, error) {
+	if !ValidVersion(version) {
+		return nil, ErrInvalidVersion
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dir := filepath.Join(s.dir, version)
+	meta, err := readMetadata(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := f(meta); err != nil {
+		return nil, err
+	}
+	if err := writeMetadata(dir, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// List returns the metadata of all stored versions, sorted by creation time.
+func (s *FirmwareStoreImpl) List() ([]Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Metadata, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() || !ValidVersion(e.Name()) {
+			continue
+		}
+		meta, err := readMetadata(filepath.Join(s.dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		list = append(list, *meta)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreatedAt.Before(list[j].CreatedAt)
+	})
+	return list, nil
+}
+
+func readMetadata(dir string) (*Metadata, error) {
+	data, err := os.ReadFile(filepath.Join(dir, metadataFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("failed to read firmware metadata: %w", err)
+	}
+	var meta Metadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse firmware metadata: %w", err)
+	}
+	// stored before the lifecycle or code signing were introduced: an unsigned image can't be
+	// delivered, so it's a draft until it's published again with a signature
+	if meta.Status == "" || (meta.Status == StatusPublished && meta.Signature == "") {
+		meta.Status = StatusDraft
+		meta.PublishedAt, meta.Channels = nil, nil
+	}
+	return &meta, nil
+}
+
+func writeMetadata(dir string, meta *Metadata) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, metadataFile), data)
+}
+
+// writeFile writes the data to a temporary file and renames it to the target path.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,173 @@
+package firmware
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestStore returns a store which pins the public key of the returned signer.
+func newTestStore(t *testing.T, dir string) (*FirmwareStoreImpl, *Signer) {
+	t.Helper()
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := NewSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewStore(dir, WithPublisherKey(key.Public()))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	return store, signer
+}
+
+// sign signs the manifest of the stored version, as the publisher does offline.
+func sign(t *testing.T, store *FirmwareStoreImpl, signer *Signer, version string) string {
+	t.Helper()
+	meta, err := store.GetMetadata(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.Sign(meta.Manifest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestFirmwareStore_PutGet(t *testing.T) {
+	store, signer := newTestStore(t, t.TempDir())
+	image := []byte("firmware image 1.0.1")
+	meta, err := store.Put(Metadata{Version: "1.0.1", ReleaseNotes: "bug fixes", Hardware: []string{"rev-a"}}, image)
+	if err != nil {
+		t.Fatalf("Failed to put firmware: %v", err)
+	}
+	if meta.Size != int64(len(image)) || meta.SHA256 == "" {
+		t.Errorf("Unexpected metadata: %+v", meta)
+	}
+	if _, err := store.Put(Metadata{Version: "1.0.1"}, image); err != ErrExists {
+		t.Errorf("Expected ErrExists, got %v", err)
+	}
+
+	got, data, err := store.GetImage("1.0.1")
+	if err != nil {
+		t.Fatalf("Failed to get firmware: %v", err)
+	}
+	if !bytes.Equal(data, image) || got.SHA256 != meta.SHA256 || got.ReleaseNotes != "bug fixes" {
+		t.Errorf("Unexpected firmware: %+v", got)
+	}
+	if _, _, err := store.GetImage("2.0.0"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, _, err := store.GetImage("../1.0.1"); err != ErrInvalidVersion {
+		t.Errorf("Expected ErrInvalidVersion, got %v", err)
+	}
+	// a range is read without reading the image
+	_, f, err := store.OpenImage("1.0.1")
+	if err != nil {
+		t.Fatalf("Failed to open firmware: %v", err)
+	}
+	part := make([]byte, 5)
+	if _, err := f.ReadAt(part, 9); err != nil || string(part) != "image" {
+		t.Errorf("Unexpected range %q: %v", part, err)
+	}
+	_ = f.Close()
+
+	if got.Status != StatusDraft {
+		t.Errorf("Expected draft status, got %s", got.Status)
+	}
+	sig := sign(t, store, signer, "1.0.1")
+	if _, err := store.Publish("1.0.1", sig); err != nil {
+		t.Fatalf("Failed to publish firmware: %v", err)
+	}
+	if _, err := store.Publish("1.0.1", sig); err == nil {
+		t.Errorf("Expected publishing twice to fail")
+	}
+	meta, err = store.Retire("1.0.1", "security issue")
+	if err != nil || meta.Status != StatusRetired || meta.RetireReason != "security issue" {
+		t.Fatalf("Failed to retire firmware: %+v, %v", meta, err)
+	}
+
+	list, err := store.List()
+	if err != nil || len(list) != 1 {
+		t.Fatalf("Expected 1 firmware, got %d: %v", len(list), err)
+	}
+}
+
+func TestFirmwareStore_Corrupted(t *testing.T) {
+	dir := t.TempDir()
+	store, _ := NewStore(dir)
+	if _, err := store.Put(Metadata{Version: "1.0.2"}, []byte("original")); err != nil {
+		t.Fatalf("Failed to put firmware: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "1.0.2", imageFile), []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.GetImage("1.0.2"); err == nil {
+		t.Errorf("Expected corrupted image to be rejected")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "1.0.2", imageFile), []byte("truncated"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := store.OpenImage("1.0.2"); err == nil {
+		t.Errorf("Expected an image of another size to be rejected")
+	}
+}
+
+func TestFirmwareStore_Channels(t *testing.T) {
+	store, signer := newTestStore(t, t.TempDir())
+	_, _ = store.Put(Metadata{Version: "1.1.0"}, []byte("firmware image 1.1.0"))
+	sig := sign(t, store, signer, "1.1.0")
+	if _, err := store.SetChannels("1.1.0", []string{ChannelStable}); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("Expected channels of a draft to fail, got %v", err)
+	}
+	if _, err := store.Publish("1.1.0", sig, "Beta!"); !errors.Is(err, ErrInvalidChannel) {
+		t.Errorf("Expected ErrInvalidChannel, got %v", err)
+	}
+	meta, err := store.Publish("1.1.0", sig, ChannelBeta, ChannelFactory, ChannelBeta)
+	if err != nil || len(meta.Channels) != 2 || !meta.InChannel(ChannelBeta) || meta.InChannel(ChannelStable) {
+		t.Fatalf("Unexpected channels %v: %v", meta, err)
+	}
+	// a request without channels doesn't promote the version to stable
+	if _, err := store.SetChannels("1.1.0", nil); !errors.Is(err, ErrInvalidChannel) {
+		t.Errorf("Expected ErrInvalidChannel, got %v", err)
+	}
+	// promoted to stable
+	meta, err = store.SetChannels("1.1.0", []string{ChannelStable, ChannelBeta})
+	if err != nil || !meta.InChannel("") || meta.InChannel(ChannelFactory) {
+		t.Fatalf("Unexpected channels %v: %v", meta, err)
+	}
+	// a version published before the channels is stable
+	if legacy := (&Metadata{Status: StatusPublished}); !legacy.InChannel(ChannelStable) || legacy.InChannel(ChannelBeta) {
+		t.Errorf("Legacy version should only be stable")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.1", "1.0.1", 0},
+		{"1.0", "1.0.0", 0},
+		{"1.10.0", "1.9.2", 1},
+		{"1.01", "1.1.0", 0},
+		{"1.0.1", "1.0.2", -1},
+		{"2.0.0-rc1", "2.0.0-rc2", -1},
+		{"2.0.0", "2.0.0-rc1", 1},
+		{"2.0-rc1", "2.0.0", -1},
+		{"2.0.0-rc1", "1.9.9", 1},
+		{"2.0.0-rc.2", "2.0.0-rc.10", -1},
+		{"2.0.0-rc.1", "2.0.0-rc.1.1", -1},
+		{"2.0.0-1", "2.0.0-beta", -1},
+	}
+	for _, c := range cases {
+		if got := CompareVersions(c.a, c.b); got != c.want {
+			t.Errorf("CompareVersions(%s, %s) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
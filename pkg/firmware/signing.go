@@ -0,0 +1,256 @@
+package firmware
+
+// Code signing of firmware images. Images are signed once offline with the publisher's key,
+// the server verifies the signature when the image is published, and devices verify it against
+// the same pinned public key. The publisher's key never lives on the server.
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	AlgEd25519   = "ed25519"
+	AlgECDSAP384 = "ecdsa-p384-sha384"
+)
+
+var (
+	ErrInvalidSignature = errors.New("invalid firmware signature")
+)
+
+// Manifest is the signed content of a firmware image.
+// The security version is omitted if 0, so the signatures of the images published before it still verify.
+type Manifest struct {
+	Version         string `json:"version"`
+	Size            int64  `json:"size"`
+	SHA256          string `json:"sha256"`
+	SecurityVersion uint32 `json:"security_version,omitempty"`
+}
+
+// Bytes returns the canonical encoding of the manifest which is signed.
+func (m Manifest) Bytes() []byte {
+	data, _ := json.Marshal(m)
+	return data
+}
+
+func (m *Metadata) Manifest() Manifest {
+	return Manifest{Version: m.Version, Size: m.Size, SHA256: m.SHA256, SecurityVersion: m.SecurityVersion}
+}
+
+// NewManifest returns the manifest of the image of the version.
+func NewManifest(version string, image []byte, securityVersion uint32) Manifest {
+	sum := sha256.Sum256(image)
+	return Manifest{Version: version, Size: int64(len(image)), SHA256: hex.EncodeToString(sum[:]), SecurityVersion: securityVersion}
+}
+
+// SignedManifest is the manifest with its signature, as the publisher hands it over to publish the version.
+type SignedManifest struct {
+	Manifest
+	Signature    string `json:"signature"`
+	SignerKeyID  string `json:"signer_key_id"`
+	SignatureAlg string `json:"signature_algorithm"`
+}
+
+// LoadSignedManifest loads a signed manifest written by the publisher.
+func LoadSignedManifest(path string) (*SignedManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m SignedManifest
+	if err := json.Unmarshal(data, &m); err != nil || m.Signature == "" {
+		return nil, fmt.Errorf("invalid signed manifest: %s", path)
+	}
+	return &m, nil
+}
+
+// Signer signs firmware manifests with the publisher's code signing key.
+type Signer struct {
+	key   crypto.Signer
+	alg   string
+	keyID string
+}
+
+// LoadSigner loads the PKCS#8 signing key from the specified path.
+func LoadSigner(path string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+	return NewSigner(signer)
+}
+
+// GenerateSigner generates a signing key of the algorithm and saves it to the specified path.
+// An existing key is never overwritten.
+func GenerateSigner(path, alg string) (*Signer, error) {
+	var key crypto.Signer
+	var err error
+	switch alg {
+	case AlgEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case AlgECDSAP384:
+		key, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %w", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save signing key: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		return nil, fmt.Errorf("failed to save signing key: %w", err)
+	}
+	return NewSigner(key)
+}
+
+// NewSigner creates a signer from an Ed25519 or ECDSA P-384 private key.
+func NewSigner(key crypto.Signer) (*Signer, error) {
+	var alg string
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		alg = AlgEd25519
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P384() {
+			return nil, errors.New("only P-384 is supported for ECDSA signing keys")
+		}
+		alg = AlgECDSAP384
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+	keyID, err := KeyID(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{key: key, alg: alg, keyID: keyID}, nil
+}
+
+func (s *Signer) KeyID() string {
+	return s.keyID
+}
+
+func (s *Signer) Algorithm() string {
+	return s.alg
+}
+
+// PublicKeyPEM returns the public key to be pinned on devices.
+func (s *Signer) PublicKeyPEM() []byte {
+	der, _ := x509.MarshalPKIXPublicKey(s.key.Public())
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// SignManifest returns the signed manifest.
+func (s *Signer) SignManifest(m Manifest) (*SignedManifest, error) {
+	sig, err := s.Sign(m)
+	if err != nil {
+		return nil, err
+	}
+	return &SignedManifest{Manifest: m, Signature: sig, SignerKeyID: s.keyID, SignatureAlg: s.alg}, nil
+}
+
+// Sign returns the base64 signature of the manifest.
+func (s *Signer) Sign(m Manifest) (string, error) {
+	var sig []byte
+	var err error
+	switch s.alg {
+	case AlgEd25519:
+		sig, err = s.key.Sign(rand.Reader, m.Bytes(), crypto.Hash(0))
+	default:
+		digest := sha512.Sum384(m.Bytes())
+		sig, err = s.key.Sign(rand.Reader, digest[:], crypto.SHA384)
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// KeyID returns the identifier of a public key: the first 8 bytes of the SHA-256 of its PKIX encoding.
+func KeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// Algorithm returns the signature algorithm of a public key.
+func Algorithm(pub crypto.PublicKey) (string, error) {
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		return AlgEd25519, nil
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P384() {
+			return AlgECDSAP384, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// LoadPublicKey loads a PEM encoded PKIX public key.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("invalid PEM block")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// VerifySignature verifies the base64 signature of the manifest with the public key.
+func VerifySignature(pub crypto.PublicKey, m Manifest, alg, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if alg != AlgEd25519 || !ed25519.Verify(k, m.Bytes(), sig) {
+			return ErrInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		digest := sha512.Sum384(m.Bytes())
+		if alg != AlgECDSAP384 || !ecdsa.VerifyASN1(k, digest[:], sig) {
+			return ErrInvalidSignature
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return nil
+}
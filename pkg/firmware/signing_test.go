@@ -0,0 +1,105 @@
+package firmware
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSigner_SignVerify(t *testing.T) {
+	for _, alg := range []string{AlgEd25519, AlgECDSAP384} {
+		dir := t.TempDir()
+		signer, err := GenerateSigner(filepath.Join(dir, "signing_key.pem"), alg)
+		if err != nil {
+			t.Fatalf("%s: failed to create signer: %v", alg, err)
+		}
+		// an existing key is never overwritten
+		if _, err := GenerateSigner(filepath.Join(dir, "signing_key.pem"), alg); err == nil {
+			t.Fatalf("%s: expected generating over an existing key to fail", alg)
+		}
+		loaded, err := LoadSigner(filepath.Join(dir, "signing_key.pem"))
+		if err != nil || loaded.KeyID() != signer.KeyID() {
+			t.Fatalf("%s: failed to load signer: %v", alg, err)
+		}
+		pubPath := filepath.Join(dir, "signing_pub.pem")
+		if err := os.WriteFile(pubPath, signer.PublicKeyPEM(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		pub, err := LoadPublicKey(pubPath)
+		if err != nil {
+			t.Fatalf("%s: failed to load public key: %v", alg, err)
+		}
+		if id, _ := KeyID(pub); id != signer.KeyID() {
+			t.Errorf("%s: key ID mismatch: %s != %s", alg, id, signer.KeyID())
+		}
+
+		m := Manifest{Version: "1.0.1", Size: 8, SHA256: "abcd"}
+		sig, err := loaded.Sign(m)
+		if err != nil {
+			t.Fatalf("%s: failed to sign: %v", alg, err)
+		}
+		if err := VerifySignature(pub, m, signer.Algorithm(), sig); err != nil {
+			t.Errorf("%s: failed to verify: %v", alg, err)
+		}
+		m.Version = "1.0.2"
+		if err := VerifySignature(pub, m, signer.Algorithm(), sig); err != ErrInvalidSignature {
+			t.Errorf("%s: expected tampered manifest to be rejected, got %v", alg, err)
+		}
+		// the security version is signed, so it can't be raised to pass the anti-rollback check
+		m.Version, m.SecurityVersion = "1.0.1", 3
+		if err := VerifySignature(pub, m, signer.Algorithm(), sig); err != ErrInvalidSignature {
+			t.Errorf("%s: expected tampered security version to be rejected, got %v", alg, err)
+		}
+	}
+}
+
+func TestFirmwareStore_PublishSigned(t *testing.T) {
+	dir := t.TempDir()
+	store, signer := newTestStore(t, dir)
+	if _, err := store.Put(Metadata{Version: "2.0.0", SecurityVersion: 2}, []byte("image")); err != nil {
+		t.Fatal(err)
+	}
+	// the publisher signs the image offline
+	signed, err := signer.SignManifest(NewManifest("2.0.0", []byte("image"), 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, _ := signer.Sign(NewManifest("2.0.0", []byte("image"), 1))
+	if _, err := store.Publish("2.0.0", forged); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected a signature of another manifest to be rejected, got %v", err)
+	}
+	if _, err := (&FirmwareStoreImpl{dir: dir}).Publish("2.0.0", signed.Signature); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Expected publishing without a publisher key to fail, got %v", err)
+	}
+	meta, err := store.Publish("2.0.0", signed.Signature)
+	if err != nil {
+		t.Fatalf("Failed to publish firmware: %v", err)
+	}
+	if meta.SignerKeyID != signer.KeyID() || meta.SignatureAlg != AlgEd25519 {
+		t.Errorf("Unexpected signer: %+v", meta)
+	}
+	if err := VerifySignature(signer.key.Public(), meta.Manifest(), meta.SignatureAlg, meta.Signature); err != nil {
+		t.Errorf("Failed to verify published firmware: %v", err)
+	}
+}
+
+func TestFirmwareStore_LegacyUnsigned(t *testing.T) {
+	dir := t.TempDir()
+	store, signer := newTestStore(t, dir)
+	if _, err := store.Put(Metadata{Version: "0.9.0"}, []byte("image")); err != nil {
+		t.Fatal(err)
+	}
+	// stored before the lifecycle was introduced, without status and signature
+	meta, _ := store.GetMetadata("0.9.0")
+	meta.Status = ""
+	if err := writeMetadata(filepath.Join(dir, "0.9.0"), meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ := store.GetMetadata("0.9.0"); meta.Status != StatusDraft {
+		t.Fatalf("Expected an unsigned legacy version to be a draft, got %s", meta.Status)
+	}
+	if _, err := store.Publish("0.9.0", sign(t, store, signer, "0.9.0")); err != nil {
+		t.Fatalf("Failed to publish legacy version: %v", err)
+	}
+}
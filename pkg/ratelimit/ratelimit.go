@@ -0,0 +1,127 @@
+package ratelimit
+
+// Package ratelimit provides token buckets keyed by a client, e.g. its address or serial number,
+// and temporary lockouts of clients after repeated failures.
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is the interval of removing idle buckets and expired lockouts, so keys don't pile up.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter allows burst requests of a key at once, refilled at rate requests per second.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{rate: rate, burst: float64(max(burst, 1)), buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token of the key, and returns false if there is none left.
+func (l *Limiter) Allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > sweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep removes the buckets which are full again, they are the same as new ones.
+func (l *Limiter) sweep(now time.Time) {
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+	l.swept = now
+}
+
+// Lockout locks a key out for the duration after failures within the window.
+type Lockout struct {
+	mu       sync.Mutex
+	failures int
+	window   time.Duration
+	duration time.Duration
+	fails    map[string][]time.Time
+	until    map[string]time.Time
+	swept    time.Time
+}
+
+func NewLockout(failures int, window, duration time.Duration) *Lockout {
+	return &Lockout{
+		failures: max(failures, 1),
+		window:   window,
+		duration: duration,
+		fails:    make(map[string][]time.Time),
+		until:    make(map[string]time.Time),
+	}
+}
+
+// Fail records a failure of the key, and returns true if the key is locked out by it.
+func (l *Lockout) Fail(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > sweepInterval {
+		l.sweep(now)
+	}
+	fails := append(l.fails[key], now)
+	for len(fails) > 0 && now.Sub(fails[0]) > l.window {
+		fails = fails[1:]
+	}
+	if len(fails) < l.failures {
+		l.fails[key] = fails
+		return false
+	}
+	delete(l.fails, key)
+	l.until[key] = now.Add(l.duration)
+	return true
+}
+
+// LockedUntil returns the end of the lockout of the key, or false if it isn't locked out.
+func (l *Lockout) LockedUntil(key string, now time.Time) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.until[key]
+	if !ok || !now.Before(until) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+func (l *Lockout) sweep(now time.Time) {
+	for k, fails := range l.fails {
+		if now.Sub(fails[len(fails)-1]) > l.window {
+			delete(l.fails, k)
+		}
+	}
+	for k, until := range l.until {
+		if !now.Before(until) {
+			delete(l.until, k)
+		}
+	}
+	l.swept = now
+}
@@ -0,0 +1,50 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	l := NewLimiter(1, 3) // 1 request per second, 3 at once
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.Allow("10.0.0.1", now) {
+			t.Fatalf("Request %d should be allowed in the burst", i+1)
+		}
+	}
+	if l.Allow("10.0.0.1", now) {
+		t.Fatalf("Request beyond the burst should be rejected")
+	}
+	// other keys have their own buckets
+	if !l.Allow("10.0.0.2", now) {
+		t.Fatalf("Another key should be allowed")
+	}
+	if !l.Allow("10.0.0.1", now.Add(time.Second)) {
+		t.Fatalf("A token should be refilled after a second")
+	}
+	if l.Allow("10.0.0.1", now.Add(time.Second)) {
+		t.Fatalf("Only one token should be refilled after a second")
+	}
+}
+
+func TestLockout_Fail(t *testing.T) {
+	l := NewLockout(3, time.Minute, 10*time.Minute)
+	now := time.Now()
+	if l.Fail("0000000001", now) || l.Fail("0000000001", now.Add(2*time.Minute)) || l.Fail("0000000001", now.Add(2*time.Minute)) {
+		t.Fatalf("Failures out of the window shouldn't lock out")
+	}
+	if _, ok := l.LockedUntil("0000000001", now.Add(2*time.Minute)); ok {
+		t.Fatalf("Key shouldn't be locked out yet")
+	}
+	if !l.Fail("0000000001", now.Add(3*time.Minute)) {
+		t.Fatalf("Third failure in the window should lock out")
+	}
+	until, ok := l.LockedUntil("0000000001", now.Add(4*time.Minute))
+	if !ok || !until.Equal(now.Add(13*time.Minute)) {
+		t.Fatalf("Unexpected lockout: %v, %v", until, ok)
+	}
+	if _, ok := l.LockedUntil("0000000001", now.Add(13*time.Minute)); ok {
+		t.Fatalf("Lockout should be over")
+	}
+}
@@ -0,0 +1,384 @@
+package store
+
+// Package store provides a small crash-safe embedded key-value store.
+// Values are JSON documents grouped in buckets. The whole data set is kept in memory,
+// every batch of changes is appended to a journal and synced to disk before it is applied,
+// and the journal is compacted into an atomically replaced snapshot from time to time.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	journalFile  = "journal.log"
+
+	// DefaultCompactEvery is the number of journal records after which the journal is compacted.
+	DefaultCompactEvery = 1000
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrClosed   = errors.New("store is closed")
+	ErrFailed   = errors.New("store failed, the journal can't be repaired")
+)
+
+// Store is a key-value store with atomic batches of changes.
+type Store interface {
+	// Get unmarshals the value of the key into v, it returns ErrNotFound if the key doesn't exist.
+	Get(bucket, key string, v interface{}) error
+	// Keys returns the sorted keys of a bucket.
+	Keys(bucket string) []string
+	// ForEach calls fn with the raw value of every key of a bucket in key order, until fn returns an error.
+	ForEach(bucket string, fn func(key string, value json.RawMessage) error) error
+	// Update applies all changes made by fn atomically: either all or none of them survive a crash.
+	Update(fn func(tx *Tx) error) error
+	Close() error
+}
+
+type operation struct {
+	Bucket string          `json:"b"`
+	Key    string          `json:"k"`
+	Value  json.RawMessage `json:"v,omitempty"` // nil means delete
+}
+
+// record is one line of the journal.
+type record struct {
+	Seq uint64      `json:"seq"`
+	Ops []operation `json:"ops"`
+	CRC uint32      `json:"crc"`
+}
+
+type snapshot struct {
+	Seq  uint64                                `json:"seq"`
+	Data map[string]map[string]json.RawMessage `json:"data"`
+}
+
+// Tx collects the changes of a batch.
+type Tx struct {
+	data map[string]map[string]json.RawMessage
+	ops  []operation
+}
+
+// Put sets the key of a bucket to the JSON encoding of v.
+func (tx *Tx) Put(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tx.ops = append(tx.ops, operation{Bucket: bucket, Key: key, Value: data})
+	return nil
+}
+
+// Delete removes the key of a bucket.
+func (tx *Tx) Delete(bucket, key string) {
+	tx.ops = append(tx.ops, operation{Bucket: bucket, Key: key})
+}
+
+// Get reads a value, taking the pending changes of the batch into account.
+func (tx *Tx) Get(bucket, key string, v interface{}) error {
+	for i := len(tx.ops) - 1; i >= 0; i-- {
+		if op := tx.ops[i]; op.Bucket == bucket && op.Key == key {
+			if op.Value == nil {
+				return ErrNotFound
+			}
+			return json.Unmarshal(op.Value, v)
+		}
+	}
+	value, ok := tx.data[bucket][key]
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(value, v)
+}
+
+// FileStore is a Store persisted in a directory.
+type FileStore struct {
+	mu           sync.RWMutex
+	dir          string
+	data         map[string]map[string]json.RawMessage
+	seq          uint64 // sequence number of the last applied record
+	snapSeq      uint64 // sequence number covered by the snapshot
+	journal      *os.File
+	size         int64 // size of the journal up to the last acknowledged record
+	failed       bool  // a failed write couldn't be undone, so further records would be lost on replay
+	compactEvery int
+}
+
+type Option func(*FileStore)
+
+// WithCompactEvery sets the number of journal records after which the journal is compacted.
+func WithCompactEvery(n int) Option {
+	return func(s *FileStore) {
+		s.compactEvery = n
+	}
+}
+
+// Open opens or creates the store in the specified directory, replaying the journal on top of the snapshot.
+func Open(dir string, opts ...Option) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	s := &FileStore{
+		dir:          dir,
+		data:         make(map[string]map[string]json.RawMessage),
+		compactEvery: DefaultCompactEvery,
+	}
+	for _, f := range opts {
+		f(s)
+	}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := s.replayJournal(); err != nil {
+		return nil, err
+	}
+	journal, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := journal.Stat()
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+	s.journal, s.size = journal, fi.Size()
+	return s, nil
+}
+
+func (s *FileStore) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("corrupted snapshot: %w", err)
+	}
+	if snap.Data != nil {
+		s.data = snap.Data
+	}
+	s.seq, s.snapSeq = snap.Seq, snap.Seq
+	return nil
+}
+
+// replayJournal applies the journal records which are not covered by the snapshot.
+// An incomplete record at the end of the journal is the result of a crash in the middle
+// of a write, that batch was never acknowledged so it is discarded.
+func (s *FileStore) replayJournal() error {
+	path := filepath.Join(s.dir, journalFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var valid int64
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var r record
+		if err := json.Unmarshal(line, &r); err != nil || r.CRC != checksum(r.Ops) {
+			break
+		}
+		valid += int64(len(line)) + 1
+		if r.Seq <= s.seq {
+			continue // already in the snapshot
+		}
+		s.apply(r.Ops)
+		s.seq = r.Seq
+	}
+	if valid < int64(len(data)) {
+		if err := os.Truncate(path, valid); err != nil {
+			return fmt.Errorf("failed to truncate journal: %w", err)
+		}
+	}
+	return nil
+}
+
+func checksum(ops []operation) uint32 {
+	data, _ := json.Marshal(ops)
+	return crc32.ChecksumIEEE(data)
+}
+
+func (s *FileStore) apply(ops []operation) {
+	for _, op := range ops {
+		if op.Value == nil {
+			delete(s.data[op.Bucket], op.Key)
+			continue
+		}
+		b, ok := s.data[op.Bucket]
+		if !ok {
+			b = make(map[string]json.RawMessage)
+			s.data[op.Bucket] = b
+		}
+		b[op.Key] = op.Value
+	}
+}
+
+func (s *FileStore) Get(bucket, key string, v interface{}) error {
+	s.mu.RLock()
+	value, ok := s.data[bucket][key]
+	s.mu.RUnlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(value, v)
+}
+
+func (s *FileStore) Keys(bucket string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.data[bucket]))
+	for k := range s.data[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *FileStore) ForEach(bucket string, fn func(key string, value json.RawMessage) error) error {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.data[bucket]))
+	values := make(map[string]json.RawMessage, len(s.data[bucket]))
+	for k, v := range s.data[bucket] {
+		keys = append(keys, k)
+		values[k] = v
+	}
+	s.mu.RUnlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k, values[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Update runs fn and writes its changes as one journal record. Updates are serialized,
+// so fn can read the current values with tx.Get and make decisions on them.
+func (s *FileStore) Update(fn func(tx *Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return ErrClosed
+	}
+	if s.failed {
+		return ErrFailed
+	}
+	tx := &Tx{data: s.data}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	r := record{Seq: s.seq + 1, Ops: tx.ops, CRC: checksum(tx.ops)}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := s.journal.Write(line); err != nil {
+		s.discard()
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+	if err := s.journal.Sync(); err != nil {
+		s.discard()
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	s.size += int64(len(line))
+	s.apply(tx.ops)
+	s.seq = r.Seq
+	if s.compactEvery > 0 && s.seq-s.snapSeq >= uint64(s.compactEvery) {
+		// the batch is durable in the journal, a failed compaction is retried next time
+		_ = s.compact()
+	}
+	return nil
+}
+
+// discard removes what a failed write left of its record, so the records acknowledged after it
+// aren't appended to a broken line and lost on replay. If it can't, the store refuses further writes.
+func (s *FileStore) discard() {
+	path := filepath.Join(s.dir, journalFile)
+	if err := os.Truncate(path, s.size); err != nil {
+		s.failed = true
+		return
+	}
+	if f, err := os.OpenFile(path, os.O_WRONLY, 0600); err == nil {
+		err = f.Sync()
+		f.Close()
+		if err == nil {
+			return
+		}
+	}
+	s.failed = true
+}
+
+// compact writes the whole data set to a new snapshot and truncates the journal.
+// A crash between both steps is harmless, records covered by the snapshot are skipped on replay.
+func (s *FileStore) compact() error {
+	data, err := json.Marshal(snapshot{Seq: s.seq, Data: s.data})
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(s.dir, snapshotFile), data); err != nil {
+		return err
+	}
+	s.snapSeq = s.seq
+	if err := s.journal.Truncate(0); err != nil {
+		return err
+	}
+	s.size = 0
+	return s.journal.Sync()
+}
+
+// writeFile atomically replaces the file by writing a temporary file and renaming it.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Close compacts the journal and closes the store.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.journal == nil {
+		return nil
+	}
+	err := s.compact()
+	if cerr := s.journal.Close(); err == nil {
+		err = cerr
+	}
+	s.journal = nil
+	return err
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore_Update(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	err = s.Update(func(tx *Tx) error {
+		if err := tx.Put("devices", "0000000001", map[string]interface{}{"state": "registered"}); err != nil {
+			return err
+		}
+		return tx.Put("settings", "allowance", 9)
+	})
+	if err != nil {
+		t.Fatalf("Failed to update store: %v", err)
+	}
+	var allowance int
+	if err := s.Get("settings", "allowance", &allowance); err != nil || allowance != 9 {
+		t.Fatalf("Unexpected allowance %d: %v", allowance, err)
+	}
+	if keys := s.Keys("devices"); len(keys) != 1 || keys[0] != "0000000001" {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+	s.Update(func(tx *Tx) error {
+		tx.Delete("devices", "0000000001")
+		return nil
+	})
+	if err := s.Get("devices", "0000000001", &map[string]interface{}{}); err != ErrNotFound {
+		t.Fatalf("Expected deleted key to be not found, got %v", err)
+	}
+}
+
+func TestFileStore_Recovery(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir, WithCompactEvery(3))
+	for i := 1; i <= 5; i++ {
+		s.Update(func(tx *Tx) error {
+			return tx.Put("settings", "allowance", i)
+		})
+	}
+	// simulate a crash: the store is not closed, and the last write is torn
+	f, _ := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"seq":6,"ops":[{"b":"settings","k":"allow`)
+	f.Close()
+
+	s2, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	var allowance int
+	if err := s2.Get("settings", "allowance", &allowance); err != nil || allowance != 5 {
+		t.Fatalf("Expected allowance 5 after recovery, got %d: %v", allowance, err)
+	}
+	// the torn record is discarded, new records are appended after the last valid one
+	s2.Update(func(tx *Tx) error {
+		return tx.Put("settings", "allowance", 6)
+	})
+	s2.journal.Close()
+	s3, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	if err := s3.Get("settings", "allowance", &allowance); err != nil || allowance != 6 {
+		t.Fatalf("Expected allowance 6, got %d: %v", allowance, err)
+	}
+	s3.Close()
+}
+
+func TestFileStore_FailedWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, journalFile)
+	s, _ := Open(dir)
+	s.Update(func(tx *Tx) error {
+		return tx.Put("settings", "allowance", 1)
+	})
+	// simulate a write which fails halfway: a part of the record is written, then an error is returned
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString(`{"seq":2,"ops":[{"b":"settings","k":"allow`)
+	f.Close()
+	journal := s.journal
+	s.journal, _ = os.Open(path)
+	if err := s.Update(func(tx *Tx) error { return tx.Put("settings", "allowance", 2) }); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	s.journal.Close()
+	s.journal = journal
+	// the next record is acknowledged, so it must survive the replay
+	if err := s.Update(func(tx *Tx) error { return tx.Put("settings", "allowance", 3) }); err != nil {
+		t.Fatalf("Failed to update store: %v", err)
+	}
+	s.journal.Close()
+
+	s2, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	var allowance int
+	if err := s2.Get("settings", "allowance", &allowance); err != nil || allowance != 3 {
+		t.Fatalf("Expected allowance 3 after replay, got %d: %v", allowance, err)
+	}
+	s2.Close()
+}
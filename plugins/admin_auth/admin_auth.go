@@ -0,0 +1,140 @@
+package admin_auth
+
+// Package admin_auth provides a plugin for authenticating the callers of admin endpoints
+// with an API key or a client certificate, and checking their roles.
+// It should be the first plugin of the pipeline, and the roles allowed on the endpoint are
+// configured in "apis.json":
+//
+//	{
+//		"Name": "Admin_Auth",
+//		"Index": 0,
+//		"Config": {
+//			"roles": ["viewer", "operator"]
+//		}
+//	}
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+)
+
+const (
+	RoleViewer         = "viewer"          // read devices, logs and firmware
+	RoleOperator       = "operator"        // block and authorize devices, manage firmware
+	RoleAllowanceAdmin = "allowance-admin" // increase the registration allowance
+	RoleAdmin          = "admin"           // all of the above
+
+	HeaderAPIKey = "X-API-Key"
+	// HeaderClientCert is set by the server to the subject of a verified client certificate.
+	HeaderClientCert = "X-Client-Cert-Subject"
+	// HeaderIdentity is set by this plugin to the name of the authenticated caller, for the next plugins.
+	HeaderIdentity = "X-Admin-Identity"
+)
+
+// IdentityProvider finds the caller of an API key or a client certificate.
+type IdentityProvider interface {
+	LookupAPIKey(key string) (name string, roles []string, ok bool)
+	LookupCertificate(subject string) (name string, roles []string, ok bool)
+}
+
+type factory struct {
+	ids IdentityProvider
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+	roles []string // roles allowed on the endpoint
+	log   audit.LogManager
+}
+
+func NewFactory(ids IdentityProvider) vicg.VicgPluginFactory {
+	return factory{ids: ids}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		log:     nil,
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	roles, _ := cfg.Config["roles"].([]interface{})
+	for _, r := range roles {
+		p.roles = append(p.roles, cvt.ToString(r))
+	}
+	if len(p.roles) == 0 {
+		return nil, fmt.Errorf("plugin '%s' has no allowed roles", cfg.Name)
+	}
+	return p, nil
+}
+
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	var name string
+	var roles []string
+	var ok bool
+	if subject := request.HeaderGet(HeaderClientCert); subject != "" {
+		name, roles, ok = p.ids.LookupCertificate(subject)
+	} else if key := request.HeaderGet(HeaderAPIKey); key != "" {
+		name, roles, ok = p.ids.LookupAPIKey(key)
+	}
+	if !ok {
+		response.WriteHeader(http.StatusUnauthorized)
+		p.log.AddIncidentLog(request.RemoteAddr, "", "missing or invalid admin credentials", http.StatusUnauthorized, request.Method+" "+request.Path)
+		response.Data = map[string]interface{}{
+			"code": http.StatusUnauthorized,
+			"msg":  "missing or invalid admin credentials",
+		}
+		return p.Error()
+	}
+	if !p.allowed(roles) {
+		response.WriteHeader(http.StatusForbidden)
+		p.log.AddIncidentLog(request.RemoteAddr, "", "admin role not allowed", http.StatusForbidden, name, request.Method+" "+request.Path)
+		response.Data = map[string]interface{}{
+			"code": http.StatusForbidden,
+			"msg":  fmt.Sprintf("'%s' is not allowed, required roles: %v", name, p.roles),
+		}
+		return p.Error()
+	}
+	request.Headers[HeaderIdentity] = []string{name}
+	return nil
+}
+
+func (p *Plugin) allowed(roles []string) bool {
+	for _, r := range roles {
+		if r == RoleAdmin {
+			return true
+		}
+		for _, allowed := range p.roles {
+			if r == allowed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
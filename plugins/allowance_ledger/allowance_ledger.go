@@ -0,0 +1,89 @@
+package allowance_ledger
+
+// Package allowance_ledger provides a plugin for reporting the allowance ledger: every grant and
+// every consumption of the device registration allowance.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/internal/pkg/ledger"
+)
+
+type AllowanceManeger interface {
+	GetAllowance(key string) int
+	GetAllowances() map[string]int
+	GetAllowanceLedger(key string) []ledger.Entry
+}
+
+type factory struct {
+	allow AllowanceManeger
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+}
+
+func NewFactory(allow AllowanceManeger) vicg.VicgPluginFactory {
+	return factory{allow: allow}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	return &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+	}, nil
+}
+
+/*
+Query: ?pool=<name>, the entries of all pools are returned if it's empty.
+
+Response:
+
+	{
+		"code": 0,
+		"msg": "success",
+		"pools": {"default": 9},
+		"ledger": [
+			{"seq": 1, "type": "grant", "pool": "default", "amount": 10, "operator": "admin", "reason": "contract",
+				"po_number": "PO-1", "timestamp": "2024-05-01T08:00:00Z", "balance": 10},
+			{"seq": 2, "type": "consume", "pool": "default", "amount": -1, "serial_number": "0000000001",
+				"timestamp": "2024-05-01T09:00:00Z", "balance": 9}
+		]
+	}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	pool := request.Query.Get("pool")
+	pools := p.allow.GetAllowances()
+	if pool != "" {
+		if _, ok := pools[pool]; !ok {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Data = map[string]interface{}{"code": http.StatusBadRequest, "msg": fmt.Sprintf("unknown allowance pool: '%s'", pool)}
+			return p.Error()
+		}
+		pools = map[string]int{pool: pools[pool]}
+	}
+	response.Data = map[string]interface{}{
+		"code":   0,
+		"msg":    "success",
+		"pools":  pools,
+		"ledger": p.allow.GetAllowanceLedger(pool),
+	}
+	return nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
@@ -1,77 +1,143 @@
-package allowance_update
-
-// Package allowance_update provides a plugin for updating device allowances.
-import (
-	"context"
-	"fmt"
-	"net/http"
-
-	"github.com/luraproject/lura/v2/config"
-	"github.com/luraproject/lura/v2/proxy"
-	"github.com/luraproject/lura/v2/vicg"
-	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
-)
-
-type AllowanceManeger interface {
-	GetAllowance(key string) int
-	IncreaseAllowance(key string, inc int)
-}
-
-type factory struct {
-	allow AllowanceManeger
-}
-
-// Plugin defines
-type Plugin struct {
-	factory
-	name  string
-	index int
-	infra interface{}
-}
-
-func NewFactory(allow AllowanceManeger) vicg.VicgPluginFactory {
-	return factory{allow: allow}
-}
-
-func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
-	return &Plugin{
-		factory: f,
-		index:   cfg.Index,
-		name:    cfg.Name,
-		infra:   infra,
-	}, nil
-}
-
-/*
-Request:
-
-	{
-		"increase_allowance": 10
-	}
-
-Response:
-
-	{
-		"code": 0,
-		"msg": "ok",
-		"allowance": 10
-	}
-*/
-func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
-	allowanceInc := cvt.ToInt(request.Private["increase_allowance"])
-	if allowanceInc <= 0 {
-		response.WriteHeader(http.StatusBadRequest)
-		response.Data = map[string]interface{}{"code": http.StatusBadRequest, "msg": "invalid increase_allowance"}
-		return p.Error()
-	}
-	p.allow.IncreaseAllowance("", allowanceInc)
-	response.Data = map[string]interface{}{"code": 0, "msg": "ok", "allowance": p.allow.GetAllowance("")}
-	return nil
-}
-
-func (p *Plugin) Priority() int {
-	return p.index
-}
-func (p *Plugin) Error() error {
-	return fmt.Errorf("failed on plugin: '%s'", p.name)
-}
+package allowance_update
+
+// Package allowance_update provides a plugin for updating device allowances.
+// The allowance is only increased by licence files signed with the vendor key.
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/internal/pkg/ledger"
+	"github.com/yuanyuanxiang/fss/internal/pkg/licence"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	"github.com/yuanyuanxiang/fss/plugins/admin_auth"
+)
+
+// maxLicenceSize is the maximum size of a licence file.
+const maxLicenceSize = 64 << 10
+
+type AllowanceManeger interface {
+	GetAllowance(key string) int
+	GetAllowances() map[string]int
+	ApplyLicence(l licence.Licence, operator string) error
+}
+
+type factory struct {
+	allow     AllowanceManeger
+	vendorKey ed25519.PublicKey // nil if no licence can be verified
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+	log   audit.LogManager
+}
+
+func NewFactory(allow AllowanceManeger, vendorKey ed25519.PublicKey) vicg.VicgPluginFactory {
+	return factory{allow: allow, vendorKey: vendorKey}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		log:     nil,
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	return p, nil
+}
+
+/*
+Request: the licence file signed by the vendor
+
+	{
+		"payload": "base64 JSON licence: id, pool, amount, po_number, issued_at, expires_at",
+		"signature": "base64 Ed25519 signature of the payload",
+		"key_id": "0123456789abcdef"
+	}
+
+Response:
+
+	{
+		"code": 0,
+		"msg": "ok",
+		"allowance": 10,
+		"pool": "default",
+		"licence_id": "LIC-0001",
+		"pools": {"default": 10, "acme": 5}
+	}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	if p.vendorKey == nil {
+		return p.reject(request, response, http.StatusForbidden, "licences can't be verified without a vendor key", nil)
+	}
+	if request.Body == nil {
+		return p.reject(request, response, http.StatusBadRequest, "missing licence", nil)
+	}
+	data, err := io.ReadAll(io.LimitReader(request.Body, maxLicenceSize))
+	if err != nil {
+		return p.reject(request, response, http.StatusBadRequest, "failed to read licence", err)
+	}
+	l, err := licence.Verify(p.vendorKey, data, time.Now())
+	switch {
+	case errors.Is(err, licence.ErrInvalidSignature), errors.Is(err, licence.ErrExpiredLicence):
+		return p.reject(request, response, http.StatusForbidden, "licence rejected", err)
+	case err != nil:
+		return p.reject(request, response, http.StatusBadRequest, "invalid licence", err)
+	}
+	pool := l.Pool
+	if pool == "" {
+		pool = ledger.DefaultPool
+	}
+	if _, ok := p.allow.GetAllowances()[pool]; !ok {
+		return p.reject(request, response, http.StatusBadRequest, fmt.Sprintf("unknown allowance pool: '%s'", pool), nil)
+	}
+	// the grant is recorded in the ledger with the operator authenticated by Admin_Auth
+	operator := request.HeaderGet(admin_auth.HeaderIdentity)
+	if err := p.allow.ApplyLicence(*l, operator); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ledger.ErrLicenceUsed) {
+			status = http.StatusConflict
+		}
+		return p.reject(request, response, status, "failed to apply licence", err)
+	}
+	p.log.AddLog(request.RemoteAddr, "", "licence applied", http.StatusOK, l.ID, pool, l.Amount, operator)
+	response.Data = map[string]interface{}{"code": 0, "msg": "ok", "allowance": p.allow.GetAllowance(pool), "pool": pool,
+		"licence_id": l.ID, "pools": p.allow.GetAllowances()}
+	return nil
+}
+
+// reject responds with the status, and logs the rejected licence as an incident.
+func (p *Plugin) reject(request *proxy.Request, response *proxy.Response, status int, msg string, err error) error {
+	if err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, err)
+	}
+	response.WriteHeader(status)
+	p.log.AddIncidentLog(request.RemoteAddr, "", msg, status, request.HeaderGet(admin_auth.HeaderIdentity))
+	response.Data = map[string]interface{}{"code": status, "msg": msg}
+	return p.Error()
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
@@ -1,75 +1,110 @@
-package audit_logs
-
-// Package audit_logs provides a plugin for logging audit information.
-// Retrieve logs of successful updates.
-// Retrieve logs of security incidents and rejected attempts
-import (
-	"context"
-	"fmt"
-	"strings"
-
-	"github.com/luraproject/lura/v2/config"
-	"github.com/luraproject/lura/v2/proxy"
-	"github.com/luraproject/lura/v2/vicg"
-	"github.com/yuanyuanxiang/fss/pkg/audit"
-)
-
-type factory struct {
-}
-
-// Plugin defines
-type Plugin struct {
-	factory
-	name  string
-	index int
-	log   audit.LogManager
-}
-
-func NewFactory() vicg.VicgPluginFactory {
-	return factory{}
-}
-
-func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
-	p := &Plugin{
-		factory: f,
-		index:   cfg.Index,
-		name:    cfg.Name,
-		log:     nil,
-	}
-	var m map[string]interface{}
-	if v, ok := infra.(*vicg.Infra); ok && v != nil {
-		m = v.ExtraConfig
-	}
-	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
-	if p.log == nil {
-		return nil, fmt.Errorf("audit log manager is not set")
-	}
-	return p, nil
-}
-
-func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
-	typ := request.Path[strings.LastIndex(request.Path, "/")+1:]
-	arr, err := p.log.GetAuditLogs(typ)
-	response.Data["msg"] = "success"
-	response.Data["code"] = 0
-	if err != nil {
-		response.Data["code"] = -1
-		response.Data["msg"] = fmt.Sprintf("failed to get audit logs: %v", err)
-	}
-	response.Data["audit_logs"] = arr
-	response.Data["type"] = typ
-	response.Data["count"] = len(arr)
-	if err != nil {
-		return p.Error()
-	}
-
-	return nil
-}
-
-func (p *Plugin) Priority() int {
-	return p.index
-}
-
-func (p *Plugin) Error() error {
-	return fmt.Errorf("failed on plugin: '%s'", p.name)
-}
+package audit_logs
+
+// Package audit_logs provides a plugin for logging audit information.
+// Retrieve logs of successful updates.
+// Retrieve logs of security incidents and rejected attempts
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+)
+
+type factory struct {
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+	log   audit.LogManager
+}
+
+func NewFactory() vicg.VicgPluginFactory {
+	return factory{}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		log:     nil,
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	return p, nil
+}
+
+/*
+Query: ?serial_number=<serial>&remote_addr=<ip>&code=<code>&since=<RFC 3339>&until=<RFC 3339>&q=<text>&cursor=<seq>&limit=<n>&order=<asc|desc>&count=<true|false>
+All parameters are optional, a page has 100 entries by default and 1000 at most. The next page is requested with
+the cursor of the response, which is 0 on the last page. The total of all pages is only in the response with count=true,
+counting reads every segment.
+
+Response:
+
+	{
+		"code": 0,
+		"msg": "success",
+		"type": "incidents",
+		"count": 1,
+		"total": 3,
+		"next_cursor": 42,
+		"audit_logs": [
+			{"seq": 42, "code": 401, "remote_addr": "10.0.0.1:5000", "serial_number": "0000000001",
+				"description": "invalid signature", "timestamp": "2024-05-01T08:00:00Z", "prev_hash": "...", "hash": "..."}
+		]
+	}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	typ := request.Path[strings.LastIndex(request.Path, "/")+1:]
+	q, err := audit.ParseQuery(request.Query)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Data["code"] = http.StatusBadRequest
+		response.Data["msg"] = err.Error()
+		return p.Error()
+	}
+	// the pages are read from the segments, the logs in memory are only the recent ones
+	page, err := p.log.QueryLogs(typ, q)
+	response.Data["msg"] = "success"
+	response.Data["code"] = 0
+	if err != nil {
+		response.Data["code"] = -1
+		response.Data["msg"] = fmt.Sprintf("failed to get audit logs: %v", err)
+		page = &audit.Page{Logs: []map[string]interface{}{}}
+	}
+	response.Data["audit_logs"] = page.Logs
+	response.Data["type"] = typ
+	response.Data["count"] = len(page.Logs)
+	if q.Count {
+		response.Data["total"] = page.Total
+	}
+	response.Data["next_cursor"] = page.Next
+	if err != nil {
+		return p.Error()
+	}
+
+	return nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
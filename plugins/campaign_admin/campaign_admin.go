@@ -0,0 +1,168 @@
+package campaign_admin
+
+// Package campaign_admin provides a plugin for managing the update campaigns.
+// List, create and show campaigns, and pause, resume, abort or advance a campaign.
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/internal/pkg/campaign"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/plugins/admin_auth"
+)
+
+const maxCampaignSize = 1 << 20
+
+type Campaigns interface {
+	List() []map[string]interface{}
+	Create(c campaign.Campaign, createdBy string) (*campaign.Campaign, error)
+	Get(id string) (*campaign.Campaign, error)
+	Control(id, op, reason string) (*campaign.Campaign, error)
+}
+
+type factory struct {
+	campaigns Campaigns
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+	log   audit.LogManager
+}
+
+func NewFactory(campaigns Campaigns) vicg.VicgPluginFactory {
+	return factory{campaigns: campaigns}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		log:     nil,
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	return p, nil
+}
+
+/*
+GET /api/campaigns - list the campaigns
+
+POST /api/campaigns - create a campaign
+
+	{
+		"id": "spring-release",
+		"version": "1.0.2",
+		"selector": {"serials": ["0000000001-0000000500"], "tags": ["lab"]},
+		"stages": [1, 10, 50, 100],
+		"failure_threshold": 5
+	}
+
+GET /api/campaigns/{id} - show a campaign with the progress of each admitted device
+
+POST /api/campaigns/{id}/pause|resume|abort|advance - control a campaign
+
+	{
+		"reason": "waiting for the field reports"
+	}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	arr := strings.Split(strings.TrimSuffix(request.Path, "/"), "/")
+	last := arr[len(arr)-1]
+	var c *campaign.Campaign
+	var err error
+	switch {
+	case last == "campaigns" && request.Method != http.MethodPost:
+		list := p.campaigns.List()
+		response.Data = map[string]interface{}{
+			"code":      0,
+			"msg":       "success",
+			"campaigns": list,
+			"total":     len(list),
+		}
+		return nil
+
+	case last == "campaigns":
+		var req campaign.Campaign
+		var data []byte
+		if request.Body != nil {
+			data, err = io.ReadAll(io.LimitReader(request.Body, maxCampaignSize))
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &req)
+		}
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Data = map[string]interface{}{"code": http.StatusBadRequest, "msg": fmt.Sprintf("invalid campaign: %v", err)}
+			return p.Error()
+		}
+		operator := request.HeaderGet(admin_auth.HeaderIdentity)
+		if c, err = p.campaigns.Create(req, operator); err == nil {
+			p.log.AddLog(request.RemoteAddr, "", "campaign created", http.StatusOK, map[string]interface{}{
+				"campaign": c.ID, "version": c.Version, "operator": operator,
+			})
+		}
+		last = "create"
+
+	case arr[len(arr)-2] == "campaigns":
+		c, err = p.campaigns.Get(last)
+		last = "show"
+
+	default:
+		id := arr[len(arr)-2]
+		reason := cvt.ToString(request.Private["reason"])
+		operator := request.HeaderGet(admin_auth.HeaderIdentity)
+		if c, err = p.campaigns.Control(id, last, reason); err == nil {
+			p.log.AddLog(request.RemoteAddr, "", "campaign "+last, http.StatusOK, map[string]interface{}{
+				"campaign": id, "reason": reason, "operator": operator,
+			})
+		}
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, campaign.ErrNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, campaign.ErrInvalidCampaign), errors.Is(err, campaign.ErrInvalidOperation):
+			status = http.StatusBadRequest
+		case errors.Is(err, campaign.ErrExists), errors.Is(err, campaign.ErrInvalidTransition):
+			status = http.StatusConflict
+		}
+		response.WriteHeader(status)
+		response.Data = map[string]interface{}{"code": status, "msg": err.Error(), "operation": last}
+		return p.Error()
+	}
+	response.Data = map[string]interface{}{
+		"code":      0,
+		"msg":       "success",
+		"operation": last,
+		"campaign":  c,
+	}
+	return nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
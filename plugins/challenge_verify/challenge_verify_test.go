@@ -0,0 +1,71 @@
+package challenge_verify
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+)
+
+type testSessions struct{ issued []string }
+
+func (testSessions) IsValidSess(string, string) bool      { return true }
+func (testSessions) MarkSessVerified(string, string) bool { return true }
+
+func (s *testSessions) GenerateAuthHeader(serialNumber, purpose, version string) (string, error) {
+	s.issued = append(s.issued, purpose)
+	return "Bearer " + purpose, nil
+}
+
+func (s *testSessions) GenerateRegisterHeader(serialNumber, pool string) (string, error) {
+	s.issued = append(s.issued, "register")
+	return "Bearer register", nil
+}
+
+type testDevices struct{}
+
+func (testDevices) ResolvePool(string, string) string    { return "default" }
+func (testDevices) GetAllowance(string) int              { return 10 }
+func (testDevices) GetDeviceKey(string) (string, error)  { return "device-key", nil }
+func (testDevices) Observe(string, string, string) error { return nil }
+
+func TestPlugin_Purpose(t *testing.T) {
+	sessions := &testSessions{}
+	logs := audit.NewManager(t.TempDir())
+	defer logs.Close()
+	plugin, err := NewFactory(sessions, testDevices{}, testDevices{}, testDevices{}).New(
+		&config.PluginConfig{Name: "Challenge_Verify"}, &vicg.Infra{ExtraConfig: map[string]interface{}{audit.LOG_MANAGER: logs}})
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	verify := func(purpose string) *proxy.Response {
+		request := &proxy.Request{Private: map[string]interface{}{
+			"serial_number": "0000000001",
+			"challenge":     "challenge",
+			"signature":     common.SignSignature("challenge", "device-key"),
+			"purpose":       purpose,
+			"version":       "1.0.1",
+		}}
+		response := &proxy.Response{Metadata: proxy.Metadata{Headers: map[string][]string{}}}
+		_ = plugin.(*Plugin).HandleHTTPMessage(context.Background(), request, response)
+		return response
+	}
+
+	// a download ticket is only issued by the firmware update, which checks the version for the device
+	if response := verify("download"); response.Metadata.StatusCode != http.StatusBadRequest || len(sessions.issued) != 0 {
+		t.Fatalf("Expected a download ticket to be refused, got %d and %v", response.Metadata.StatusCode, sessions.issued)
+	}
+	for _, purpose := range []string{"firmware", "check-in", "register"} {
+		if response := verify(purpose); response.Metadata.StatusCode == http.StatusBadRequest {
+			t.Fatalf("Expected a %s token, got %v", purpose, response.Data)
+		}
+	}
+	if len(sessions.issued) != 3 {
+		t.Fatalf("Expected 3 tokens issued, got %v", sessions.issued)
+	}
+}
@@ -1,94 +1,130 @@
-package device_auth
-
-// Package device_auth provides a plugin for device authentication.
-// Manually block a specific device or authorize a specific device.
-import (
-	"context"
-	"fmt"
-	"net/http"
-	"strings"
-
-	"github.com/luraproject/lura/v2/config"
-	"github.com/luraproject/lura/v2/proxy"
-	"github.com/luraproject/lura/v2/vicg"
-	"github.com/yuanyuanxiang/fss/pkg/audit"
-)
-
-type DeviceAuth interface {
-	BlockDevice(serialNumber string) error
-	AuthorizeDevice(serialNumber string) error
-}
-
-type factory struct {
-	auth DeviceAuth
-}
-
-// Plugin defines
-type Plugin struct {
-	factory
-	name  string
-	index int
-	log   audit.LogManager
-}
-
-func NewFactory(auth DeviceAuth) vicg.VicgPluginFactory {
-	return factory{auth: auth}
-}
-
-func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
-	p := &Plugin{
-		factory: f,
-		index:   cfg.Index,
-		name:    cfg.Name,
-		log:     nil,
-	}
-	var m map[string]interface{}
-	if v, ok := infra.(*vicg.Infra); ok && v != nil {
-		m = v.ExtraConfig
-	}
-	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
-	if p.log == nil {
-		return nil, fmt.Errorf("audit log manager is not set")
-	}
-	return p, nil
-}
-
-func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
-	arr := strings.Split(request.Path, "/")
-	serialNumber := arr[len(arr)-2]
-	operation := arr[len(arr)-1]
-	var err error
-	switch operation {
-	case "block":
-		err = p.auth.BlockDevice(serialNumber)
-	case "authorize":
-		err = p.auth.AuthorizeDevice(serialNumber)
-	default:
-		response.WriteHeader(http.StatusBadRequest)
-		response.Data = map[string]interface{}{"code": http.StatusBadRequest, "msg": "invalid operation", "serial_number": serialNumber}
-		return p.Error()
-	}
-	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "failed to "+operation, http.StatusInternalServerError, err.Error())
-		response.Data = map[string]interface{}{"code": http.StatusInternalServerError, "msg": err.Error()}
-		return p.Error()
-	}
-	response.Data = map[string]interface{}{
-		"code":          0,
-		"msg":           "success",
-		"serial_number": serialNumber,
-		"operation":     operation,
-	}
-	p.log.AddLog(request.RemoteAddr, serialNumber, "success", http.StatusOK)
-
-	return nil
-}
-
-func (p *Plugin) Priority() int {
-	return p.index
-}
-
-func (p *Plugin) Error() error {
-	return fmt.Errorf("failed on plugin: '%s'", p.name)
-}
+package device_auth
+
+// Package device_auth provides a plugin for device authentication.
+// Manually block a specific device or authorize a specific device, tag a device for the update campaigns,
+// set the release channel of a device, or approve the rollback of a device below its security version.
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+	"github.com/yuanyuanxiang/fss/plugins/admin_auth"
+)
+
+type DeviceAuth interface {
+	BlockDevice(serialNumber string) error
+	AuthorizeDevice(serialNumber string) error
+	SetDeviceTags(serialNumber string, tags []string) error
+	SetDeviceChannel(serialNumber, channel string) error
+	ApproveRollback(serialNumber, version, operator, reason string) error
+}
+
+type factory struct {
+	auth DeviceAuth
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+	log   audit.LogManager
+}
+
+func NewFactory(auth DeviceAuth) vicg.VicgPluginFactory {
+	return factory{auth: auth}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		log:     nil,
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	return p, nil
+}
+
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	arr := strings.Split(request.Path, "/")
+	serialNumber := arr[len(arr)-2]
+	operation := arr[len(arr)-1]
+	var err error
+	var detail interface{} = operation
+	switch operation {
+	case "block":
+		err = p.auth.BlockDevice(serialNumber)
+	case "authorize":
+		err = p.auth.AuthorizeDevice(serialNumber)
+	case "tags":
+		// {"tags": ["lab", "beta"]}, an empty list removes the tags
+		tags := []string{}
+		list, _ := request.Private["tags"].([]interface{})
+		for _, t := range list {
+			if tag := cvt.ToString(t); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		err = p.auth.SetDeviceTags(serialNumber, tags)
+		detail = map[string]interface{}{"operation": operation, "tags": tags}
+	case "channel":
+		// {"channel": "beta"}
+		channel := cvt.ToString(request.Private["channel"])
+		err = p.auth.SetDeviceChannel(serialNumber, channel)
+		detail = map[string]interface{}{"operation": operation, "channel": channel}
+	case "rollback":
+		// {"version": "1.0.2", "reason": "1.0.3 bricks rev-a boards"}, the approval is used by the response which delivers it
+		version := cvt.ToString(request.Private["version"])
+		reason := cvt.ToString(request.Private["reason"])
+		operator := request.HeaderGet(admin_auth.HeaderIdentity)
+		err = p.auth.ApproveRollback(serialNumber, version, operator, reason)
+		detail = map[string]interface{}{"operation": operation, "version": version, "reason": reason, "operator": operator}
+	default:
+		response.WriteHeader(http.StatusBadRequest)
+		response.Data = map[string]interface{}{"code": http.StatusBadRequest, "msg": "invalid operation", "serial_number": serialNumber}
+		return p.Error()
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, firmware.ErrInvalidChannel) || errors.Is(err, firmware.ErrInvalidVersion) {
+			status = http.StatusBadRequest
+		}
+		response.WriteHeader(status)
+		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "failed to "+operation, status, err.Error())
+		response.Data = map[string]interface{}{"code": status, "msg": err.Error()}
+		return p.Error()
+	}
+	response.Data = map[string]interface{}{
+		"code":          0,
+		"msg":           "success",
+		"serial_number": serialNumber,
+		"operation":     operation,
+	}
+	p.log.AddLog(request.RemoteAddr, serialNumber, "success", http.StatusOK, detail)
+
+	return nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
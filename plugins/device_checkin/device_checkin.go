@@ -0,0 +1,233 @@
+package device_checkin
+
+// Package device_checkin provides a plugin for the check-in of devices.
+// A device reports the firmware it runs, and gets the version it should run.
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	"github.com/yuanyuanxiang/fss/internal/pkg/token"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+)
+
+const (
+	StatusUpdateAvailable = "update-available"
+	StatusUpToDate        = "up-to-date"
+	StatusBlocked         = "blocked"
+
+	// StateFailed is reported by a device which failed to install its target version.
+	StateFailed = "failed"
+)
+
+// Report is what a device reports at check-in.
+type Report struct {
+	Version  string `json:"version"`         // firmware version the device runs
+	State    string `json:"state"`           // state of the device, "failed" if the last update failed
+	Hardware string `json:"hardware"`        // hardware revision
+	Error    string `json:"error,omitempty"` // why the last update failed
+}
+
+// Target is the firmware the device should run.
+type Target struct {
+	Status   string `json:"status"`
+	Version  string `json:"target_version,omitempty"`
+	Campaign string `json:"campaign,omitempty"` // the campaign which assigned the version
+	Channel  string `json:"channel,omitempty"`  // release channel of the device
+	Size     int64  `json:"size,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+type SessionManager interface {
+	GenerateAuthHeader(serialNumber, purpose, version string) (string, error)
+	VerifyAuthHeader(authHeader, purpose, version string) (string, error)
+}
+
+type DeviceManager interface {
+	GetDeviceCertificate(serialNumber string) string
+}
+
+// Planner records the report of the device, and returns the firmware it should run.
+type Planner interface {
+	CheckIn(serialNumber string, report Report) (*Target, error)
+}
+
+// CloneDetector checks that an authenticated device isn't a clone, it raises the incident itself.
+type CloneDetector interface {
+	Observe(serialNumber, remoteAddr, publicKey string) error
+}
+
+type factory struct {
+	sess    SessionManager
+	dev     DeviceManager
+	planner Planner
+	clones  CloneDetector
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+	log   audit.LogManager
+}
+
+func NewFactory(sess SessionManager, dev DeviceManager, planner Planner, clones CloneDetector) vicg.VicgPluginFactory {
+	return factory{sess: sess, dev: dev, planner: planner, clones: clones}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		log:     nil,
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	return p, nil
+}
+
+/*
+POST /api/devices/{serialNumber}/check-in
+
+Header: <Authorization: "xxx">, a "check-in" token, not needed if the device presents its certificate in the TLS handshake
+
+Request:
+
+	{
+		"version": "1.0.1",
+		"state": "updated",
+		"hardware": "rev-b",
+		"error": "why the last update failed, with the state 'failed'"
+	}
+
+Response:
+
+	{
+		"code": 0,
+		"msg": "success",
+		"serial_number": "0000000001",
+		"status": "update-available",
+		"target_version": "1.0.2",
+		"campaign": "spring-release",
+		"channel": "stable",
+		"size": 1048576,
+		"sha256": "sha256 of the plain firmware image",
+		"token": "firmware token of the target version, unless the device presents its certificate"
+	}
+
+The status is "update-available", "up-to-date", or "blocked" for a device which may not be updated.
+A device reports the result of an update at its next check-in, with the state "failed" if it failed.
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	arr := strings.Split(strings.TrimSuffix(request.Path, "/"), "/")
+	serialNumber := arr[len(arr)-2]
+	authenticated, err := p.authenticate(request)
+	if err == nil && authenticated != serialNumber {
+		err = fmt.Errorf("not authorized for device %s", serialNumber)
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusUnauthorized)
+		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "missing or invalid authorization header", http.StatusUnauthorized, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusUnauthorized,
+			"msg":           fmt.Sprintf("missing or invalid authorization header: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	if err := p.clones.Observe(serialNumber, request.RemoteAddr, ""); err != nil {
+		response.WriteHeader(http.StatusForbidden)
+		response.Data = map[string]interface{}{
+			"code":          http.StatusForbidden,
+			"msg":           err.Error(),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	report := Report{
+		Version:  cvt.ToString(request.Private["version"]),
+		State:    cvt.ToString(request.Private["state"]),
+		Hardware: cvt.ToString(request.Private["hardware"]),
+		Error:    cvt.ToString(request.Private["error"]),
+	}
+	target, err := p.planner.CheckIn(serialNumber, report)
+	if err != nil {
+		response.WriteHeader(http.StatusConflict)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "check-in failed", http.StatusConflict, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusConflict,
+			"msg":           fmt.Sprintf("check-in failed: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	response.Data = map[string]interface{}{
+		"code":           0,
+		"msg":            "success",
+		"serial_number":  serialNumber,
+		"status":         target.Status,
+		"target_version": target.Version,
+		"campaign":       target.Campaign,
+		"channel":        target.Channel,
+		"size":           target.Size,
+		"sha256":         target.SHA256,
+	}
+	// the check-in authorizes the download of the target version, without another challenge
+	if target.Status == StatusUpdateAvailable && request.HeaderGet(common.HeaderDeviceCert) == "" {
+		auth, err := p.sess.GenerateAuthHeader(serialNumber, token.PurposeFirmware, target.Version)
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			response.Data = map[string]interface{}{
+				"code":          http.StatusInternalServerError,
+				"msg":           fmt.Sprintf("failed to generate token: %v", err),
+				"serial_number": serialNumber,
+			}
+			return p.Error()
+		}
+		response.Data["token"] = auth
+	}
+	p.log.AddLog(request.RemoteAddr, serialNumber, "check-in", http.StatusOK, map[string]interface{}{
+		"version":        report.Version,
+		"state":          report.State,
+		"status":         target.Status,
+		"target_version": target.Version,
+	})
+	return nil
+}
+
+// authenticate returns the serial number of the device, which is authenticated by its certificate,
+// or by the auth header whose token must be issued for the check-in.
+func (p *Plugin) authenticate(request *proxy.Request) (string, error) {
+	serialNumber := request.HeaderGet(common.HeaderDeviceCert)
+	if serialNumber == "" {
+		return p.sess.VerifyAuthHeader(request.HeaderGet("Authorization"), token.PurposeCheckIn, "")
+	}
+	// the certificate must be the last one issued to the device
+	fingerprint := p.dev.GetDeviceCertificate(serialNumber)
+	if fingerprint == "" || fingerprint != request.HeaderGet(common.HeaderDeviceCertSHA256) {
+		return serialNumber, fmt.Errorf("certificate is not bound to the device")
+	}
+	return serialNumber, nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
@@ -1,132 +1,201 @@
-package device_register
-
-// Package device_register provides a plugin for registering devices in the simulator.
-
-import (
-	"context"
-	"fmt"
-	"net/http"
-
-	"github.com/luraproject/lura/v2/config"
-	"github.com/luraproject/lura/v2/proxy"
-	"github.com/luraproject/lura/v2/vicg"
-	"github.com/yuanyuanxiang/fss/pkg/audit"
-	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
-)
-
-type SessionManager interface {
-	VerifyAuthHeader(authHeader string) (string, error)
-}
-
-type DeviceManager interface {
-	RegisterDevice(serialNumber, publicKey, state string, isVerified bool) error
-}
-
-type factory struct {
-	sess      SessionManager
-	dev       DeviceManager
-	publicKey string
-}
-
-// Plugin defines
-type Plugin struct {
-	factory
-	name  string
-	index int
-	log   audit.LogManager
-}
-
-func NewFactory(sess SessionManager, dev DeviceManager, publicKey string) vicg.VicgPluginFactory {
-	return factory{sess: sess, dev: dev, publicKey: publicKey}
-}
-
-func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
-	p := &Plugin{
-		factory: f,
-		index:   cfg.Index,
-		name:    cfg.Name,
-		log:     nil,
-	}
-	var m map[string]interface{}
-	if v, ok := infra.(*vicg.Infra); ok && v != nil {
-		m = v.ExtraConfig
-	}
-	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
-	if p.log == nil {
-		return nil, fmt.Errorf("audit log manager is not set")
-	}
-	return p, nil
-}
-
-/*
-Request:
-
-	{
-		"serial_number": "1234567890",
-		"public_key": "abcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890"
-	}
-
-Response:
-
-	{
-		"code" : 0,
-		"msg" : "ok"
-		"public_key": "abcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890"
-	}
-*/
-func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
-	// verify auth header
-	serialNumber, err := p.sess.VerifyAuthHeader(request.HeaderGet("Authorization"))
-	if serialNumber == "" || err != nil {
-		response.WriteHeader(http.StatusUnauthorized)
-		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "missing or invalid authorization header", http.StatusUnauthorized, err.Error())
-		response.Data = map[string]interface{}{
-			"code":          http.StatusUnauthorized,
-			"msg":           fmt.Sprintf("missing or invalid authorization header: %v", err),
-			"serial_number": serialNumber,
-		}
-		return p.Error()
-	}
-
-	if cvt.ToString(request.Private["serial_number"]) != serialNumber {
-		response.WriteHeader(http.StatusBadRequest)
-		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "serial number mismatch", http.StatusBadRequest)
-		response.Data = map[string]interface{}{
-			"code":          http.StatusBadRequest,
-			"msg":           "serial number mismatch",
-			"serial_number": cvt.ToString(request.Private["serial_number"]),
-		}
-		return p.Error()
-	}
-
-	// register device: if the allowance is exceeded, it will also return an error
-	if err := p.dev.RegisterDevice(serialNumber, cvt.ToString(request.Private["public_key"]),
-		cvt.ToString(request.Private["state"]), true); err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "failed to register device", http.StatusInternalServerError, err.Error())
-		response.Data = map[string]interface{}{
-			"code":          http.StatusInternalServerError,
-			"msg":           fmt.Sprintf("failed to register device: %v", err),
-			"serial_number": serialNumber,
-		}
-		return p.Error()
-	}
-
-	response.Data = map[string]interface{}{
-		"code":          0,
-		"msg":           "success",
-		"serial_number": serialNumber,
-		"public_key":    p.publicKey,
-	}
-	response.WriteHeader(http.StatusCreated)
-	p.log.AddLog(request.RemoteAddr, serialNumber, "success", http.StatusOK)
-	return nil
-}
-
-func (p *Plugin) Priority() int {
-	return p.index
-}
-
-func (p *Plugin) Error() error {
-	return fmt.Errorf("failed on plugin: '%s'", p.name)
-}
+package device_register
+
+// Package device_register provides a plugin for registering devices in the simulator.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/internal/pkg/ledger"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+)
+
+type SessionManager interface {
+	VerifyRegisterHeader(authHeader string) (string, string, error)
+}
+
+type DeviceManager interface {
+	RegisterDevice(serialNumber, publicKey, state, productID, pool string, isVerified bool) error
+	SetDeviceCertificate(serialNumber, fingerprint string) error
+}
+
+// CertificateAuthority issues the client certificates of devices.
+type CertificateAuthority interface {
+	SignCSR(serialNumber, csrPEM string) (certPEM, fingerprint string, err error)
+	CertificatePEM() string
+}
+
+// CloneDetector checks that an authenticated device isn't a clone, it raises the incident itself.
+type CloneDetector interface {
+	Observe(serialNumber, remoteAddr, publicKey string) error
+}
+
+type factory struct {
+	sess      SessionManager
+	dev       DeviceManager
+	publicKey string
+	ca        CertificateAuthority // nil if devices don't get certificates
+	clones    CloneDetector
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+	log   audit.LogManager
+}
+
+func NewFactory(sess SessionManager, dev DeviceManager, publicKey string, ca CertificateAuthority, clones CloneDetector) vicg.VicgPluginFactory {
+	return factory{sess: sess, dev: dev, publicKey: publicKey, ca: ca, clones: clones}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		log:     nil,
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	return p, nil
+}
+
+/*
+Request:
+
+	{
+		"serial_number": "1234567890",
+		"public_key": "abcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890",
+		"csr": "optional PEM certificate signing request, whose common name is the serial number",
+		"product_id": "optional product ID, which must select the allowance pool of the register token"
+	}
+
+Response:
+
+	{
+		"code" : 0,
+		"msg" : "ok"
+		"public_key": "abcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890",
+		"certificate": "PEM device certificate, only if a CSR is sent and the device CA is enabled",
+		"ca_certificate": "PEM device CA certificate"
+	}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	// verify auth header, the token carries the allowance pool resolved when it was issued
+	serialNumber, pool, err := p.sess.VerifyRegisterHeader(request.HeaderGet("Authorization"))
+	if serialNumber == "" || err != nil {
+		response.WriteHeader(http.StatusUnauthorized)
+		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "missing or invalid authorization header", http.StatusUnauthorized, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusUnauthorized,
+			"msg":           fmt.Sprintf("missing or invalid authorization header: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+
+	if cvt.ToString(request.Private["serial_number"]) != serialNumber {
+		response.WriteHeader(http.StatusBadRequest)
+		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "serial number mismatch", http.StatusBadRequest)
+		response.Data = map[string]interface{}{
+			"code":          http.StatusBadRequest,
+			"msg":           "serial number mismatch",
+			"serial_number": cvt.ToString(request.Private["serial_number"]),
+		}
+		return p.Error()
+	}
+
+	// a clone registers the serial number again with its own public key
+	if err := p.clones.Observe(serialNumber, request.RemoteAddr, cvt.ToString(request.Private["public_key"])); err != nil {
+		response.WriteHeader(http.StatusForbidden)
+		response.Data = map[string]interface{}{
+			"code":          http.StatusForbidden,
+			"msg":           err.Error(),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+
+	// sign the certificate before registering, so an invalid request doesn't change the registry
+	var certPEM, fingerprint string
+	if csr := cvt.ToString(request.Private["csr"]); csr != "" && p.ca != nil {
+		certPEM, fingerprint, err = p.ca.SignCSR(serialNumber, csr)
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "invalid certificate signing request", http.StatusBadRequest, err.Error())
+			response.Data = map[string]interface{}{
+				"code":          http.StatusBadRequest,
+				"msg":           fmt.Sprintf("invalid certificate signing request: %v", err),
+				"serial_number": serialNumber,
+			}
+			return p.Error()
+		}
+	}
+
+	// register device: if the allowance is exceeded, or the product ID doesn't select the pool, it will also return an error
+	if err := p.dev.RegisterDevice(serialNumber, cvt.ToString(request.Private["public_key"]),
+		cvt.ToString(request.Private["state"]), cvt.ToString(request.Private["product_id"]), pool, true); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ledger.ErrPoolMismatch) {
+			status = http.StatusForbidden
+		}
+		response.WriteHeader(status)
+		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "failed to register device", status, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          status,
+			"msg":           fmt.Sprintf("failed to register device: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+
+	// registering again drops the previous certificate, only the new one is bound to the device
+	if fingerprint != "" {
+		if err := p.dev.SetDeviceCertificate(serialNumber, fingerprint); err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "failed to save device certificate", http.StatusInternalServerError, err.Error())
+			response.Data = map[string]interface{}{
+				"code":          http.StatusInternalServerError,
+				"msg":           fmt.Sprintf("failed to save device certificate: %v", err),
+				"serial_number": serialNumber,
+			}
+			return p.Error()
+		}
+	}
+
+	response.Data = map[string]interface{}{
+		"code":          0,
+		"msg":           "success",
+		"serial_number": serialNumber,
+		"public_key":    p.publicKey,
+	}
+	if certPEM != "" {
+		response.Data["certificate"] = certPEM
+		response.Data["ca_certificate"] = p.ca.CertificatePEM()
+	}
+	response.WriteHeader(http.StatusCreated)
+	p.log.AddLog(request.RemoteAddr, serialNumber, "success", http.StatusOK)
+	return nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
@@ -1,89 +1,89 @@
-package device_simulate
-
-// Package device_simulate provides a plugin for generating devices in the simulator.
-
-import (
-	"context"
-	"fmt"
-	"net/http"
-
-	"github.com/luraproject/lura/v2/config"
-	"github.com/luraproject/lura/v2/proxy"
-	"github.com/luraproject/lura/v2/vicg"
-	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
-)
-
-type DeviceSimulator interface {
-	GenerateDevices(master string, count int, startSerial int) error
-}
-
-type factory struct {
-	gen DeviceSimulator
-}
-
-// Plugin defines
-type Plugin struct {
-	factory
-	name  string
-	index int
-	infra interface{}
-}
-
-func NewFactory(gen DeviceSimulator) vicg.VicgPluginFactory {
-	return factory{gen: gen}
-}
-
-func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
-	return &Plugin{
-		factory: f,
-		index:   cfg.Index,
-		name:    cfg.Name,
-		infra:   infra,
-	}, nil
-}
-
-/*
-Request:
-
-	{
-		"master_address": "127.0.0.1:9000",
-		"generate": "100",
-		"start-serial":1
-	}
-*/
-func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
-	masterAddress := cvt.ToString(request.Private["master_address"])
-	generate := cvt.ToInt(request.Private["generate"])
-	startSerial := cvt.ToInt(request.Private["start-serial"])
-	if generate <= 0 || startSerial <= 0 {
-		response.WriteHeader(http.StatusBadRequest)
-		response.Data = map[string]interface{}{
-			"code": http.StatusBadRequest,
-			"msg":  "generate and start-serial must be greater than 0",
-		}
-		return p.Error()
-	}
-	err := p.gen.GenerateDevices(masterAddress, generate, startSerial)
-	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		response.Data = map[string]interface{}{
-			"code": http.StatusInternalServerError,
-			"msg":  fmt.Sprintf("failed to generate devices: %v", err),
-		}
-		return p.Error()
-	}
-	response.Data = map[string]interface{}{
-		"code": 0,
-		"msg":  "success",
-	}
-
-	return nil
-}
-
-func (p *Plugin) Priority() int {
-	return p.index
-}
-
-func (p *Plugin) Error() error {
-	return fmt.Errorf("failed on plugin: '%s'", p.name)
-}
+package device_simulate
+
+// Package device_simulate provides a plugin for generating devices in the simulator.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+)
+
+type DeviceSimulator interface {
+	GenerateDevices(master string, count int, startSerial int) error
+}
+
+type factory struct {
+	gen DeviceSimulator
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+	infra interface{}
+}
+
+func NewFactory(gen DeviceSimulator) vicg.VicgPluginFactory {
+	return factory{gen: gen}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	return &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		infra:   infra,
+	}, nil
+}
+
+/*
+Request:
+
+	{
+		"master_address": "127.0.0.1:9000",
+		"generate": "100",
+		"start-serial":1
+	}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	masterAddress := cvt.ToString(request.Private["master_address"])
+	generate := cvt.ToInt(request.Private["generate"])
+	startSerial := cvt.ToInt(request.Private["start-serial"])
+	if generate <= 0 || startSerial <= 0 {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Data = map[string]interface{}{
+			"code": http.StatusBadRequest,
+			"msg":  "generate and start-serial must be greater than 0",
+		}
+		return p.Error()
+	}
+	err := p.gen.GenerateDevices(masterAddress, generate, startSerial)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		response.Data = map[string]interface{}{
+			"code": http.StatusInternalServerError,
+			"msg":  fmt.Sprintf("failed to generate devices: %v", err),
+		}
+		return p.Error()
+	}
+	response.Data = map[string]interface{}{
+		"code": 0,
+		"msg":  "success",
+	}
+
+	return nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
@@ -0,0 +1,178 @@
+package firmware_admin
+
+// Package firmware_admin provides a plugin for managing the firmware repository.
+// List firmware versions, publish a version to its release channels, change the channels or retire (yank) a version.
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+)
+
+type FirmwareStore interface {
+	List() ([]firmware.Metadata, error)
+	Publish(version, signature string, channels ...string) (*firmware.Metadata, error)
+	SetChannels(version string, channels []string) (*firmware.Metadata, error)
+	Retire(version, reason string) (*firmware.Metadata, error)
+}
+
+type factory struct {
+	store FirmwareStore
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+	log   audit.LogManager
+}
+
+func NewFactory(store FirmwareStore) vicg.VicgPluginFactory {
+	return factory{store: store}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		log:     nil,
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	return p, nil
+}
+
+/*
+GET /api/firmwares - list all firmware versions
+
+POST /api/firmwares/{version}/publish - publish a version, to the stable channel if no channels;
+the signature of its manifest is made offline with the publisher key (fss vendor --sign-firmware)
+
+	{
+		"channels": ["beta", "factory"],
+		"signature": "base64 signature of the firmware manifest"
+	}
+
+POST /api/firmwares/{version}/channels - change the channels of a published version, e.g. promote it to stable; the channels are required
+
+	{
+		"channels": ["stable", "beta"]
+	}
+
+POST /api/firmwares/{version}/retire - retire a version
+
+	{
+		"reason": "security issue"
+	}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	arr := strings.Split(strings.TrimSuffix(request.Path, "/"), "/")
+	operation := arr[len(arr)-1]
+	if operation == "firmwares" {
+		list, err := p.store.List()
+		if err != nil {
+			response.WriteHeader(http.StatusInternalServerError)
+			response.Data = map[string]interface{}{
+				"code": http.StatusInternalServerError,
+				"msg":  fmt.Sprintf("failed to list firmware: %v", err),
+			}
+			return p.Error()
+		}
+		response.Data = map[string]interface{}{
+			"code":      0,
+			"msg":       "success",
+			"firmwares": list,
+			"total":     len(list),
+		}
+		return nil
+	}
+
+	version := arr[len(arr)-2]
+	var meta *firmware.Metadata
+	var desc string
+	var detail interface{} = version
+	var err error
+	switch operation {
+	case "publish":
+		meta, err = p.store.Publish(version, cvt.ToString(request.Private["signature"]), channels(request.Private["channels"])...)
+		desc = "firmware published"
+	case "channels":
+		meta, err = p.store.SetChannels(version, channels(request.Private["channels"]))
+		desc = "firmware channels changed"
+	case "retire":
+		meta, err = p.store.Retire(version, cvt.ToString(request.Private["reason"]))
+		desc = "firmware retired"
+	default:
+		response.WriteHeader(http.StatusBadRequest)
+		response.Data = map[string]interface{}{"code": http.StatusBadRequest, "msg": "invalid operation", "version": version}
+		return p.Error()
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, firmware.ErrNotFound), errors.Is(err, firmware.ErrInvalidVersion):
+			status = http.StatusNotFound
+		case errors.Is(err, firmware.ErrInvalidStatus):
+			status = http.StatusConflict
+		case errors.Is(err, firmware.ErrInvalidChannel), errors.Is(err, firmware.ErrInvalidSignature):
+			status = http.StatusBadRequest
+		}
+		response.WriteHeader(status)
+		response.Data = map[string]interface{}{"code": status, "msg": err.Error(), "version": version}
+		return p.Error()
+	}
+	response.Data = map[string]interface{}{
+		"code":      0,
+		"msg":       "success",
+		"operation": operation,
+		"firmware":  meta,
+	}
+	if operation != "retire" {
+		detail = map[string]interface{}{"version": version, "channels": meta.Channels}
+	}
+	p.log.AddLog(request.RemoteAddr, "", desc, http.StatusOK, detail)
+
+	return nil
+}
+
+// channels returns the channels in the request body, a list or a comma separated string.
+func channels(v interface{}) []string {
+	var list []string
+	switch v := v.(type) {
+	case []interface{}:
+		for _, ch := range v {
+			list = append(list, cvt.ToString(ch))
+		}
+	case string:
+		for _, ch := range strings.Split(v, ",") {
+			if ch = strings.TrimSpace(ch); ch != "" {
+				list = append(list, ch)
+			}
+		}
+	}
+	return list
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
@@ -0,0 +1,276 @@
+package firmware_download
+
+// Package firmware_download provides a plugin for the resumable download of firmware images.
+// The device downloads the image in ranges, authorized by the ticket of a binary firmware update.
+// Only the requested range is read from the image, its SHA-256 was checked when the ticket was issued.
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/internal/pkg/campaign"
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+)
+
+// errUnsatisfiable is returned for a range which starts after the end of the image.
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+type SessionManager interface {
+	VerifyDownloadTicket(authHeader, version string) (string, error)
+}
+
+type DeviceManager interface {
+	IsDeviceRegistered(serialNumber string) error
+	GetDevicePublicKey(serialNumber string) string
+	RaiseSecurityFloor(serialNumber string, securityVersion uint32) error
+}
+
+type FirmwareStore interface {
+	OpenImage(version string) (*firmware.Metadata, *os.File, error)
+}
+
+// CloneDetector checks that an authenticated device isn't a clone, it raises the incident itself.
+type CloneDetector interface {
+	Observe(serialNumber, remoteAddr, publicKey string) error
+}
+
+// Campaigns records the progress of the devices admitted by update campaigns.
+type Campaigns interface {
+	Record(serialNumber, version, status, errMsg string) error
+}
+
+type factory struct {
+	sess       SessionManager
+	dev        DeviceManager
+	store      FirmwareStore
+	serverPriv *ecdh.PrivateKey
+	clones     CloneDetector
+	campaigns  Campaigns
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+	log   audit.LogManager
+}
+
+func NewFactory(sess SessionManager, dev DeviceManager, store FirmwareStore, serverPriv *ecdh.PrivateKey, clones CloneDetector, campaigns Campaigns) vicg.VicgPluginFactory {
+	return factory{sess: sess, dev: dev, store: store, serverPriv: serverPriv, clones: clones, campaigns: campaigns}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		log:     nil,
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	return p, nil
+}
+
+/*
+GET /api/firmware/{version}/download
+
+Header: <Authorization: "Bearer xxx">, the ticket of GET /api/firmware/{version}?mode=binary
+Header: <Range: "bytes=65536-">, optional, a single range of the image
+
+Response: the image encrypted with AES-CTR by the key shared with the device, the IV is derived from the ticket.
+The bytes of a range are encrypted at their offset in the image, so the device decrypts each range on its own.
+A range is answered with 206 and the Content-Range header, a range after the end of the image with 416.
+The device is delivered the version when the last byte of the image is served, which raises its security floor.
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	arr := strings.Split(strings.TrimSuffix(request.Path, "/"), "/")
+	version := arr[len(arr)-2]
+	auth := request.HeaderGet("Authorization")
+	serialNumber, err := p.sess.VerifyDownloadTicket(auth, version)
+	if serialNumber == "" || err != nil {
+		if err == nil {
+			err = fmt.Errorf("invalid ticket")
+		}
+		response.WriteHeader(http.StatusUnauthorized)
+		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "missing or invalid download ticket", http.StatusUnauthorized, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusUnauthorized,
+			"msg":           fmt.Sprintf("missing or invalid download ticket: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	if err := p.clones.Observe(serialNumber, request.RemoteAddr, ""); err != nil {
+		response.WriteHeader(http.StatusForbidden)
+		response.Data = map[string]interface{}{
+			"code":          http.StatusForbidden,
+			"msg":           err.Error(),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	// a device blocked during the download isn't served the rest of the image
+	if err := p.dev.IsDeviceRegistered(serialNumber); err != nil {
+		response.WriteHeader(http.StatusConflict)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "check device status failed", http.StatusConflict, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusConflict,
+			"msg":           "check device status failed",
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	// nor a version retired during the download
+	meta, image, err := p.store.OpenImage(version)
+	if err == nil {
+		defer image.Close()
+		if meta.Status != firmware.StatusPublished {
+			err = fmt.Errorf("firmware %s is %s", version, meta.Status)
+		}
+	}
+	if err != nil {
+		response.WriteHeader(http.StatusNotFound)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "firmware unavailable", http.StatusNotFound, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusNotFound,
+			"msg":           fmt.Sprintf("firmware unavailable: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	clientPubKey, err := common.Base64ToPublicKey(p.dev.GetDevicePublicKey(serialNumber))
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "invalid public key", http.StatusBadRequest, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusBadRequest,
+			"msg":           fmt.Sprintf("invalid public key: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	size := meta.Size
+	start, end, partial, err := parseRange(request.HeaderGet("Range"), size)
+	if err != nil {
+		response.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		response.Metadata.Headers["Content-Range"] = []string{fmt.Sprintf("bytes */%d", size)}
+		response.Data = map[string]interface{}{
+			"code":          http.StatusRequestedRangeNotSatisfiable,
+			"msg":           err.Error(),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	sharedSecret, _ := p.serverPriv.ECDH(clientPubKey)
+	encKey, _ := common.DeriveKeys(sharedSecret)
+	stream, err := common.NewStreamAt(encKey, common.DeriveIV(strings.TrimPrefix(auth, "Bearer ")), start)
+	if err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		response.Data = map[string]interface{}{
+			"code":          http.StatusInternalServerError,
+			"msg":           fmt.Sprintf("failed to encrypt response: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	out := make([]byte, end-start+1)
+	if _, err := image.ReadAt(out, start); err != nil {
+		response.WriteHeader(http.StatusInternalServerError)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "failed to read firmware image", http.StatusInternalServerError, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusInternalServerError,
+			"msg":           fmt.Sprintf("failed to read firmware image: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	stream.XORKeyStream(out, out)
+
+	response.Metadata.Headers["Content-Type"] = []string{"application/octet-stream"}
+	response.Metadata.Headers["Accept-Ranges"] = []string{"bytes"}
+	if partial {
+		response.Metadata.Headers["Content-Range"] = []string{fmt.Sprintf("bytes %d-%d/%d", start, end, size)}
+		response.WriteHeader(http.StatusPartialContent)
+	} else {
+		response.WriteHeader(http.StatusOK)
+	}
+	// or the router adds "Cache-Control: public" of the cache TTL
+	response.IsComplete = false
+	response.Io = bytes.NewReader(out)
+	if end == size-1 {
+		if err := p.dev.RaiseSecurityFloor(serialNumber, meta.SecurityVersion); err != nil {
+			p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "failed to raise security floor", http.StatusInternalServerError, err.Error())
+		}
+		if err := p.campaigns.Record(serialNumber, version, campaign.DeviceDelivered, ""); err != nil {
+			p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "failed to record campaign progress", http.StatusInternalServerError, err.Error())
+		}
+	}
+	return nil
+}
+
+// parseRange returns the first and the last byte of the range of the header, or the whole image if there's no
+// range. A malformed header, or one of several ranges, is ignored and the whole image is served.
+func parseRange(header string, size int64) (start, end int64, partial bool, err error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, size - 1, false, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, size - 1, false, nil
+	}
+	switch {
+	case first == "":
+		// the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, size - 1, false, nil
+		}
+		if size == 0 {
+			return 0, 0, false, errUnsatisfiable
+		}
+		return max(size-n, 0), size - 1, true, nil
+	default:
+		start, err = strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return 0, size - 1, false, nil
+		}
+		end = size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return 0, size - 1, false, nil
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			return 0, 0, false, errUnsatisfiable
+		}
+		return start, end, true, nil
+	}
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
@@ -0,0 +1,163 @@
+package firmware_download
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/internal/pkg/campaign"
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+)
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		header     string
+		start, end int64
+		partial    bool
+		err        error
+	}{
+		{"", 0, 99, false, nil},
+		{"bytes=10-", 10, 99, true, nil},
+		{"bytes=10-19", 10, 19, true, nil},
+		{"bytes=90-200", 90, 99, true, nil},
+		{"bytes=-10", 90, 99, true, nil},
+		{"bytes=-200", 0, 99, true, nil},
+		{"bytes=100-", 0, 0, false, errUnsatisfiable},
+		{"bytes=20-10", 0, 99, false, nil}, // malformed, the whole image
+		{"bytes=0-1,5-9", 0, 99, false, nil},
+		{"items=0-9", 0, 99, false, nil},
+	}
+	for _, c := range cases {
+		start, end, partial, err := parseRange(c.header, 100)
+		if start != c.start || end != c.end || partial != c.partial || err != c.err {
+			t.Errorf("parseRange(%q) = %d, %d, %v, %v, expected %d, %d, %v, %v", c.header, start, end, partial, err, c.start, c.end, c.partial, c.err)
+		}
+	}
+}
+
+type testSessions struct{}
+
+func (testSessions) VerifyDownloadTicket(authHeader, version string) (string, error) {
+	if authHeader != "Bearer ticket" {
+		return "", nil
+	}
+	return "0000000001", nil
+}
+
+type testDevices struct {
+	pub   string
+	floor *uint32
+}
+
+func (testDevices) IsDeviceRegistered(string) error      { return nil }
+func (d testDevices) GetDevicePublicKey(string) string   { return d.pub }
+func (testDevices) Observe(string, string, string) error { return nil }
+
+func (d testDevices) RaiseSecurityFloor(serialNumber string, securityVersion uint32) error {
+	*d.floor = max(*d.floor, securityVersion)
+	return nil
+}
+
+type testStore struct{ path string }
+
+func (s testStore) OpenImage(version string) (*firmware.Metadata, *os.File, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, _ := f.Stat()
+	return &firmware.Metadata{Version: version, Size: info.Size(), SecurityVersion: 2, Status: firmware.StatusPublished}, f, nil
+}
+
+type testCampaigns struct{ delivered int }
+
+func (c *testCampaigns) Record(serialNumber, version, status, errMsg string) error {
+	if status == campaign.DeviceDelivered {
+		c.delivered++
+	}
+	return nil
+}
+
+func TestPlugin_Range(t *testing.T) {
+	image := bytes.Repeat([]byte("0123456789"), 10)
+	path := filepath.Join(t.TempDir(), "image.bin")
+	if err := os.WriteFile(path, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	serverPriv, _ := ecdh.P384().GenerateKey(rand.Reader)
+	devPriv, _ := ecdh.P384().GenerateKey(rand.Reader)
+	devices := testDevices{pub: common.PublicKeyToBase64(devPriv.PublicKey()), floor: new(uint32)}
+	campaigns := &testCampaigns{}
+	logs := audit.NewManager(t.TempDir())
+	defer logs.Close()
+	plugin, err := NewFactory(testSessions{}, devices, testStore{path}, serverPriv, devices, campaigns).New(
+		&config.PluginConfig{Name: "Firmware_Download"}, &vicg.Infra{ExtraConfig: map[string]interface{}{audit.LOG_MANAGER: logs}})
+	if err != nil {
+		t.Fatalf("Failed to create plugin: %v", err)
+	}
+	shared, _ := devPriv.ECDH(serverPriv.PublicKey())
+	encKey, _ := common.DeriveKeys(shared)
+
+	download := func(rangeHeader string) (*proxy.Response, []byte) {
+		request := &proxy.Request{Path: "/api/firmware/1.0.1/download", Headers: map[string][]string{
+			"Authorization": {"Bearer ticket"}, "Range": {rangeHeader},
+		}}
+		response := &proxy.Response{Data: map[string]interface{}{}, Metadata: proxy.Metadata{Headers: map[string][]string{}}}
+		_ = plugin.(*Plugin).HandleHTTPMessage(context.Background(), request, response)
+		var body []byte
+		if response.Io != nil {
+			body, _ = io.ReadAll(response.Io)
+		}
+		return response, body
+	}
+	decrypt := func(body []byte, offset int64) []byte {
+		stream, _ := common.NewStreamAt(encKey, common.DeriveIV("ticket"), offset)
+		out := make([]byte, len(body))
+		stream.XORKeyStream(out, body)
+		return out
+	}
+
+	// a range in the middle of the image, which isn't delivered yet
+	response, body := download("bytes=10-19")
+	if response.Metadata.StatusCode != http.StatusPartialContent || response.Metadata.Headers["Content-Range"][0] != "bytes 10-19/100" {
+		t.Fatalf("Unexpected response %d %v", response.Metadata.StatusCode, response.Metadata.Headers)
+	}
+	if got := decrypt(body, 10); !bytes.Equal(got, image[10:20]) {
+		t.Fatalf("Unexpected range %q", got)
+	}
+	if campaigns.delivered != 0 || *devices.floor != 0 {
+		t.Fatalf("Device shouldn't be delivered before the last byte")
+	}
+
+	// the rest of the image
+	response, body = download("bytes=20-")
+	if response.Metadata.StatusCode != http.StatusPartialContent || !bytes.Equal(decrypt(body, 20), image[20:]) {
+		t.Fatalf("Unexpected response %d", response.Metadata.StatusCode)
+	}
+	if campaigns.delivered != 1 || *devices.floor != 2 {
+		t.Fatalf("Device should be delivered with the last byte, and its floor raised")
+	}
+
+	// a range after the end of the image
+	response, body = download("bytes=100-")
+	if response.Metadata.StatusCode != http.StatusRequestedRangeNotSatisfiable || response.Metadata.Headers["Content-Range"][0] != "bytes */100" || body != nil {
+		t.Fatalf("Unexpected response %d %v", response.Metadata.StatusCode, response.Metadata.Headers)
+	}
+
+	// the whole image
+	response, body = download("")
+	if response.Metadata.StatusCode != http.StatusOK || !bytes.Equal(decrypt(body, 0), image) {
+		t.Fatalf("Unexpected response %d", response.Metadata.StatusCode)
+	}
+}
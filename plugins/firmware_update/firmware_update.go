@@ -1,169 +1,411 @@
-package firmware_update
-
-// Package firmware_update provides a plugin for updating device firmware.
-import (
-	"context"
-	"crypto/ecdh"
-	"encoding/base64"
-	"fmt"
-	"net/http"
-	"strings"
-
-	"github.com/luraproject/lura/v2/config"
-	"github.com/luraproject/lura/v2/proxy"
-	"github.com/luraproject/lura/v2/vicg"
-	"github.com/yuanyuanxiang/fss/internal/pkg/common"
-	"github.com/yuanyuanxiang/fss/pkg/audit"
-)
-
-type SessionManager interface {
-	VerifyAuthHeader(authHeader string) (string, error)
-}
-
-type DeviceManager interface {
-	IsDeviceRegistered(serialNumber string) error
-	GetDevicePublicKey(serialNumber string) string
-}
-
-type factory struct {
-	sess       SessionManager
-	dev        DeviceManager
-	serverPriv *ecdh.PrivateKey
-}
-
-// Plugin defines
-type Plugin struct {
-	factory
-	name  string
-	index int
-	log   audit.LogManager
-}
-
-func NewFactory(sess SessionManager, dev DeviceManager, serverPriv *ecdh.PrivateKey) vicg.VicgPluginFactory {
-	return factory{sess: sess, dev: dev, serverPriv: serverPriv}
-}
-
-func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
-	p := &Plugin{
-		factory: f,
-		index:   cfg.Index,
-		name:    cfg.Name,
-		log:     nil,
-	}
-	var m map[string]interface{}
-	if v, ok := infra.(*vicg.Infra); ok && v != nil {
-		m = v.ExtraConfig
-	}
-	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
-	if p.log == nil {
-		return nil, fmt.Errorf("audit log manager is not set")
-	}
-	return p, nil
-}
-
-/*
-	Deliver signed firmware update to authenticated devices
-
-Header: <Authorization: "xxx">
-
-Response:
-
-	{
-		"data": "base64 encrypted firmware data",
-		"serial_number": "0000000001",
-		"version": "1.0.1",
-		"timestamp": 1234567890,
-		"signature": "abcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890"
-	}
-*/
-func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
-	// verify auth header
-	serialNumber, err := p.sess.VerifyAuthHeader(request.HeaderGet("Authorization"))
-	if serialNumber == "" || err != nil {
-		response.WriteHeader(http.StatusUnauthorized)
-		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "missing or invalid authorization header", http.StatusUnauthorized, err.Error())
-		response.Data = map[string]interface{}{
-			"code":          http.StatusUnauthorized,
-			"msg":           fmt.Sprintf("missing or invalid authorization header: %v", err),
-			"serial_number": serialNumber,
-		}
-		return p.Error()
-	}
-	// get firmware version
-	version := request.Path[strings.LastIndex(request.Path, "/")+1:]
-	if version == "" {
-		response.WriteHeader(http.StatusBadRequest)
-		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "request invalid version", http.StatusBadRequest)
-		response.Data = map[string]interface{}{
-			"code":          http.StatusBadRequest,
-			"msg":           fmt.Sprintf("invalid version: %s", version),
-			"serial_number": serialNumber,
-		}
-		return p.Error()
-	}
-	// check if device is already registered
-	err = p.dev.IsDeviceRegistered(serialNumber)
-	if err != nil {
-		response.WriteHeader(http.StatusConflict)
-		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "check device status failed", http.StatusConflict, err.Error())
-		response.Data = map[string]interface{}{
-			"code":          http.StatusConflict,
-			"msg":           "check device status failed",
-			"serial_number": serialNumber,
-		}
-		return p.Error()
-	}
-	// get client public key
-	clientPubKey, err := common.Base64ToPublicKey(p.dev.GetDevicePublicKey(serialNumber))
-	if err != nil {
-		response.WriteHeader(http.StatusBadRequest)
-		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "invalid public key", http.StatusBadRequest, err.Error())
-		response.Data = map[string]interface{}{
-			"code":          http.StatusBadRequest,
-			"msg":           fmt.Sprintf("invalid public key: %v", err),
-			"serial_number": serialNumber,
-		}
-		return p.Error()
-
-	}
-	// derive shared secret
-	sharedSecret, _ := p.serverPriv.ECDH(clientPubKey)
-	encKey, macKey := common.DeriveKeys(sharedSecret)
-	// encrypt the firmware data
-	var firmwareData = version
-	encryptedData, err := common.EncryptData([]byte(firmwareData), encKey)
-	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "failed to encrypt response", http.StatusInternalServerError, err.Error())
-		response.Data = map[string]interface{}{
-			"code":          http.StatusInternalServerError,
-			"msg":           fmt.Sprintf("failed to encrypt response: %v", err),
-			"serial_number": serialNumber,
-		}
-		return p.Error()
-	}
-
-	base64Data := base64.StdEncoding.EncodeToString(encryptedData)
-	mac := common.SignSignature(base64Data, string(macKey))
-
-	response.Data = map[string]interface{}{
-		"code":          0,
-		"msg":           "success",
-		"serial_number": serialNumber,
-		"data":          base64Data, // base64 encrypted firmware data
-		"version":       version,
-		"timestamp":     common.GetCurrentTimestamp(),
-		"signature":     mac,
-	}
-	p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "success", http.StatusOK)
-
-	return nil
-}
-
-func (p *Plugin) Priority() int {
-	return p.index
-}
-
-func (p *Plugin) Error() error {
-	return fmt.Errorf("failed on plugin: '%s'", p.name)
-}
+package firmware_update
+
+// Package firmware_update provides a plugin for updating device firmware.
+import (
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/internal/pkg/campaign"
+	"github.com/yuanyuanxiang/fss/internal/pkg/common"
+	"github.com/yuanyuanxiang/fss/internal/pkg/token"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+)
+
+const (
+	// ModeBinary is the mode of a resumable download: the response has a download ticket instead of the image.
+	ModeBinary = "binary"
+)
+
+type SessionManager interface {
+	VerifyAuthHeader(authHeader, purpose, version string) (string, error)
+	GenerateDownloadTicket(serialNumber, version string) (string, time.Time, error)
+}
+
+type DeviceManager interface {
+	IsDeviceRegistered(serialNumber string) error
+	GetDevicePublicKey(serialNumber string) string
+	GetDeviceCertificate(serialNumber string) string
+	GetTarget(serialNumber string) string
+	GetDeviceChannel(serialNumber string) string
+	GetSecurityFloor(serialNumber string) uint32
+	RaiseSecurityFloor(serialNumber string, securityVersion uint32) error
+	GetRollback(serialNumber string) string
+	ConsumeRollback(serialNumber, version string) bool
+}
+
+type FirmwareStore interface {
+	GetImage(version string) (*firmware.Metadata, []byte, error)
+}
+
+// CloneDetector checks that an authenticated device isn't a clone, it raises the incident itself.
+type CloneDetector interface {
+	Observe(serialNumber, remoteAddr, publicKey string) error
+}
+
+// Campaigns gates the versions targeted by update campaigns, and records the progress of the admitted devices.
+type Campaigns interface {
+	Admit(serialNumber, version string) error
+	Record(serialNumber, version, status, errMsg string) error
+}
+
+type factory struct {
+	sess       SessionManager
+	dev        DeviceManager
+	store      FirmwareStore
+	serverPriv *ecdh.PrivateKey
+	clones     CloneDetector
+	campaigns  Campaigns
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name      string
+	index     int
+	log       audit.LogManager
+	chunkSize int64
+}
+
+func NewFactory(sess SessionManager, dev DeviceManager, store FirmwareStore, serverPriv *ecdh.PrivateKey, clones CloneDetector,
+	campaigns Campaigns) vicg.VicgPluginFactory {
+	return factory{sess: sess, dev: dev, store: store, serverPriv: serverPriv, clones: clones, campaigns: campaigns}
+}
+
+// New creates the plugin. Config: {"chunk_size": 65536}, the size of the chunks of a binary download.
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory:   f,
+		index:     cfg.Index,
+		name:      cfg.Name,
+		log:       nil,
+		chunkSize: firmware.DefaultChunkSize,
+	}
+	if v := cvt.ToInt64(cfg.Config["chunk_size"]); v > 0 {
+		p.chunkSize = v
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	return p, nil
+}
+
+/*
+	Deliver signed firmware update to authenticated devices
+
+Header: <Authorization: "xxx">, not needed if the device presents its certificate in the TLS handshake,
+which only authorizes the version assigned to the device at its last check-in
+
+Response:
+
+	{
+		"data": "base64 encrypted firmware data",
+		"serial_number": "0000000001",
+		"version": "1.0.1",
+		"size": 1048576,
+		"sha256": "sha256 of the plain firmware image",
+		"timestamp": 1234567890,
+		"signature": "abcdef1234567890abcdef1234567890abcdef1234567890abcdef1234567890",
+		"code_signature": "base64 signature of the firmware manifest made with the publisher key",
+		"signer_key_id": "0123456789abcdef",
+		"signature_algorithm": "ed25519",
+		"security_version": 2,
+		"rollback": "MAC of the approved rollback below the security floor of the device, only in its response"
+	}
+
+With the query "mode=binary", the response has no data but a download ticket, which authorizes the ranges of
+GET /api/firmware/{version}/download until it expires. The image is verified chunk by chunk, the signature
+authenticates the ticket followed by the chunk manifest {"version", "size", "chunk_size", "chunks"}:
+
+	{
+		"ticket": "download ticket, sent as <Authorization: "Bearer xxx">",
+		"expires_at": 1234567890,
+		"download": "/api/firmware/1.0.1/download",
+		"chunk_size": 65536,
+		"chunks": ["sha256 of each chunk"],
+		...
+	}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	// get firmware version
+	version := request.Path[strings.LastIndex(request.Path, "/")+1:]
+	if version == "" {
+		response.WriteHeader(http.StatusBadRequest)
+		p.log.AddUpdateLog(request.RemoteAddr, "", "request invalid version", http.StatusBadRequest)
+		response.Data = map[string]interface{}{
+			"code": http.StatusBadRequest,
+			"msg":  fmt.Sprintf("invalid version: %s", version),
+		}
+		return p.Error()
+	}
+	serialNumber, err := p.authenticate(request, version)
+	if serialNumber == "" || err != nil {
+		response.WriteHeader(http.StatusUnauthorized)
+		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "missing or invalid authorization header", http.StatusUnauthorized, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusUnauthorized,
+			"msg":           fmt.Sprintf("missing or invalid authorization header: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	if err := p.clones.Observe(serialNumber, request.RemoteAddr, ""); err != nil {
+		response.WriteHeader(http.StatusForbidden)
+		response.Data = map[string]interface{}{
+			"code":          http.StatusForbidden,
+			"msg":           err.Error(),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	// check if device is already registered
+	err = p.dev.IsDeviceRegistered(serialNumber)
+	if err != nil {
+		response.WriteHeader(http.StatusConflict)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "check device status failed", http.StatusConflict, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusConflict,
+			"msg":           "check device status failed",
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	// load the firmware image, checked against its SHA-256 once for the whole download of a ticket
+	meta, image, err := p.store.GetImage(version)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, firmware.ErrNotFound) || errors.Is(err, firmware.ErrInvalidVersion) {
+			status = http.StatusNotFound
+		}
+		response.WriteHeader(status)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "firmware unavailable", status, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          status,
+			"msg":           fmt.Sprintf("firmware unavailable: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	if meta.Status != firmware.StatusPublished {
+		response.WriteHeader(http.StatusNotFound)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "firmware not published", http.StatusNotFound, string(meta.Status))
+		response.Data = map[string]interface{}{
+			"code":          http.StatusNotFound,
+			"msg":           fmt.Sprintf("firmware %s is %s", version, meta.Status),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	// a device is only served the versions published to its release channel
+	if channel := p.dev.GetDeviceChannel(serialNumber); !meta.InChannel(channel) {
+		response.WriteHeader(http.StatusForbidden)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "firmware not in channel", http.StatusForbidden, map[string]interface{}{
+			"version": version, "channel": channel,
+		})
+		response.Data = map[string]interface{}{
+			"code":          http.StatusForbidden,
+			"msg":           fmt.Sprintf("firmware %s is not published to the channel '%s'", version, channel),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	// a device isn't downgraded below the highest security version delivered to it, unless an operator approved it
+	floor := p.dev.GetSecurityFloor(serialNumber)
+	rollback := meta.SecurityVersion < floor
+	if rollback && p.dev.GetRollback(serialNumber) != version {
+		response.WriteHeader(http.StatusForbidden)
+		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "rollback refused", http.StatusForbidden, map[string]interface{}{
+			"version": version, "security_version": meta.SecurityVersion, "security_floor": floor,
+		})
+		response.Data = map[string]interface{}{
+			"code":          http.StatusForbidden,
+			"msg":           fmt.Sprintf("firmware %s is below the security version %d of the device", version, floor),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	// a version of an update campaign is only served to the devices it admitted
+	if err := p.campaigns.Admit(serialNumber, version); err != nil {
+		status, desc := http.StatusInternalServerError, "failed to admit device"
+		if errors.Is(err, campaign.ErrNotAdmitted) {
+			status, desc = http.StatusForbidden, "not admitted by a campaign"
+		}
+		response.WriteHeader(status)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, desc, status, version)
+		response.Data = map[string]interface{}{
+			"code":          status,
+			"msg":           err.Error(),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	if meta.Signature == "" {
+		p.record(request.RemoteAddr, serialNumber, version, campaign.DeviceFailed, "firmware not signed")
+		response.WriteHeader(http.StatusInternalServerError)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "firmware not signed", http.StatusInternalServerError, version)
+		response.Data = map[string]interface{}{
+			"code":          http.StatusInternalServerError,
+			"msg":           fmt.Sprintf("firmware %s is not signed", version),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	// get client public key
+	clientPubKey, err := common.Base64ToPublicKey(p.dev.GetDevicePublicKey(serialNumber))
+	if err != nil {
+		p.record(request.RemoteAddr, serialNumber, version, campaign.DeviceFailed, "invalid public key")
+		response.WriteHeader(http.StatusBadRequest)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "invalid public key", http.StatusBadRequest, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusBadRequest,
+			"msg":           fmt.Sprintf("invalid public key: %v", err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+
+	}
+	// the approval of a rollback is used by one response, a concurrent request doesn't use it again
+	if rollback && !p.dev.ConsumeRollback(serialNumber, version) {
+		response.WriteHeader(http.StatusForbidden)
+		p.log.AddIncidentLog(request.RemoteAddr, serialNumber, "rollback refused", http.StatusForbidden, map[string]interface{}{
+			"version": version, "security_version": meta.SecurityVersion, "security_floor": floor,
+		})
+		response.Data = map[string]interface{}{
+			"code":          http.StatusForbidden,
+			"msg":           fmt.Sprintf("rollback of firmware %s is already used", version),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	// derive shared secret
+	sharedSecret, _ := p.serverPriv.ECDH(clientPubKey)
+	encKey, macKey := common.DeriveKeys(sharedSecret)
+
+	data := map[string]interface{}{
+		"code":          0,
+		"msg":           "success",
+		"serial_number": serialNumber,
+		"version":       version,
+		"size":          meta.Size,
+		"sha256":        meta.SHA256,
+		"timestamp":     common.GetCurrentTimestamp(),
+		// code signature made by the publisher, verified against the device's pinned key
+		"code_signature":      meta.Signature,
+		"signer_key_id":       meta.SignerKeyID,
+		"signature_algorithm": meta.SignatureAlg,
+		"security_version":    meta.SecurityVersion,
+	}
+	// the device installs an image below its fuse counter only with the approval, authenticated by its MAC key
+	if rollback {
+		data["rollback"] = common.SignSignature(common.RollbackMessage(serialNumber, version), string(macKey))
+		p.log.AddLog(request.RemoteAddr, serialNumber, "rollback approved", http.StatusOK, map[string]interface{}{
+			"version": version, "security_version": meta.SecurityVersion, "security_floor": floor,
+		})
+	}
+	desc := "failed to encrypt response"
+	if request.Query.Get("mode") == ModeBinary {
+		desc, err = "failed to issue download ticket", p.ticket(serialNumber, version, image, macKey, data)
+	} else {
+		err = encrypt(image, encKey, macKey, data)
+	}
+	if err != nil {
+		p.record(request.RemoteAddr, serialNumber, version, campaign.DeviceFailed, desc)
+		response.WriteHeader(http.StatusInternalServerError)
+		p.log.AddUpdateLog(request.RemoteAddr, serialNumber, desc, http.StatusInternalServerError, err.Error())
+		response.Data = map[string]interface{}{
+			"code":          http.StatusInternalServerError,
+			"msg":           fmt.Sprintf("%s: %v", desc, err),
+			"serial_number": serialNumber,
+		}
+		return p.Error()
+	}
+	response.Data = data
+	p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "success", http.StatusOK)
+	// a binary update is delivered when the device downloads the last byte with the ticket, which raises the floor
+	if request.Query.Get("mode") != ModeBinary {
+		if err := p.dev.RaiseSecurityFloor(serialNumber, meta.SecurityVersion); err != nil {
+			p.log.AddUpdateLog(request.RemoteAddr, serialNumber, "failed to raise security floor", http.StatusInternalServerError, err.Error())
+		}
+		p.record(request.RemoteAddr, serialNumber, version, campaign.DeviceDelivered, "")
+	}
+
+	return nil
+}
+
+// record records the progress of the device in its campaigns, a failure to save it is logged.
+func (p *Plugin) record(remoteAddr, serialNumber, version, status, errMsg string) {
+	if err := p.campaigns.Record(serialNumber, version, status, errMsg); err != nil {
+		p.log.AddUpdateLog(remoteAddr, serialNumber, "failed to record campaign progress", http.StatusInternalServerError, err.Error())
+	}
+}
+
+// encrypt adds the encrypted image to the response, authenticated with the MAC key of the device.
+func encrypt(image, encKey, macKey []byte, data map[string]interface{}) error {
+	encryptedData, err := common.EncryptData(image, encKey)
+	if err != nil {
+		return err
+	}
+	base64Data := base64.StdEncoding.EncodeToString(encryptedData)
+	data["data"] = base64Data // base64 encrypted firmware data
+	data["signature"] = common.SignSignature(base64Data, string(macKey))
+	return nil
+}
+
+// ticket adds the download ticket and the chunk manifest of the image to the response. The ticket, which also
+// seeds the key stream of the download, and the manifest are authenticated with the MAC key of the device.
+func (p *Plugin) ticket(serialNumber, version string, image, macKey []byte, data map[string]interface{}) error {
+	ticket, expiresAt, err := p.sess.GenerateDownloadTicket(serialNumber, version)
+	if err != nil {
+		return err
+	}
+	chunks := firmware.NewChunks(version, image, p.chunkSize)
+	data["ticket"] = ticket
+	data["expires_at"] = expiresAt.Unix()
+	data["download"] = fmt.Sprintf("/api/firmware/%s/download", version)
+	data["chunk_size"] = chunks.ChunkSize
+	data["chunks"] = chunks.SHA256
+	data["signature"] = common.SignSignature(ticket+string(chunks.Bytes()), string(macKey))
+	return nil
+}
+
+// authenticate returns the serial number of the device, which is authenticated by its certificate for the version
+// assigned at its last check-in, or by the auth header whose token must be issued to download this version.
+func (p *Plugin) authenticate(request *proxy.Request, version string) (string, error) {
+	serialNumber := request.HeaderGet(common.HeaderDeviceCert)
+	if serialNumber == "" {
+		return p.sess.VerifyAuthHeader(request.HeaderGet("Authorization"), token.PurposeFirmware, version)
+	}
+	// the certificate must be the last one issued to the device
+	fingerprint := p.dev.GetDeviceCertificate(serialNumber)
+	if fingerprint == "" || fingerprint != request.HeaderGet(common.HeaderDeviceCertSHA256) {
+		return serialNumber, fmt.Errorf("certificate is not bound to the device")
+	}
+	// like the token of the check-in, the certificate only authorizes the version assigned to the device
+	if target := p.dev.GetTarget(serialNumber); target != version {
+		return serialNumber, fmt.Errorf("firmware %s is not the target of the device", version)
+	}
+	return serialNumber, nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
@@ -0,0 +1,252 @@
+package firmware_upload
+
+// Package firmware_upload provides a plugin for uploading firmware images to the firmware repository.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/pkg/firmware"
+)
+
+const (
+	MaxImageSize = 64 << 20 // 64 MiB
+)
+
+type FirmwareStore interface {
+	Put(meta firmware.Metadata, image []byte) (*firmware.Metadata, error)
+	Publish(version, signature string, channels ...string) (*firmware.Metadata, error)
+}
+
+type factory struct {
+	store FirmwareStore
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+	log   audit.LogManager
+}
+
+func NewFactory(store FirmwareStore) vicg.VicgPluginFactory {
+	return factory{store: store}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		log:     nil,
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	return p, nil
+}
+
+/*
+	Upload a firmware image as the specified version
+
+The image is sent either as the raw request body, with the metadata in the query string:
+
+	POST /api/firmwares/1.0.1?release_notes=xxx&hardware=rev-a,rev-b&publish=true&channels=beta,factory&security_version=2&signature=xxx
+
+or as a "multipart/form-data" body with a "file" part and the same metadata fields.
+The channels and the signature apply with "publish", the version is published to the stable channel if none.
+The signature of the manifest is made offline with the publisher key, the version stays a draft if it's invalid.
+The security version is raised by a release which fixes a vulnerability, devices aren't downgraded below it.
+
+Response:
+
+	{
+		"code": 0,
+		"msg": "success",
+		"firmware": {
+			"version": "1.0.1",
+			"size": 1048576,
+			"sha256": "xxx",
+			"status": "draft"
+		}
+	}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	version := request.Path[strings.LastIndex(request.Path, "/")+1:]
+	if !firmware.ValidVersion(version) {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Data = map[string]interface{}{
+			"code": http.StatusBadRequest,
+			"msg":  fmt.Sprintf("invalid version: %s", version),
+		}
+		return p.Error()
+	}
+	image, fields, err := p.readImage(request)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Data = map[string]interface{}{
+			"code":    http.StatusBadRequest,
+			"msg":     fmt.Sprintf("failed to read firmware image: %v", err),
+			"version": version,
+		}
+		return p.Error()
+	}
+	meta := firmware.Metadata{
+		Version:      version,
+		ReleaseNotes: fields.Get("release_notes"),
+	}
+	meta.Hardware = splitList(fields.Get("hardware"))
+	if svn := fields.Get("security_version"); svn != "" {
+		n, err := strconv.ParseUint(svn, 10, 32)
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Data = map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"msg":     fmt.Sprintf("invalid security version: %s", svn),
+				"version": version,
+			}
+			return p.Error()
+		}
+		meta.SecurityVersion = uint32(n)
+	}
+	channels := splitList(fields.Get("channels"))
+	for _, ch := range channels {
+		if !firmware.ValidChannel(ch) {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Data = map[string]interface{}{
+				"code":    http.StatusBadRequest,
+				"msg":     fmt.Sprintf("invalid release channel: %s", ch),
+				"version": version,
+			}
+			return p.Error()
+		}
+	}
+	stored, err := p.store.Put(meta, image)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, firmware.ErrExists) {
+			status = http.StatusConflict
+		}
+		response.WriteHeader(status)
+		response.Data = map[string]interface{}{
+			"code":    status,
+			"msg":     fmt.Sprintf("failed to store firmware: %v", err),
+			"version": version,
+		}
+		return p.Error()
+	}
+	p.log.AddLog(request.RemoteAddr, "", "firmware uploaded", http.StatusCreated, version)
+	if cvt.ToBoolean(fields.Get("publish")) {
+		if stored, err = p.store.Publish(version, fields.Get("signature"), channels...); err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, firmware.ErrInvalidSignature) {
+				status = http.StatusBadRequest
+			}
+			response.WriteHeader(status)
+			response.Data = map[string]interface{}{
+				"code":    status,
+				"msg":     fmt.Sprintf("failed to publish firmware: %v", err),
+				"version": version,
+			}
+			return p.Error()
+		}
+		p.log.AddLog(request.RemoteAddr, "", "firmware published", http.StatusOK, map[string]interface{}{
+			"version": version, "channels": stored.Channels,
+		})
+	}
+
+	response.WriteHeader(http.StatusCreated)
+	response.Data = map[string]interface{}{
+		"code":     0,
+		"msg":      "success",
+		"firmware": stored,
+	}
+	return nil
+}
+
+// splitList splits a comma separated field, skipping the empty items.
+func splitList(field string) []string {
+	var list []string
+	for _, item := range strings.Split(field, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// readImage reads the firmware image and its metadata fields from the request.
+func (p *Plugin) readImage(request *proxy.Request) ([]byte, url.Values, error) {
+	if request.Body == nil {
+		return nil, nil, fmt.Errorf("empty request body")
+	}
+	mediaType, params, _ := mime.ParseMediaType(request.HeaderGet("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		image, err := readLimited(request.Body)
+		return image, request.Query, err
+	}
+
+	var image []byte
+	fields := url.Values{}
+	reader := multipart.NewReader(request.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := readLimited(part)
+		if err != nil {
+			return nil, nil, err
+		}
+		if part.FormName() == "file" {
+			image = data
+		} else {
+			fields.Set(part.FormName(), string(data))
+		}
+	}
+	if image == nil {
+		return nil, nil, fmt.Errorf("missing 'file' part")
+	}
+	return image, fields, nil
+}
+
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, MaxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxImageSize {
+		return nil, fmt.Errorf("firmware image exceeds %d bytes", MaxImageSize)
+	}
+	return data, nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
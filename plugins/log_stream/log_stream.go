@@ -0,0 +1,172 @@
+package log_stream
+
+// Package log_stream provides a plugin for streaming new audit log entries as Server-Sent Events.
+// The endpoint must have "OutputEncoding": "no-op", so the stream is written to the client as it is.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+)
+
+const (
+	defaultHeartbeat = 15 * time.Second
+	defaultBuffer    = 256
+)
+
+type factory struct {
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name      string
+	index     int
+	log       audit.LogManager
+	heartbeat time.Duration // comment lines which keep the connection open, and detect a gone client
+	buffer    int           // events buffered for a slow client before they are dropped
+}
+
+func NewFactory() vicg.VicgPluginFactory {
+	return factory{}
+}
+
+// New creates the plugin. Config: {"heartbeat": 15, "buffer": 256}, the heartbeat is in seconds.
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory:   f,
+		index:     cfg.Index,
+		name:      cfg.Name,
+		heartbeat: defaultHeartbeat,
+		buffer:    defaultBuffer,
+	}
+	if v := cvt.ToInt(cfg.Config["heartbeat"]); v > 0 {
+		p.heartbeat = time.Duration(v) * time.Second
+	}
+	if v := cvt.ToInt(cfg.Config["buffer"]); v > 0 {
+		p.buffer = v
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	return p, nil
+}
+
+/*
+Query: ?types=incidents,updates&serial_number=<serial>&remote_addr=<ip>&code=<code>&q=<text>
+All parameters are optional, the incidents and updates are streamed by default.
+
+Response: a stream of events, the id is the sequence number of the entry.
+
+	id: 42
+	event: incidents
+	data: {"seq": 42, "code": 401, "remote_addr": "10.0.0.1:5000", "serial_number": "0000000001", "description": "invalid signature", ...}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	q, err := audit.ParseQuery(request.Query)
+	if err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Data["code"] = http.StatusBadRequest
+		response.Data["msg"] = err.Error()
+		return p.Error()
+	}
+	types := map[audit.LogType]bool{audit.TYPE_INCIDENT: true, audit.TYPE_UPDATE: true}
+	if s := request.Query.Get("types"); s != "" {
+		types = make(map[audit.LogType]bool)
+		for _, typ := range strings.Split(s, ",") {
+			switch typ := audit.LogType(strings.TrimSpace(typ)); typ {
+			case audit.TYPE_NORMAL, audit.TYPE_UPDATE, audit.TYPE_INCIDENT, audit.TYPE_ACTION:
+				types[typ] = true
+			default:
+				response.WriteHeader(http.StatusBadRequest)
+				response.Data["code"] = http.StatusBadRequest
+				response.Data["msg"] = fmt.Sprintf("unknown log type: '%s'", typ)
+				return p.Error()
+			}
+		}
+	}
+	response.Metadata.Headers["Content-Type"] = []string{"text/event-stream"}
+	response.Metadata.Headers["Cache-Control"] = []string{"no-cache"}
+	response.Metadata.Headers["X-Accel-Buffering"] = []string{"no"} // no buffering by a reverse proxy
+	// or the router adds "Cache-Control: public" of the cache TTL
+	response.IsComplete = false
+	response.Io = &stream{log: p.log, types: types, query: q, heartbeat: p.heartbeat, buffer: p.buffer}
+	return nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
+
+// stream writes the events when the response is rendered. It subscribes to the logs only then,
+// so a request which fails on a later plugin doesn't leave a subscription behind.
+type stream struct {
+	log       audit.LogManager
+	types     map[audit.LogType]bool
+	query     audit.Query
+	heartbeat time.Duration
+	buffer    int
+}
+
+// Read is never called, the response is copied with WriteTo.
+func (s *stream) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+// WriteTo writes the events until the client is gone, which fails the next heartbeat at the latest.
+func (s *stream) WriteTo(w io.Writer) (int64, error) {
+	events, cancel := s.log.Subscribe(s.buffer)
+	defer cancel()
+	ticker := time.NewTicker(s.heartbeat)
+	defer ticker.Stop()
+	var written int64
+	send := func(msg string) error {
+		n, err := io.WriteString(w, msg)
+		written += int64(n)
+		if f, ok := w.(http.Flusher); ok && err == nil {
+			f.Flush()
+		}
+		return err
+	}
+	if err := send(": subscribed\n\n"); err != nil {
+		return written, err
+	}
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return written, nil
+			}
+			if !s.types[ev.Type] || !s.query.Match(ev.Entry) {
+				continue
+			}
+			data, _ := json.Marshal(ev.Entry)
+			if err := send(fmt.Sprintf("id: %v\nevent: %s\ndata: %s\n\n", ev.Entry["seq"], ev.Type, data)); err != nil {
+				return written, err
+			}
+		case <-ticker.C:
+			if err := send(": heartbeat\n\n"); err != nil {
+				return written, err
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package policy_rules
+
+// Package policy_rules provides a plugin for listing the rules of automatic actions on incidents,
+// and dry-running rules against the logged incidents.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/internal/pkg/policy"
+)
+
+const maxRulesSize = 1 << 20
+
+type PolicyEngine interface {
+	Rules() []policy.Rule
+	DryRun(rules []policy.Rule) []policy.Firing
+}
+
+type factory struct {
+	engine PolicyEngine
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+}
+
+func NewFactory(engine PolicyEngine) vicg.VicgPluginFactory {
+	return factory{engine: engine}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	return &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+	}, nil
+}
+
+/*
+GET /api/policy/rules lists the rules in effect.
+
+POST /api/policy/dry-run evaluates the rules against the logged incidents, without taking any action.
+The rules in effect are evaluated if the request has no rules.
+
+Request:
+
+	{
+		"rules": [
+			{"name": "brute-force", "incident": "invalid signature", "threshold": 5, "window": "10m", "actions": ["block"]}
+		]
+	}
+
+Response:
+
+	{
+		"code": 0,
+		"msg": "success",
+		"rules": [...],
+		"fired": [
+			{"rule": "brute-force", "serial_number": "0000000001", "remote_addr": "10.0.0.1:5000",
+				"incident": "invalid signature", "count": 5, "actions": ["block"], "timestamp": "2024-05-01T08:00:00Z"}
+		]
+	}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	rules := p.engine.Rules()
+	if request.Method != http.MethodPost {
+		response.Data = map[string]interface{}{"code": 0, "msg": "success", "rules": rules}
+		return nil
+	}
+	if request.Body != nil {
+		var req struct {
+			Rules []policy.Rule `json:"rules"`
+		}
+		data, err := io.ReadAll(io.LimitReader(request.Body, maxRulesSize))
+		if err == nil && len(data) > 0 {
+			err = json.Unmarshal(data, &req)
+		}
+		if err == nil {
+			err = policy.Validate(req.Rules)
+		}
+		if err != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			response.Data = map[string]interface{}{"code": http.StatusBadRequest, "msg": fmt.Sprintf("invalid rules: %v", err)}
+			return p.Error()
+		}
+		if len(req.Rules) > 0 {
+			rules = req.Rules
+		}
+	}
+	response.Data = map[string]interface{}{
+		"code":  0,
+		"msg":   "success",
+		"rules": rules,
+		"fired": p.engine.DryRun(rules),
+	}
+	return nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
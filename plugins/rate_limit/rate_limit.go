@@ -0,0 +1,174 @@
+package rate_limit
+
+// Package rate_limit provides a plugin for limiting the requests of each remote address and serial number,
+// and rejecting the serial numbers and addresses which are locked out after repeated failures.
+// It should be the first plugin of the pipeline, and is configured per endpoint, e.g.
+//
+//	{
+//		"Name": "Rate_Limit",
+//		"Index": 0,
+//		"Config": {
+//			"per_address": {"rate": 60, "burst": 20},
+//			"per_serial": {"rate": 6, "burst": 3},
+//			"serial": "path",
+//			"lockout": true
+//		}
+//	}
+//
+// The rate is in requests per minute, and burst requests are allowed at once. The serial number is the last
+// segment of the path, or the "serial_number" of the JSON body, and it isn't limited if "serial" is not set.
+// If "lockout" is set, the requests of locked out serial numbers and addresses are rejected.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+	"github.com/yuanyuanxiang/fss/pkg/audit"
+	cvt "github.com/yuanyuanxiang/fss/pkg/convert"
+	"github.com/yuanyuanxiang/fss/pkg/ratelimit"
+)
+
+const maxBodySize = 1 << 20
+
+type factory struct {
+	serials   *ratelimit.Lockout // nil if serial numbers aren't locked out
+	addresses *ratelimit.Lockout // nil if addresses aren't locked out
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name      string
+	index     int
+	log       audit.LogManager
+	byAddress *ratelimit.Limiter // nil if not limited
+	bySerial  *ratelimit.Limiter // nil if not limited
+	serial    string             // where the serial number is: "path" or "body"
+	lockout   bool
+}
+
+func NewFactory(serials, addresses *ratelimit.Lockout) vicg.VicgPluginFactory {
+	return factory{serials: serials, addresses: addresses}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	p := &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+		log:     nil,
+	}
+	var m map[string]interface{}
+	if v, ok := infra.(*vicg.Infra); ok && v != nil {
+		m = v.ExtraConfig
+	}
+	p.log, _ = m[audit.LOG_MANAGER].(audit.LogManager)
+	if p.log == nil {
+		return nil, fmt.Errorf("audit log manager is not set")
+	}
+	p.byAddress = newLimiter(cfg.Config["per_address"])
+	p.bySerial = newLimiter(cfg.Config["per_serial"])
+	p.serial = cvt.ToString(cfg.Config["serial"])
+	if p.serial != "" && p.serial != "path" && p.serial != "body" {
+		return nil, fmt.Errorf("plugin '%s': invalid serial '%s', should be path or body", cfg.Name, p.serial)
+	}
+	p.lockout = cvt.ToBoolean(cfg.Config["lockout"])
+	return p, nil
+}
+
+// newLimiter returns the limiter of the config {"rate": <per minute>, "burst": <n>}, or nil if it isn't set.
+func newLimiter(v interface{}) *ratelimit.Limiter {
+	m, _ := v.(map[string]interface{})
+	rate := cvt.ToFloat64(m["rate"])
+	if rate <= 0 {
+		return nil
+	}
+	return ratelimit.NewLimiter(rate/60, cvt.ToInt(m["burst"]))
+}
+
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	now := time.Now()
+	address := request.RemoteAddr
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	serialNumber := p.serialNumber(request)
+
+	if p.lockout {
+		if until, ok := lockedUntil(p.serials, serialNumber, now); ok {
+			return p.reject(request, response, serialNumber, "serial number locked out after repeated failures", until.Sub(now))
+		}
+		if until, ok := lockedUntil(p.addresses, address, now); ok {
+			return p.reject(request, response, serialNumber, "address locked out after repeated failures", until.Sub(now))
+		}
+	}
+	if p.byAddress != nil && !p.byAddress.Allow(address, now) {
+		return p.reject(request, response, serialNumber, "too many requests from the address", time.Minute)
+	}
+	if p.bySerial != nil && serialNumber != "" && !p.bySerial.Allow(serialNumber, now) {
+		return p.reject(request, response, serialNumber, "too many requests of the serial number", time.Minute)
+	}
+	return nil
+}
+
+func lockedUntil(lockout *ratelimit.Lockout, key string, now time.Time) (time.Time, bool) {
+	if lockout == nil || key == "" {
+		return time.Time{}, false
+	}
+	return lockout.LockedUntil(key, now)
+}
+
+// serialNumber returns the serial number of the request, the body is restored for the next plugins.
+func (p *Plugin) serialNumber(request *proxy.Request) string {
+	switch p.serial {
+	case "path":
+		return request.URL.Path[strings.LastIndex(request.URL.Path, "/")+1:]
+	case "body":
+		if request.Body == nil {
+			return ""
+		}
+		data, err := io.ReadAll(io.LimitReader(request.Body, maxBodySize))
+		request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(data), request.Body))
+		if err != nil {
+			return ""
+		}
+		var body struct {
+			SerialNumber string `json:"serial_number"`
+		}
+		_ = json.Unmarshal(data, &body)
+		return body.SerialNumber
+	}
+	return ""
+}
+
+func (p *Plugin) reject(request *proxy.Request, response *proxy.Response, serialNumber, msg string, retryAfter time.Duration) error {
+	seconds := int(retryAfter.Round(time.Second).Seconds())
+	response.WriteHeader(http.StatusTooManyRequests)
+	response.Metadata.Headers["Retry-After"] = []string{strconv.Itoa(max(seconds, 1))}
+	p.log.AddIncidentLog(request.RemoteAddr, serialNumber, msg, http.StatusTooManyRequests, request.Method+" "+request.Path)
+	response.Data = map[string]interface{}{
+		"code":          http.StatusTooManyRequests,
+		"msg":           msg,
+		"serial_number": serialNumber,
+	}
+	return p.Error()
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}
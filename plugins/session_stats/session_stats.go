@@ -0,0 +1,72 @@
+package session_stats
+
+// Package session_stats provides a plugin for reporting the live sessions and one-time tokens of the server.
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/luraproject/lura/v2/config"
+	"github.com/luraproject/lura/v2/proxy"
+	"github.com/luraproject/lura/v2/vicg"
+)
+
+type SessionManager interface {
+	Stats() map[string]interface{}
+}
+
+type factory struct {
+	sess SessionManager
+}
+
+// Plugin defines
+type Plugin struct {
+	factory
+	name  string
+	index int
+}
+
+func NewFactory(sess SessionManager) vicg.VicgPluginFactory {
+	return factory{sess: sess}
+}
+
+func (f factory) New(cfg *config.PluginConfig, infra interface{}) (vicg.VicgPlugin, error) {
+	return &Plugin{
+		factory: f,
+		index:   cfg.Index,
+		name:    cfg.Name,
+	}, nil
+}
+
+/*
+Response:
+
+	{
+		"code": 0,
+		"msg": "success",
+		"stats": {
+			"sessions": 12,
+			"tokens": 5,
+			"used_tokens": 3,
+			"serial_numbers": 10,
+			"rejected_sessions": 0,
+			"expired": 25
+		}
+	}
+*/
+func (p *Plugin) HandleHTTPMessage(ctx context.Context, request *proxy.Request, response *proxy.Response) error {
+	response.Data = map[string]interface{}{
+		"code":  0,
+		"msg":   "success",
+		"stats": p.sess.Stats(),
+	}
+	return nil
+}
+
+func (p *Plugin) Priority() int {
+	return p.index
+}
+
+func (p *Plugin) Error() error {
+	return fmt.Errorf("failed on plugin: '%s'", p.name)
+}